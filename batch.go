@@ -0,0 +1,124 @@
+package captionbot
+
+import (
+	"context"
+	"sync"
+)
+
+// BatchOptions configures BatchURLCaption and BatchUploadCaption.
+type BatchOptions struct {
+	// Workers is how many images are captioned at once, 4 if zero. Each
+	// worker has a session of its own, since a session's conversation
+	// takes one caption at a time.
+	Workers int
+	// Options configure each worker's session, as New's do.
+	Options []Option
+}
+
+// Result is the caption of one image of a batch.
+type Result struct {
+	// Input is the image's URL or file path, as given.
+	Input   string
+	Caption string
+	Err     error
+}
+
+// BatchURLCaption captions the images at urls concurrently, returning
+// their results in the same order. An image that fails to caption
+// doesn't stop the batch; its Result holds the error. The error returned
+// is not nil only if no worker could start a session.
+func BatchURLCaption(urls []string, opts BatchOptions) ([]Result, error) {
+	return BatchURLCaptionContext(context.Background(), urls, opts)
+}
+
+// BatchURLCaptionContext is BatchURLCaption with a context for its
+// requests. Images not captioned by the time ctx is done have its error.
+func BatchURLCaptionContext(ctx context.Context, urls []string, opts BatchOptions) ([]Result, error) {
+	return batch(ctx, urls, opts, (*CaptionBot).URLCaptionContext)
+}
+
+// BatchUploadCaption uploads the image files at paths and captions them
+// concurrently, as BatchURLCaption does URLs.
+func BatchUploadCaption(paths []string, opts BatchOptions) ([]Result, error) {
+	return BatchUploadCaptionContext(context.Background(), paths, opts)
+}
+
+// BatchUploadCaptionContext is BatchUploadCaption with a context for its
+// requests.
+func BatchUploadCaptionContext(ctx context.Context, paths []string, opts BatchOptions) ([]Result, error) {
+	return batch(ctx, paths, opts, (*CaptionBot).UploadCaptionContext)
+}
+
+// batch captions each input with caption, on opts.Workers sessions. Each
+// session is used by one goroutine only, so their states need no lock.
+func batch(ctx context.Context, inputs []string, opts BatchOptions, caption func(*CaptionBot, context.Context, string) (string, error)) ([]Result, error) {
+	results := make([]Result, len(inputs))
+	for i, input := range inputs {
+		results[i].Input = input
+	}
+	if len(inputs) == 0 {
+		return results, nil
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	if workers > len(inputs) {
+		workers = len(inputs)
+	}
+
+	// Sessions are started at once, so a batch of many workers doesn't
+	// wait for each in turn.
+	bots := make([]*CaptionBot, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := range bots {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bots[i], errs[i] = NewContext(ctx, opts.Options...)
+		}(i)
+	}
+	wg.Wait()
+	started := bots[:0]
+	for i, bot := range bots {
+		if errs[i] == nil {
+			started = append(started, bot)
+		}
+	}
+	if len(started) == 0 {
+		return nil, errs[0]
+	}
+
+	next := make(chan int)
+	for _, bot := range started {
+		wg.Add(1)
+		go func(bot *CaptionBot) {
+			defer wg.Done()
+			for i := range next {
+				results[i].Caption, results[i].Err = caption(bot, ctx, inputs[i])
+				if results[i].Err != nil && ctx.Err() == nil {
+					// A failed caption can leave the conversation's water
+					// mark behind, so the next one starts a new one. The
+					// old one is kept if that fails too.
+					bot.RefreshContext(ctx)
+				}
+			}
+		}(bot)
+	}
+	i := 0
+feed:
+	for ; i < len(inputs); i++ {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	for ; i < len(inputs); i++ {
+		results[i].Err = ctx.Err()
+	}
+	return results, nil
+}
@@ -0,0 +1,251 @@
+// Package batch builds bulk captioning pipelines out of a source, filters,
+// processing stages and sinks, without goroutine plumbing of their own:
+//
+//	err := batch.NewJob().
+//		FromDir("photos").
+//		Filter(batch.MaxSize(5 << 20)).
+//		WithWorkers(8).
+//		Then(pipeline.WriteCaptions(source.Dir("photos"))).
+//		To(pipeline.CSVSink(os.Stdout)).
+//		Run(ctx)
+//
+// A Job is a fluent way to set up a pipeline.Pipeline, whose stages and
+// sinks it uses. Objects that fail to caption don't stop a job unless
+// OnError says so; they reach the sinks with their error. A job's results
+// can also be ranged over as they finish, with All:
+//
+//	for obj, result := range job.All(ctx) {
+//		if result.Err != nil {
+//			break // cancels the captions still running
+//		}
+//		fmt.Println(obj.Key, result.Caption)
+//	}
+//	if err := job.Err(); err != nil {
+//		// ...
+//	}
+package batch
+
+import (
+	"context"
+	"io"
+	"iter"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/pipeline"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// Job is a batch captioning pipeline. Its methods configure it and return
+// it, so they can be chained; the first configuration error is returned by
+// Run.
+type Job struct {
+	p       pipeline.Pipeline
+	input   pipeline.Source
+	filters []func(source.Object) bool
+	err     error
+}
+
+// NewJob returns a job with one worker and no source.
+func NewJob() *Job {
+	return &Job{p: pipeline.Pipeline{Workers: 1}}
+}
+
+// From sets the source of the job's objects to the images of src, as
+// source.IsImage tells them apart.
+func (job *Job) From(src source.Source) *Job {
+	job.input = pipeline.FromSource(src)
+	return job
+}
+
+// FromDir sets the source of the job's objects to the images of a local
+// directory.
+func (job *Job) FromDir(dir string) *Job {
+	return job.From(source.Dir(dir))
+}
+
+// FromURL sets the source of the job's objects to the images of the
+// source source.Open returns for rawurl.
+func (job *Job) FromURL(rawurl string) *Job {
+	src, err := source.Open(rawurl)
+	if err != nil {
+		if job.err == nil {
+			job.err = err
+		}
+		return job
+	}
+	return job.From(src)
+}
+
+// FromURLs sets the job's objects to the images at urls.
+func (job *Job) FromURLs(urls ...string) *Job {
+	job.input = pipeline.URLs(urls...)
+	return job
+}
+
+// FromURLList sets the job's objects to the image URLs read from r, one
+// per line.
+func (job *Job) FromURLList(r io.Reader) *Job {
+	job.input = pipeline.URLList(r)
+	return job
+}
+
+// Filter skips the objects keep returns false for. Filters are applied
+// in the order they are added.
+func (job *Job) Filter(keep func(source.Object) bool) *Job {
+	job.filters = append(job.filters, keep)
+	return job
+}
+
+// Then adds a stage that each successfully captioned result goes
+// through, after the stages added before it.
+func (job *Job) Then(stage pipeline.Stage) *Job {
+	job.p.Stages = append(job.p.Stages, stage)
+	return job
+}
+
+// WithWorkers sets how many objects are captioned at once.
+func (job *Job) WithWorkers(n int) *Job {
+	if n < 1 {
+		n = 1
+	}
+	job.p.Workers = n
+	return job
+}
+
+// WithBuffer sets how many objects may wait between the steps of the
+// job, as pipeline.Pipeline's Buffer.
+func (job *Job) WithBuffer(n int) *Job {
+	job.p.Buffer = n
+	return job
+}
+
+// WithRetries retries captioning an object up to n more times, delay
+// apart, before it fails.
+func (job *Job) WithRetries(n int, delay time.Duration) *Job {
+	job.p.Retries = n
+	job.p.RetryDelay = delay
+	return job
+}
+
+// OnError sets what the job does with objects that fail.
+func (job *Job) OnError(policy pipeline.ErrorPolicy) *Job {
+	job.p.OnError = policy
+	return job
+}
+
+// SkipSeen skips the objects whose content m records as captioned, and
+// records those the job captions, so that a job run again over a growing
+// archive only captions new images.
+func (job *Job) SkipSeen(m pipeline.Manifest) *Job {
+	job.p.Manifest = m
+	return job
+}
+
+// WithCaptioner captions with c, which every worker shares, instead of a
+// captionbot.ai session for each worker. c must be safe for concurrent
+// use. A *captionbot.CaptionBot isn't, so it is wrapped in a
+// captionbot.Serial, which makes one caption at a time and can't cancel
+// them early.
+func (job *Job) WithCaptioner(c pipeline.Captioner) *Job {
+	if bot, ok := c.(*captionbot.CaptionBot); ok {
+		c = captionbot.NewSerial(bot)
+	}
+	job.p.NewCaptioner = func() (pipeline.Captioner, error) {
+		return c, nil
+	}
+	return job
+}
+
+// To adds sinks that every result is written to, in the order results
+// finish.
+func (job *Job) To(sinks ...pipeline.Sink) *Job {
+	job.p.Sinks = append(job.p.Sinks, sinks...)
+	return job
+}
+
+// Run runs the job until every object is through it or ctx is done, and
+// flushes its sinks. It returns what pipeline.Pipeline's Run does.
+func (job *Job) Run(ctx context.Context) error {
+	if err := job.pipeline(); err != nil {
+		return err
+	}
+	return job.p.Run(ctx)
+}
+
+// All returns an iterator over the job's objects and their results, in
+// the order they finish, which runs the job as Run does each time it is
+// ranged over. Breaking out of the loop cancels the objects still being
+// captioned and skips the rest. Err returns the error that ended the
+// last iteration early, if any.
+func (job *Job) All(ctx context.Context) iter.Seq2[source.Object, pipeline.Result] {
+	return func(yield func(source.Object, pipeline.Result) bool) {
+		if job.pipeline() != nil {
+			return
+		}
+		for item, result := range job.p.All(ctx) {
+			if !yield(item.Object, result) {
+				break
+			}
+		}
+	}
+}
+
+// Err returns the first configuration error, or the error of the last
+// iteration of All, which Run would have returned. Stopping the iteration
+// isn't an error.
+func (job *Job) Err() error {
+	if job.err != nil {
+		return job.err
+	}
+	return job.p.Err()
+}
+
+// pipeline sets the source of the job's pipeline, with its filters.
+func (job *Job) pipeline() error {
+	if job.err != nil {
+		return job.err
+	}
+	job.p.Source = job.input
+	if job.input != nil && len(job.filters) > 0 {
+		job.p.Source = pipeline.Filter(job.input, func(item pipeline.Item) bool {
+			for _, keep := range job.filters {
+				if !keep(item.Object) {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	return nil
+}
+
+// MaxSize is a filter that skips objects known to be larger than size
+// bytes.
+func MaxSize(size int64) func(source.Object) bool {
+	return func(obj source.Object) bool {
+		return obj.Size <= size
+	}
+}
+
+// Match is a filter that keeps the objects whose key matches one of the
+// path.Match patterns, such as "2023/*.jpg".
+func Match(patterns ...string) func(source.Object) bool {
+	return func(obj source.Object) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, obj.Key); ok {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Prefix is a filter that keeps the objects whose key starts with prefix.
+func Prefix(prefix string) func(source.Object) bool {
+	return func(obj source.Object) bool {
+		return strings.HasPrefix(obj.Key, prefix)
+	}
+}
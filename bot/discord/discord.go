@@ -0,0 +1,415 @@
+// Package discord implements a Discord interactions endpoint that captions
+// images. It provides a /caption slash command taking an image attachment
+// or URL, and a "Caption image" message command for images already posted
+// in a channel. Watch also captions every image posted in the configured
+// channels, through the Gateway. When the Captioner is a Rater, each
+// caption is followed by rating buttons whose clicks are sent back to the
+// provider.
+//
+// Set the application's Interactions Endpoint URL to the Handler and call
+// RegisterCommands once to create the commands.
+package discord
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// APIURL is the root of the Discord HTTP API.
+var APIURL = "https://discord.com/api/v10/"
+
+// Interaction, response and component types from the Discord API.
+const (
+	interactionPing               = 1
+	interactionApplicationCommand = 2
+	interactionMessageComponent   = 3
+
+	responsePong                   = 1
+	responseChannelMessage         = 4
+	responseDeferredChannelMessage = 5
+	messageFlagEphemeral           = 1 << 6
+
+	componentActionRow = 1
+	componentButton    = 2
+	buttonSecondary    = 2
+
+	commandTypeChatInput    = 1
+	commandTypeMessage      = 3
+	commandOptionString     = 3
+	commandOptionAttachment = 11
+)
+
+const (
+	slashCommandName   = "caption"
+	messageCommandName = "Caption image"
+	ratingPrefix       = "rate:"
+
+	// ratingLifetime is how long a caption can still be rated.
+	ratingLifetime = time.Hour
+
+	// maxClockSkew is how far a request's timestamp may be from now.
+	maxClockSkew = 5 * time.Minute
+)
+
+// Command is an application command definition.
+type Command struct {
+	Name        string          `json:"name"`
+	Type        int             `json:"type"`
+	Description string          `json:"description,omitempty"`
+	Options     []CommandOption `json:"options,omitempty"`
+}
+
+// CommandOption is an option of a slash command.
+type CommandOption struct {
+	Name        string `json:"name"`
+	Type        int    `json:"type"`
+	Description string `json:"description"`
+	Required    bool   `json:"required,omitempty"`
+}
+
+// Commands are the commands the Handler answers.
+var Commands = []Command{
+	{
+		Name:        slashCommandName,
+		Type:        commandTypeChatInput,
+		Description: "Describe an image",
+		Options: []CommandOption{
+			{Name: "image", Type: commandOptionAttachment, Description: "Image to describe"},
+			{Name: "url", Type: commandOptionString, Description: "URL of an image to describe"},
+		},
+	},
+	{Name: messageCommandName, Type: commandTypeMessage},
+}
+
+// RegisterCommands replaces the application's global commands with Commands.
+func RegisterCommands(client *http.Client, applicationID, botToken string) error {
+	body, err := json.Marshal(Commands)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("PUT", APIURL+"applications/"+applicationID+"/commands", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bot "+botToken)
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("registering commands: status %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
+
+// Rater is implemented by Captioners that can send a rating of one of
+// their captions back to their provider, as a server.Session does.
+type Rater interface {
+	// Rate rates caption from 1 (poor) to 5 (great).
+	Rate(caption string, rating int) error
+}
+
+type captioned struct {
+	caption string
+	created time.Time
+}
+
+// Handler is an http.Handler for Discord interactions.
+type Handler struct {
+	PublicKey ed25519.PublicKey
+	// BotToken authenticates Watch and the replies it posts.
+	BotToken string
+	// Channels lists the IDs of the channels Watch captions images in.
+	Channels []string
+
+	// Captioner captions the images. Interactions are answered
+	// concurrently, so it must be safe for concurrent use.
+	Captioner  captionbot.Captioner
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	mu sync.Mutex
+	// captions maps the keys in rating buttons to the captions they
+	// rate.
+	captions map[string]captioned
+}
+
+// NewHandler creates a Handler for the application with the given
+// hex-encoded public key, captioning with captioner.
+func NewHandler(publicKey string, captioner captionbot.Captioner) (*Handler, error) {
+	key, err := hex.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	return &Handler{PublicKey: key, Captioner: captioner}, nil
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type attachment struct {
+	URL         string `json:"url"`
+	ContentType string `json:"content_type"`
+}
+
+type interaction struct {
+	ID            string `json:"id"`
+	ApplicationID string `json:"application_id"`
+	Type          int    `json:"type"`
+	Token         string `json:"token"`
+	Data          struct {
+		Name     string `json:"name"`
+		CustomID string `json:"custom_id"`
+		TargetID string `json:"target_id"`
+		Options  []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"options"`
+		Resolved struct {
+			Attachments map[string]attachment `json:"attachments"`
+			Messages    map[string]struct {
+				Attachments []attachment `json:"attachments"`
+				Embeds      []struct {
+					Image *struct {
+						URL string `json:"url"`
+					} `json:"image"`
+				} `json:"embeds"`
+			} `json:"messages"`
+		} `json:"resolved"`
+	} `json:"data"`
+}
+
+// imageURL returns the image a command refers to.
+func (i *interaction) imageURL() string {
+	if msg, ok := i.Data.Resolved.Messages[i.Data.TargetID]; ok {
+		for _, a := range msg.Attachments {
+			if strings.HasPrefix(a.ContentType, "image/") {
+				return a.URL
+			}
+		}
+		for _, e := range msg.Embeds {
+			if e.Image != nil {
+				return e.Image.URL
+			}
+		}
+		return ""
+	}
+	for _, opt := range i.Data.Options {
+		switch opt.Name {
+		case "image":
+			if a, ok := i.Data.Resolved.Attachments[opt.Value]; ok {
+				return a.URL
+			}
+		case "url":
+			return opt.Value
+		}
+	}
+	return ""
+}
+
+// verify checks the Ed25519 signature Discord makes of the request's
+// timestamp and body, and that the timestamp is recent, so a captured
+// request can't be replayed later.
+func (handler *Handler) verify(header http.Header, body []byte) bool {
+	timestamp := header.Get("X-Signature-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > maxClockSkew || age < -maxClockSkew {
+		return false
+	}
+	sig, err := hex.DecodeString(header.Get("X-Signature-Ed25519"))
+	if err != nil || len(handler.PublicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(handler.PublicKey, append([]byte(timestamp), body...), sig)
+}
+
+// ServeHTTP verifies and answers an interaction. Captions are produced
+// after a deferred response, since captioning can exceed Discord's three
+// second deadline.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !handler.verify(r.Header, body) {
+		http.Error(w, "invalid request signature", http.StatusUnauthorized)
+		return
+	}
+
+	var in interaction
+	if err := json.Unmarshal(body, &in); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch in.Type {
+	case interactionPing:
+		respond(w, map[string]interface{}{"type": responsePong})
+	case interactionApplicationCommand:
+		imageURL := in.imageURL()
+		if imageURL == "" {
+			respond(w, ephemeral("Give me an image attachment or URL to describe."))
+			return
+		}
+		respond(w, map[string]interface{}{"type": responseDeferredChannelMessage})
+		go handler.caption(in, imageURL)
+	case interactionMessageComponent:
+		respond(w, ephemeral(handler.rate(in.Data.CustomID)))
+	default:
+		http.Error(w, "unsupported interaction type", http.StatusBadRequest)
+	}
+}
+
+func respond(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func ephemeral(text string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": responseChannelMessage,
+		"data": map[string]interface{}{"content": text, "flags": messageFlagEphemeral},
+	}
+}
+
+// caption captions imageURL and edits the deferred response to show it.
+func (handler *Handler) caption(in interaction, imageURL string) {
+	var message map[string]interface{}
+	caption, err := handler.Captioner.CaptionURL(imageURL)
+	if err != nil {
+		message = map[string]interface{}{"content": "Sorry, I couldn't describe that image: " + err.Error()}
+	} else {
+		message = handler.captionMessage(in.ID, caption)
+	}
+
+	url := APIURL + "webhooks/" + in.ApplicationID + "/" + in.Token + "/messages/@original"
+	if err := handler.send("PATCH", url, false, message); err != nil {
+		handler.logf("discord: editing response: %s", err)
+	}
+}
+
+// captionMessage returns a message showing caption, with rating buttons
+// under key if the Captioner can rate it.
+func (handler *Handler) captionMessage(key, caption string) map[string]interface{} {
+	message := map[string]interface{}{"content": caption}
+	if _, ok := handler.Captioner.(Rater); ok {
+		handler.mu.Lock()
+		handler.expire()
+		if handler.captions == nil {
+			handler.captions = map[string]captioned{}
+		}
+		handler.captions[key] = captioned{caption: caption, created: time.Now()}
+		handler.mu.Unlock()
+		message["components"] = ratingButtons(key)
+	}
+	return message
+}
+
+func ratingButtons(id string) []interface{} {
+	var buttons []interface{}
+	for rating := 1; rating <= 5; rating++ {
+		buttons = append(buttons, map[string]interface{}{
+			"type":      componentButton,
+			"style":     buttonSecondary,
+			"label":     strings.Repeat("★", rating),
+			"custom_id": ratingPrefix + id + ":" + strconv.Itoa(rating),
+		})
+	}
+	return []interface{}{map[string]interface{}{"type": componentActionRow, "components": buttons}}
+}
+
+// rate handles a rating button and returns the text to show the user.
+func (handler *Handler) rate(customID string) string {
+	fields := strings.Split(strings.TrimPrefix(customID, ratingPrefix), ":")
+	if len(fields) != 2 {
+		return "Unknown button."
+	}
+	rating, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "Unknown button."
+	}
+
+	handler.mu.Lock()
+	c, ok := handler.captions[fields[0]]
+	handler.mu.Unlock()
+	rater, canRate := handler.Captioner.(Rater)
+	if !ok || !canRate || time.Since(c.created) > ratingLifetime {
+		return "Sorry, that caption is too old to rate."
+	}
+	if err := rater.Rate(c.caption, rating); err != nil {
+		handler.logf("discord: rating caption: %s", err)
+		return "Sorry, I couldn't send your rating."
+	}
+	return "Thanks for the feedback!"
+}
+
+// expire drops captions too old to be rated. The caller holds mu.
+func (handler *Handler) expire() {
+	for key, c := range handler.captions {
+		if time.Since(c.created) > ratingLifetime {
+			delete(handler.captions, key)
+		}
+	}
+}
+
+// send sends message to the API at url, authenticated with BotToken if
+// authorize is set.
+func (handler *Handler) send(method, url string, authorize bool, message map[string]interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorize {
+		req.Header.Set("Authorization", "Bot "+handler.BotToken)
+	}
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package discord
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeCaptioner captions every image "a cat" and keeps the ratings it is
+// sent.
+type fakeCaptioner struct {
+	mu      sync.Mutex
+	ratings []int
+}
+
+func (f *fakeCaptioner) CaptionURL(url string) (string, error) { return "a cat", nil }
+
+func (f *fakeCaptioner) CaptionReader(r io.Reader, name string) (string, error) {
+	return "a cat", nil
+}
+
+func (f *fakeCaptioner) Rate(caption string, rating int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ratings = append(f.ratings, rating)
+	return nil
+}
+
+func TestVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	sign := func(key ed25519.PrivateKey, timestamp, body string) string {
+		return hex.EncodeToString(ed25519.Sign(key, []byte(timestamp+body)))
+	}
+
+	const body = `{"type":1}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		status    int
+	}{
+		{"valid", now, sign(private, now, body), http.StatusOK},
+		{"bad signature", now, sign(other, now, body), http.StatusUnauthorized},
+		{"signature of another time", now, sign(private, old, body), http.StatusUnauthorized},
+		{"expired", old, sign(private, old, body), http.StatusUnauthorized},
+		{"no timestamp", "", sign(private, "", body), http.StatusUnauthorized},
+		{"no signature", now, "", http.StatusUnauthorized},
+		{"signature not hex", now, "zz", http.StatusUnauthorized},
+	}
+	handler := &Handler{PublicKey: public}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/discord", strings.NewReader(body))
+		req.Header.Set("X-Signature-Timestamp", test.timestamp)
+		req.Header.Set("X-Signature-Ed25519", test.signature)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+		if test.status == http.StatusOK && !strings.Contains(rec.Body.String(), `"type":1`) {
+			t.Errorf("%s: body = %q, want a pong", test.name, rec.Body)
+		}
+	}
+
+	// A handler without a key refuses everything rather than panicking.
+	req := httptest.NewRequest("POST", "/discord", strings.NewReader(body))
+	req.Header.Set("X-Signature-Timestamp", now)
+	req.Header.Set("X-Signature-Ed25519", sign(private, now, body))
+	rec := httptest.NewRecorder()
+	(&Handler{}).ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("zero Handler: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	var mu sync.Mutex
+	var replies []map[string]interface{}
+	replied := make(chan struct{}, 10)
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/channels/watched/messages" || r.Header.Get("Authorization") != "Bot token" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		var reply map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&reply)
+		mu.Lock()
+		replies = append(replies, reply)
+		mu.Unlock()
+		replied <- struct{}{}
+	}))
+	defer api.Close()
+
+	image := []attachment{{URL: "https://cdn.example.com/cat.png", ContentType: "image/png"}}
+	messages := []message{
+		{ID: "1", ChannelID: "other", Attachments: image},
+		{ID: "2", ChannelID: "watched", Attachments: []attachment{{URL: "https://cdn.example.com/a.txt", ContentType: "text/plain"}}},
+		{ID: "3", ChannelID: "watched", Attachments: image},
+		{ID: "4", ChannelID: "watched", Attachments: image},
+	}
+	messages[3].Author.Bot = true
+
+	var upgrader websocket.Upgrader
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.WriteJSON(map[string]interface{}{"op": opHello, "d": map[string]int{"heartbeat_interval": 45000}})
+		var identify struct {
+			Op int `json:"op"`
+			D  struct {
+				Token string `json:"token"`
+			} `json:"d"`
+		}
+		if err := conn.ReadJSON(&identify); err != nil || identify.Op != opIdentify || identify.D.Token != "token" {
+			t.Errorf("identify = %+v, %v", identify, err)
+		}
+		for i, msg := range messages {
+			conn.WriteJSON(map[string]interface{}{"op": opDispatch, "s": i + 1, "t": "MESSAGE_CREATE", "d": msg})
+		}
+		select {
+		case <-replied:
+		case <-time.After(5 * time.Second):
+			t.Error("no reply was posted")
+		}
+		// Messages are handled in order, so the ones after the reply
+		// have been too once Watch sees this.
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(4004, "authentication failed"))
+	}))
+	defer gateway.Close()
+
+	defer func(apiURL, gatewayURL string) { APIURL, GatewayURL = apiURL, gatewayURL }(APIURL, GatewayURL)
+	APIURL = api.URL + "/"
+	GatewayURL = "ws" + strings.TrimPrefix(gateway.URL, "http")
+
+	captioner := &fakeCaptioner{}
+	handler := &Handler{BotToken: "token", Channels: []string{"watched"}, Captioner: captioner}
+	if err := handler.Watch(); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Fatalf("Watch = %v, want the bot refused", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(replies) != 1 {
+		t.Fatalf("%d replies, want 1: %v", len(replies), replies)
+	}
+	reply := replies[0]
+	if reply["content"] != "a cat" {
+		t.Errorf("content = %v, want the caption", reply["content"])
+	}
+	if ref, _ := reply["message_reference"].(map[string]interface{}); ref["message_id"] != "3" {
+		t.Errorf("message_reference = %v, want message 3", reply["message_reference"])
+	}
+	if reply["components"] == nil {
+		t.Error("reply has no rating buttons")
+	}
+
+	if text := handler.rate(ratingPrefix + "3-0:4"); text != "Thanks for the feedback!" {
+		t.Errorf("rating the reply: %q", text)
+	}
+	if text := handler.rate(ratingPrefix + "1-0:4"); text == "Thanks for the feedback!" {
+		t.Error("rated a caption that wasn't made")
+	}
+	if len(captioner.ratings) != 1 || captioner.ratings[0] != 4 {
+		t.Errorf("ratings = %v, want [4]", captioner.ratings)
+	}
+}
@@ -0,0 +1,186 @@
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// GatewayURL is the Discord Gateway Watch connects to.
+var GatewayURL = "wss://gateway.discord.gg/?v=10&encoding=json"
+
+// Gateway opcodes and intents.
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+
+	intentGuildMessages  = 1 << 9
+	intentMessageContent = 1 << 15
+)
+
+// reconnectDelay is how long Watch waits before connecting again.
+const reconnectDelay = 5 * time.Second
+
+type gatewayEvent struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  int64           `json:"s"`
+	T  string          `json:"t"`
+}
+
+type message struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	Author    struct {
+		Bot bool `json:"bot"`
+	} `json:"author"`
+	Attachments []attachment `json:"attachments"`
+}
+
+// Watch connects to the Gateway as the bot and replies to every image
+// attached to a message in Channels with its caption. It reconnects when
+// Discord drops the connection, and only returns when Discord refuses
+// the bot, such as for a bad token or without the Message Content
+// intent, which it needs to see attachments.
+func (handler *Handler) Watch() error {
+	for {
+		err := handler.watch()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) && (closeErr.Code == 4004 || closeErr.Code >= 4010 && closeErr.Code <= 4014) {
+			return fmt.Errorf("discord: gateway refused the bot: %w", err)
+		}
+		handler.logf("discord: gateway: %s; reconnecting", err)
+		time.Sleep(reconnectDelay)
+	}
+}
+
+// watch runs one Gateway connection until it fails or Discord asks for a
+// new one.
+func (handler *Handler) watch() error {
+	conn, _, err := websocket.DefaultDialer.Dial(GatewayURL, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var hello struct {
+		HeartbeatInterval int64 `json:"heartbeat_interval"`
+	}
+	var event gatewayEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		return err
+	}
+	if event.Op != opHello || json.Unmarshal(event.D, &hello) != nil || hello.HeartbeatInterval <= 0 {
+		return fmt.Errorf("expected hello, got opcode %d", event.Op)
+	}
+	interval := time.Duration(hello.HeartbeatInterval) * time.Millisecond
+
+	identify := map[string]interface{}{
+		"op": opIdentify,
+		"d": map[string]interface{}{
+			"token":   handler.BotToken,
+			"intents": intentGuildMessages | intentMessageContent,
+			"properties": map[string]string{
+				"os":      runtime.GOOS,
+				"browser": "captionbot",
+				"device":  "captionbot",
+			},
+		},
+	}
+	if err := conn.WriteJSON(identify); err != nil {
+		return err
+	}
+
+	// The heartbeat goroutine is the only writer from here on; beat asks
+	// it for a heartbeat out of turn.
+	var seq atomic.Int64
+	beat := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			case <-beat:
+			}
+			var last interface{}
+			if s := seq.Load(); s != 0 {
+				last = s
+			}
+			if conn.WriteJSON(map[string]interface{}{"op": opHeartbeat, "d": last}) != nil {
+				return
+			}
+		}
+	}()
+
+	channels := map[string]bool{}
+	for _, id := range handler.Channels {
+		channels[id] = true
+	}
+	for {
+		// Discord acknowledges every heartbeat, so a silent connection
+		// is a dead one.
+		conn.SetReadDeadline(time.Now().Add(2 * interval))
+		var event gatewayEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			return err
+		}
+		switch event.Op {
+		case opDispatch:
+			seq.Store(event.S)
+			if event.T != "MESSAGE_CREATE" {
+				continue
+			}
+			var msg message
+			if err := json.Unmarshal(event.D, &msg); err != nil {
+				handler.logf("discord: gateway: %s", err)
+				continue
+			}
+			if channels[msg.ChannelID] && !msg.Author.Bot {
+				handler.captionAttachments(msg)
+			}
+		case opHeartbeat:
+			select {
+			case beat <- struct{}{}:
+			default:
+			}
+		case opReconnect, opInvalidSession:
+			return fmt.Errorf("gateway asked for a new session")
+		}
+	}
+}
+
+// captionAttachments replies to msg with a caption of each image attached
+// to it.
+func (handler *Handler) captionAttachments(msg message) {
+	for i, a := range msg.Attachments {
+		if !strings.HasPrefix(a.ContentType, "image/") {
+			continue
+		}
+		caption, err := handler.Captioner.CaptionURL(a.URL)
+		if err != nil {
+			handler.logf("discord: captioning %s: %s", a.URL, err)
+			continue
+		}
+		reply := handler.captionMessage(fmt.Sprintf("%s-%d", msg.ID, i), caption)
+		reply["message_reference"] = map[string]string{"message_id": msg.ID}
+		reply["allowed_mentions"] = map[string]interface{}{"parse": []string{}}
+		if err := handler.send("POST", APIURL+"channels/"+msg.ChannelID+"/messages", true, reply); err != nil {
+			handler.logf("discord: replying in %s: %s", msg.ChannelID, err)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package github
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// App authenticates as a GitHub App and its installations.
+type App struct {
+	ID  int64
+	Key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	tokens map[int64]installationToken
+}
+
+type installationToken struct {
+	token   string
+	expires time.Time
+}
+
+// NewApp creates an App from its ID and PEM-encoded private key.
+func NewApp(id int64, privateKey []byte) (*App, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err8 != nil {
+			return nil, err
+		}
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); !ok {
+			return nil, fmt.Errorf("private key is not an RSA key")
+		}
+	}
+	return &App{ID: id, Key: key, tokens: map[int64]installationToken{}}, nil
+}
+
+// jwt returns a short-lived RS256 token identifying the app.
+func (app *App) jwt() (string, error) {
+	now := time.Now()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		// Backdated to allow for clock drift, as GitHub recommends.
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": strconv.FormatInt(app.ID, 10),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, app.Key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// InstallationToken returns an access token for an installation, reusing
+// it until shortly before it expires.
+func (app *App) InstallationToken(client *http.Client, installationID int64) (string, error) {
+	app.mu.Lock()
+	defer app.mu.Unlock()
+	if t, ok := app.tokens[installationID]; ok && time.Until(t.expires) > 5*time.Minute {
+		return t.token, nil
+	}
+
+	jwt, err := app.jwt()
+	if err != nil {
+		return "", err
+	}
+	rawurl := fmt.Sprintf("%s/app/installations/%d/access_tokens", APIURL, installationID)
+	req, err := http.NewRequest("POST", rawurl, nil)
+	if err != nil {
+		return "", err
+	}
+	setHeaders(req, jwt)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("creating installation token: status %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	app.tokens[installationID] = installationToken{token: result.Token, expires: result.ExpiresAt}
+	return result.Token, nil
+}
@@ -0,0 +1,228 @@
+// Package github implements a GitHub webhook that suggests alt text. When
+// an issue, pull request or comment is opened with images that lack a
+// meaningful description, it comments with a collapsed section of
+// suggested alt text for each.
+//
+// It runs either as a GitHub App, authenticating as the installation that
+// sent each event, or with a single personal access token.
+package github
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/internal/mdimage"
+)
+
+// APIURL is the root of the GitHub REST API.
+var APIURL = "https://api.github.com"
+
+// marker identifies the bot's own comments.
+const marker = "<!-- captionbot -->"
+
+// Handler is an http.Handler for GitHub webhook deliveries.
+type Handler struct {
+	// Secret is the webhook secret that deliveries are signed with.
+	Secret string
+	// App, if set, authenticates as the installation of each event.
+	App *App
+	// Token is a personal access token used when App is nil.
+	Token string
+
+	// Captioner makes captions, for requests on many goroutines at once,
+	// so a CaptionBot must be wrapped in a captionbot.Serial.
+	Captioner  captionbot.Captioner
+	HTTPClient *http.Client
+	Logger     *log.Logger
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type user struct {
+	Login string `json:"login"`
+	Type  string `json:"type"`
+}
+
+type payload struct {
+	Action       string `json:"action"`
+	Installation struct {
+		ID int64 `json:"id"`
+	} `json:"installation"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		Private  bool   `json:"private"`
+	} `json:"repository"`
+	Sender      user  `json:"sender"`
+	Issue       *post `json:"issue"`
+	PullRequest *post `json:"pull_request"`
+	Comment     *post `json:"comment"`
+}
+
+type post struct {
+	Number int    `json:"number"`
+	Body   string `json:"body"`
+}
+
+// ServeHTTP verifies a delivery and acknowledges it, handling opened
+// issues, pull requests and new comments in the background.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 25<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(handler.Secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	// An empty secret signs nothing anyone couldn't sign.
+	if handler.Secret == "" || !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Hub-Signature-256"))) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var p payload
+	if err := json.Unmarshal(body, &p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+
+	if p.Sender.Type == "Bot" {
+		return
+	}
+	var text string
+	var number int
+	switch event := r.Header.Get("X-GitHub-Event"); {
+	case event == "issues" && p.Action == "opened" && p.Issue != nil:
+		text, number = p.Issue.Body, p.Issue.Number
+	case event == "pull_request" && p.Action == "opened" && p.PullRequest != nil:
+		text, number = p.PullRequest.Body, p.PullRequest.Number
+	case event == "issue_comment" && p.Action == "created" && p.Comment != nil && p.Issue != nil:
+		text, number = p.Comment.Body, p.Issue.Number
+	default:
+		return
+	}
+	if strings.Contains(text, marker) {
+		return
+	}
+
+	go func() {
+		if err := handler.suggest(p, number, text); err != nil {
+			handler.logf("github: %s#%d: %s", p.Repository.FullName, number, err)
+		}
+	}()
+}
+
+func (handler *Handler) suggest(p payload, number int, text string) error {
+	missing := mdimage.MissingAlt(text)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	token := handler.Token
+	if handler.App != nil {
+		var err error
+		if token, err = handler.App.InstallationToken(handler.httpClient(), p.Installation.ID); err != nil {
+			return err
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString(marker + "\n<details>\n<summary>Suggested alt text for ")
+	if len(missing) == 1 {
+		b.WriteString("1 image")
+	} else {
+		fmt.Fprintf(&b, "%d images", len(missing))
+	}
+	b.WriteString("</summary>\n\n")
+	described := 0
+	for _, img := range missing {
+		caption, err := handler.caption(img.URL, token, p.Repository.Private)
+		if err != nil {
+			handler.logf("github: captioning %s: %s", img.URL, err)
+			continue
+		}
+		described++
+		b.WriteString(mdimage.Suggestion(caption, img.URL))
+	}
+	if described == 0 {
+		return nil
+	}
+	b.WriteString("</details>\n")
+
+	body, err := json.Marshal(map[string]string{"body": b.String()})
+	if err != nil {
+		return err
+	}
+	rawurl := fmt.Sprintf("%s/repos/%s/issues/%d/comments", APIURL, p.Repository.FullName, number)
+	req, err := http.NewRequest("POST", rawurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	setHeaders(req, token)
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("creating comment: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func setHeaders(req *http.Request, token string) {
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// caption captions a public image by URL. Images in private repositories
+// aren't reachable by captionbot.ai, so they are downloaded with the
+// token and uploaded instead.
+func (handler *Handler) caption(imageURL, token string, private bool) (string, error) {
+	if !private {
+		return handler.Captioner.CaptionURL(imageURL)
+	}
+
+	req, err := http.NewRequest("GET", imageURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading image: status %d", resp.StatusCode)
+	}
+	name := "image" + path.Ext(resp.Request.URL.Path)
+	return handler.Captioner.CaptionReader(resp.Body, name)
+}
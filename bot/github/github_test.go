@@ -0,0 +1,139 @@
+package github
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign returns the X-Hub-Signature-256 of body.
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestDeliverySignature(t *testing.T) {
+	const body = `{"action":"closed"}`
+	tests := []struct {
+		name      string
+		secret    string
+		body      string
+		signature string
+		status    int
+	}{
+		{"valid", "secret", body, sign("secret", body), http.StatusAccepted},
+		{"bad signature", "secret", body, sign("other", body), http.StatusUnauthorized},
+		{"tampered body", "secret", `{"action":"opened"}`, sign("secret", body), http.StatusUnauthorized},
+		{"no signature", "secret", body, "", http.StatusUnauthorized},
+		{"no secret", "", body, sign("", body), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		handler := &Handler{Secret: test.secret}
+		req := httptest.NewRequest("POST", "/github", strings.NewReader(test.body))
+		req.Header.Set("X-GitHub-Event", "issues")
+		req.Header.Set("X-Hub-Signature-256", test.signature)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+	}
+}
+
+func TestAppJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := &App{ID: 42, Key: key}
+	token, err := app.jwt()
+	if err != nil {
+		t.Fatalf("jwt: %v", err)
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("token %q doesn't have three parts", token)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("signature doesn't verify: %v", err)
+	}
+
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var claims struct {
+		Issuer    string `json:"iss"`
+		IssuedAt  int64  `json:"iat"`
+		ExpiresAt int64  `json:"exp"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if claims.Issuer != "42" {
+		t.Errorf("iss = %q, want the app ID", claims.Issuer)
+	}
+	if issued := time.Unix(claims.IssuedAt, 0); !issued.Before(now) {
+		t.Errorf("iat = %s, want it backdated from %s", issued, now)
+	}
+	// GitHub refuses app tokens living more than ten minutes.
+	if expires := time.Unix(claims.ExpiresAt, 0); !expires.After(now) || expires.Sub(time.Unix(claims.IssuedAt, 0)) > 10*time.Minute {
+		t.Errorf("token lives from %d to %d, want at most ten minutes from now", claims.IssuedAt, claims.ExpiresAt)
+	}
+}
+
+func TestInstallationTokenExpiry(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		lifetime time.Duration
+		requests int
+	}{
+		{"fresh token reused", time.Hour, 1},
+		{"token about to expire renewed", 2 * time.Minute, 2},
+		{"expired token renewed", -time.Minute, 2},
+	}
+	defer func(previous string) { APIURL = previous }(APIURL)
+	for _, test := range tests {
+		requests := 0
+		api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+				t.Errorf("%s: request isn't authenticated with the app's JWT", test.name)
+			}
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"token":      fmt.Sprintf("token-%d", requests),
+				"expires_at": time.Now().Add(test.lifetime),
+			})
+		}))
+		APIURL = api.URL
+
+		app := &App{ID: 42, Key: key, tokens: map[int64]installationToken{}}
+		for i := 0; i < 2; i++ {
+			if _, err := app.InstallationToken(api.Client(), 7); err != nil {
+				t.Fatalf("%s: InstallationToken: %v", test.name, err)
+			}
+		}
+		if requests != test.requests {
+			t.Errorf("%s: %d token requests, want %d", test.name, requests, test.requests)
+		}
+		api.Close()
+	}
+}
@@ -0,0 +1,204 @@
+// Package gitlab implements a GitLab webhook that suggests alt text. When
+// an issue or merge request is opened, or a comment posted on one, with
+// images that lack a meaningful description, it comments with a collapsed
+// section of suggested alt text for each.
+//
+// It authenticates with a project (or group) access token with the api
+// scope. Images uploaded to the project are downloaded through the API,
+// so private projects work too.
+package gitlab
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/internal/mdimage"
+)
+
+// marker identifies the bot's own comments.
+const marker = "<!-- captionbot -->"
+
+// Handler is an http.Handler for GitLab webhook events.
+type Handler struct {
+	// BaseURL is the GitLab instance, https://gitlab.com by default.
+	BaseURL string
+	// Secret is the webhook's secret token.
+	Secret string
+	// Token is a project or group access token.
+	Token string
+
+	// Captioner captions the images of issues, merge requests and
+	// comments. Hooks are handled as they arrive, so it must be safe for
+	// concurrent use; NewHandler wraps its bot in a captionbot.Serial.
+	Captioner  captionbot.Captioner
+	HTTPClient *http.Client
+	Logger     *log.Logger
+}
+
+// NewHandler creates a Handler for gitlab.com.
+func NewHandler(secret, token string, bot *captionbot.CaptionBot) *Handler {
+	return &Handler{BaseURL: "https://gitlab.com", Secret: secret, Token: token, Captioner: captionbot.NewSerial(bot)}
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type event struct {
+	ObjectKind string `json:"object_kind"`
+	Project    struct {
+		ID int64 `json:"id"`
+	} `json:"project"`
+	ObjectAttributes struct {
+		IID          int    `json:"iid"`
+		Action       string `json:"action"`
+		Description  string `json:"description"`
+		Note         string `json:"note"`
+		NoteableType string `json:"noteable_type"`
+		System       bool   `json:"system"`
+	} `json:"object_attributes"`
+	Issue *struct {
+		IID int `json:"iid"`
+	} `json:"issue"`
+	MergeRequest *struct {
+		IID int `json:"iid"`
+	} `json:"merge_request"`
+}
+
+// ServeHTTP checks the secret token and acknowledges the event, handling
+// it in the background. Without a Secret every event is refused.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("X-Gitlab-Token")
+	if handler.Secret == "" || subtle.ConstantTimeCompare([]byte(token), []byte(handler.Secret)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	var e event
+	if err := json.NewDecoder(io.LimitReader(r.Body, 25<<20)).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	attrs := e.ObjectAttributes
+	var text, notes string
+	switch {
+	case e.ObjectKind == "issue" && attrs.Action == "open":
+		text, notes = attrs.Description, fmt.Sprintf("issues/%d/notes", attrs.IID)
+	case e.ObjectKind == "merge_request" && attrs.Action == "open":
+		text, notes = attrs.Description, fmt.Sprintf("merge_requests/%d/notes", attrs.IID)
+	case e.ObjectKind == "note" && !attrs.System && attrs.NoteableType == "Issue" && e.Issue != nil:
+		text, notes = attrs.Note, fmt.Sprintf("issues/%d/notes", e.Issue.IID)
+	case e.ObjectKind == "note" && !attrs.System && attrs.NoteableType == "MergeRequest" && e.MergeRequest != nil:
+		text, notes = attrs.Note, fmt.Sprintf("merge_requests/%d/notes", e.MergeRequest.IID)
+	default:
+		return
+	}
+	if strings.Contains(text, marker) {
+		return
+	}
+
+	go func() {
+		if err := handler.suggest(e.Project.ID, notes, text); err != nil {
+			handler.logf("gitlab: project %d %s: %s", e.Project.ID, notes, err)
+		}
+	}()
+}
+
+func (handler *Handler) api(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, strings.TrimRight(handler.BaseURL, "/")+"/api/v4/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("PRIVATE-TOKEN", handler.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return handler.httpClient().Do(req)
+}
+
+func (handler *Handler) suggest(projectID int64, notes, text string) error {
+	missing := mdimage.MissingAlt(text)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	var b strings.Builder
+	b.WriteString(marker + "\n<details>\n<summary>Suggested alt text for ")
+	if len(missing) == 1 {
+		b.WriteString("1 image")
+	} else {
+		fmt.Fprintf(&b, "%d images", len(missing))
+	}
+	b.WriteString("</summary>\n\n")
+	described := 0
+	for _, img := range missing {
+		caption, err := handler.caption(projectID, img.URL)
+		if err != nil {
+			handler.logf("gitlab: captioning %s: %s", img.URL, err)
+			continue
+		}
+		described++
+		b.WriteString(mdimage.Suggestion(caption, img.URL))
+	}
+	if described == 0 {
+		return nil
+	}
+	b.WriteString("</details>\n")
+
+	body, err := json.Marshal(map[string]string{"body": b.String()})
+	if err != nil {
+		return err
+	}
+	resp, err := handler.api("POST", fmt.Sprintf("projects/%d/%s", projectID, notes), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("creating note: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// caption captions an image. Project uploads, linked as
+// /uploads/SECRET/FILENAME, are downloaded through the API; other images
+// are captioned by URL.
+func (handler *Handler) caption(projectID int64, imageURL string) (string, error) {
+	if !strings.HasPrefix(imageURL, "/uploads/") {
+		return handler.Captioner.CaptionURL(imageURL)
+	}
+	parts := strings.SplitN(strings.TrimPrefix(imageURL, "/uploads/"), "/", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("unrecognized upload path")
+	}
+	resp, err := handler.api("GET", fmt.Sprintf("projects/%d/uploads/%s/%s", projectID, url.PathEscape(parts[0]), url.PathEscape(parts[1])), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading upload: status %d", resp.StatusCode)
+	}
+	return handler.Captioner.CaptionReader(resp.Body, path.Base(parts[1]))
+}
@@ -0,0 +1,35 @@
+package gitlab
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecretToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		status int
+	}{
+		{"valid", "secret", "secret", http.StatusOK},
+		{"wrong token", "secret", "other", http.StatusUnauthorized},
+		{"prefix of the secret", "secret", "secr", http.StatusUnauthorized},
+		{"no token", "secret", "", http.StatusUnauthorized},
+		{"no secret", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		handler := &Handler{Secret: test.secret}
+		req := httptest.NewRequest("POST", "/gitlab", strings.NewReader(`{"object_kind":"push"}`))
+		if test.token != "" {
+			req.Header.Set("X-Gitlab-Token", test.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Package irc implements an IRC bot that posts a one-line description of
+// images linked in its channels. Auto-captioning is limited to the
+// configured channels; "!caption URL" also works in private messages.
+// Outgoing lines are throttled so the bot isn't kicked for flooding.
+package irc
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/source"
+)
+
+const (
+	// floodBurst lines may be sent at once before throttling applies.
+	floodBurst = 4
+	// floodInterval is the sustained delay between lines.
+	floodInterval = 2 * time.Second
+	// repeatWindow is how long a URL isn't captioned again in a channel.
+	repeatWindow = 10 * time.Minute
+	// maxLineLength leaves room for the prefix the server adds when
+	// relaying a line to other clients.
+	maxLineLength = 400
+)
+
+// Bot is an IRC client that captions image links.
+type Bot struct {
+	// Server is a host:port address.
+	Server   string
+	TLS      bool
+	Nick     string
+	Password string
+	// Channels are joined, and image links posted in them captioned.
+	Channels []string
+	// Ignore lists nicks, such as other bots, whose messages are skipped.
+	Ignore []string
+
+	// Captioner captions the links, one at a time, so a CaptionBot
+	// serves as it is.
+	Captioner  captionbot.Captioner
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	conn  net.Conn
+	send  chan string
+	nick  string
+	seen  map[string]time.Time
+	queue chan request
+}
+
+type request struct {
+	target string
+	url    string
+}
+
+// NewBot creates a Bot.
+func NewBot(server, nick string, channels []string, bot *captionbot.CaptionBot) *Bot {
+	return &Bot{Server: server, Nick: nick, Channels: channels, Captioner: bot}
+}
+
+func (irc *Bot) httpClient() *http.Client {
+	if irc.HTTPClient != nil {
+		return irc.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
+}
+
+func (irc *Bot) logf(format string, args ...interface{}) {
+	if irc.Logger != nil {
+		irc.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Run connects and handles messages until the connection closes.
+func (irc *Bot) Run() error {
+	var err error
+	if irc.TLS {
+		host, _, _ := net.SplitHostPort(irc.Server)
+		irc.conn, err = tls.Dial("tcp", irc.Server, &tls.Config{ServerName: host})
+	} else {
+		irc.conn, err = net.Dial("tcp", irc.Server)
+	}
+	if err != nil {
+		return err
+	}
+	defer irc.conn.Close()
+
+	irc.send = make(chan string, 64)
+	irc.queue = make(chan request, 16)
+	irc.seen = map[string]time.Time{}
+	irc.nick = irc.Nick
+
+	writerDone := make(chan struct{})
+	captionerDone := make(chan struct{})
+	go func() {
+		irc.writeLoop()
+		close(writerDone)
+	}()
+	go func() {
+		irc.captionLoop()
+		close(captionerDone)
+	}()
+	defer func() {
+		close(irc.queue)
+		<-captionerDone
+		close(irc.send)
+		<-writerDone
+	}()
+
+	if irc.Password != "" {
+		irc.writeNow("PASS " + irc.Password)
+	}
+	irc.writeNow("NICK " + irc.nick)
+	irc.writeNow("USER " + irc.Nick + " 0 * :captionbot")
+
+	scanner := bufio.NewScanner(irc.conn)
+	for scanner.Scan() {
+		irc.handle(parse(scanner.Text()))
+	}
+	return scanner.Err()
+}
+
+// writeNow sends a line bypassing the flood queue, for registration and
+// PONGs, which must not wait behind captions.
+func (irc *Bot) writeNow(line string) {
+	fmt.Fprintf(irc.conn, "%s\r\n", line)
+}
+
+// writeLoop sends queued lines, allowing a burst of floodBurst lines and
+// then one per floodInterval.
+func (irc *Bot) writeLoop() {
+	tokens := floodBurst
+	last := time.Now()
+	for line := range irc.send {
+		tokens += int(time.Since(last) / floodInterval)
+		if tokens > floodBurst {
+			tokens = floodBurst
+		}
+		if tokens == 0 {
+			time.Sleep(floodInterval)
+			tokens = 1
+		}
+		last = time.Now()
+		tokens--
+		irc.writeNow(line)
+	}
+}
+
+func (irc *Bot) say(target, text string) {
+	text = strings.ReplaceAll(text, "\n", " ")
+	if len(text) > maxLineLength {
+		text = text[:maxLineLength]
+	}
+	select {
+	case irc.send <- "PRIVMSG " + target + " :" + text:
+	default:
+		irc.logf("irc: send queue full, dropping message to %s", target)
+	}
+}
+
+type message struct {
+	nick    string
+	command string
+	params  []string
+}
+
+func parse(line string) message {
+	var m message
+	if strings.HasPrefix(line, "@") {
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			line = line[i+1:]
+		}
+	}
+	if strings.HasPrefix(line, ":") {
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return m
+		}
+		m.nick = strings.SplitN(line[1:i], "!", 2)[0]
+		line = line[i+1:]
+	}
+	if i := strings.Index(line, " :"); i >= 0 {
+		m.params = append(strings.Fields(line[:i]), line[i+2:])
+	} else {
+		m.params = strings.Fields(line)
+	}
+	if len(m.params) > 0 {
+		m.command, m.params = strings.ToUpper(m.params[0]), m.params[1:]
+	}
+	return m
+}
+
+func (irc *Bot) handle(m message) {
+	switch m.command {
+	case "PING":
+		irc.writeNow("PONG :" + strings.Join(m.params, " "))
+	case "001":
+		for _, channel := range irc.Channels {
+			irc.writeNow("JOIN " + channel)
+		}
+	case "433":
+		irc.nick += "_"
+		irc.writeNow("NICK " + irc.nick)
+	case "PRIVMSG":
+		if len(m.params) == 2 {
+			irc.handlePrivmsg(m.nick, m.params[0], m.params[1])
+		}
+	}
+}
+
+var urlPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+
+func (irc *Bot) enabled(channel string) bool {
+	for _, c := range irc.Channels {
+		if strings.EqualFold(c, channel) {
+			return true
+		}
+	}
+	return false
+}
+
+func (irc *Bot) ignored(nick string) bool {
+	for _, n := range irc.Ignore {
+		if strings.EqualFold(n, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (irc *Bot) handlePrivmsg(nick, target, text string) {
+	if irc.ignored(nick) || strings.EqualFold(nick, irc.nick) {
+		return
+	}
+
+	command := strings.HasPrefix(text, "!caption ")
+	replyTo := target
+	if !strings.HasPrefix(target, "#") && !strings.HasPrefix(target, "&") {
+		replyTo = nick
+	} else if !command && !irc.enabled(target) {
+		return
+	}
+	if replyTo == nick && !command {
+		return
+	}
+
+	for _, link := range urlPattern.FindAllString(text, 3) {
+		link = strings.TrimRight(link, ".,;:!?)")
+		key := strings.ToLower(replyTo) + " " + link
+		if at, ok := irc.seen[key]; ok && time.Since(at) < repeatWindow && !command {
+			continue
+		}
+		irc.seen[key] = time.Now()
+		select {
+		case irc.queue <- request{target: replyTo, url: link}:
+		default:
+			irc.logf("irc: caption queue full, skipping %s", link)
+		}
+	}
+	for key, at := range irc.seen {
+		if time.Since(at) > repeatWindow {
+			delete(irc.seen, key)
+		}
+	}
+}
+
+// captionLoop captions queued links one at a time.
+func (irc *Bot) captionLoop() {
+	for req := range irc.queue {
+		if !irc.isImage(req.url) {
+			continue
+		}
+		caption, err := irc.Captioner.CaptionURL(req.url)
+		if err != nil {
+			irc.logf("irc: captioning %s: %s", req.url, err)
+			continue
+		}
+		irc.say(req.target, "Image: "+caption)
+	}
+}
+
+// isImage reports whether link looks like or is served as an image.
+func (irc *Bot) isImage(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil {
+		return false
+	}
+	if source.IsImage(path.Base(u.Path)) {
+		return true
+	}
+	resp, err := irc.httpClient().Head(link)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK && strings.HasPrefix(resp.Header.Get("Content-Type"), "image/")
+}
@@ -0,0 +1,320 @@
+// Package mailbox captions images emailed to an IMAP mailbox, such as a
+// photo submission inbox. Each unread message with image attachments is
+// answered (or forwarded) over SMTP with one caption per image, then
+// marked read.
+package mailbox
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/nhatbui/captionbot"
+)
+
+// maxMessageSize bounds how much of a message is fetched.
+const maxMessageSize = 25 << 20
+
+// Mailbox polls an IMAP folder and replies with captions.
+type Mailbox struct {
+	// IMAPAddr is the host:port of an IMAP server that speaks TLS.
+	IMAPAddr string
+	// SMTPAddr is the host:port of an SMTP submission server that
+	// supports STARTTLS.
+	SMTPAddr string
+	Username string
+	Password string
+	// Folder is the IMAP folder to watch, INBOX by default.
+	Folder string
+	// From is the sender address of replies, Username by default.
+	From string
+	// Forward, if set, receives the captions instead of the sender.
+	Forward string
+
+	// Captioner captions the attachments of each message in turn.
+	Captioner captionbot.Captioner
+	// Interval is how often the folder is checked.
+	Interval time.Duration
+	Logger   *log.Logger
+}
+
+func (mailbox *Mailbox) logf(format string, args ...interface{}) {
+	if mailbox.Logger != nil {
+		mailbox.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Run checks the folder every Interval until a check fails.
+func (mailbox *Mailbox) Run() error {
+	interval := mailbox.Interval
+	if interval == 0 {
+		interval = time.Minute
+	}
+	for {
+		if err := mailbox.Check(); err != nil {
+			return err
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Check answers every unread message in the folder once.
+func (mailbox *Mailbox) Check() error {
+	c, err := client.DialTLS(mailbox.IMAPAddr, nil)
+	if err != nil {
+		return err
+	}
+	defer c.Logout()
+	if err := c.Login(mailbox.Username, mailbox.Password); err != nil {
+		return err
+	}
+	folder := mailbox.Folder
+	if folder == "" {
+		folder = "INBOX"
+	}
+	if _, err := c.Select(folder, false); err != nil {
+		return err
+	}
+
+	criteria := imap.NewSearchCriteria()
+	criteria.WithoutFlags = []string{imap.SeenFlag}
+	uids, err := c.UidSearch(criteria)
+	if err != nil || len(uids) == 0 {
+		return err
+	}
+
+	for _, uid := range uids {
+		raw, err := fetch(c, uid)
+		if err != nil {
+			return err
+		}
+		if err := mailbox.answer(raw); err != nil {
+			mailbox.logf("mailbox: message %d: %s", uid, err)
+			continue
+		}
+
+		seqset := new(imap.SeqSet)
+		seqset.AddNum(uid)
+		if err := c.UidStore(seqset, imap.FormatFlagsOp(imap.AddFlags, true), []interface{}{imap.SeenFlag}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch reads a whole message without marking it read.
+func fetch(c *client.Client, uid uint32) ([]byte, error) {
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uid)
+	section := &imap.BodySectionName{Peek: true}
+
+	messages := make(chan *imap.Message, 1)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, messages)
+	}()
+
+	var raw []byte
+	for msg := range messages {
+		if body := msg.GetBody(section); body != nil {
+			var err error
+			if raw, err = io.ReadAll(io.LimitReader(body, maxMessageSize)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := <-done; err != nil {
+		return nil, err
+	}
+	if raw == nil {
+		return nil, fmt.Errorf("message %d has no body", uid)
+	}
+	return raw, nil
+}
+
+type image struct {
+	name string
+	data []byte
+}
+
+// answer captions the images in a raw message and sends the reply.
+func (mailbox *Mailbox) answer(raw []byte) error {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	// Don't answer bounces and autoresponders, to avoid mail loops.
+	if auto := msg.Header.Get("Auto-Submitted"); auto != "" && auto != "no" {
+		return nil
+	}
+
+	images, err := findImages(msg.Header, msg.Body)
+	if err != nil || len(images) == 0 {
+		return err
+	}
+
+	var body strings.Builder
+	body.WriteString("Image descriptions:\r\n\r\n")
+	for _, img := range images {
+		caption, err := mailbox.Captioner.CaptionReader(bytes.NewReader(img.data), img.name)
+		if err != nil {
+			caption = "(couldn't describe this image: " + err.Error() + ")"
+		}
+		fmt.Fprintf(&body, "%s: %s\r\n", img.name, caption)
+	}
+
+	return mailbox.send(msg.Header, body.String())
+}
+
+// header is a mail.Header or a MIME part's textproto.MIMEHeader.
+type header interface {
+	Get(key string) string
+}
+
+// findImages walks a MIME body and returns its image parts.
+func findImages(h header, body io.Reader) ([]image, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		var images []image
+		reader := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				return images, nil
+			}
+			if err != nil {
+				return images, err
+			}
+			found, err := findImages(part.Header, part)
+			if err != nil {
+				return images, err
+			}
+			for i := range found {
+				if found[i].name == "" {
+					found[i].name = part.FileName()
+				}
+			}
+			images = append(images, found...)
+		}
+	}
+
+	if !strings.HasPrefix(mediaType, "image/") {
+		return nil, nil
+	}
+	if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	name := params["name"]
+	if name == "" {
+		name = "image"
+		if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return []image{{name: name, data: data}}, nil
+}
+
+// send replies to original, or forwards the captions if Forward is set.
+func (mailbox *Mailbox) send(original mail.Header, body string) error {
+	from := mailbox.From
+	if from == "" {
+		from = mailbox.Username
+	}
+
+	to := mailbox.Forward
+	if to == "" {
+		replyTo := original.Get("Reply-To")
+		if replyTo == "" {
+			replyTo = original.Get("From")
+		}
+		addr, err := mail.ParseAddress(replyTo)
+		if err != nil {
+			return err
+		}
+		to = addr.Address
+	}
+
+	subject := original.Get("Subject")
+	if dec, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = dec
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-replied\r\n")
+	if id := original.Get("Message-Id"); id != "" {
+		fmt.Fprintf(&msg, "In-Reply-To: %s\r\n", id)
+		fmt.Fprintf(&msg, "References: %s\r\n", strings.TrimSpace(original.Get("References")+" "+id))
+	}
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+
+	host, _, err := net.SplitHostPort(mailbox.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	auth := smtp.PlainAuth("", mailbox.Username, mailbox.Password, host)
+	return sendMail(mailbox.SMTPAddr, host, auth, from, to, msg.Bytes())
+}
+
+// sendMail is smtp.SendMail with STARTTLS required rather than optional.
+func sendMail(addr, host string, auth smtp.Auth, from, to string, msg []byte) error {
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+		return err
+	}
+	if err := c.Auth(auth); err != nil {
+		return err
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,291 @@
+// Package mastodon implements a Mastodon bot that suggests alt text. It
+// replies to mentions with a caption for each image in the mentioning
+// post, or in the post it replies to. It can also watch the account's own
+// posts and send a direct message when an image is posted without a
+// description.
+package mastodon
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// maxStatusLength is the default Mastodon post length limit.
+const maxStatusLength = 500
+
+// Bot is a Mastodon account that captions images for the people who
+// mention it.
+type Bot struct {
+	Server string
+	Token  string
+	// Captioner captions attachments by URL. Run polls and answers on
+	// one goroutine, so it needn't be safe for concurrent use.
+	Captioner captionbot.Captioner
+
+	// Interval is how often notifications are polled.
+	Interval time.Duration
+	// WatchOwnPosts enables direct messages about the account's own
+	// posts with undescribed images.
+	WatchOwnPosts bool
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	account      account
+	mentionsFrom string
+	postsFrom    string
+}
+
+// NewBot creates a Bot for the account the access token belongs to.
+func NewBot(server, token string, bot *captionbot.CaptionBot) *Bot {
+	return &Bot{
+		Server:    strings.TrimRight(server, "/"),
+		Token:     token,
+		Captioner: bot,
+		Interval:  time.Minute,
+	}
+}
+
+func (mastodon *Bot) httpClient() *http.Client {
+	if mastodon.HTTPClient != nil {
+		return mastodon.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (mastodon *Bot) logf(format string, args ...interface{}) {
+	if mastodon.Logger != nil {
+		mastodon.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type account struct {
+	ID   string `json:"id"`
+	Acct string `json:"acct"`
+}
+
+type attachment struct {
+	Type        string `json:"type"`
+	URL         string `json:"url"`
+	Description string `json:"description"`
+}
+
+type status struct {
+	ID               string       `json:"id"`
+	InReplyToID      string       `json:"in_reply_to_id"`
+	Visibility       string       `json:"visibility"`
+	Account          account      `json:"account"`
+	MediaAttachments []attachment `json:"media_attachments"`
+	Reblog           *status      `json:"reblog"`
+}
+
+type notification struct {
+	ID     string  `json:"id"`
+	Type   string  `json:"type"`
+	Status *status `json:"status"`
+}
+
+// do sends an API request with form parameters and decodes the response
+// into v.
+func (mastodon *Bot) do(method, path string, params url.Values, v interface{}) error {
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		req, err = http.NewRequest(method, mastodon.Server+path+"?"+params.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, mastodon.Server+path, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+mastodon.Token)
+
+	resp, err := mastodon.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s: status %d: %s", method, path, resp.StatusCode, apiErr.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Run polls for mentions (and own posts) every Interval until an API
+// call fails. Mentions and posts from before Run was called are ignored.
+func (mastodon *Bot) Run() error {
+	if err := mastodon.do("GET", "/api/v1/accounts/verify_credentials", nil, &mastodon.account); err != nil {
+		return err
+	}
+	if err := mastodon.checkMentions(false); err != nil {
+		return err
+	}
+	if mastodon.WatchOwnPosts {
+		if err := mastodon.checkOwnPosts(false); err != nil {
+			return err
+		}
+	}
+
+	for {
+		time.Sleep(mastodon.Interval)
+		if err := mastodon.checkMentions(true); err != nil {
+			return err
+		}
+		if mastodon.WatchOwnPosts {
+			if err := mastodon.checkOwnPosts(true); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// checkMentions answers new mentions, oldest first. With handle false it
+// only records where the next poll starts.
+func (mastodon *Bot) checkMentions(handle bool) error {
+	params := url.Values{"types[]": {"mention"}, "limit": {"40"}}
+	if mastodon.mentionsFrom != "" {
+		params.Set("since_id", mastodon.mentionsFrom)
+	}
+	var notifications []notification
+	if err := mastodon.do("GET", "/api/v1/notifications", params, &notifications); err != nil {
+		return err
+	}
+	if len(notifications) > 0 {
+		mastodon.mentionsFrom = notifications[0].ID
+	}
+	if !handle {
+		return nil
+	}
+
+	for i := len(notifications) - 1; i >= 0; i-- {
+		if n := notifications[i]; n.Type == "mention" && n.Status != nil {
+			mastodon.answerMention(n.Status)
+		}
+	}
+	return nil
+}
+
+func (mastodon *Bot) answerMention(mention *status) {
+	target := mention
+	if len(images(target)) == 0 && target.InReplyToID != "" {
+		var parent status
+		if err := mastodon.do("GET", "/api/v1/statuses/"+target.InReplyToID, nil, &parent); err != nil {
+			mastodon.logf("mastodon: fetching %s: %s", target.InReplyToID, err)
+			return
+		}
+		target = &parent
+	}
+
+	media := images(target)
+	if len(media) == 0 {
+		return
+	}
+	lines := []string{"@" + mention.Account.Acct + " Suggested alt text:"}
+	lines = append(lines, mastodon.captions(media)...)
+	mastodon.post(strings.Join(lines, "\n"), mention.ID, replyVisibility(mention.Visibility))
+}
+
+// checkOwnPosts messages the account about new posts with images that
+// have no description.
+func (mastodon *Bot) checkOwnPosts(handle bool) error {
+	params := url.Values{"limit": {"40"}, "exclude_reblogs": {"true"}}
+	if mastodon.postsFrom != "" {
+		params.Set("since_id", mastodon.postsFrom)
+	}
+	var statuses []status
+	if err := mastodon.do("GET", "/api/v1/accounts/"+mastodon.account.ID+"/statuses", params, &statuses); err != nil {
+		return err
+	}
+	if len(statuses) > 0 {
+		mastodon.postsFrom = statuses[0].ID
+	}
+	if !handle {
+		return nil
+	}
+
+	for i := len(statuses) - 1; i >= 0; i-- {
+		var missing []attachment
+		for _, a := range images(&statuses[i]) {
+			if strings.TrimSpace(a.Description) == "" {
+				missing = append(missing, a)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		lines := []string{"@" + mastodon.account.Acct + " Your post " + statuses[i].ID + " has images without alt text. Suggestions:"}
+		lines = append(lines, mastodon.captions(missing)...)
+		mastodon.post(strings.Join(lines, "\n"), "", "direct")
+	}
+	return nil
+}
+
+func images(s *status) []attachment {
+	if s.Reblog != nil {
+		s = s.Reblog
+	}
+	var media []attachment
+	for _, a := range s.MediaAttachments {
+		if a.Type == "image" {
+			media = append(media, a)
+		}
+	}
+	return media
+}
+
+// captions returns one line per image.
+func (mastodon *Bot) captions(media []attachment) []string {
+	var lines []string
+	for i, a := range media {
+		caption, err := mastodon.Captioner.CaptionURL(a.URL)
+		if err != nil {
+			mastodon.logf("mastodon: captioning %s: %s", a.URL, err)
+			caption = "(couldn't describe this one)"
+		}
+		if len(media) > 1 {
+			caption = fmt.Sprintf("%d. %s", i+1, caption)
+		}
+		lines = append(lines, caption)
+	}
+	return lines
+}
+
+// replyVisibility keeps replies to private mentions private.
+func replyVisibility(visibility string) string {
+	if visibility == "public" {
+		return "unlisted"
+	}
+	return visibility
+}
+
+func (mastodon *Bot) post(text, inReplyTo, visibility string) {
+	if runes := []rune(text); len(runes) > maxStatusLength {
+		text = string(runes[:maxStatusLength-1]) + "…"
+	}
+	params := url.Values{"status": {text}, "visibility": {visibility}}
+	if inReplyTo != "" {
+		params.Set("in_reply_to_id", inReplyTo)
+	}
+	if err := mastodon.do("POST", "/api/v1/statuses", params, nil); err != nil {
+		mastodon.logf("mastodon: posting reply: %s", err)
+	}
+}
@@ -0,0 +1,366 @@
+// Package matrix implements a Matrix bot that captions images. It accepts
+// room invites, and replies to each m.image event in its rooms with a
+// description of the image.
+//
+// Encrypted rooms need a Crypto helper, which holds the bot's device keys
+// and Olm/Megolm sessions. Without one the bot ignores encrypted rooms.
+// Encrypted attachments are decrypted by the bot itself.
+package matrix
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// Crypto is an end-to-end encryption helper, such as one built on
+// libolm or vodozemac.
+type Crypto interface {
+	// ProcessSync is given each raw /sync response before the bot
+	// handles it, to consume to-device messages, one-time key counts
+	// and device list changes.
+	ProcessSync(response json.RawMessage) error
+	// Decrypt decrypts an m.room.encrypted event into a plain event.
+	Decrypt(roomID string, event json.RawMessage) (json.RawMessage, error)
+	// Encrypt encrypts event content for a room, returning the content
+	// of an m.room.encrypted event.
+	Encrypt(roomID, eventType string, content interface{}) (json.RawMessage, error)
+}
+
+// Bot is a Matrix account that captions images posted in its rooms.
+type Bot struct {
+	Homeserver  string
+	AccessToken string
+	// Captioner captions the images, uploaded after they are downloaded
+	// and decrypted. Events are handled in turn, so any Captioner will
+	// do.
+	Captioner captionbot.Captioner
+
+	// Crypto, if set, lets the bot take part in encrypted rooms.
+	Crypto Crypto
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	userID    string
+	encrypted map[string]bool
+	txnID     int64
+}
+
+// NewBot creates a Bot for the account the access token belongs to.
+func NewBot(homeserver, accessToken string, bot *captionbot.CaptionBot) *Bot {
+	return &Bot{
+		Homeserver:  strings.TrimRight(homeserver, "/"),
+		AccessToken: accessToken,
+		Captioner:   bot,
+		encrypted:   map[string]bool{},
+	}
+}
+
+func (matrix *Bot) httpClient() *http.Client {
+	if matrix.HTTPClient != nil {
+		return matrix.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (matrix *Bot) logf(format string, args ...interface{}) {
+	if matrix.Logger != nil {
+		matrix.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// request sends an authenticated request and returns the response if its
+// status is 200.
+func (matrix *Bot) request(method, path string, body interface{}) (*http.Response, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, matrix.Homeserver+path, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+matrix.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := matrix.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr struct {
+			ErrCode string `json:"errcode"`
+			Error   string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("%s %s: %s: %s", method, strings.SplitN(path, "?", 2)[0], apiErr.ErrCode, apiErr.Error)
+	}
+	return resp, nil
+}
+
+func (matrix *Bot) do(method, path string, body, v interface{}) error {
+	resp, err := matrix.request(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type event struct {
+	Type    string          `json:"type"`
+	Sender  string          `json:"sender"`
+	EventID string          `json:"event_id"`
+	Content json.RawMessage `json:"content"`
+}
+
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			State    struct{ Events []event }           `json:"state"`
+			Timeline struct{ Events []json.RawMessage } `json:"timeline"`
+		} `json:"join"`
+		Invite map[string]json.RawMessage `json:"invite"`
+	} `json:"rooms"`
+}
+
+// syncFilter limits /sync to what the bot needs.
+const syncFilter = `{"presence":{"types":[]},"account_data":{"types":[]},` +
+	`"room":{"ephemeral":{"types":[]},"account_data":{"types":[]},` +
+	`"state":{"types":["m.room.encryption"]},` +
+	`"timeline":{"types":["m.room.message","m.room.encrypted","m.room.encryption"]}}}`
+
+// Run syncs with the homeserver until a request fails. Events from
+// before Run was called are not answered.
+func (matrix *Bot) Run() error {
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := matrix.do("GET", "/_matrix/client/v3/account/whoami", nil, &whoami); err != nil {
+		return err
+	}
+	matrix.userID = whoami.UserID
+
+	since := ""
+	for {
+		params := url.Values{"filter": {syncFilter}, "timeout": {"30000"}}
+		if since != "" {
+			params.Set("since", since)
+		}
+		resp, err := matrix.request("GET", "/_matrix/client/v3/sync?"+params.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		raw, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if matrix.Crypto != nil {
+			if err := matrix.Crypto.ProcessSync(raw); err != nil {
+				return err
+			}
+		}
+		var response syncResponse
+		if err := json.Unmarshal(raw, &response); err != nil {
+			return err
+		}
+		matrix.handleSync(&response, since != "")
+		since = response.NextBatch
+	}
+}
+
+func (matrix *Bot) handleSync(response *syncResponse, answer bool) {
+	for roomID := range response.Rooms.Invite {
+		if err := matrix.do("POST", "/_matrix/client/v3/join/"+url.PathEscape(roomID), struct{}{}, nil); err != nil {
+			matrix.logf("matrix: joining %s: %s", roomID, err)
+		}
+	}
+
+	for roomID, room := range response.Rooms.Join {
+		for _, e := range room.State.Events {
+			if e.Type == "m.room.encryption" {
+				matrix.encrypted[roomID] = true
+			}
+		}
+		for _, raw := range room.Timeline.Events {
+			var e event
+			if err := json.Unmarshal(raw, &e); err != nil {
+				continue
+			}
+			if e.Type == "m.room.encryption" {
+				matrix.encrypted[roomID] = true
+				continue
+			}
+			if !answer || e.Sender == matrix.userID {
+				continue
+			}
+			if e.Type == "m.room.encrypted" {
+				if matrix.Crypto == nil {
+					continue
+				}
+				plain, err := matrix.Crypto.Decrypt(roomID, raw)
+				if err != nil {
+					matrix.logf("matrix: decrypting %s: %s", e.EventID, err)
+					continue
+				}
+				var decrypted event
+				if err := json.Unmarshal(plain, &decrypted); err != nil {
+					continue
+				}
+				e.Type, e.Content = decrypted.Type, decrypted.Content
+			}
+			if e.Type == "m.room.message" {
+				matrix.handleMessage(roomID, e)
+			}
+		}
+	}
+}
+
+// encryptedFile is the EncryptedFile object of an encrypted attachment.
+type encryptedFile struct {
+	URL string `json:"url"`
+	Key struct {
+		K string `json:"k"`
+	} `json:"key"`
+	IV     string            `json:"iv"`
+	Hashes map[string]string `json:"hashes"`
+}
+
+type imageContent struct {
+	MsgType string         `json:"msgtype"`
+	Body    string         `json:"body"`
+	URL     string         `json:"url"`
+	File    *encryptedFile `json:"file"`
+}
+
+func (matrix *Bot) handleMessage(roomID string, e event) {
+	var content imageContent
+	if err := json.Unmarshal(e.Content, &content); err != nil || content.MsgType != "m.image" {
+		return
+	}
+
+	caption, err := matrix.caption(content)
+	if err != nil {
+		matrix.logf("matrix: captioning %s: %s", e.EventID, err)
+		return
+	}
+
+	reply := map[string]interface{}{
+		"msgtype": "m.notice",
+		"body":    caption,
+		"m.relates_to": map[string]interface{}{
+			"m.in_reply_to": map[string]string{"event_id": e.EventID},
+		},
+	}
+	if err := matrix.send(roomID, "m.room.message", reply); err != nil {
+		matrix.logf("matrix: replying to %s: %s", e.EventID, err)
+	}
+}
+
+// send sends an event to a room, encrypting it if the room is encrypted.
+func (matrix *Bot) send(roomID, eventType string, content interface{}) error {
+	if matrix.encrypted[roomID] {
+		if matrix.Crypto == nil {
+			return fmt.Errorf("room is encrypted and no crypto helper is configured")
+		}
+		encrypted, err := matrix.Crypto.Encrypt(roomID, eventType, content)
+		if err != nil {
+			return err
+		}
+		eventType, content = "m.room.encrypted", encrypted
+	}
+
+	txnID := strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.FormatInt(atomic.AddInt64(&matrix.txnID, 1), 10)
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/" + eventType + "/" + txnID
+	return matrix.do("PUT", path, content, nil)
+}
+
+// caption downloads an image, decrypting it if needed, and captions its
+// content.
+func (matrix *Bot) caption(content imageContent) (string, error) {
+	mxc := content.URL
+	if content.File != nil {
+		mxc = content.File.URL
+	}
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return "", fmt.Errorf("unsupported media URL %q", mxc)
+	}
+
+	resp, err := matrix.request("GET", "/_matrix/client/v1/media/download/"+strings.TrimPrefix(mxc, "mxc://"), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var r io.Reader = resp.Body
+	if content.File != nil {
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return "", err
+		}
+		if data, err = decryptAttachment(content.File, data); err != nil {
+			return "", err
+		}
+		r = bytes.NewReader(data)
+	}
+	return matrix.Captioner.CaptionReader(r, content.Body)
+}
+
+// decryptAttachment decrypts an attachment with AES-256-CTR after
+// checking its SHA-256 hash, as the client-server spec describes.
+func decryptAttachment(file *encryptedFile, data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	want, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(file.Hashes["sha256"], "="))
+	if err != nil || !bytes.Equal(sum[:], want) {
+		return nil, fmt.Errorf("attachment hash mismatch")
+	}
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(file.Key.K, "="))
+	if err != nil {
+		return nil, err
+	}
+	iv, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(file.IV, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("invalid attachment IV")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCTR(block, iv).XORKeyStream(plain, data)
+	return plain, nil
+}
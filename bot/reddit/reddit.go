@@ -0,0 +1,375 @@
+// Package reddit implements a Reddit bot that describes images. It
+// replies to new image posts in configured subreddits and to username
+// mentions in comments on image posts. Users can opt out by sending the
+// bot a private message containing "!optout".
+//
+// The bot authenticates as a "script" app with the account's password
+// and paces its requests by the rate limit headers Reddit returns.
+package reddit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// Endpoints of the Reddit API.
+var (
+	TokenURL = "https://www.reddit.com/api/v1/access_token"
+	APIURL   = "https://oauth.reddit.com"
+)
+
+// Bot is a Reddit account that describes images.
+type Bot struct {
+	ClientID     string
+	ClientSecret string
+	Username     string
+	Password     string
+
+	// Captioner captions the images of new posts and of summoning
+	// comments. Run polls on one goroutine, so it is called in turn.
+	Captioner captionbot.Captioner
+
+	// Subreddits are watched for new image posts.
+	Subreddits []string
+	// OptOutFile, if set, holds one opted-out username per line. It is
+	// read by Run and appended to when a user opts out.
+	OptOutFile string
+	// Interval is how often subreddits and the inbox are polled.
+	Interval time.Duration
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	token     string
+	expires   time.Time
+	remaining float64
+	reset     time.Time
+	optOut    map[string]bool
+	seen      map[string]bool
+}
+
+// NewBot creates a Bot.
+func NewBot(clientID, clientSecret, username, password string, captioner captionbot.Captioner) *Bot {
+	return &Bot{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Username:     username,
+		Password:     password,
+		Captioner:    captioner,
+		Interval:     time.Minute,
+	}
+}
+
+func (reddit *Bot) httpClient() *http.Client {
+	if reddit.HTTPClient != nil {
+		return reddit.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (reddit *Bot) logf(format string, args ...interface{}) {
+	if reddit.Logger != nil {
+		reddit.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// userAgent follows Reddit's required format.
+func (reddit *Bot) userAgent() string {
+	return "go:github.com/nhatbui/captionbot:v1 (by /u/" + reddit.Username + ")"
+}
+
+func (reddit *Bot) authorize() error {
+	if reddit.token != "" && time.Now().Before(reddit.expires) {
+		return nil
+	}
+	form := url.Values{
+		"grant_type": {"password"},
+		"username":   {reddit.Username},
+		"password":   {reddit.Password},
+	}
+	req, err := http.NewRequest("POST", TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(reddit.ClientID, reddit.ClientSecret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("User-Agent", reddit.userAgent())
+
+	resp, err := reddit.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	if token.AccessToken == "" {
+		return fmt.Errorf("reddit: authorizing: %s", token.Error)
+	}
+	reddit.token = token.AccessToken
+	reddit.expires = time.Now().Add(time.Duration(token.ExpiresIn)*time.Second - time.Minute)
+	return nil
+}
+
+// do sends an API request, waiting first if the rate limit is used up.
+// Form values are sent as the body of POST requests and the query of GETs.
+func (reddit *Bot) do(method, path string, params url.Values, v interface{}) error {
+	if err := reddit.authorize(); err != nil {
+		return err
+	}
+	if reddit.remaining < 1 && time.Now().Before(reddit.reset) {
+		time.Sleep(time.Until(reddit.reset))
+	}
+
+	var req *http.Request
+	var err error
+	if method == "GET" {
+		req, err = http.NewRequest(method, APIURL+path+"?"+params.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, APIURL+path, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+reddit.token)
+	req.Header.Set("User-Agent", reddit.userAgent())
+
+	resp, err := reddit.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if remaining, err := strconv.ParseFloat(resp.Header.Get("X-Ratelimit-Remaining"), 64); err == nil {
+		reddit.remaining = remaining
+		reset, _ := strconv.Atoi(resp.Header.Get("X-Ratelimit-Reset"))
+		reddit.reset = time.Now().Add(time.Duration(reset) * time.Second)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("reddit: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type thing struct {
+	Kind string `json:"kind"`
+	Data struct {
+		Name          string `json:"name"`
+		Author        string `json:"author"`
+		Subject       string `json:"subject"`
+		Body          string `json:"body"`
+		LinkID        string `json:"link_id"`
+		URL           string `json:"url"`
+		IsGallery     bool   `json:"is_gallery"`
+		MediaMetadata map[string]struct {
+			Status string `json:"status"`
+			E      string `json:"e"`
+			M      string `json:"m"`
+		} `json:"media_metadata"`
+		GalleryData struct {
+			Items []struct {
+				MediaID string `json:"media_id"`
+			} `json:"items"`
+		} `json:"gallery_data"`
+	} `json:"data"`
+}
+
+type listing struct {
+	Data struct {
+		Children []thing `json:"children"`
+	} `json:"data"`
+}
+
+// Run polls until an API call fails. Subreddit posts from before Run was
+// called are not answered; unread mentions are.
+func (reddit *Bot) Run() error {
+	if err := reddit.loadOptOut(); err != nil {
+		return err
+	}
+	reddit.seen = map[string]bool{}
+
+	answer := false
+	for {
+		if len(reddit.Subreddits) > 0 {
+			if err := reddit.checkSubreddits(answer); err != nil {
+				return err
+			}
+		}
+		if err := reddit.checkInbox(); err != nil {
+			return err
+		}
+		answer = true
+		time.Sleep(reddit.Interval)
+	}
+}
+
+func (reddit *Bot) checkSubreddits(answer bool) error {
+	var posts listing
+	path := "/r/" + strings.Join(reddit.Subreddits, "+") + "/new"
+	if err := reddit.do("GET", path, url.Values{"limit": {"100"}, "raw_json": {"1"}}, &posts); err != nil {
+		return err
+	}
+
+	current := map[string]bool{}
+	children := posts.Data.Children
+	for i := len(children) - 1; i >= 0; i-- {
+		post := children[i]
+		current[post.Data.Name] = true
+		if !answer || reddit.seen[post.Data.Name] || reddit.optOut[strings.ToLower(post.Data.Author)] {
+			continue
+		}
+		if urls := images(post); len(urls) > 0 {
+			reddit.reply(post.Data.Name, urls)
+		}
+	}
+	// Keep only posts still in the listing, so seen doesn't grow forever.
+	reddit.seen = current
+	return nil
+}
+
+// checkInbox answers unread mentions and opt-out requests, then marks
+// them read.
+func (reddit *Bot) checkInbox() error {
+	var inbox listing
+	if err := reddit.do("GET", "/message/unread", url.Values{"limit": {"100"}, "raw_json": {"1"}}, &inbox); err != nil {
+		return err
+	}
+
+	var read []string
+	for _, msg := range inbox.Data.Children {
+		read = append(read, msg.Data.Name)
+		author := strings.ToLower(msg.Data.Author)
+
+		switch {
+		case msg.Kind == "t4" && strings.Contains(strings.ToLower(msg.Data.Body), "!optout"):
+			if err := reddit.addOptOut(author); err != nil {
+				return err
+			}
+		case msg.Kind == "t1" && msg.Data.Subject == "username mention" && !reddit.optOut[author]:
+			var posts listing
+			if err := reddit.do("GET", "/api/info", url.Values{"id": {msg.Data.LinkID}, "raw_json": {"1"}}, &posts); err != nil {
+				return err
+			}
+			if len(posts.Data.Children) == 1 {
+				if urls := images(posts.Data.Children[0]); len(urls) > 0 {
+					reddit.reply(msg.Data.Name, urls)
+				}
+			}
+		}
+	}
+
+	if len(read) == 0 {
+		return nil
+	}
+	return reddit.do("POST", "/api/read_message", url.Values{"id": {strings.Join(read, ",")}}, nil)
+}
+
+// images returns the image URLs of a link post or gallery.
+func images(post thing) []string {
+	var urls []string
+	if post.Data.IsGallery {
+		for _, item := range post.Data.GalleryData.Items {
+			media, ok := post.Data.MediaMetadata[item.MediaID]
+			if ok && media.Status == "valid" && media.E == "Image" {
+				urls = append(urls, "https://i.redd.it/"+item.MediaID+"."+strings.TrimPrefix(media.M, "image/"))
+			}
+		}
+		return urls
+	}
+	u, err := url.Parse(post.Data.URL)
+	if err == nil && (u.Host == "i.redd.it" || u.Host == "i.imgur.com") && source.IsImage(path.Base(u.Path)) {
+		urls = append(urls, post.Data.URL)
+	}
+	return urls
+}
+
+func (reddit *Bot) reply(parent string, urls []string) {
+	var lines []string
+	for i, u := range urls {
+		caption, err := reddit.Captioner.CaptionURL(u)
+		if err != nil {
+			reddit.logf("reddit: captioning %s: %s", u, err)
+			continue
+		}
+		if len(urls) > 1 {
+			caption = fmt.Sprintf("Image %d: %s", i+1, caption)
+		}
+		lines = append(lines, caption)
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	text := "**Image description:** " + strings.Join(lines, "\n\n") +
+		"\n\n^(I'm a bot. Message me \"!optout\" and I won't reply to your posts.)"
+	params := url.Values{"thing_id": {parent}, "text": {text}, "api_type": {"json"}}
+	if err := reddit.do("POST", "/api/comment", params, nil); err != nil {
+		reddit.logf("reddit: replying to %s: %s", parent, err)
+	}
+}
+
+func (reddit *Bot) loadOptOut() error {
+	reddit.optOut = map[string]bool{}
+	if reddit.OptOutFile == "" {
+		return nil
+	}
+	f, err := os.Open(reddit.OptOutFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if name := strings.TrimSpace(scanner.Text()); name != "" {
+			reddit.optOut[strings.ToLower(name)] = true
+		}
+	}
+	return scanner.Err()
+}
+
+func (reddit *Bot) addOptOut(username string) error {
+	if reddit.optOut[username] {
+		return nil
+	}
+	reddit.optOut[username] = true
+	if reddit.OptOutFile == "" {
+		return nil
+	}
+	f, err := os.OpenFile(reddit.OptOutFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, username)
+	return err
+}
@@ -0,0 +1,305 @@
+// Package slack implements a Slack app that captions images: it answers
+// Events API callbacks for files shared in channels the app is in, and the
+// /caption slash command for image URLs. Captions are posted in the thread
+// of the message that shared the image.
+//
+// The app needs the files:read and chat:write bot scopes, a subscription
+// to the message.channels (and message.groups, message.im) events, and a
+// /caption slash command, all pointed at the Handler's URL.
+package slack
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// APIURL is the root of the Slack Web API.
+var APIURL = "https://slack.com/api/"
+
+// maxClockSkew is how old a request timestamp may be before the request is
+// rejected as a possible replay.
+const maxClockSkew = 5 * time.Minute
+
+// Handler is an http.Handler for Slack event and slash command requests.
+type Handler struct {
+	SigningSecret string
+	BotToken      string
+	// Captioner captions shared files and /caption URLs. Slack's
+	// callbacks are served concurrently, so it must be safe for
+	// concurrent use; NewHandler wraps its bot in a captionbot.Serial.
+	Captioner  captionbot.Captioner
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	seenMu sync.Mutex
+	// seen maps recently handled event IDs to when they arrived, so
+	// Slack's retries of slow deliveries aren't captioned twice.
+	seen map[string]time.Time
+}
+
+// NewHandler creates a Handler.
+func NewHandler(signingSecret, botToken string, bot *captionbot.CaptionBot) *Handler {
+	return &Handler{
+		SigningSecret: signingSecret,
+		BotToken:      botToken,
+		Captioner:     captionbot.NewSerial(bot),
+	}
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// verify checks the request signature Slack computes with the app's
+// signing secret.
+func (handler *Handler) verify(header http.Header, body []byte) bool {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > maxClockSkew || age < -maxClockSkew {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(handler.SigningSecret))
+	fmt.Fprintf(mac, "v0:%s:%s", timestamp, body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+// ServeHTTP verifies the request and dispatches it. Work that may take
+// longer than Slack's three second deadline is done after responding.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !handler.verify(r.Header, body) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		handler.serveCommand(w, r, body)
+		return
+	}
+	handler.serveEvent(w, body)
+}
+
+type file struct {
+	Name               string `json:"name"`
+	Mimetype           string `json:"mimetype"`
+	URLPrivateDownload string `json:"url_private_download"`
+}
+
+type event struct {
+	Type     string `json:"type"`
+	Subtype  string `json:"subtype"`
+	BotID    string `json:"bot_id"`
+	Channel  string `json:"channel"`
+	TS       string `json:"ts"`
+	ThreadTS string `json:"thread_ts"`
+	Files    []file `json:"files"`
+}
+
+func (handler *Handler) serveEvent(w http.ResponseWriter, body []byte) {
+	var envelope struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		EventID   string `json:"event_id"`
+		Event     event  `json:"event"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch envelope.Type {
+	case "url_verification":
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, envelope.Challenge)
+	case "event_callback":
+		w.WriteHeader(http.StatusOK)
+		if handler.firstDelivery(envelope.EventID) {
+			go handler.handleEvent(envelope.Event)
+		}
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// firstDelivery records eventID and reports whether it is new.
+func (handler *Handler) firstDelivery(eventID string) bool {
+	handler.seenMu.Lock()
+	defer handler.seenMu.Unlock()
+
+	if handler.seen == nil {
+		handler.seen = map[string]time.Time{}
+	}
+	now := time.Now()
+	for id, at := range handler.seen {
+		if now.Sub(at) > time.Hour {
+			delete(handler.seen, id)
+		}
+	}
+	if _, ok := handler.seen[eventID]; ok {
+		return false
+	}
+	handler.seen[eventID] = now
+	return true
+}
+
+func (handler *Handler) handleEvent(e event) {
+	if e.Type != "message" || e.BotID != "" || len(e.Files) == 0 {
+		return
+	}
+	thread := e.ThreadTS
+	if thread == "" {
+		thread = e.TS
+	}
+
+	for _, f := range e.Files {
+		if !strings.HasPrefix(f.Mimetype, "image/") {
+			continue
+		}
+		caption, err := handler.captionFile(f)
+		if err != nil {
+			handler.logf("slack: captioning %s: %s", f.Name, err)
+			continue
+		}
+		if err := handler.postMessage(e.Channel, thread, caption); err != nil {
+			handler.logf("slack: posting caption: %s", err)
+		}
+	}
+}
+
+// captionFile downloads a private file with the bot token and uploads it
+// to captionbot.ai.
+func (handler *Handler) captionFile(f file) (string, error) {
+	req, err := http.NewRequest("GET", f.URLPrivateDownload, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+handler.BotToken)
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading file: status %d", resp.StatusCode)
+	}
+
+	return handler.Captioner.CaptionReader(resp.Body, f.Name)
+}
+
+// postMessage posts text as a reply in thread.
+func (handler *Handler) postMessage(channel, thread, text string) error {
+	body, err := json.Marshal(map[string]string{
+		"channel":   channel,
+		"thread_ts": thread,
+		"text":      text,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", APIURL+"chat.postMessage", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+handler.BotToken)
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("chat.postMessage: %s", result.Error)
+	}
+	return nil
+}
+
+// serveCommand handles "/caption URL". The caption is sent to the
+// command's response_url once it is ready.
+func (handler *Handler) serveCommand(w http.ResponseWriter, r *http.Request, body []byte) {
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	imageURL := strings.Trim(strings.TrimSpace(r.PostForm.Get("text")), "<>")
+	if !strings.HasPrefix(imageURL, "http://") && !strings.HasPrefix(imageURL, "https://") {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"response_type": "ephemeral",
+			"text":          "Usage: " + r.PostForm.Get("command") + " IMAGE_URL",
+		})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	responseURL := r.PostForm.Get("response_url")
+	go func() {
+		text, err := handler.Captioner.CaptionURL(imageURL)
+		if err != nil {
+			text = "Sorry, I couldn't caption that image: " + err.Error()
+		}
+		if err := handler.respond(responseURL, text); err != nil {
+			handler.logf("slack: responding to command: %s", err)
+		}
+	}()
+}
+
+func (handler *Handler) respond(responseURL, text string) error {
+	body, err := json.Marshal(map[string]string{"response_type": "in_channel", "text": text})
+	if err != nil {
+		return err
+	}
+	resp, err := handler.httpClient().Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response_url returned status %d", resp.StatusCode)
+	}
+	return nil
+}
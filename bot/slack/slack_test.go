@@ -0,0 +1,67 @@
+package slack
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign returns the X-Slack-Signature of body sent at timestamp.
+func sign(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerify(t *testing.T) {
+	const body = `{"type":"url_verification","challenge":"abc"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		status    int
+	}{
+		{"valid", now, sign("secret", now, body), http.StatusOK},
+		{"bad signature", now, sign("other", now, body), http.StatusUnauthorized},
+		{"signature of another time", now, sign("secret", old, body), http.StatusUnauthorized},
+		{"expired", old, sign("secret", old, body), http.StatusUnauthorized},
+		{"no timestamp", "", sign("secret", "", body), http.StatusUnauthorized},
+		{"no signature", now, "", http.StatusUnauthorized},
+	}
+	handler := &Handler{SigningSecret: "secret"}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/slack", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Slack-Request-Timestamp", test.timestamp)
+		req.Header.Set("X-Slack-Signature", test.signature)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+		if test.status == http.StatusOK && rec.Body.String() != "abc" {
+			t.Errorf("%s: body = %q, want the challenge", test.name, rec.Body)
+		}
+	}
+}
+
+func TestFirstDeliveryZeroHandler(t *testing.T) {
+	var handler Handler
+	if !handler.firstDelivery("Ev1") {
+		t.Error("first delivery of Ev1 was taken as a retry")
+	}
+	if handler.firstDelivery("Ev1") {
+		t.Error("second delivery of Ev1 was taken as new")
+	}
+	if !handler.firstDelivery("Ev2") {
+		t.Error("first delivery of Ev2 was taken as a retry")
+	}
+}
@@ -0,0 +1,213 @@
+package teams
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Endpoints used to authenticate with the Bot Framework.
+var (
+	OpenIDConfigURL = "https://login.botframework.com/v1/.well-known/openidconfiguration"
+	TokenURL        = "https://login.microsoftonline.com/%s/oauth2/v2.0/token"
+)
+
+// issuer is the issuer of tokens the Bot Framework connector sends.
+const issuer = "https://api.botframework.com"
+
+// keySet caches the connector's signing keys, refreshing them daily as
+// the Bot Framework documentation recommends.
+type keySet struct {
+	mu      sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	fetched time.Time
+}
+
+func (set *keySet) key(client *http.Client, kid string) (*rsa.PublicKey, error) {
+	set.mu.Lock()
+	defer set.mu.Unlock()
+
+	if key, ok := set.keys[kid]; ok && time.Since(set.fetched) < 24*time.Hour {
+		return key, nil
+	}
+	// Refresh at most every five minutes for unknown key IDs.
+	if time.Since(set.fetched) > 5*time.Minute {
+		if err := set.refresh(client); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := set.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (set *keySet) refresh(client *http.Client) error {
+	var config struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(client, OpenIDConfigURL, &config); err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := getJSON(client, config.JWKSURI, &jwks); err != nil {
+		return err
+	}
+
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	set.keys = keys
+	set.fetched = time.Now()
+	return nil
+}
+
+func getJSON(client *http.Client, rawurl string, v interface{}) error {
+	resp, err := client.Get(rawurl)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: status %d", rawurl, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// verify checks a connector token's RS256 signature, issuer, audience,
+// lifetime, and that it was issued for serviceURL.
+func (set *keySet) verify(client *http.Client, token, appID, serviceURL string) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return err
+	}
+	if header.Alg != "RS256" {
+		return fmt.Errorf("unexpected algorithm %q", header.Alg)
+	}
+	key, err := set.key(client, header.Kid)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return fmt.Errorf("invalid signature")
+	}
+
+	var claims struct {
+		Iss        string `json:"iss"`
+		Aud        string `json:"aud"`
+		Exp        int64  `json:"exp"`
+		Nbf        int64  `json:"nbf"`
+		ServiceURL string `json:"serviceurl"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return err
+	}
+	// Allow five minutes of clock skew.
+	now := time.Now().Unix()
+	switch {
+	case claims.Iss != issuer:
+		return fmt.Errorf("unexpected issuer %q", claims.Iss)
+	case appID == "" || claims.Aud != appID:
+		return fmt.Errorf("token is for another application")
+	case now > claims.Exp+300 || now < claims.Nbf-300:
+		return fmt.Errorf("token expired or not yet valid")
+	case claims.ServiceURL != "" && claims.ServiceURL != serviceURL:
+		return fmt.Errorf("token was issued for another service URL")
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// botToken is the bot's own access token for calling the connector.
+type botToken struct {
+	appID    string
+	password string
+	tenant   string
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+func (botToken *botToken) get(client *http.Client) (string, error) {
+	botToken.mu.Lock()
+	defer botToken.mu.Unlock()
+	if botToken.token != "" && time.Now().Before(botToken.expires) {
+		return botToken.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {botToken.appID},
+		"client_secret": {botToken.password},
+		"scope":         {"https://api.botframework.com/.default"},
+	}
+	resp, err := client.PostForm(fmt.Sprintf(TokenURL, botToken.tenant), form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", fmt.Errorf("getting bot token: %s", result.ErrorDescription)
+	}
+	botToken.token = result.AccessToken
+	botToken.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return botToken.token, nil
+}
@@ -0,0 +1,122 @@
+package teams
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// signToken returns a connector token with header and claims, signed
+// with key.
+func signToken(t *testing.T, key *rsa.PrivateKey, header, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	unsigned := encode(header) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// serveKeys serves an OpenID configuration whose key set holds key as
+// kid, and points OpenIDConfigURL at it until the test ends.
+func serveKeys(t *testing.T, kid string, key *rsa.PublicKey) {
+	t.Helper()
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	mux.HandleFunc("/openid", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": server.URL + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": kid,
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	previous := OpenIDConfigURL
+	OpenIDConfigURL = server.URL + "/openid"
+	t.Cleanup(func() { OpenIDConfigURL = previous })
+}
+
+func TestVerify(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveKeys(t, "key1", &key.PublicKey)
+
+	const serviceURL = "https://smba.trafficmanager.net/teams/"
+	now := time.Now()
+	header := map[string]interface{}{"alg": "RS256", "kid": "key1"}
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":        issuer,
+			"aud":        "app-id",
+			"nbf":        now.Add(-time.Minute).Unix(),
+			"exp":        now.Add(time.Hour).Unix(),
+			"serviceurl": serviceURL,
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", signToken(t, key, header, claims(nil)), true},
+		{"valid within clock skew", signToken(t, key, header, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-time.Minute).Unix()
+		})), true},
+		{"bad signature", signToken(t, other, header, claims(nil)), false},
+		{"expired", signToken(t, key, header, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-10 * time.Minute).Unix()
+		})), false},
+		{"not yet valid", signToken(t, key, header, claims(func(c map[string]interface{}) {
+			c["nbf"] = now.Add(10 * time.Minute).Unix()
+		})), false},
+		{"no expiry", signToken(t, key, header, claims(func(c map[string]interface{}) { delete(c, "exp") })), false},
+		{"wrong issuer", signToken(t, key, header, claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" })), false},
+		{"wrong audience", signToken(t, key, header, claims(func(c map[string]interface{}) { c["aud"] = "other-app" })), false},
+		{"other service URL", signToken(t, key, header, claims(func(c map[string]interface{}) { c["serviceurl"] = "https://evil.example.com/" })), false},
+		{"unknown key", signToken(t, key, map[string]interface{}{"alg": "RS256", "kid": "key2"}, claims(nil)), false},
+		{"other algorithm", signToken(t, key, map[string]interface{}{"alg": "none", "kid": "key1"}, claims(nil)), false},
+		{"malformed", "not-a-token", false},
+	}
+	var set keySet
+	for _, test := range tests {
+		err := set.verify(http.DefaultClient, test.token, "app-id", serviceURL)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: verify = %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+
+	if err := set.verify(http.DefaultClient, tests[0].token, "", serviceURL); err == nil {
+		t.Error("token verified for an empty app ID")
+	}
+}
@@ -0,0 +1,252 @@
+// Package teams implements a Bot Framework messaging endpoint for
+// Microsoft Teams. Users drop an image into a chat with the bot, or
+// mention it on a message with an image, and get a caption back.
+//
+// Requests are authenticated with the Bot Framework's signed tokens, and
+// only tenants in the allow list are served. Attachments are downloaded
+// through the connector with the bot's own token.
+package teams
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// fileDownloadInfo is the content type of files shared in Teams chats.
+const fileDownloadInfo = "application/vnd.microsoft.teams.file.download.info"
+
+// Handler is an http.Handler for Bot Framework activities.
+type Handler struct {
+	AppID       string
+	AppPassword string
+	// Captioner captions image attachments. The Bot Framework sends
+	// activities concurrently, so it must be safe for concurrent use, as
+	// the captionbot.Serial NewHandler makes is.
+	Captioner captionbot.Captioner
+
+	// Tenants lists the Microsoft Entra tenant IDs allowed to use the
+	// bot. If empty, every tenant is.
+	Tenants []string
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	keys  *keySet
+	token *botToken
+}
+
+// NewHandler creates a Handler for a bot registration. tenant is the
+// registration's tenant ID for single-tenant bots, or "" for multi-tenant
+// ones.
+func NewHandler(appID, appPassword, tenant string, bot *captionbot.CaptionBot) *Handler {
+	if tenant == "" {
+		tenant = "botframework.com"
+	}
+	return &Handler{
+		AppID:       appID,
+		AppPassword: appPassword,
+		Captioner:   captionbot.NewSerial(bot),
+		keys:        &keySet{},
+		token:       &botToken{appID: appID, password: appPassword, tenant: tenant},
+	}
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type attachment struct {
+	ContentType string `json:"contentType"`
+	ContentURL  string `json:"contentUrl"`
+	Name        string `json:"name"`
+	Content     struct {
+		DownloadURL string `json:"downloadUrl"`
+		FileType    string `json:"fileType"`
+	} `json:"content"`
+}
+
+type activity struct {
+	Type         string `json:"type"`
+	ID           string `json:"id"`
+	ServiceURL   string `json:"serviceUrl"`
+	Conversation struct {
+		ID       string `json:"id"`
+		TenantID string `json:"tenantId"`
+	} `json:"conversation"`
+	ChannelData struct {
+		Tenant struct {
+			ID string `json:"id"`
+		} `json:"tenant"`
+	} `json:"channelData"`
+	Attachments []attachment `json:"attachments"`
+}
+
+func (a *activity) tenant() string {
+	if a.ChannelData.Tenant.ID != "" {
+		return a.ChannelData.Tenant.ID
+	}
+	return a.Conversation.TenantID
+}
+
+func (handler *Handler) allowed(tenant string) bool {
+	if len(handler.Tenants) == 0 {
+		return true
+	}
+	for _, t := range handler.Tenants {
+		if strings.EqualFold(t, tenant) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP authenticates an activity and acknowledges it. Messages with
+// images are captioned in the background.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var a activity
+	if err := json.Unmarshal(body, &a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if err := handler.keys.verify(handler.httpClient(), token, handler.AppID, a.ServiceURL); err != nil {
+		handler.logf("teams: rejected request: %s", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !handler.allowed(a.tenant()) {
+		http.Error(w, "tenant not allowed", http.StatusForbidden)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	if a.Type == "message" {
+		go handler.handleMessage(a)
+	}
+}
+
+func (handler *Handler) handleMessage(a activity) {
+	var captions []string
+	for _, att := range a.Attachments {
+		var downloadURL string
+		var authenticated bool
+		switch {
+		case strings.HasPrefix(att.ContentType, "image/"):
+			downloadURL, authenticated = att.ContentURL, true
+		case att.ContentType == fileDownloadInfo && isImageType(att.Content.FileType):
+			// Download URLs of shared files are pre-authenticated.
+			downloadURL = att.Content.DownloadURL
+		default:
+			continue
+		}
+
+		caption, err := handler.caption(downloadURL, authenticated, att.Name)
+		if err != nil {
+			handler.logf("teams: captioning attachment of %s: %s", a.ID, err)
+			caption = "Sorry, I couldn't describe that image."
+		}
+		captions = append(captions, caption)
+	}
+	if len(captions) == 0 {
+		captions = []string{"Send me an image and I'll describe it."}
+	}
+
+	if err := handler.reply(a, strings.Join(captions, "\n\n")); err != nil {
+		handler.logf("teams: replying to %s: %s", a.ID, err)
+	}
+}
+
+func isImageType(fileType string) bool {
+	switch strings.ToLower(fileType) {
+	case "jpg", "jpeg", "png", "gif", "bmp":
+		return true
+	}
+	return false
+}
+
+func (handler *Handler) caption(downloadURL string, authenticated bool, name string) (string, error) {
+	req, err := http.NewRequest("GET", downloadURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if authenticated {
+		token, err := handler.token.get(handler.httpClient())
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading attachment: status %d", resp.StatusCode)
+	}
+
+	if name == "" {
+		name = "image"
+	}
+	return handler.Captioner.CaptionReader(resp.Body, name)
+}
+
+// reply posts text as a reply to an activity through the connector.
+func (handler *Handler) reply(a activity, text string) error {
+	token, err := handler.token.get(handler.httpClient())
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"type":       "message",
+		"text":       text,
+		"replyToId":  a.ID,
+		"textFormat": "plain",
+	})
+	if err != nil {
+		return err
+	}
+
+	rawurl := strings.TrimRight(a.ServiceURL, "/") + "/v3/conversations/" + a.Conversation.ID + "/activities/" + a.ID
+	req, err := http.NewRequest("POST", rawurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+// Package telegram implements a Telegram bot that captions photos. In
+// private chats every photo and image URL is captioned; in groups the bot
+// answers /caption sent with a photo, as a reply to a photo, or followed by
+// an image URL. Updates arrive either by long polling (Poll) or through a
+// webhook (the Bot is an http.Handler).
+package telegram
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// APIURL is the root of the Telegram Bot API.
+var APIURL = "https://api.telegram.org/"
+
+// pollTimeout is the long polling timeout in seconds.
+const pollTimeout = 50
+
+// Bot is a Telegram bot backed by a captionbot.ai session.
+type Bot struct {
+	Token string
+	// Captioner captions the photos and image URLs the bot is sent. It
+	// must be safe for concurrent use when updates come by webhook, as
+	// a captionbot.Serial is; NewBot makes one.
+	Captioner captionbot.Captioner
+
+	// SecretToken must match the X-Telegram-Bot-Api-Secret-Token header
+	// of webhook requests; ServeHTTP refuses every update without one.
+	// Pass it to setWebhook as secret_token. Polling doesn't use it.
+	SecretToken string
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+}
+
+// NewBot creates a Bot.
+func NewBot(token string, bot *captionbot.CaptionBot) *Bot {
+	return &Bot{Token: token, Captioner: captionbot.NewSerial(bot)}
+}
+
+func (telegram *Bot) httpClient() *http.Client {
+	if telegram.HTTPClient != nil {
+		return telegram.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (telegram *Bot) logf(format string, args ...interface{}) {
+	if telegram.Logger != nil {
+		telegram.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type photoSize struct {
+	FileID   string `json:"file_id"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	FileSize int    `json:"file_size"`
+}
+
+type document struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	MimeType string `json:"mime_type"`
+}
+
+type message struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
+		ID   int64  `json:"id"`
+		Type string `json:"type"`
+	} `json:"chat"`
+	Text           string      `json:"text"`
+	Caption        string      `json:"caption"`
+	Photo          []photoSize `json:"photo"`
+	Document       *document   `json:"document"`
+	ReplyToMessage *message    `json:"reply_to_message"`
+}
+
+type update struct {
+	UpdateID int      `json:"update_id"`
+	Message  *message `json:"message"`
+}
+
+// call invokes a Bot API method and decodes its result into v.
+func (telegram *Bot) call(method string, params interface{}, v interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	resp, err := telegram.httpClient().Post(APIURL+"bot"+telegram.Token+"/"+method, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// The request URL contains the token; don't let it reach logs.
+		return fmt.Errorf("%s: request failed", method)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.OK {
+		return fmt.Errorf("%s: %s", method, result.Description)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(result.Result, v)
+}
+
+// Poll receives updates with getUpdates until an API call fails.
+func (telegram *Bot) Poll() error {
+	offset := 0
+	for {
+		var updates []update
+		params := map[string]interface{}{
+			"offset":          offset,
+			"timeout":         pollTimeout,
+			"allowed_updates": []string{"message"},
+		}
+		if err := telegram.call("getUpdates", params, &updates); err != nil {
+			return err
+		}
+		for _, u := range updates {
+			offset = u.UpdateID + 1
+			telegram.handleUpdate(u)
+		}
+	}
+}
+
+// ServeHTTP handles a webhook update. The update is processed before
+// responding so Telegram redelivers it if captioning crashes the process.
+func (telegram *Bot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+	if telegram.SecretToken == "" || subtle.ConstantTimeCompare([]byte(got), []byte(telegram.SecretToken)) != 1 {
+		http.Error(w, "invalid secret token", http.StatusUnauthorized)
+		return
+	}
+
+	var u update
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	telegram.handleUpdate(u)
+	w.WriteHeader(http.StatusOK)
+}
+
+// command returns the arguments of a /caption command in text, and
+// whether text is one. Commands may be addressed as /caption@BotName.
+func command(text string) (string, bool) {
+	fields := strings.SplitN(strings.TrimSpace(text), " ", 2)
+	name := strings.SplitN(fields[0], "@", 2)[0]
+	if name != "/caption" {
+		return "", false
+	}
+	if len(fields) == 1 {
+		return "", true
+	}
+	return strings.TrimSpace(fields[1]), true
+}
+
+func (telegram *Bot) handleUpdate(u update) {
+	msg := u.Message
+	if msg == nil {
+		return
+	}
+
+	args, isCommand := command(msg.Text + msg.Caption)
+	if !isCommand {
+		if msg.Chat.Type != "private" {
+			return
+		}
+		args = strings.TrimSpace(msg.Text)
+	}
+
+	target := msg
+	if !hasImage(msg) && msg.ReplyToMessage != nil && hasImage(msg.ReplyToMessage) {
+		target = msg.ReplyToMessage
+	}
+
+	var caption string
+	var err error
+	switch {
+	case hasImage(target):
+		caption, err = telegram.captionMessage(target)
+	case strings.HasPrefix(args, "http://") || strings.HasPrefix(args, "https://"):
+		caption, err = telegram.Captioner.CaptionURL(args)
+	case isCommand || msg.Chat.Type == "private":
+		caption = "Send me a photo, or reply to one with /caption."
+	default:
+		return
+	}
+	if err != nil {
+		telegram.logf("telegram: captioning message %d: %s", target.MessageID, err)
+		caption = "Sorry, I couldn't describe that image."
+	}
+
+	params := map[string]interface{}{
+		"chat_id":             msg.Chat.ID,
+		"text":                caption,
+		"reply_to_message_id": target.MessageID,
+	}
+	if err := telegram.call("sendMessage", params, nil); err != nil {
+		telegram.logf("telegram: sending caption: %s", err)
+	}
+}
+
+func hasImage(msg *message) bool {
+	return len(msg.Photo) > 0 || msg.Document != nil && strings.HasPrefix(msg.Document.MimeType, "image/")
+}
+
+// largest returns the file ID of the largest size of a photo.
+func largest(sizes []photoSize) string {
+	best := sizes[0]
+	for _, size := range sizes[1:] {
+		if size.Width*size.Height > best.Width*best.Height {
+			best = size
+		}
+	}
+	return best.FileID
+}
+
+// captionMessage downloads the image in msg and uploads it to captionbot.ai.
+func (telegram *Bot) captionMessage(msg *message) (string, error) {
+	fileID := ""
+	if len(msg.Photo) > 0 {
+		fileID = largest(msg.Photo)
+	} else {
+		fileID = msg.Document.FileID
+	}
+
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := telegram.call("getFile", map[string]string{"file_id": fileID}, &file); err != nil {
+		return "", err
+	}
+
+	resp, err := telegram.httpClient().Get(APIURL + "file/bot" + telegram.Token + "/" + file.FilePath)
+	if err != nil {
+		return "", fmt.Errorf("downloading file: request failed")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading file: status %d", resp.StatusCode)
+	}
+
+	return telegram.Captioner.CaptionReader(resp.Body, path.Base(file.FilePath))
+}
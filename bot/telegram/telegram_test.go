@@ -0,0 +1,36 @@
+package telegram
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecretToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		header string
+		status int
+	}{
+		{"valid", "s3cret", "s3cret", http.StatusOK},
+		{"wrong", "s3cret", "guess", http.StatusUnauthorized},
+		{"prefix", "s3cret", "s3cre", http.StatusUnauthorized},
+		{"missing", "s3cret", "", http.StatusUnauthorized},
+		{"no secret set", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		telegram := &Bot{SecretToken: test.secret}
+		// An update without a message, which is ignored once accepted.
+		req := httptest.NewRequest("POST", "/telegram", strings.NewReader(`{"update_id":1}`))
+		if test.header != "" {
+			req.Header.Set("X-Telegram-Bot-Api-Secret-Token", test.header)
+		}
+		w := httptest.NewRecorder()
+		telegram.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Package twilio implements a Twilio Messaging webhook that captions
+// photos sent by MMS. The caption is returned as a TwiML reply, so a user
+// can text a photo to the number and get its description back.
+package twilio
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// maxMedia is the number of attachments Twilio delivers per message.
+const maxMedia = 10
+
+// Handler is an http.Handler for Twilio incoming message webhooks.
+type Handler struct {
+	AccountSID string
+	AuthToken  string
+	// Captioner captions the photos of incoming MMS. Twilio may deliver
+	// several messages at once, so it must be safe for concurrent use,
+	// as the captionbot.Serial NewHandler makes is.
+	Captioner captionbot.Captioner
+
+	// PublicURL is the webhook URL configured in Twilio, which request
+	// signatures are computed over. If empty it is reconstructed from
+	// the request, honoring X-Forwarded-Proto.
+	PublicURL string
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+}
+
+// NewHandler creates a Handler.
+func NewHandler(accountSID, authToken string, bot *captionbot.CaptionBot) *Handler {
+	return &Handler{AccountSID: accountSID, AuthToken: authToken, Captioner: captionbot.NewSerial(bot)}
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func (handler *Handler) requestURL(r *http.Request) string {
+	if handler.PublicURL != "" {
+		return handler.PublicURL
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
+
+// validSignature checks X-Twilio-Signature: the HMAC-SHA1 of the URL
+// followed by each POST parameter name and value, sorted by name.
+func (handler *Handler) validSignature(r *http.Request) bool {
+	var b strings.Builder
+	b.WriteString(handler.requestURL(r))
+	keys := make([]string, 0, len(r.PostForm))
+	for key := range r.PostForm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range r.PostForm[key] {
+			b.WriteString(key + value)
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(handler.AuthToken))
+	mac.Write([]byte(b.String()))
+	expected := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Twilio-Signature")))
+}
+
+type twiml struct {
+	XMLName  xml.Name `xml:"Response"`
+	Messages []string `xml:"Message"`
+}
+
+// ServeHTTP captions the message's images and replies with TwiML.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !handler.validSignature(r) {
+		http.Error(w, "invalid signature", http.StatusForbidden)
+		return
+	}
+
+	count, _ := strconv.Atoi(r.PostForm.Get("NumMedia"))
+	if count > maxMedia {
+		count = maxMedia
+	}
+	var captions []string
+	for i := 0; i < count; i++ {
+		contentType := r.PostForm.Get(fmt.Sprintf("MediaContentType%d", i))
+		if !strings.HasPrefix(contentType, "image/") {
+			continue
+		}
+		caption, err := handler.caption(r.PostForm.Get(fmt.Sprintf("MediaUrl%d", i)), contentType)
+		if err != nil {
+			handler.logf("twilio: captioning %s: %s", r.PostForm.Get("MessageSid"), err)
+			caption = "Sorry, I couldn't describe that image."
+		}
+		captions = append(captions, caption)
+	}
+	if len(captions) == 0 {
+		captions = []string{"Send me a photo and I'll describe it."}
+	} else if len(captions) > 1 {
+		for i := range captions {
+			captions[i] = fmt.Sprintf("%d. %s", i+1, captions[i])
+		}
+		captions = []string{strings.Join(captions, "\n")}
+	}
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(twiml{Messages: captions})
+}
+
+// caption downloads a media URL with the account's credentials, which
+// Twilio requires when HTTP basic auth is enabled for media.
+func (handler *Handler) caption(mediaURL, contentType string) (string, error) {
+	req, err := http.NewRequest("GET", mediaURL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(handler.AccountSID, handler.AuthToken)
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("downloading media: status %d", resp.StatusCode)
+	}
+
+	name := "image"
+	if exts, _ := mime.ExtensionsByType(contentType); len(exts) > 0 {
+		name += exts[0]
+	}
+	return handler.Captioner.CaptionReader(resp.Body, name)
+}
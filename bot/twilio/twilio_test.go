@@ -0,0 +1,83 @@
+package twilio
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// sign returns the X-Twilio-Signature of a POST of form to rawurl.
+func sign(authToken, rawurl string, form url.Values) string {
+	data := rawurl
+	keys := make([]string, 0, len(form))
+	for key := range form {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range form[key] {
+			data += key + value
+		}
+	}
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestValidSignature(t *testing.T) {
+	const hook = "https://example.com/twilio?key=1"
+	form := url.Values{"From": {"+15551234567"}, "Body": {"hi"}, "NumMedia": {"0"}}
+	tampered := url.Values{"From": {"+15557654321"}, "Body": {"hi"}, "NumMedia": {"0"}}
+	tests := []struct {
+		name      string
+		form      url.Values
+		proto     string
+		signature string
+		status    int
+	}{
+		{"valid", form, "https", sign("token", hook, form), http.StatusOK},
+		{"bad signature", form, "https", sign("other", hook, form), http.StatusForbidden},
+		{"tampered parameters", tampered, "https", sign("token", hook, form), http.StatusForbidden},
+		{"signed for another URL", form, "https", sign("token", "https://example.com/other", form), http.StatusForbidden},
+		{"signed over https, forwarded over http", form, "http", sign("token", hook, form), http.StatusForbidden},
+		{"no signature", form, "https", "", http.StatusForbidden},
+	}
+	handler := &Handler{AuthToken: "token"}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", hook, strings.NewReader(test.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Twilio-Signature", test.signature)
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+		if test.status == http.StatusOK && !strings.Contains(rec.Body.String(), "<Message>") {
+			t.Errorf("%s: body = %q, want a TwiML reply", test.name, rec.Body)
+		}
+	}
+}
+
+func TestValidSignaturePublicURL(t *testing.T) {
+	const public = "https://hooks.example.com/twilio"
+	form := url.Values{"Body": {"hi"}}
+	handler := &Handler{AuthToken: "token", PublicURL: public}
+	// Received behind a proxy, at an address other than the one Twilio
+	// signed.
+	req := httptest.NewRequest("POST", "http://10.0.0.2:8080/twilio", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Twilio-Signature", sign("token", public, form))
+	req.ParseForm()
+	if !handler.validSignature(req) {
+		t.Error("signature over PublicURL was refused")
+	}
+}
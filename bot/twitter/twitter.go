@@ -0,0 +1,281 @@
+// Package twitter implements an alt-text bot for X (formerly Twitter).
+// When the account is mentioned in a post with images, or in a reply to
+// or quote of one, it replies with a description of each image.
+//
+// Replies are posted in user context, so the bot needs OAuth 1.0a
+// consumer keys and an access token with read and write permission.
+package twitter
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/internal/oauth1"
+)
+
+// APIURL is the root of the X API v2.
+var APIURL = "https://api.twitter.com/2/"
+
+// maxPostLength is the length limit of a post for non-subscribers.
+const maxPostLength = 280
+
+// Bot is an X account that describes images for the people who mention it.
+type Bot struct {
+	Credentials oauth1.Credentials
+	// Captioner describes the images of the posts the account is
+	// mentioned under, one mention at a time.
+	Captioner captionbot.Captioner
+
+	// Interval is how often mentions are polled. The default suits the
+	// Basic tier's mention timeline limit.
+	Interval time.Duration
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	userID  string
+	sinceID string
+}
+
+// NewBot creates a Bot for the account the access token belongs to.
+func NewBot(credentials oauth1.Credentials, captioner captionbot.Captioner) *Bot {
+	return &Bot{Credentials: credentials, Captioner: captioner, Interval: 90 * time.Second}
+}
+
+func (twitter *Bot) httpClient() *http.Client {
+	if twitter.HTTPClient != nil {
+		return twitter.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (twitter *Bot) logf(format string, args ...interface{}) {
+	if twitter.Logger != nil {
+		twitter.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// rateLimitError is returned when the API answers 429 Too Many Requests.
+type rateLimitError struct {
+	reset time.Time
+}
+
+func (err rateLimitError) Error() string {
+	return "rate limited until " + err.reset.Format(time.RFC3339)
+}
+
+// do sends a signed API request with an optional JSON body and decodes
+// the response into v.
+func (twitter *Bot) do(method, path string, params url.Values, body, v interface{}) error {
+	rawurl := APIURL + path
+	if len(params) > 0 {
+		rawurl += "?" + params.Encode()
+	}
+
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	auth, err := twitter.Credentials.Header(method, rawurl, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := twitter.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-Rate-Limit-Reset"), 10, 64)
+		return rateLimitError{reset: time.Unix(reset, 0)}
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Title  string `json:"title"`
+			Detail string `json:"detail"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s: status %d: %s %s", method, path, resp.StatusCode, apiErr.Title, apiErr.Detail)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+type post struct {
+	ID               string `json:"id"`
+	ReferencedTweets []struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	} `json:"referenced_tweets"`
+	Attachments struct {
+		MediaKeys []string `json:"media_keys"`
+	} `json:"attachments"`
+}
+
+type media struct {
+	MediaKey string `json:"media_key"`
+	Type     string `json:"type"`
+	URL      string `json:"url"`
+}
+
+type timeline struct {
+	Data     []post `json:"data"`
+	Includes struct {
+		Tweets []post  `json:"tweets"`
+		Media  []media `json:"media"`
+	} `json:"includes"`
+	Meta struct {
+		NewestID string `json:"newest_id"`
+	} `json:"meta"`
+}
+
+// Run polls for mentions every Interval, waiting out rate limits, until
+// an API call fails. Mentions from before Run was called are ignored.
+func (twitter *Bot) Run() error {
+	var me struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := twitter.do("GET", "users/me", nil, nil, &me); err != nil {
+		return err
+	}
+	twitter.userID = me.Data.ID
+
+	handle := false
+	for {
+		err := twitter.checkMentions(handle)
+		if limit, ok := err.(rateLimitError); ok {
+			twitter.logf("twitter: %s", limit)
+			time.Sleep(time.Until(limit.reset))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		handle = true
+		time.Sleep(twitter.Interval)
+	}
+}
+
+// checkMentions answers new mentions, oldest first. With handle false it
+// only records where the next poll starts.
+func (twitter *Bot) checkMentions(handle bool) error {
+	params := url.Values{
+		"max_results":  {"100"},
+		"tweet.fields": {"attachments,referenced_tweets"},
+		"expansions":   {"attachments.media_keys,referenced_tweets.id,referenced_tweets.id.attachments.media_keys"},
+		"media.fields": {"type,url"},
+	}
+	if twitter.sinceID != "" {
+		params.Set("since_id", twitter.sinceID)
+	} else if !handle {
+		params.Set("max_results", "5")
+	}
+
+	var mentions timeline
+	if err := twitter.do("GET", "users/"+twitter.userID+"/mentions", params, nil, &mentions); err != nil {
+		return err
+	}
+	if mentions.Meta.NewestID != "" {
+		twitter.sinceID = mentions.Meta.NewestID
+	}
+	if !handle {
+		return nil
+	}
+
+	for i := len(mentions.Data) - 1; i >= 0; i-- {
+		mention := mentions.Data[i]
+		urls := mentions.images(mention)
+		if len(urls) == 0 {
+			continue
+		}
+		if err := twitter.reply(mention.ID, twitter.describe(urls)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// images returns the photo URLs of p, or of the post it replies to or
+// quotes when p has none.
+func (mentions *timeline) images(p post) []string {
+	urls := mentions.photos(p)
+	for _, ref := range p.ReferencedTweets {
+		if len(urls) > 0 {
+			break
+		}
+		for _, included := range mentions.Includes.Tweets {
+			if included.ID == ref.ID {
+				urls = mentions.photos(included)
+			}
+		}
+	}
+	return urls
+}
+
+func (mentions *timeline) photos(p post) []string {
+	var urls []string
+	for _, key := range p.Attachments.MediaKeys {
+		for _, m := range mentions.Includes.Media {
+			if m.MediaKey == key && m.Type == "photo" {
+				urls = append(urls, m.URL)
+			}
+		}
+	}
+	return urls
+}
+
+func (twitter *Bot) describe(urls []string) string {
+	var lines []string
+	for i, u := range urls {
+		caption, err := twitter.Captioner.CaptionURL(u)
+		if err != nil {
+			twitter.logf("twitter: captioning %s: %s", u, err)
+			caption = "(couldn't describe this one)"
+		}
+		if len(urls) > 1 {
+			caption = fmt.Sprintf("Image %d: %s", i+1, caption)
+		}
+		lines = append(lines, caption)
+	}
+
+	text := strings.Join(lines, "\n")
+	if runes := []rune(text); len(runes) > maxPostLength {
+		text = string(runes[:maxPostLength-1]) + "…"
+	}
+	return text
+}
+
+func (twitter *Bot) reply(id, text string) error {
+	body := map[string]interface{}{
+		"text":  text,
+		"reply": map[string]string{"in_reply_to_tweet_id": id},
+	}
+	return twitter.do("POST", "tweets", nil, body, nil)
+}
@@ -0,0 +1,299 @@
+// Package whatsapp implements a WhatsApp Cloud API webhook that captions
+// images sent to a business number and replies with the description.
+//
+// Free-form replies are only allowed within 24 hours of the user's last
+// message. When a reply is rejected for being outside that window and a
+// message template is configured, the caption is sent as the template's
+// single body parameter instead.
+package whatsapp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// GraphURL is the root of the Graph API, including its version.
+var GraphURL = "https://graph.facebook.com/v20.0/"
+
+// errReengagement is the error code for a free-form message sent outside
+// the customer service window.
+const errReengagement = 131047
+
+// Handler is an http.Handler for WhatsApp Cloud API webhooks.
+type Handler struct {
+	// AccessToken is a system user token with whatsapp_business_messaging.
+	AccessToken string
+	// AppSecret verifies X-Hub-Signature-256 on notifications.
+	AppSecret string
+	// VerifyToken is the token entered when subscribing the webhook.
+	VerifyToken string
+	// Captioner captions the images of incoming messages. Deliveries can
+	// overlap, so it must be safe for concurrent use; NewHandler wraps
+	// its bot in a captionbot.Serial.
+	Captioner captionbot.Captioner
+
+	// TemplateName and TemplateLanguage name an approved template with
+	// one body parameter, used outside the 24 hour window.
+	TemplateName     string
+	TemplateLanguage string
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	seenMu sync.Mutex
+	// seen holds recently handled message IDs, since notifications are
+	// redelivered when they aren't acknowledged in time.
+	seen map[string]time.Time
+}
+
+// NewHandler creates a Handler.
+func NewHandler(accessToken, appSecret, verifyToken string, bot *captionbot.CaptionBot) *Handler {
+	return &Handler{
+		AccessToken:      accessToken,
+		AppSecret:        appSecret,
+		VerifyToken:      verifyToken,
+		Captioner:        captionbot.NewSerial(bot),
+		TemplateLanguage: "en_US",
+		seen:             map[string]time.Time{},
+	}
+}
+
+func (handler *Handler) httpClient() *http.Client {
+	if handler.HTTPClient != nil {
+		return handler.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type message struct {
+	ID    string `json:"id"`
+	From  string `json:"from"`
+	Type  string `json:"type"`
+	Image struct {
+		ID       string `json:"id"`
+		MimeType string `json:"mime_type"`
+	} `json:"image"`
+}
+
+type notification struct {
+	Entry []struct {
+		Changes []struct {
+			Value struct {
+				Metadata struct {
+					PhoneNumberID string `json:"phone_number_id"`
+				} `json:"metadata"`
+				Messages []message `json:"messages"`
+			} `json:"value"`
+		} `json:"changes"`
+	} `json:"entry"`
+}
+
+// ServeHTTP answers webhook verification and acknowledges notifications,
+// handling their messages in the background.
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		query := r.URL.Query()
+		token := query.Get("hub.verify_token")
+		if query.Get("hub.mode") != "subscribe" || handler.VerifyToken == "" || !hmac.Equal([]byte(token), []byte(handler.VerifyToken)) {
+			http.Error(w, "verification failed", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, query.Get("hub.challenge"))
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Without a secret, anyone could compute the signature.
+	mac := hmac.New(sha256.New, []byte(handler.AppSecret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if handler.AppSecret == "" || !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Hub-Signature-256"))) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var n notification
+	if err := json.Unmarshal(body, &n); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+
+	for _, entry := range n.Entry {
+		for _, change := range entry.Changes {
+			for _, msg := range change.Value.Messages {
+				if msg.Type == "image" && handler.firstDelivery(msg.ID) {
+					go handler.handleMessage(change.Value.Metadata.PhoneNumberID, msg)
+				}
+			}
+		}
+	}
+}
+
+// firstDelivery records a message ID and reports whether it is new.
+func (handler *Handler) firstDelivery(id string) bool {
+	handler.seenMu.Lock()
+	defer handler.seenMu.Unlock()
+
+	now := time.Now()
+	for seen, at := range handler.seen {
+		if now.Sub(at) > 24*time.Hour {
+			delete(handler.seen, seen)
+		}
+	}
+	if _, ok := handler.seen[id]; ok {
+		return false
+	}
+	if handler.seen == nil {
+		handler.seen = map[string]time.Time{}
+	}
+	handler.seen[id] = now
+	return true
+}
+
+func (handler *Handler) handleMessage(phoneNumberID string, msg message) {
+	caption, err := handler.caption(msg.Image.ID, msg.Image.MimeType)
+	if err != nil {
+		handler.logf("whatsapp: captioning %s: %s", msg.ID, err)
+		caption = "Sorry, I couldn't describe that image."
+	}
+
+	reply := map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                msg.From,
+		"context":           map[string]string{"message_id": msg.ID},
+		"type":              "text",
+		"text":              map[string]string{"body": caption},
+	}
+	err = handler.send(phoneNumberID, reply)
+	if apiErr, ok := err.(*apiError); ok && apiErr.Code == errReengagement && handler.TemplateName != "" {
+		err = handler.send(phoneNumberID, handler.template(msg.From, caption))
+	}
+	if err != nil {
+		handler.logf("whatsapp: replying to %s: %s", msg.ID, err)
+	}
+}
+
+func (handler *Handler) template(to, caption string) map[string]interface{} {
+	return map[string]interface{}{
+		"messaging_product": "whatsapp",
+		"to":                to,
+		"type":              "template",
+		"template": map[string]interface{}{
+			"name":     handler.TemplateName,
+			"language": map[string]string{"code": handler.TemplateLanguage},
+			"components": []interface{}{map[string]interface{}{
+				"type":       "body",
+				"parameters": []interface{}{map[string]string{"type": "text", "text": caption}},
+			}},
+		},
+	}
+}
+
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (err *apiError) Error() string {
+	return fmt.Sprintf("%s (code %d)", err.Message, err.Code)
+}
+
+// do sends a request with the access token, which both the Graph API and
+// media download URLs require, and returns the response if it is a 200.
+func (handler *Handler) do(method, rawurl string, body interface{}) (*http.Response, error) {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		payload = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, rawurl, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+handler.AccessToken)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := handler.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var result struct {
+			Error *apiError `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Error != nil {
+			return nil, result.Error
+		}
+		return nil, fmt.Errorf("%s: status %d", method, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (handler *Handler) send(phoneNumberID string, message interface{}) error {
+	resp, err := handler.do("POST", GraphURL+phoneNumberID+"/messages", message)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// caption looks up a media ID's short-lived download URL, downloads the
+// image with the access token and uploads it to captionbot.ai.
+func (handler *Handler) caption(mediaID, mimeType string) (string, error) {
+	resp, err := handler.do("GET", GraphURL+mediaID, nil)
+	if err != nil {
+		return "", err
+	}
+	var media struct {
+		URL string `json:"url"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&media)
+	resp.Body.Close()
+	if err != nil {
+		return "", err
+	}
+
+	resp, err = handler.do("GET", media.URL, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	name := "image"
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		name += exts[0]
+	}
+	return handler.Captioner.CaptionReader(resp.Body, name)
+}
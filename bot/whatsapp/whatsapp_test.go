@@ -0,0 +1,81 @@
+package whatsapp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sign returns the X-Hub-Signature-256 of body.
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestNotificationSignature(t *testing.T) {
+	const body = `{"entry":[]}`
+	tests := []struct {
+		name      string
+		secret    string
+		body      string
+		signature string
+		status    int
+	}{
+		{"valid", "secret", body, sign("secret", body), http.StatusOK},
+		{"bad signature", "secret", body, sign("other", body), http.StatusUnauthorized},
+		{"tampered body", "secret", `{"entry":[{}]}`, sign("secret", body), http.StatusUnauthorized},
+		{"no prefix", "secret", body, strings.TrimPrefix(sign("secret", body), "sha256="), http.StatusUnauthorized},
+		{"no signature", "secret", body, "", http.StatusUnauthorized},
+		{"no app secret", "", body, sign("", body), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		handler := &Handler{AppSecret: test.secret}
+		req := httptest.NewRequest("POST", "/whatsapp", strings.NewReader(test.body))
+		req.Header.Set("X-Hub-Signature-256", test.signature)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+	}
+}
+
+func TestSubscriptionVerification(t *testing.T) {
+	tests := []struct {
+		name        string
+		verifyToken string
+		query       string
+		status      int
+	}{
+		{"valid", "token", "hub.mode=subscribe&hub.verify_token=token&hub.challenge=abc", http.StatusOK},
+		{"wrong token", "token", "hub.mode=subscribe&hub.verify_token=other&hub.challenge=abc", http.StatusForbidden},
+		{"wrong mode", "token", "hub.mode=unsubscribe&hub.verify_token=token&hub.challenge=abc", http.StatusForbidden},
+		{"no verify token", "", "hub.mode=subscribe&hub.verify_token=&hub.challenge=abc", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		handler := &Handler{VerifyToken: test.verifyToken}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/whatsapp?"+test.query, nil))
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+		if test.status == http.StatusOK && rec.Body.String() != "abc" {
+			t.Errorf("%s: body = %q, want the challenge", test.name, rec.Body)
+		}
+	}
+}
+
+func TestFirstDeliveryZeroHandler(t *testing.T) {
+	var handler Handler
+	if !handler.firstDelivery("wamid.1") {
+		t.Error("first delivery was taken as a redelivery")
+	}
+	if handler.firstDelivery("wamid.1") {
+		t.Error("redelivery was taken as new")
+	}
+}
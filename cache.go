@@ -0,0 +1,137 @@
+package captionbot
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// DefaultCacheTTL is how long captions are cached by default.
+const DefaultCacheTTL = 7 * 24 * time.Hour
+
+// Cache stores captions by key, for a CaptionBot's Cache or a
+// server.CachedCaptioner. Implementations must be safe for concurrent
+// use. The server/cache/redis package holds one in Redis.
+type Cache interface {
+	// Get returns the caption stored under key, and whether there was
+	// one that hasn't expired.
+	Get(key string) (string, bool, error)
+	// Set stores caption under key for ttl.
+	Set(key, caption string, ttl time.Duration) error
+}
+
+// cacheKey returns the key of an image in a Cache: a hash of its URL for
+// kind "url", or of its content for kind "sha256". Captions in a locale
+// are kept apart from others. server.CachedCaptioner keys images the
+// same way, so the two can share a Cache.
+func cacheKey(locale, kind string, data []byte) string {
+	sum := sha256.Sum256(data)
+	key := kind + ":" + hex.EncodeToString(sum[:])
+	if locale != "" {
+		return "locale:" + locale + ":" + key
+	}
+	return key
+}
+
+// cached returns the caption cached under key, if the session has a
+// Cache holding one. Cache errors are taken as misses.
+func (captionBot *CaptionBot) cached(key string) (string, bool) {
+	if captionBot.Cache == nil {
+		return "", false
+	}
+	caption, ok, err := captionBot.Cache.Get(key)
+	return caption, ok && err == nil
+}
+
+// cache stores caption under key in the session's Cache, if it has one.
+func (captionBot *CaptionBot) cache(key, caption string) {
+	if captionBot.Cache == nil {
+		return
+	}
+	ttl := captionBot.CacheTTL
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	captionBot.Cache.Set(key, caption, ttl)
+}
+
+// MemoryCache is a Cache in memory, dropping the least recently used
+// captions beyond MaxEntries, or none if it is 0. The zero value is an
+// empty cache without a bound.
+type MemoryCache struct {
+	MaxEntries int
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key     string
+	caption string
+	expires time.Time
+}
+
+var _ Cache = (*MemoryCache)(nil)
+
+// NewMemoryCache creates a MemoryCache of at most maxEntries captions.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return &MemoryCache{MaxEntries: maxEntries, lru: list.New(), entries: map[string]*list.Element{}}
+}
+
+// Get implements Cache.
+func (cache *MemoryCache) Get(key string) (string, bool, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	elem := cache.entries[key]
+	if elem == nil {
+		return "", false, nil
+	}
+	entry := elem.Value.(*memoryEntry)
+	if time.Now().After(entry.expires) {
+		cache.lru.Remove(elem)
+		delete(cache.entries, key)
+		return "", false, nil
+	}
+	cache.lru.MoveToFront(elem)
+	return entry.caption, true, nil
+}
+
+// Set implements Cache.
+func (cache *MemoryCache) Set(key, caption string, ttl time.Duration) error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.lazyInit()
+	entry := &memoryEntry{key: key, caption: caption, expires: time.Now().Add(ttl)}
+	if elem := cache.entries[key]; elem != nil {
+		elem.Value = entry
+		cache.lru.MoveToFront(elem)
+		return nil
+	}
+	cache.entries[key] = cache.lru.PushFront(entry)
+	for cache.MaxEntries > 0 && cache.lru.Len() > cache.MaxEntries {
+		oldest := cache.lru.Back()
+		cache.lru.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*memoryEntry).key)
+	}
+	return nil
+}
+
+// Purge drops every caption in the cache.
+func (cache *MemoryCache) Purge() error {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	cache.lru = list.New()
+	cache.entries = map[string]*list.Element{}
+	return nil
+}
+
+// lazyInit makes the list and map of a zero MemoryCache.
+func (cache *MemoryCache) lazyInit() {
+	if cache.entries == nil {
+		cache.lru = list.New()
+		cache.entries = map[string]*list.Element{}
+	}
+}
@@ -0,0 +1,121 @@
+package captionbot_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+// cached returns the caption cache holds under key, failing t on an
+// error.
+func cached(t *testing.T, cache captionbot.Cache, key string) (string, bool) {
+	t.Helper()
+	caption, ok, err := cache.Get(key)
+	if err != nil {
+		t.Fatalf("Get(%q): %v", key, err)
+	}
+	return caption, ok
+}
+
+func TestMemoryCacheZeroValue(t *testing.T) {
+	var cache captionbot.MemoryCache
+	if _, ok := cached(t, &cache, "a"); ok {
+		t.Error("empty cache had a caption")
+	}
+	if err := cache.Set("a", "a cat", time.Hour); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if caption, ok := cached(t, &cache, "a"); !ok || caption != "a cat" {
+		t.Errorf("Get = %q, %v, want %q, true", caption, ok, "a cat")
+	}
+
+	var purged captionbot.MemoryCache
+	if err := purged.Purge(); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+}
+
+func TestMemoryCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := captionbot.NewMemoryCache(2)
+	cache.Set("a", "a cat", time.Hour)
+	cache.Set("b", "a dog", time.Hour)
+	cached(t, cache, "a")
+	cache.Set("c", "a bird", time.Hour)
+
+	if _, ok := cached(t, cache, "b"); ok {
+		t.Error("least recently used caption wasn't dropped")
+	}
+	for key, want := range map[string]string{"a": "a cat", "c": "a bird"} {
+		if caption, ok := cached(t, cache, key); !ok || caption != want {
+			t.Errorf("Get(%q) = %q, %v, want %q, true", key, caption, ok, want)
+		}
+	}
+}
+
+func TestMemoryCacheReplaces(t *testing.T) {
+	cache := captionbot.NewMemoryCache(2)
+	cache.Set("a", "a cat", time.Hour)
+	cache.Set("a", "a kitten", time.Hour)
+	cache.Set("b", "a dog", time.Hour)
+
+	if caption, ok := cached(t, cache, "a"); !ok || caption != "a kitten" {
+		t.Errorf("Get = %q, %v, want %q, true", caption, ok, "a kitten")
+	}
+	if _, ok := cached(t, cache, "b"); !ok {
+		t.Error("replacing a caption dropped another")
+	}
+}
+
+func TestMemoryCacheExpires(t *testing.T) {
+	cache := captionbot.NewMemoryCache(0)
+	cache.Set("a", "a cat", -time.Second)
+	cache.Set("b", "a dog", time.Hour)
+
+	if _, ok := cached(t, cache, "a"); ok {
+		t.Error("expired caption was returned")
+	}
+	if _, ok := cached(t, cache, "b"); !ok {
+		t.Error("caption expired early")
+	}
+}
+
+func TestMemoryCachePurge(t *testing.T) {
+	cache := captionbot.NewMemoryCache(0)
+	cache.Set("a", "a cat", time.Hour)
+	if err := cache.Purge(); err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if _, ok := cached(t, cache, "a"); ok {
+		t.Error("purged caption was returned")
+	}
+	cache.Set("b", "a dog", time.Hour)
+	if _, ok := cached(t, cache, "b"); !ok {
+		t.Error("caption set after Purge is missing")
+	}
+}
+
+func TestCaptionBotCache(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	server.SetCaption(testImage, "a cat")
+	bot, err := captionbot.New(server.Option(), captionbot.WithCache(&captionbot.MemoryCache{}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		caption, err := bot.URLCaption(testImage)
+		if err != nil {
+			t.Fatalf("URLCaption: %v", err)
+		}
+		if caption != "a cat" {
+			t.Errorf("caption = %q, want %q", caption, "a cat")
+		}
+	}
+	// A task and its result, for the first caption only.
+	if got := server.Requests("message"); got != 2 {
+		t.Errorf("message requests = %d, want 2", got)
+	}
+}
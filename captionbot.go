@@ -2,20 +2,26 @@ package captionbot
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/textproto"
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // BaseURL is the root path of Caption Bot URL.
-// All requests will be paths starting from here.
+// All requests will be paths starting from here, unless a CaptionBot has
+// its own BaseURL.
 var BaseURL = "https://www.captionbot.ai/api/"
 
 // CaptionBotRequest is a struct to hold data for API URL caption requests.
@@ -26,12 +32,25 @@ type CaptionBotRequest struct {
 }
 
 // CaptionBotResponse is a struct to hold data for API URL caption responses.
+// Decoding it tolerates fields captionbot.ai renames or adds; see
+// UnmarshalJSON.
 type CaptionBotResponse struct {
 	ConversationID string
 	UserMessage    string
 	WaterMark      string
 	Status         string
-	BotMessages    []string
+	// BotMessages are the bot's messages: the image's URL echoed back,
+	// its caption, and sometimes remarks after.
+	BotMessages []string
+
+	// Raw is the response's JSON, for data the fields above don't hold.
+	Raw json.RawMessage `json:"-"`
+	// Extra holds the fields of the response the library doesn't know or
+	// couldn't decode, by name.
+	Extra map[string]json.RawMessage `json:"-"`
+
+	// renamed lists the fields found under other names than their own.
+	renamed []string
 }
 
 // CaptionBotClientState is a struct to hold "session" state.
@@ -42,26 +61,113 @@ type CaptionBotResponse struct {
 type CaptionBotClientState struct {
 	waterMark      string
 	conversationID string
+	// lastUsed is when the session was initialized or last captioned.
+	lastUsed time.Time
 }
 
 // CaptionBot is a struct representing one session with CaptionBot.
+// Its fields can be set directly or with the Options of New.
 type CaptionBot struct {
+	// BaseURL, if set, is the root of the session's requests instead of
+	// the package's BaseURL.
+	BaseURL string
+	// HTTPClient, if not nil, sends the session's requests instead of
+	// http.DefaultClient.
+	HTTPClient *http.Client
+	// RefreshAfter, if not zero, starts a new conversation before a
+	// caption when the session has been idle this long, since
+	// captionbot.ai may have expired the old one.
+	RefreshAfter time.Duration
+	// MaxRetries is how many times a caption or initialization failing
+	// for a reason that may pass, such as a 5XX, a 429, a network error
+	// or an empty response, is tried again. RetryBackoff is the wait
+	// before the first retry, doubled before each after it; a second if
+	// zero. A conversation captionbot.ai has expired is replaced and the
+	// caption retried regardless.
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Cache, if not nil, answers repeated captions without captionbot.ai:
+	// URLs by the URL, and uploads by a hash of their content, which are
+	// read into memory to hash them. Captions are kept for CacheTTL, or
+	// DefaultCacheTTL if zero; failed ones aren't cached.
+	Cache    Cache
+	CacheTTL time.Duration
+	// MaxUploadSize is the largest image an upload sends,
+	// DefaultMaxUploadSize if zero and any size if negative. Larger
+	// images fail with ErrImageTooLarge before they are sent, or if their
+	// size isn't known, once the limit is. Uploads that aren't JPEG, PNG
+	// or GIF images fail with ErrUnsupportedImageType.
+	MaxUploadSize int64
+	// ResizeUploads shrinks images larger than MaxUploadSize to fit
+	// instead of failing, decoding them and encoding them again as JPEGs.
+	ResizeUploads bool
+	// Strict fails captions whose responses have fields the library
+	// doesn't know or finds under other names, with a *SchemaError, to
+	// notice changes to captionbot.ai rather than tolerate them.
+	Strict bool
+	// Locale, if set, is sent as the Accept-Language of the session's
+	// requests, such as "fr-FR", to ask for captions in that language
+	// where the service supports it.
+	Locale string
+	// UserAgent, if set, is the User-Agent of the session's requests
+	// instead of the package's UserAgent.
+	UserAgent string
+	// Header is added to every request of the session, such as an
+	// Origin or Referer the site expects.
+	Header http.Header
+	// Jar, if not nil, keeps the cookies captionbot.ai sets and sends
+	// them back with the session's later requests. New gives every
+	// session its own.
+	Jar http.CookieJar
+	// Hooks are told of every request the session makes, for logging,
+	// metrics or tracing.
+	Hooks Hooks
+	// TransportMiddleware wraps the transport of the session's HTTP
+	// client, the first given outermost, such as to trace or count its
+	// requests.
+	TransportMiddleware []func(http.RoundTripper) http.RoundTripper
+
 	state CaptionBotClientState
+	// wrapped is the transport wrappedFrom with the first wrappedCount
+	// of TransportMiddleware around it.
+	wrapped      http.RoundTripper
+	wrappedFrom  http.RoundTripper
+	wrappedCount int
 }
 
 // CaptionBotConnection is an interface for methods for one CaptionBot session.
+// It covers everything a CaptionBot does, so consumers can mock the whole
+// client.
 type CaptionBotConnection interface {
 	URLCaption(url string) (string, error)
+	UploadCaption(fileName string) (string, error)
+	UploadCaptionReader(r io.Reader, name string) (string, error)
+	UploadCaptionBytes(data []byte, name string) (string, error)
+	RateCaption(rating int) error
 	Initialize() error
+	ConversationID() string
+	WaterMark() string
 }
 
 var _ CaptionBotConnection = (*CaptionBot)(nil)
 
-// New creates and initializes a new CaptionBot object
-func New() (*CaptionBot, error) {
+// New creates and initializes a new CaptionBot object, configured by
+// opts.
+func New(opts ...Option) (*CaptionBot, error) {
+	return NewContext(context.Background(), opts...)
+}
+
+// NewContext is New with a context for the request initializing the
+// session.
+func NewContext(ctx context.Context, opts ...Option) (*CaptionBot, error) {
 	var err error
 	cb := &CaptionBot{}
-	err = cb.Initialize()
+	// cookiejar.New fails only on bad options.
+	cb.Jar, _ = cookiejar.New(nil)
+	for _, opt := range opts {
+		opt(cb)
+	}
+	err = cb.InitializeContext(ctx)
 	if err != nil {
 		return cb, err
 	}
@@ -69,27 +175,140 @@ func New() (*CaptionBot, error) {
 	return cb, nil
 }
 
+// ConversationID returns the session's conversation ID, empty until
+// Initialize.
+func (captionBot *CaptionBot) ConversationID() string {
+	return captionBot.state.conversationID
+}
+
+// WaterMark returns the watermark of the session's most recent caption.
+func (captionBot *CaptionBot) WaterMark() string {
+	return captionBot.state.waterMark
+}
+
+// LastUsed returns when the session was initialized or last captioned.
+func (captionBot *CaptionBot) LastUsed() time.Time {
+	return captionBot.state.lastUsed
+}
+
+// Refresh starts a new conversation, as if the session were new.
+// The old conversation is kept if that fails.
+func (captionBot *CaptionBot) Refresh() error {
+	return captionBot.RefreshContext(context.Background())
+}
+
+// RefreshContext is Refresh with a context for its request.
+func (captionBot *CaptionBot) RefreshContext(ctx context.Context) error {
+	old := captionBot.state
+	captionBot.state = CaptionBotClientState{}
+	if err := captionBot.InitializeContext(ctx); err != nil {
+		captionBot.state = old
+		return err
+	}
+	return nil
+}
+
+func (captionBot *CaptionBot) baseURL() string {
+	if captionBot.BaseURL != "" {
+		return captionBot.BaseURL
+	}
+	return BaseURL
+}
+
+func (captionBot *CaptionBot) httpClient() *http.Client {
+	client := http.DefaultClient
+	if captionBot.HTTPClient != nil {
+		client = captionBot.HTTPClient
+	}
+	return captionBot.wrapClient(client)
+}
+
+// do sends req, made for phase, with the session's User-Agent, its Locale
+// as its Accept-Language, its Header and the cookies of its Jar, and keeps
+// the cookies the response sets. Its Hooks are told of it.
+func (captionBot *CaptionBot) do(phase string, req *http.Request) (*http.Response, error) {
+	event := RequestEvent{Phase: phase, Method: req.Method, URL: req.URL.String(), Start: time.Now()}
+	if start := captionBot.Hooks.OnRequestStart; start != nil {
+		if ctx := start(req.Context(), event); ctx != nil {
+			req = req.WithContext(ctx)
+		}
+	}
+	resp, err := captionBot.send(req)
+	if end := captionBot.Hooks.OnRequestEnd; end != nil {
+		event.Duration = time.Since(event.Start)
+		event.Err = err
+		if resp != nil {
+			event.StatusCode = resp.StatusCode
+		}
+		end(req.Context(), event)
+	}
+	return resp, err
+}
+
+func (captionBot *CaptionBot) send(req *http.Request) (*http.Response, error) {
+	if captionBot.UserAgent != "" {
+		req.Header.Set("User-Agent", captionBot.UserAgent)
+	} else {
+		req.Header.Set("User-Agent", UserAgent)
+	}
+	if captionBot.Locale != "" {
+		req.Header.Set("Accept-Language", captionBot.Locale)
+	}
+	for key, values := range captionBot.Header {
+		req.Header[key] = values
+	}
+	if captionBot.Jar != nil {
+		for _, cookie := range captionBot.Jar.Cookies(req.URL) {
+			req.AddCookie(cookie)
+		}
+	}
+	resp, err := captionBot.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if captionBot.Jar != nil {
+		if cookies := resp.Cookies(); len(cookies) > 0 {
+			captionBot.Jar.SetCookies(resp.Request.URL, cookies)
+		}
+	}
+	return resp, nil
+}
+
+func (captionBot *CaptionBot) get(ctx context.Context, phase, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return captionBot.do(phase, req)
+}
+
 // CreateCaptionTask is the request that starts a URL caption request on the
 // server. Result will need to be retrieved by a subsequent GET request with the
 // same parameters used here.
 func CreateCaptionTask(data bytes.Buffer) error {
-	queryURL := BaseURL + "/message"
-	req, err := http.NewRequest("POST", queryURL, &data)
+	return CreateCaptionTaskContext(context.Background(), data)
+}
+
+// CreateCaptionTaskContext is CreateCaptionTask with a context for its
+// request.
+func CreateCaptionTaskContext(ctx context.Context, data bytes.Buffer) error {
+	return (&CaptionBot{}).createCaptionTask(ctx, PhaseTask, data)
+}
+
+func (captionBot *CaptionBot) createCaptionTask(ctx context.Context, phase string, data bytes.Buffer) error {
+	queryURL := captionBot.baseURL() + "/message"
+	req, err := http.NewRequestWithContext(ctx, "POST", queryURL, &data)
 	if err != nil {
 		return err
 	}
 	req.Header.Add("Content-Type", "application/json; charset=utf8")
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := captionBot.do(phase, req)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return fmt.Errorf("non 2XX status code when POST-ing caption task")
-	}
-
-	return nil
+	return checkStatus(resp, "message")
 }
 
 // MakeValuesFromState creates values struct from state struct
@@ -104,24 +323,88 @@ func MakeValuesFromState(imgURL string, state CaptionBotClientState) url.Values
 // Initialize sends request to /init endpoint to retrieve conversationID.
 // This is a session variable used in the state struct.
 func (captionBot *CaptionBot) Initialize() error {
-	resp, err := http.Get(BaseURL + "init")
+	return captionBot.InitializeContext(context.Background())
+}
+
+// InitializeContext is Initialize with a context for its request.
+func (captionBot *CaptionBot) InitializeContext(ctx context.Context) error {
+	return captionBot.retry(ctx, func() error {
+		return captionBot.initialize(ctx)
+	})
+}
+
+func (captionBot *CaptionBot) initialize(ctx context.Context) error {
+	resp, err := captionBot.get(ctx, PhaseInit, captionBot.baseURL()+"init")
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	if err := checkStatus(resp, "init"); err != nil {
+		return err
+	}
 
-	return json.NewDecoder(resp.Body).Decode(&captionBot.state.conversationID)
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := DecodeResponse(data, &captionBot.state.conversationID); err != nil {
+		return err
+	}
+	captionBot.state.lastUsed = time.Now()
+	return nil
 }
 
 // URLCaption is the entry method for getting caption for image pointed to by URL.
 // Performs a POST request to start the caption task.
 // Then performs a GET request to retrieve the result.
 func (captionBot *CaptionBot) URLCaption(url string) (string, error) {
+	return captionBot.URLCaptionContext(context.Background(), url)
+}
+
+// URLCaptionContext is URLCaption with a context for its requests, which
+// stops them when it is done.
+func (captionBot *CaptionBot) URLCaptionContext(ctx context.Context, url string) (string, error) {
+	key := cacheKey(captionBot.Locale, "url", []byte(url))
+	if caption, ok := captionBot.cached(key); ok {
+		return caption, nil
+	}
+	captionJSON, err := captionBot.URLCaptionResponseContext(ctx, url)
+	if err != nil {
+		return "", err
+	}
+	captionBot.cache(key, captionJSON.Caption())
+	return captionJSON.Caption(), nil
+}
+
+// URLCaptionResponse captions the image at url as URLCaption does, but
+// returns the whole response, with its raw JSON.
+func (captionBot *CaptionBot) URLCaptionResponse(url string) (*CaptionBotResponse, error) {
+	return captionBot.URLCaptionResponseContext(context.Background(), url)
+}
+
+// URLCaptionResponseContext is URLCaptionResponse with a context for its
+// requests.
+func (captionBot *CaptionBot) URLCaptionResponseContext(ctx context.Context, url string) (*CaptionBotResponse, error) {
+	var response *CaptionBotResponse
+	err := captionBot.retry(ctx, func() error {
+		var err error
+		response, err = captionBot.urlCaption(ctx, url)
+		return err
+	})
+	return response, err
+}
+
+// urlCaption makes one try at captioning the image at url.
+func (captionBot *CaptionBot) urlCaption(ctx context.Context, url string) (*CaptionBotResponse, error) {
 	var err error
 
 	if captionBot.state.conversationID == "" {
-		return "", fmt.Errorf(`captionBot not initialize.\n
-                              Please call CaptionBot::Initialize()`)
+		return nil, ErrNotInitialized
+	}
+	if captionBot.RefreshAfter > 0 && time.Since(captionBot.state.lastUsed) >= captionBot.RefreshAfter {
+		if err := captionBot.RefreshContext(ctx); err != nil {
+			return nil, err
+		}
 	}
 
 	// Create JSON data from state for POST request
@@ -133,7 +416,7 @@ func (captionBot *CaptionBot) URLCaption(url string) (string, error) {
 
 	var data bytes.Buffer
 	if err := json.NewEncoder(&data).Encode(requestData); err != nil {
-		return "", err
+		return nil, err
 	}
 
 	/*
@@ -142,45 +425,261 @@ func (captionBot *CaptionBot) URLCaption(url string) (string, error) {
 	  - the result will need to be retrieved with a subseqent
 	    GET request using the above data as URL-encoded params.
 	*/
-	if err = CreateCaptionTask(data); err != nil {
-		return "", err
+	if err = captionBot.createCaptionTask(ctx, PhaseTask, data); err != nil {
+		return nil, err
 	}
 
 	// Create Values struct for URL encoded params
 	v := MakeValuesFromState(url, captionBot.state)
 
 	// Actually Query for Caption
-	queryURL := BaseURL + "/message"
-	resp, err := http.Get(queryURL + "?" + v.Encode())
+	queryURL := captionBot.baseURL() + "/message"
+	resp, err := captionBot.get(ctx, PhaseResult, queryURL+"?"+v.Encode())
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
-
-	// they return a json as string; unmarshal it into a string first then into caption bot response type
-	var response string
-	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		return "", err
+	if err := checkStatus(resp, "message"); err != nil {
+		return nil, err
 	}
 
-	// Unmarshal it
-	var captionJSON CaptionBotResponse
-	if err := json.Unmarshal([]byte(response), &captionJSON); err != nil {
-		return "", err
+	captionJSON, err := ParseMessageResponse(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	// Update the state with the new watermark.
 	// This is a side-effect.
 	captionBot.state.waterMark = captionJSON.WaterMark
+	captionBot.state.lastUsed = time.Now()
+
+	if captionBot.Strict {
+		if err := captionJSON.CheckSchema(); err != nil {
+			return nil, err
+		}
+	}
+	return captionJSON, nil
+}
+
+// ParseMessageResponse parses the body of a GET request to /message with
+// DecodeResponse. It is an error for the response to hold no caption, as
+// when BotMessages is too short or its caption empty: a *SchemaError with
+// the response's raw JSON.
+func ParseMessageResponse(r io.Reader) (*CaptionBotResponse, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var captionJSON CaptionBotResponse
+	if err := DecodeResponse(data, &captionJSON); err != nil {
+		return nil, err
+	}
+	if len(captionJSON.BotMessages) < 2 {
+		return nil, &SchemaError{Missing: []string{"BotMessages"}, Raw: captionJSON.Raw}
+	}
+	if strings.TrimSpace(captionJSON.Caption()) == "" {
+		return nil, &SchemaError{Missing: []string{"caption"}, Raw: captionJSON.Raw}
+	}
+	return &captionJSON, nil
+}
+
+// maxEncodings is how many times DecodeResponse unwraps JSON strings
+// holding JSON.
+const maxEncodings = 4
+
+// ErrMalformedResponse matches, with errors.Is, the errors of responses
+// DecodeResponse can't decode.
+var ErrMalformedResponse = errors.New("captionbot: malformed response")
+
+// MalformedResponseError is the error of a response DecodeResponse can't
+// decode, with the body as it was received.
+type MalformedResponseError struct {
+	Body []byte
+	Err  error
+}
+
+func (err *MalformedResponseError) Error() string {
+	body := err.Body
+	if len(body) > 200 {
+		body = body[:200]
+	}
+	return fmt.Sprintf("%s: %s: %q", ErrMalformedResponse, err.Err, body)
+}
+
+func (err *MalformedResponseError) Unwrap() error {
+	return err.Err
+}
+
+// Is reports whether target is ErrMalformedResponse.
+func (err *MalformedResponseError) Is(target error) bool {
+	return target == ErrMalformedResponse
+}
+
+// DecodeResponse decodes the body of a captionbot.ai response into v.
+// The service answers JSON strings holding JSON, such as
+// "{\"WaterMark\":\"1\"}", which are decoded as many times as they were
+// encoded. It also accepts the JSON itself, a byte order mark, JSON whose
+// escapes were left in without the string around them, and escaped
+// newlines between JSON tokens, as in {\n"WaterMark":"1"}, or around the
+// JSON. A body it can't decode is a *MalformedResponseError.
+func DecodeResponse(data []byte, v interface{}) error {
+	if err := decodeResponse(data, v); err != nil {
+		return &MalformedResponseError{Body: data, Err: err}
+	}
+	return nil
+}
+
+func decodeResponse(data []byte, v interface{}) error {
+	data = trimEscapes(bytes.TrimPrefix(data, []byte("\ufeff")))
+	if len(data) > 0 && data[0] != '"' && bytes.Contains(data, []byte(`\"`)) {
+		// The escapes of a JSON string, without the string.
+		var s string
+		if json.Unmarshal(append(append([]byte{'"'}, data...), '"'), &s) == nil {
+			data = trimEscapes([]byte(s))
+		}
+	}
+	for i := 0; i < maxEncodings && len(data) > 0 && data[0] == '"'; i++ {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		inner := trimEscapes([]byte(s))
+		if len(inner) == 0 || !bytes.ContainsAny(inner[:1], `{["`) {
+			// The string is the value itself, such as a URL.
+			break
+		}
+		data = inner
+	}
+	err := json.Unmarshal(data, v)
+	if _, ok := err.(*json.SyntaxError); ok {
+		if cleaned := unescapeSpace(data); !bytes.Equal(cleaned, data) {
+			return json.Unmarshal(cleaned, v)
+		}
+	}
+	return err
+}
+
+// trimEscapes trims space from data, and the escapes \n, \r and \t left
+// around JSON, which can't start or end with a backslash.
+func trimEscapes(data []byte) []byte {
+	for {
+		data = bytes.TrimSpace(data)
+		switch {
+		case len(data) >= 2 && data[0] == '\\' && bytes.IndexByte([]byte("nrt"), data[1]) >= 0:
+			data = data[2:]
+		case len(data) >= 2 && data[len(data)-2] == '\\' && bytes.IndexByte([]byte("nrt"), data[len(data)-1]) >= 0:
+			data = data[:len(data)-2]
+		default:
+			return data
+		}
+	}
+}
+
+// unescapeSpace replaces the escapes \n, \r and \t outside of the strings
+// in data with spaces, which JSON allows between tokens.
+func unescapeSpace(data []byte) []byte {
+	cleaned := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString && c == '\\' && i+1 < len(data):
+			cleaned = append(cleaned, c, data[i+1])
+			i++
+			continue
+		case c == '"':
+			inString = !inString
+		case !inString && c == '\\' && i+1 < len(data) && bytes.IndexByte([]byte("nrt"), data[i+1]) >= 0:
+			cleaned = append(cleaned, ' ', ' ')
+			i++
+			continue
+		}
+		cleaned = append(cleaned, c)
+	}
+	return cleaned
+}
+
+// Caption returns the caption in the response. BotMessages echoes the
+// image's URL and then gives its caption.
+func (response *CaptionBotResponse) Caption() string {
+	if len(response.BotMessages) < 2 {
+		return ""
+	}
+	return response.BotMessages[1]
+}
+
+// EchoedURL returns the image URL the response echoes back, the first of
+// BotMessages.
+func (response *CaptionBotResponse) EchoedURL() string {
+	if len(response.BotMessages) < 1 {
+		return ""
+	}
+	return response.BotMessages[0]
+}
+
+// Remarks returns the bot's messages after the caption, if any.
+func (response *CaptionBotResponse) Remarks() []string {
+	if len(response.BotMessages) < 3 {
+		return nil
+	}
+	return response.BotMessages[2:]
+}
+
+// ParseUploadResponse parses the body of a POST request to /upload, a
+// JSON string of the URL the image was uploaded to.
+func ParseUploadResponse(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	var body string
+	if err := DecodeResponse(data, &body); err != nil {
+		return "", err
+	}
+	if body == "" {
+		return "", fmt.Errorf("upload response has no URL")
+	}
+	return body, nil
+}
 
-	//requestedURL := captionJSON.BotMessages[0]
-	caption := captionJSON.BotMessages[1]
+// RateCaption rates the most recent caption in this session from 1 (poor)
+// to 5 (great), the same feedback the captionbot.ai page collects.
+func (captionBot *CaptionBot) RateCaption(rating int) error {
+	return captionBot.RateCaptionContext(context.Background(), rating)
+}
+
+// RateCaptionContext is RateCaption with a context for its request.
+func (captionBot *CaptionBot) RateCaptionContext(ctx context.Context, rating int) error {
+	if captionBot.state.conversationID == "" {
+		return ErrNotInitialized
+	}
+	if rating < 1 || rating > 5 {
+		return fmt.Errorf("rating %d is not between 1 and 5", rating)
+	}
 
-	return caption, nil
+	requestData := CaptionBotRequest{
+		ConversationID: captionBot.state.conversationID,
+		UserMessage:    strconv.Itoa(rating),
+		WaterMark:      captionBot.state.waterMark,
+	}
+
+	var data bytes.Buffer
+	if err := json.NewEncoder(&data).Encode(requestData); err != nil {
+		return err
+	}
+
+	return captionBot.createCaptionTask(ctx, PhaseRate, data)
 }
 
 // UploadCaption uploads a file and runs URLCaption on the result
 func (captionBot *CaptionBot) UploadCaption(fileName string) (string, error) {
+	return captionBot.UploadCaptionContext(context.Background(), fileName)
+}
+
+// UploadCaptionContext is UploadCaption with a context for its requests.
+func (captionBot *CaptionBot) UploadCaptionContext(ctx context.Context, fileName string) (string, error) {
 	// Make sure file exist, that its readable and then read it into memory
 	if _, err := os.Stat(fileName); os.IsNotExist(err) {
 		return "", err
@@ -192,46 +691,130 @@ func (captionBot *CaptionBot) UploadCaption(fileName string) (string, error) {
 	}
 	defer file.Close()
 
-	// Prepare the post
-	mimetype := mime.TypeByExtension(filepath.Ext(fileName))
+	return captionBot.UploadCaptionReaderContext(ctx, file, filepath.Base(fileName))
+}
 
-	postbody := new(bytes.Buffer)
-	writer := multipart.NewWriter(postbody)
-	defer writer.Close()
+// UploadCaptionBytes uploads image data and runs URLCaption on the result.
+// name is the image's file name, whose extension gives its type.
+func (captionBot *CaptionBot) UploadCaptionBytes(data []byte, name string) (string, error) {
+	return captionBot.UploadCaptionBytesContext(context.Background(), data, name)
+}
 
-	h := make(textproto.MIMEHeader)
-	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "file", filepath.Base(fileName)))
-	h.Set("Content-Type", mimetype)
-	part, err := writer.CreatePart(h)
+// UploadCaptionBytesContext is UploadCaptionBytes with a context for its
+// requests.
+func (captionBot *CaptionBot) UploadCaptionBytesContext(ctx context.Context, data []byte, name string) (string, error) {
+	return captionBot.UploadCaptionReaderContext(ctx, bytes.NewReader(data), name)
+}
+
+// UploadCaptionReader uploads the image read from r and runs URLCaption on
+// the result. name is the image's file name, whose extension gives its
+// type.
+func (captionBot *CaptionBot) UploadCaptionReader(file io.Reader, name string) (string, error) {
+	return captionBot.UploadCaptionReaderContext(context.Background(), file, name)
+}
+
+// UploadCaptionReaderContext is UploadCaptionReader with a context for
+// its requests.
+func (captionBot *CaptionBot) UploadCaptionReaderContext(ctx context.Context, file io.Reader, name string) (string, error) {
+	return captionBot.UploadCaptionReaderTypeContext(ctx, file, name, "")
+}
+
+// UploadCaptionReaderType is UploadCaptionReader for an image whose type
+// is known, such as from the Content-Type of a multipart upload or an S3
+// object. If contentType is empty, the type sniffed from the image's
+// first bytes is sent.
+func (captionBot *CaptionBot) UploadCaptionReaderType(file io.Reader, name, contentType string) (string, error) {
+	return captionBot.UploadCaptionReaderTypeContext(context.Background(), file, name, contentType)
+}
+
+// UploadCaptionReaderTypeContext is UploadCaptionReaderType with a
+// context for its requests.
+func (captionBot *CaptionBot) UploadCaptionReaderTypeContext(ctx context.Context, file io.Reader, name, contentType string) (string, error) {
+	var key string
+	if captionBot.Cache != nil {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			return "", err
+		}
+		key = cacheKey(captionBot.Locale, "sha256", data)
+		if caption, ok := captionBot.cached(key); ok {
+			return caption, nil
+		}
+		file = bytes.NewReader(data)
+	}
+	captionJSON, err := captionBot.upload(ctx, file, name, contentType)
 	if err != nil {
 		return "", err
 	}
+	if key != "" {
+		captionBot.cache(key, captionJSON.Caption())
+	}
+	return captionJSON.Caption(), nil
+}
 
-	// Copy file content directly into part; no need to read contents into memory
-	if _, err := io.Copy(part, file); err != nil {
-		return "", err
+// UploadCaptionResponse captions the image read from r as
+// UploadCaptionReader does, but returns the whole response, with its raw
+// JSON.
+func (captionBot *CaptionBot) UploadCaptionResponse(file io.Reader, name string) (*CaptionBotResponse, error) {
+	return captionBot.UploadCaptionResponseContext(context.Background(), file, name)
+}
+
+// UploadCaptionResponseContext is UploadCaptionResponse with a context
+// for its requests.
+func (captionBot *CaptionBot) UploadCaptionResponseContext(ctx context.Context, file io.Reader, name string) (*CaptionBotResponse, error) {
+	return captionBot.upload(ctx, file, name, "")
+}
+
+// upload streams the image read from file to captionbot.ai as a multipart
+// form, without holding it in memory, and captions the URL it is given.
+func (captionBot *CaptionBot) upload(ctx context.Context, file io.Reader, name, contentType string) (*CaptionBotResponse, error) {
+	file, name, contentType, err := captionBot.prepareUpload(file, name, contentType)
+	if err != nil {
+		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%supload", BaseURL), postbody)
+	// Prepare the post, written into the request body as it is sent
+	postbody, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	go func() {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, "file", filepath.Base(name)))
+		h.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(h)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		pipe.CloseWithError(err)
+	}()
+	// Stop the goroutine if the request ends before reading the whole body.
+	defer postbody.Close()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("%supload", captionBot.baseURL()), postbody)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	req.Header.Add("Content-Type", writer.FormDataContentType())
 
 	// Send the request
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := captionBot.do(PhaseUpload, req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := checkStatus(resp, "upload"); err != nil {
+		return nil, err
+	}
 
 	// read body directly into a string
-	var body string
-	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
-		return "", err
+	body, err := ParseUploadResponse(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
 	// Sanitize reply and return it
-	return captionBot.URLCaption(body)
+	return captionBot.URLCaptionResponseContext(ctx, body)
 }
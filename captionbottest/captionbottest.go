@@ -0,0 +1,465 @@
+// Package captionbottest is a fake captionbot.ai for hermetic tests of
+// code using the captionbot package.
+//
+// A Server speaks the protocol the captionbot package does: GET /init
+// answers a conversation ID, POST /message starts a caption task that GET
+// /message answers as a JSON-encoded string of JSON, and POST /upload
+// answers the URL of the uploaded image as a JSON string. Captions,
+// delays and failures can be scripted, and Option points a CaptionBot at
+// the server, or Use the whole captionbot package:
+//
+//	fake := captionbottest.NewServer()
+//	defer fake.Close()
+//	fake.SetCaption("https://example.com/cat.jpg", "a cat sitting on a couch")
+//	fake.Fail("message", http.StatusBadGateway, 1)
+//
+//	bot, _ := captionbot.New(fake.Option())
+//	_, err := bot.URLCaption("https://example.com/cat.jpg") // fails once
+//	caption, _ := bot.URLCaption("https://example.com/cat.jpg")
+//
+// A Recorder instead records interactions with the live service to a
+// cassette file and replays them, a ChaosTransport injects timeouts,
+// 5xx bursts, slow responses and broken bodies into requests to either,
+// and a FakeCaptioner stands in for the
+// provider behind a server.Server, or anything else taking a
+// server.Captioner, with stable made-up captions.
+package captionbottest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// DefaultCaption is the caption of images with none set, the one
+// captionbot.ai gives when it can't tell what an image shows.
+const DefaultCaption = "I really can't describe the picture 😳"
+
+// maxLogged is how many requests a Server keeps in its Log, and
+// maxLoggedBody how much of each body.
+const (
+	maxLogged     = 1000
+	maxLoggedBody = 2048
+)
+
+// LoggedRequest is a request the server received, as Log returns it.
+type LoggedRequest struct {
+	Time   time.Time `json:"time"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Query  string    `json:"query,omitempty"`
+	// Body is the start of the request body, or its size if it isn't
+	// text.
+	Body       string `json:"body,omitempty"`
+	Status     int    `json:"status"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// failure is a scripted failure of an endpoint.
+type failure struct {
+	status int
+	left   int
+}
+
+// conversation is the state of one session with the server.
+type conversation struct {
+	waterMark int
+	// pending holds the images POSTed to /message whose captions
+	// haven't been fetched.
+	pending map[string]bool
+}
+
+// Server is a fake captionbot.ai, serving the API under /api/.
+type Server struct {
+	*httptest.Server
+
+	mu            sync.Mutex
+	captions      map[string]string
+	errors        map[string]string
+	defaultCap    string
+	delays        map[string]time.Duration
+	failures      map[string]*failure
+	requests      map[string]int
+	conversations map[string]*conversation
+	uploads       map[string]string
+	ratings       []int
+	next          int
+	log           []LoggedRequest
+}
+
+// NewServer starts a Server. Close it when done.
+func NewServer() *Server {
+	server := NewUnstartedServer()
+	server.Start()
+	return server
+}
+
+// NewUnstartedServer returns a Server that isn't started, so that its
+// Listener or Config can be changed before calling Start. Its handler
+// is the Server itself.
+func NewUnstartedServer() *Server {
+	server := &Server{
+		captions:      map[string]string{},
+		errors:        map[string]string{},
+		defaultCap:    DefaultCaption,
+		delays:        map[string]time.Duration{},
+		failures:      map[string]*failure{},
+		requests:      map[string]int{},
+		conversations: map[string]*conversation{},
+		uploads:       map[string]string{},
+	}
+	server.Server = httptest.NewUnstartedServer(server)
+	return server
+}
+
+// BaseURL returns the root of the server's API, for captionbot.BaseURL.
+func (server *Server) BaseURL() string {
+	return server.URL + "/api/"
+}
+
+// Option returns the option pointing a CaptionBot at the server, which
+// unlike Use leaves other clients alone, so tests using it can run in
+// parallel.
+func (server *Server) Option() captionbot.Option {
+	return captionbot.WithBaseURL(server.BaseURL())
+}
+
+// Use points the captionbot package at the server, returning a function
+// that points it back.
+func (server *Server) Use() func() {
+	previous := captionbot.BaseURL
+	captionbot.BaseURL = server.BaseURL()
+	return func() { captionbot.BaseURL = previous }
+}
+
+// SetCaption sets the caption of an image: a URL, or the file name of an
+// upload.
+func (server *Server) SetCaption(image, caption string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	delete(server.errors, image)
+	server.captions[image] = caption
+}
+
+// SetDefaultCaption sets the caption of images with none set.
+func (server *Server) SetDefaultCaption(caption string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.defaultCap = caption
+}
+
+// FailCaption makes captioning an image fail: GET /message answers 500
+// with message instead of its caption.
+func (server *Server) FailCaption(image, message string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.errors[image] = message
+}
+
+// SetDelay makes an endpoint, "init", "message" or "upload", wait before
+// answering. For "message", only the GET answering a caption waits, as
+// the real service does while it captions.
+func (server *Server) SetDelay(endpoint string, delay time.Duration) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.delays[endpoint] = delay
+}
+
+// Fail makes the next n requests to an endpoint, "init", "message" or
+// "upload", answer status with an empty body. A negative n fails them
+// all until Fail is called again with zero.
+func (server *Server) Fail(endpoint string, status, n int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if n == 0 {
+		delete(server.failures, endpoint)
+		return
+	}
+	server.failures[endpoint] = &failure{status: status, left: n}
+}
+
+// Requests returns the number of requests an endpoint has had, failed
+// ones included.
+func (server *Server) Requests(endpoint string) int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.requests[endpoint]
+}
+
+// Ratings returns the ratings sent with captionbot.CaptionBot.RateCaption,
+// in order.
+func (server *Server) Ratings() []int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]int(nil), server.ratings...)
+}
+
+// Log returns the requests the server has received, the most recent
+// last, up to the last 1000.
+func (server *Server) Log() []LoggedRequest {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return append([]LoggedRequest(nil), server.log...)
+}
+
+// ServeHTTP serves the fake API under /api/, logging each request.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	body := &cappedBuffer{}
+	if r.Body != nil {
+		r.Body = readCloser{io.TeeReader(r.Body, body), r.Body}
+	}
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	server.route(recorder, r)
+
+	entry := LoggedRequest{
+		Time:       start,
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Query:      r.URL.RawQuery,
+		Body:       body.String(),
+		Status:     recorder.status,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	server.mu.Lock()
+	server.log = append(server.log, entry)
+	if len(server.log) > maxLogged {
+		server.log = server.log[len(server.log)-maxLogged:]
+	}
+	server.mu.Unlock()
+}
+
+// route routes a request to its endpoint. The captionbot package joins
+// some paths with a double slash, so slashes around the endpoint are
+// ignored.
+func (server *Server) route(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/uploads/") {
+		// Uploaded images are only kept by name; their URLs answer
+		// empty.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	endpoint := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api"), "/")
+
+	server.mu.Lock()
+	server.requests[endpoint]++
+	delay := server.delays[endpoint]
+	if endpoint == "message" && r.Method == "POST" {
+		delay = 0
+	}
+	status := 0
+	if fail := server.failures[endpoint]; fail != nil {
+		status = fail.status
+		if fail.left > 0 {
+			fail.left--
+			if fail.left == 0 {
+				delete(server.failures, endpoint)
+			}
+		}
+	}
+	server.mu.Unlock()
+
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if status != 0 {
+		w.WriteHeader(status)
+		return
+	}
+
+	switch {
+	case endpoint == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		w.WriteHeader(http.StatusOK)
+	case endpoint == "init" && r.Method == "GET":
+		server.handleInit(w, r)
+	case endpoint == "message" && r.Method == "POST":
+		server.handleMessage(w, r)
+	case endpoint == "message" && r.Method == "GET":
+		server.handleResult(w, r)
+	case endpoint == "upload" && r.Method == "POST":
+		server.handleUpload(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleInit starts a conversation, answering its ID as a JSON string.
+func (server *Server) handleInit(w http.ResponseWriter, r *http.Request) {
+	server.mu.Lock()
+	server.next++
+	id := fmt.Sprintf("conversation-%d", server.next)
+	server.conversations[id] = &conversation{pending: map[string]bool{}}
+	server.mu.Unlock()
+	writeJSON(w, id)
+}
+
+// handleMessage starts captioning an image, or records a rating when the
+// message is a number from 1 to 5.
+func (server *Server) handleMessage(w http.ResponseWriter, r *http.Request) {
+	var req captionbot.CaptionBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	conv := server.conversations[req.ConversationID]
+	if conv == nil {
+		http.Error(w, "unknown conversation", http.StatusBadRequest)
+		return
+	}
+	if rating, err := strconv.Atoi(req.UserMessage); err == nil && rating >= 1 && rating <= 5 {
+		server.ratings = append(server.ratings, rating)
+		return
+	}
+	conv.pending[req.UserMessage] = true
+}
+
+// handleResult answers the caption of an image POSTed to /message as a
+// CaptionBotResponse, JSON-encoded and then encoded again as a JSON
+// string, as captionbot.ai does.
+func (server *Server) handleResult(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	image := query.Get("userMessage")
+
+	server.mu.Lock()
+	conv := server.conversations[query.Get("conversationID")]
+	if conv == nil || !conv.pending[image] {
+		server.mu.Unlock()
+		http.Error(w, "no caption task for this image", http.StatusBadRequest)
+		return
+	}
+	delete(conv.pending, image)
+	name := image
+	if upload, ok := server.uploads[image]; ok {
+		name = upload
+	}
+	if message, ok := server.errors[name]; ok {
+		server.mu.Unlock()
+		http.Error(w, message, http.StatusInternalServerError)
+		return
+	}
+	caption, ok := server.captions[name]
+	if !ok {
+		caption = server.defaultCap
+	}
+	conv.waterMark++
+	response := captionbot.CaptionBotResponse{
+		ConversationID: query.Get("conversationID"),
+		UserMessage:    image,
+		WaterMark:      strconv.Itoa(conv.waterMark),
+		BotMessages:    []string{image, caption},
+	}
+	server.mu.Unlock()
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, string(data))
+}
+
+// handleUpload stores nothing of an uploaded image but its file name,
+// answering a URL for it as a JSON string.
+func (server *Server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	// Only the first part is read; older versions of the captionbot
+	// package sent the form without its closing boundary.
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	part, err := reader.NextPart()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if part.FormName() != "file" || part.FileName() == "" {
+		http.Error(w, "the form needs a file field", http.StatusBadRequest)
+		return
+	}
+	name := path.Base(part.FileName())
+
+	server.mu.Lock()
+	server.next++
+	url := fmt.Sprintf("http://%s/uploads/%d/%s", r.Host, server.next, name)
+	server.uploads[url] = name
+	server.mu.Unlock()
+	writeJSON(w, url)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// statusRecorder records the status of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (recorder *statusRecorder) WriteHeader(status int) {
+	recorder.status = status
+	recorder.ResponseWriter.WriteHeader(status)
+}
+
+// cappedBuffer keeps the first maxLoggedBody bytes written to it.
+type cappedBuffer struct {
+	data []byte
+	size int
+}
+
+func (buffer *cappedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	buffer.size += n
+	if room := maxLoggedBody - len(buffer.data); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		buffer.data = append(buffer.data, p...)
+	}
+	return n, nil
+}
+
+// String returns the buffered text, or the size of the data if it isn't
+// text.
+func (buffer *cappedBuffer) String() string {
+	text := buffer.data
+	if buffer.size > len(text) {
+		// The cap may have cut a character short.
+		for i := 0; i < utf8.UTFMax-1 && len(text) > 0 && !utf8.Valid(text); i++ {
+			text = text[:len(text)-1]
+		}
+	}
+	switch {
+	case buffer.size == 0:
+		return ""
+	case !utf8.Valid(text):
+		return fmt.Sprintf("[%d bytes]", buffer.size)
+	case buffer.size > len(text):
+		return fmt.Sprintf("%s... [%d bytes]", text, buffer.size)
+	}
+	return string(text)
+}
+
+// readCloser reads from a Reader and closes a Closer.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,110 @@
+package captionbottest
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// ErrFake is the error a FakeCaptioner fails with unless told otherwise.
+var ErrFake = errors.New("captionbottest: fake captioning failure")
+
+var (
+	subjects = []string{"a cat", "a dog", "a man", "a woman", "a group of people", "a bird", "a car", "a train", "a child", "a horse"}
+	actions  = []string{"sitting", "standing", "lying", "walking", "playing", "riding a bicycle", "eating", "looking at the camera"}
+	places   = []string{"on a couch", "in a field", "on a beach", "in front of a building", "next to a tree", "on a city street", "in a kitchen", "in the snow"}
+)
+
+// FakeCaptioner is a captionbot.Captioner for soak tests that needs no
+// network. Each image gets a caption chosen by a hash of its URL or data,
+// so the same image is always captioned alike, and latency and failures
+// can be configured, also chosen by the hash. Set its fields before
+// using it; it is safe for concurrent use.
+type FakeCaptioner struct {
+	// Captions, if set, are the captions to choose from instead of
+	// generated ones.
+	Captions []string
+	// Latency is how long each caption takes, plus up to Jitter more.
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the fraction of images, from 0 to 1, that fail to
+	// caption with Err, or ErrFake if it is nil.
+	ErrorRate float64
+	Err       error
+
+	mu    sync.Mutex
+	calls int
+}
+
+var _ captionbot.Captioner = (*FakeCaptioner)(nil)
+
+// CaptionURL captions the image at url from url alone.
+func (fake *FakeCaptioner) CaptionURL(url string) (string, error) {
+	return fake.caption(sha256.Sum256([]byte(url)))
+}
+
+// CaptionReader captions image data.
+func (fake *FakeCaptioner) CaptionReader(r io.Reader, name string) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return fake.caption(sum)
+}
+
+// Check implements server.Checker; a FakeCaptioner is always reachable.
+func (fake *FakeCaptioner) Check() error {
+	return nil
+}
+
+// Rate implements server.Rater, accepting any rating.
+func (fake *FakeCaptioner) Rate(caption string, rating int) error {
+	return nil
+}
+
+// Calls returns the number of captions asked for, failed ones included.
+func (fake *FakeCaptioner) Calls() int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return fake.calls
+}
+
+// caption makes the caption of the image whose hash is sum.
+func (fake *FakeCaptioner) caption(sum [sha256.Size]byte) (string, error) {
+	fake.mu.Lock()
+	fake.calls++
+	fake.mu.Unlock()
+
+	// Separate parts of the hash choose the delay, failure and caption,
+	// so that they don't correlate.
+	if fake.Latency > 0 || fake.Jitter > 0 {
+		delay := fake.Latency
+		if fake.Jitter > 0 {
+			delay += time.Duration(binary.BigEndian.Uint64(sum[0:8]) % uint64(fake.Jitter))
+		}
+		time.Sleep(delay)
+	}
+	if fake.ErrorRate > 0 && float64(binary.BigEndian.Uint64(sum[8:16])>>11)/(1<<53) < fake.ErrorRate {
+		if fake.Err != nil {
+			return "", fake.Err
+		}
+		return "", ErrFake
+	}
+	n := binary.BigEndian.Uint64(sum[16:24])
+	if len(fake.Captions) > 0 {
+		return fake.Captions[n%uint64(len(fake.Captions))], nil
+	}
+	subject := subjects[n%uint64(len(subjects))]
+	n /= uint64(len(subjects))
+	action := actions[n%uint64(len(actions))]
+	n /= uint64(len(actions))
+	return fmt.Sprintf("%s %s %s", subject, action, places[n%uint64(len(places))]), nil
+}
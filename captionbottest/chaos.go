@@ -0,0 +1,228 @@
+package captionbottest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fault is a kind of failure a ChaosTransport injects.
+type Fault string
+
+// The faults a ChaosTransport injects, as ChaosTransport describes them.
+const (
+	FaultTimeout     Fault = "timeout"
+	FaultBurst       Fault = "burst"
+	FaultSlow        Fault = "slow"
+	FaultPartialBody Fault = "partial-body"
+	FaultMalformed   Fault = "malformed"
+)
+
+// timeoutError is the error of an injected timeout, a net.Error like
+// those of real ones.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "captionbottest: injected timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// ChaosTransport is an http.RoundTripper that injects faults into the
+// requests it sends, each with its own probability, for checking that
+// retries and circuit breakers behave as intended. Requests are faulted
+// as follows, with one fault at most before sending and one after:
+//
+//   - timeouts: the request fails with a timeout error after Timeout, or
+//     when its context ends if that is sooner
+//   - bursts: BurstLength requests in a row are answered BurstStatus
+//   - slow responses: the request is sent after SlowDelay
+//   - partial bodies: the response body ends early with
+//     io.ErrUnexpectedEOF
+//   - malformed JSON: the response body, or the JSON inside the
+//     JSON string captionbot.ai answers with, is cut short
+//
+// The same Seed injects the same faults into the same requests. Set its
+// fields before using it; it is safe for concurrent use.
+type ChaosTransport struct {
+	// Transport sends the requests, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+	// Seed seeds the choice of faults.
+	Seed int64
+
+	TimeoutRate float64
+	Timeout     time.Duration
+
+	BurstRate   float64
+	BurstLength int
+	// BurstStatus is the status bursts answer, 503 if zero.
+	BurstStatus int
+
+	SlowRate  float64
+	SlowDelay time.Duration
+
+	PartialBodyRate float64
+	MalformedRate   float64
+
+	mu       sync.Mutex
+	rand     *rand.Rand
+	burst    int
+	injected map[Fault]int
+}
+
+// Use makes http.DefaultClient send its requests through the
+// ChaosTransport, returning a function that undoes it.
+func (chaos *ChaosTransport) Use() func() {
+	previous := http.DefaultClient.Transport
+	http.DefaultClient.Transport = chaos
+	return func() { http.DefaultClient.Transport = previous }
+}
+
+// Injected returns the number of each fault injected so far.
+func (chaos *ChaosTransport) Injected() map[Fault]int {
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	injected := map[Fault]int{}
+	for fault, n := range chaos.injected {
+		injected[fault] = n
+	}
+	return injected
+}
+
+// roll chooses the faults of a request, before and after sending it.
+func (chaos *ChaosTransport) roll() (before, after Fault) {
+	chaos.mu.Lock()
+	defer chaos.mu.Unlock()
+	if chaos.rand == nil {
+		chaos.rand = rand.New(rand.NewSource(chaos.Seed))
+		chaos.injected = map[Fault]int{}
+	}
+	// Every roll is made each time, so that one fault's rate doesn't
+	// change which requests the others hit.
+	timeout := chaos.rand.Float64() < chaos.TimeoutRate
+	burst := chaos.rand.Float64() < chaos.BurstRate
+	slow := chaos.rand.Float64() < chaos.SlowRate
+	partial := chaos.rand.Float64() < chaos.PartialBodyRate
+	malformed := chaos.rand.Float64() < chaos.MalformedRate
+
+	switch {
+	case chaos.burst > 0:
+		chaos.burst--
+		before = FaultBurst
+	case timeout:
+		before = FaultTimeout
+	case burst && chaos.BurstLength > 0:
+		chaos.burst = chaos.BurstLength - 1
+		before = FaultBurst
+	case slow:
+		before = FaultSlow
+	}
+	switch {
+	case before == FaultTimeout || before == FaultBurst:
+	case partial:
+		after = FaultPartialBody
+	case malformed:
+		after = FaultMalformed
+	}
+	for _, fault := range []Fault{before, after} {
+		if fault != "" {
+			chaos.injected[fault]++
+		}
+	}
+	return before, after
+}
+
+// RoundTrip implements http.RoundTripper.
+func (chaos *ChaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	before, after := chaos.roll()
+	switch before {
+	case FaultTimeout:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		if err := sleep(req, chaos.Timeout); err != nil {
+			return nil, err
+		}
+		return nil, timeoutError{}
+	case FaultBurst:
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		status := chaos.BurstStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		return &http.Response{
+			Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+			StatusCode: status,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{},
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	case FaultSlow:
+		if err := sleep(req, chaos.SlowDelay); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+	}
+
+	transport := chaos.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil || after == "" {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	switch after {
+	case FaultPartialBody:
+		resp.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body[:len(body)/2]), errReader{io.ErrUnexpectedEOF}))
+	case FaultMalformed:
+		resp.Body = io.NopCloser(bytes.NewReader(malform(body)))
+	}
+	return resp, nil
+}
+
+// sleep waits for d or until req's context ends.
+func sleep(req *http.Request, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	}
+}
+
+// malform cuts JSON short. A JSON string holding JSON, as captionbot.ai
+// answers, stays a valid string holding broken JSON.
+func malform(body []byte) []byte {
+	var inner string
+	if err := json.Unmarshal(body, &inner); err == nil && strings.HasPrefix(inner, "{") {
+		data, _ := json.Marshal(inner[:len(inner)/2])
+		return data
+	}
+	return body[:len(body)/2]
+}
+
+// errReader fails every read with err.
+type errReader struct{ err error }
+
+func (reader errReader) Read([]byte) (int, error) { return 0, reader.err }
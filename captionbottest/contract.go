@@ -0,0 +1,315 @@
+package captionbottest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// ContractEnv is the environment variable that opts in to checking the
+// contract of the live service in tests, since it needs the network and
+// captionbot.ai to be up.
+const ContractEnv = "CAPTIONBOT_CONTRACT"
+
+// messageFields are the fields of a /message response, as
+// captionbot.CaptionBotResponse expects them, and the JSON kinds they
+// may have.
+var messageFields = map[string][]string{
+	"ConversationID": {"string"},
+	"UserMessage":    {"string"},
+	"WaterMark":      {"string"},
+	"Status":         {"string", "null"},
+	"BotMessages":    {"array"},
+}
+
+// Drift is a way the service's answers differ from what the captionbot
+// package expects.
+type Drift struct {
+	// Endpoint is the request, such as "GET /message".
+	Endpoint string `json:"endpoint"`
+	// Kind is "status", "encoding", "new field", "missing field", "type"
+	// or "value".
+	Kind   string `json:"kind"`
+	Detail string `json:"detail"`
+}
+
+func (drift Drift) String() string {
+	return fmt.Sprintf("%s: %s: %s", drift.Endpoint, drift.Kind, drift.Detail)
+}
+
+// ContractReport is the result of CheckContract.
+type ContractReport struct {
+	// Checked lists the requests made.
+	Checked []string `json:"checked"`
+	Drifts  []Drift  `json:"drifts,omitempty"`
+}
+
+// contractCheck makes the requests of a contract check.
+type contractCheck struct {
+	base   string
+	report *ContractReport
+}
+
+func (check *contractCheck) drift(endpoint, kind, format string, args ...interface{}) {
+	check.report.Drifts = append(check.report.Drifts, Drift{Endpoint: endpoint, Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// do makes a request and returns its body if it answered 2xx, recording
+// drift if not.
+func (check *contractCheck) do(endpoint string, req *http.Request) ([]byte, bool, error) {
+	check.report.Checked = append(check.report.Checked, endpoint)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		check.drift(endpoint, "status", "answered %s", resp.Status)
+		return nil, false, nil
+	}
+	return body, true, nil
+}
+
+// jsonString decodes a body that should be a JSON string, recording
+// drift if it isn't.
+func (check *contractCheck) jsonString(endpoint string, body []byte) (string, bool) {
+	var s string
+	if err := json.Unmarshal(body, &s); err != nil {
+		check.drift(endpoint, "encoding", "answered %s, not a JSON string", jsonKind(body))
+		return "", false
+	}
+	return s, true
+}
+
+// CheckContract captions imageURL, and uploads the image file at
+// imagePath if it isn't empty, with the service at captionbot.BaseURL,
+// reporting how its answers drift from what the captionbot package
+// expects: other statuses, encodings, fields or types. An error means
+// the check couldn't be made, such as for a network failure.
+func CheckContract(imageURL, imagePath string) (*ContractReport, error) {
+	check := &contractCheck{
+		base:   strings.TrimRight(captionbot.BaseURL, "/") + "/",
+		report: &ContractReport{},
+	}
+
+	req, err := http.NewRequest("GET", check.base+"init", nil)
+	if err != nil {
+		return nil, err
+	}
+	body, ok, err := check.do("GET /init", req)
+	if err != nil || !ok {
+		return check.report, err
+	}
+	conversationID, ok := check.jsonString("GET /init", body)
+	if !ok {
+		return check.report, nil
+	}
+	if conversationID == "" {
+		check.drift("GET /init", "value", "the conversation ID is empty")
+	}
+
+	waterMark, err := check.caption(conversationID, "", imageURL)
+	if err != nil || imagePath == "" {
+		return check.report, err
+	}
+
+	uploaded, err := check.upload(imagePath)
+	if err != nil || uploaded == "" {
+		return check.report, err
+	}
+	_, err = check.caption(conversationID, waterMark, uploaded)
+	return check.report, err
+}
+
+// caption checks captioning an image by URL, returning the new
+// watermark.
+func (check *contractCheck) caption(conversationID, waterMark, image string) (string, error) {
+	var data bytes.Buffer
+	json.NewEncoder(&data).Encode(captionbot.CaptionBotRequest{
+		ConversationID: conversationID,
+		UserMessage:    image,
+		WaterMark:      waterMark,
+	})
+	req, err := http.NewRequest("POST", check.base+"message", &data)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf8")
+	if _, ok, err := check.do("POST /message", req); err != nil || !ok {
+		return "", err
+	}
+
+	v := url.Values{}
+	v.Set("conversationID", conversationID)
+	v.Set("userMessage", image)
+	v.Set("waterMark", waterMark)
+	req, err = http.NewRequest("GET", check.base+"message?"+v.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	const endpoint = "GET /message"
+	body, ok, err := check.do(endpoint, req)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	var inner string
+	if err := json.Unmarshal(body, &inner); err == nil {
+		body = []byte(inner)
+	} else {
+		check.drift(endpoint, "encoding", "answered %s, not JSON encoded in a JSON string", jsonKind(body))
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		check.drift(endpoint, "encoding", "the response is %s, not a JSON object", jsonKind(body))
+		return "", nil
+	}
+
+	names := make([]string, 0, len(fields)+len(messageFields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	for name := range messageFields {
+		if _, ok := fields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	typeDrift := false
+	for _, name := range names {
+		raw, present := fields[name]
+		kinds, known := messageFields[name]
+		switch {
+		case !known:
+			check.drift(endpoint, "new field", "%s (%s)", name, jsonKind(raw))
+		case !present:
+			check.drift(endpoint, "missing field", "%s", name)
+		case !contains(kinds, jsonKind(raw)):
+			typeDrift = true
+			check.drift(endpoint, "type", "%s is %s, not %s", name, jsonKind(raw), strings.Join(kinds, " or "))
+		}
+	}
+
+	var response captionbot.CaptionBotResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		if !typeDrift {
+			check.drift(endpoint, "type", "%s", err)
+		}
+		return "", nil
+	}
+	if response.ConversationID != "" && response.ConversationID != conversationID {
+		check.drift(endpoint, "value", "ConversationID %q isn't the one /init gave", response.ConversationID)
+	}
+	switch {
+	case len(response.BotMessages) < 2:
+		check.drift(endpoint, "value", "BotMessages has %d messages, not the image and its caption", len(response.BotMessages))
+	case response.BotMessages[0] != image:
+		check.drift(endpoint, "value", "BotMessages doesn't start with the image's URL")
+	case response.BotMessages[1] == "":
+		check.drift(endpoint, "value", "the caption is empty")
+	}
+	return response.WaterMark, nil
+}
+
+// upload checks uploading an image, returning the URL it is uploaded to.
+func (check *contractCheck) upload(imagePath string) (string, error) {
+	image, err := os.ReadFile(imagePath)
+	if err != nil {
+		return "", err
+	}
+	var data bytes.Buffer
+	writer := multipart.NewWriter(&data)
+	part, err := writer.CreateFormFile("file", filepath.Base(imagePath))
+	if err != nil {
+		return "", err
+	}
+	part.Write(image)
+	writer.Close()
+	req, err := http.NewRequest("POST", check.base+"upload", &data)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+
+	const endpoint = "POST /upload"
+	body, ok, err := check.do(endpoint, req)
+	if err != nil || !ok {
+		return "", err
+	}
+	uploaded, ok := check.jsonString(endpoint, body)
+	if !ok {
+		return "", nil
+	}
+	if u, err := url.Parse(uploaded); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		check.drift(endpoint, "value", "%q isn't an image URL", uploaded)
+		return "", nil
+	}
+	return uploaded, nil
+}
+
+// RunContract checks the contract of the live service from a test, and
+// fails the test for each drift. It skips the test unless $CAPTIONBOT_CONTRACT
+// is set, so that it only runs when asked to:
+//
+//	func TestContract(t *testing.T) {
+//		captionbottest.RunContract(t, "https://example.com/cat.jpg", "testdata/cat.jpg")
+//	}
+func RunContract(t testing.TB, imageURL, imagePath string) {
+	t.Helper()
+	if os.Getenv(ContractEnv) == "" {
+		t.Skipf("set $%s to check the contract of captionbot.ai", ContractEnv)
+	}
+	report, err := CheckContract(imageURL, imagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, drift := range report.Drifts {
+		t.Error(drift)
+	}
+}
+
+// jsonKind returns the kind of a JSON value: "string", "number",
+// "object", "array", "bool", "null", or "invalid JSON".
+func jsonKind(raw []byte) string {
+	raw = bytes.TrimSpace(raw)
+	if !json.Valid(raw) {
+		return "invalid JSON"
+	}
+	switch raw[0] {
+	case '"':
+		return "string"
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "bool"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
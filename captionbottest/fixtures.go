@@ -0,0 +1,92 @@
+package captionbottest
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// fixtures holds raw response bodies in the shapes captionbot.ai answers.
+//
+//go:embed fixtures/*.json
+var fixtures embed.FS
+
+// Fixture returns a raw response body of captionbot.ai by name, for
+// testing code that parses them, such as captionbot.ParseMessageResponse:
+//
+//	init                an /init conversation ID, a JSON string
+//	upload              an /upload image URL, a JSON string
+//	message             a /message caption, JSON encoded twice
+//	message-unicode     a caption with an emoji, escaped in the inner JSON
+//	message-status      a caption with a Status set
+//	message-once        a caption encoded once, as the service sometimes answers
+//	message-twice       a caption encoded three times
+//	message-unquoted    a caption whose escapes are left without the string around them
+//	message-newlines    a caption with escaped newlines between its JSON tokens
+//	message-no-caption  a response with no caption, which is an error
+//
+// It panics if there is no such fixture.
+func Fixture(name string) []byte {
+	data, err := fixtures.ReadFile("fixtures/" + name + ".json")
+	if err != nil {
+		panic(fmt.Sprintf("captionbottest: no fixture %q", name))
+	}
+	return data
+}
+
+// FixtureNames returns the names of the fixtures whose names start with
+// prefix, such as "message", in order.
+func FixtureNames(prefix string) []string {
+	entries, _ := fs.ReadDir(fixtures, "fixtures")
+	var names []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// LoadCassette loads a cassette a Recorder saved.
+func LoadCassette(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return &cassette, nil
+}
+
+// ResponseBodies returns the raw bodies of the responses to method
+// requests to endpoint, such as "message", in the order recorded, to
+// test parsing against payloads recorded from the live service.
+func (cassette *Cassette) ResponseBodies(method, endpoint string) [][]byte {
+	var bodies [][]byte
+	for _, interaction := range cassette.Interactions {
+		if interaction.Request.Method != method {
+			continue
+		}
+		u, err := url.Parse(interaction.Request.URL)
+		if err != nil || endpointOf(u.Path) != endpoint {
+			continue
+		}
+		response := interaction.Response
+		bodies = append(bodies, joinBody(response.Body, response.BinaryBody))
+	}
+	return bodies
+}
+
+// endpointOf returns the endpoint a captionbot.ai URL path names,
+// ignoring the doubled slashes the captionbot package sends.
+func endpointOf(urlPath string) string {
+	urlPath = strings.TrimRight(urlPath, "/")
+	return urlPath[strings.LastIndex(urlPath, "/")+1:]
+}
@@ -0,0 +1,269 @@
+package captionbottest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Mode is what a Recorder does with requests.
+type Mode int
+
+const (
+	// ModeReplay answers requests from the cassette, failing those it
+	// has no recording for.
+	ModeReplay Mode = iota
+	// ModeRecord sends requests to the live service and records them,
+	// replacing the cassette when saved.
+	ModeRecord
+	// ModeAuto replays the cassette if it exists, and records one if not.
+	ModeAuto
+)
+
+// DefaultScrubHeaders are the headers a Recorder scrubs unless told
+// otherwise, those that usually carry credentials.
+var DefaultScrubHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// scrubbed replaces the values of scrubbed headers.
+const scrubbed = "[scrubbed]"
+
+// Cassette is a file of recorded interactions.
+type Cassette struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Interaction is one recorded request and its response.
+type Interaction struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+// RecordedRequest is a request as recorded. Body holds a text body and
+// BinaryBody any other.
+type RecordedRequest struct {
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BinaryBody []byte      `json:"binary_body,omitempty"`
+}
+
+// RecordedResponse is a response as recorded.
+type RecordedResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header,omitempty"`
+	Body       string      `json:"body,omitempty"`
+	BinaryBody []byte      `json:"binary_body,omitempty"`
+}
+
+// Recorder is an http.RoundTripper that records interactions with the
+// live captionbot.ai to a cassette file and replays them later, so tests
+// don't depend on the service being up. The captionbot package sends its
+// requests with http.DefaultClient, so Use installs the Recorder there:
+//
+//	rec, err := captionbottest.NewRecorder("testdata/caption.json", captionbottest.ModeAuto)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer rec.Use()()
+//	defer rec.Save()
+//
+// Replayed requests are matched to the first unused recording with the
+// same method, URL and body, or failing that the same method and URL, as
+// multipart uploads differ in their boundaries. Headers in ScrubHeaders
+// are scrubbed from what is recorded.
+type Recorder struct {
+	// Path is the cassette file.
+	Path string
+	// Mode is what the Recorder does, resolved from ModeAuto by
+	// NewRecorder.
+	Mode Mode
+	// Transport sends recorded requests, http.DefaultTransport if nil.
+	Transport http.RoundTripper
+	// ScrubHeaders are the headers whose values aren't recorded.
+	ScrubHeaders []string
+
+	mu       sync.Mutex
+	cassette Cassette
+	used     []bool
+}
+
+// NewRecorder creates a Recorder for the cassette at path, loading it
+// unless recording.
+func NewRecorder(path string, mode Mode) (*Recorder, error) {
+	recorder := &Recorder{Path: path, Mode: mode, ScrubHeaders: DefaultScrubHeaders}
+	if mode == ModeAuto {
+		recorder.Mode = ModeReplay
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			recorder.Mode = ModeRecord
+		}
+	}
+	if recorder.Mode == ModeRecord {
+		return recorder, nil
+	}
+	cassette, err := LoadCassette(path)
+	if err != nil {
+		return nil, err
+	}
+	recorder.cassette = *cassette
+	recorder.used = make([]bool, len(recorder.cassette.Interactions))
+	return recorder, nil
+}
+
+// Use makes http.DefaultClient send its requests through the Recorder,
+// returning a function that undoes it.
+func (recorder *Recorder) Use() func() {
+	previous := http.DefaultClient.Transport
+	http.DefaultClient.Transport = recorder
+	return func() { http.DefaultClient.Transport = previous }
+}
+
+// Save writes the recorded interactions to the cassette file. It does
+// nothing when replaying.
+func (recorder *Recorder) Save() error {
+	if recorder.Mode != ModeRecord {
+		return nil
+	}
+	recorder.mu.Lock()
+	data, err := json.MarshalIndent(recorder.cassette, "", "  ")
+	recorder.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(recorder.Path, append(data, '\n'), 0644)
+}
+
+// RoundTrip implements http.RoundTripper.
+func (recorder *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	if recorder.Mode == ModeRecord {
+		return recorder.record(req, body)
+	}
+	return recorder.replay(req, body)
+}
+
+// record sends req to the live service and records the interaction.
+func (recorder *Recorder) record(req *http.Request, body []byte) (*http.Response, error) {
+	transport := recorder.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(respBody))
+
+	interaction := Interaction{
+		Request: RecordedRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: recorder.scrub(req.Header),
+		},
+		Response: RecordedResponse{
+			StatusCode: resp.StatusCode,
+			Header:     recorder.scrub(resp.Header),
+		},
+	}
+	interaction.Request.Body, interaction.Request.BinaryBody = splitBody(body)
+	interaction.Response.Body, interaction.Response.BinaryBody = splitBody(respBody)
+	recorder.mu.Lock()
+	recorder.cassette.Interactions = append(recorder.cassette.Interactions, interaction)
+	recorder.mu.Unlock()
+	return resp, nil
+}
+
+// replay answers req with the recording it matches.
+func (recorder *Recorder) replay(req *http.Request, body []byte) (*http.Response, error) {
+	url := req.URL.String()
+	recorder.mu.Lock()
+	match := -1
+	for i, interaction := range recorder.cassette.Interactions {
+		recorded := interaction.Request
+		if recorder.used[i] || recorded.Method != req.Method || recorded.URL != url {
+			continue
+		}
+		if bytes.Equal(joinBody(recorded.Body, recorded.BinaryBody), body) {
+			match = i
+			break
+		}
+		if match < 0 {
+			match = i
+		}
+	}
+	if match < 0 {
+		recorder.mu.Unlock()
+		return nil, fmt.Errorf("captionbottest: %s has no recording of %s %s", recorder.Path, req.Method, url)
+	}
+	recorder.used[match] = true
+	recorded := recorder.cassette.Interactions[match].Response
+	recorder.mu.Unlock()
+
+	respBody := joinBody(recorded.Body, recorded.BinaryBody)
+	header := recorded.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", recorded.StatusCode, http.StatusText(recorded.StatusCode)),
+		StatusCode:    recorded.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// scrub copies header with the values of ScrubHeaders replaced.
+func (recorder *Recorder) scrub(header http.Header) http.Header {
+	header = header.Clone()
+	for name := range header {
+		for _, scrub := range recorder.ScrubHeaders {
+			if strings.EqualFold(name, scrub) {
+				for i := range header[name] {
+					header[name][i] = scrubbed
+				}
+			}
+		}
+	}
+	return header
+}
+
+// splitBody returns body as text if it is UTF-8, and as binary if not.
+func splitBody(body []byte) (string, []byte) {
+	if utf8.Valid(body) {
+		return string(body), nil
+	}
+	return "", body
+}
+
+// joinBody returns the body a split one holds.
+func joinBody(text string, binary []byte) []byte {
+	if binary != nil {
+		return binary
+	}
+	return []byte(text)
+}
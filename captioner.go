@@ -0,0 +1,142 @@
+package captionbot
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Captioner captions images, by URL or from their data. A CaptionBot is
+// one, captioning with captionbot.ai; other services can stand in for it,
+// such as Azure AI Vision with the provider/azure package, and a Fallback
+// tries several in turn. It has the methods of server.Captioner, so any
+// Captioner safe for concurrent use can back a server.
+type Captioner interface {
+	CaptionURL(url string) (string, error)
+	// CaptionReader captions image data. name is the image's file name,
+	// whose extension gives its type.
+	CaptionReader(r io.Reader, name string) (string, error)
+}
+
+// ContextCaptioner is a Captioner that also captions with a context,
+// whose cancellation abandons the caption's requests. A CaptionBot and an
+// azure.Client are ContextCaptioners.
+type ContextCaptioner interface {
+	Captioner
+	CaptionURLContext(ctx context.Context, url string) (string, error)
+	CaptionReaderContext(ctx context.Context, r io.Reader, name string) (string, error)
+}
+
+var _ ContextCaptioner = (*CaptionBot)(nil)
+
+// CaptionURL captions the image at url, as URLCaption does.
+func (captionBot *CaptionBot) CaptionURL(url string) (string, error) {
+	return captionBot.URLCaption(url)
+}
+
+// CaptionReader captions the image read from r, as UploadCaptionReader
+// does.
+func (captionBot *CaptionBot) CaptionReader(r io.Reader, name string) (string, error) {
+	return captionBot.UploadCaptionReader(r, name)
+}
+
+// CaptionURLContext captions the image at url, as URLCaptionContext does.
+func (captionBot *CaptionBot) CaptionURLContext(ctx context.Context, url string) (string, error) {
+	return captionBot.URLCaptionContext(ctx, url)
+}
+
+// CaptionReaderContext captions the image read from r, as
+// UploadCaptionReaderContext does.
+func (captionBot *CaptionBot) CaptionReaderContext(ctx context.Context, r io.Reader, name string) (string, error) {
+	return captionBot.UploadCaptionReaderContext(ctx, r, name)
+}
+
+// Serial is a Captioner making one caption at a time with Bot, so that
+// handlers on many goroutines can share it: a CaptionBot holds a single
+// conversation.
+type Serial struct {
+	Bot *CaptionBot
+
+	mu sync.Mutex
+}
+
+var _ Captioner = (*Serial)(nil)
+
+// NewSerial creates a Serial for bot.
+func NewSerial(bot *CaptionBot) *Serial {
+	return &Serial{Bot: bot}
+}
+
+// CaptionURL captions the image at url once no other caption is being
+// made.
+func (serial *Serial) CaptionURL(url string) (string, error) {
+	serial.mu.Lock()
+	defer serial.mu.Unlock()
+	return serial.Bot.URLCaption(url)
+}
+
+// CaptionReader captions the image read from r once no other caption is
+// being made.
+func (serial *Serial) CaptionReader(r io.Reader, name string) (string, error) {
+	serial.mu.Lock()
+	defer serial.mu.Unlock()
+	return serial.Bot.UploadCaptionReader(r, name)
+}
+
+// Do calls fn with Bot once no other caption is being made, for work that
+// mustn't interleave with captions, such as rating the last one.
+func (serial *Serial) Do(fn func(bot *CaptionBot) error) error {
+	serial.mu.Lock()
+	defer serial.mu.Unlock()
+	return fn(serial.Bot)
+}
+
+// ErrNoCaptioners is the error of a Fallback with no Captioners.
+var ErrNoCaptioners = errors.New("captionbot: no captioners")
+
+// Fallback is a Captioner that tries its Captioners in order and returns
+// the first caption one makes, or if none does, all of their errors
+// joined. It is safe for concurrent use if its Captioners are.
+type Fallback []Captioner
+
+var _ Captioner = Fallback(nil)
+
+// CaptionURL captions the image at url with the first Captioner that
+// can.
+func (fallback Fallback) CaptionURL(url string) (string, error) {
+	return fallback.caption(func(captioner Captioner) (string, error) {
+		return captioner.CaptionURL(url)
+	})
+}
+
+// CaptionReader captions the image read from r with the first Captioner
+// that can. The image is buffered, to send it again to the next.
+func (fallback Fallback) CaptionReader(r io.Reader, name string) (string, error) {
+	if len(fallback) == 1 {
+		return fallback[0].CaptionReader(r, name)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return fallback.caption(func(captioner Captioner) (string, error) {
+		return captioner.CaptionReader(bytes.NewReader(data), name)
+	})
+}
+
+func (fallback Fallback) caption(caption func(Captioner) (string, error)) (string, error) {
+	if len(fallback) == 0 {
+		return "", ErrNoCaptioners
+	}
+	var errs []error
+	for _, captioner := range fallback {
+		text, err := caption(captioner)
+		if err == nil {
+			return text, nil
+		}
+		errs = append(errs, err)
+	}
+	return "", errors.Join(errs...)
+}
@@ -0,0 +1,106 @@
+// Command captionbot-fakeserver serves a fake captionbot.ai, with a web
+// console of the requests it receives, for developing and demoing against
+// the captionbot package offline and in CI sandboxes.
+//
+// Usage:
+//
+//	captionbot-fakeserver [flags]
+//
+// Point the captionbot package at it by setting captionbot.BaseURL to
+// http://localhost:8089/api/, or the captionbot command by setting
+// $CAPTIONBOT_BASE_URL. The console is at http://localhost:8089/.
+package main
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+//go:embed console.html
+var consolePage []byte
+
+func main() {
+	addr := flag.String("addr", "localhost:8089", "address to listen on")
+	defaultCaption := flag.String("default-caption", captionbottest.DefaultCaption, "caption of images with none set")
+	delay := flag.Duration("delay", 0, "how long captions take")
+	captions := map[string]string{}
+	flag.Func("caption", "caption an image `IMAGE=CAPTION`, by URL or uploaded file name (repeatable)", func(value string) error {
+		image, caption, ok := strings.Cut(value, "=")
+		if !ok {
+			return fmt.Errorf("want IMAGE=CAPTION")
+		}
+		captions[image] = caption
+		return nil
+	})
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: captionbot-fakeserver [flags]\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fake := captionbottest.NewUnstartedServer()
+	fake.Listener.Close()
+	fake.Listener = lis
+	fake.SetDefaultCaption(*defaultCaption)
+	fake.SetDelay("message", *delay)
+	for image, caption := range captions {
+		fake.SetCaption(image, caption)
+	}
+
+	// A ServeMux would redirect the doubled slashes the captionbot
+	// package sends, so requests are routed here.
+	fake.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write(consolePage)
+		case "/console/requests":
+			requests := fake.Log()
+			if requests == nil {
+				requests = []captionbottest.LoggedRequest{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(requests)
+		default:
+			fake.ServeHTTP(w, r)
+		}
+	})
+	fake.Start()
+
+	log.Printf("fake captionbot.ai at http://%s/api/, console at http://%s/", lis.Addr(), lis.Addr())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	done := make(chan struct{})
+	go func() {
+		fake.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+	}
+}
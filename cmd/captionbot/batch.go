@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nhatbui/captionbot/batch"
+	"github.com/nhatbui/captionbot/notify"
+	"github.com/nhatbui/captionbot/pipeline"
+	"github.com/nhatbui/captionbot/source"
+	_ "github.com/nhatbui/captionbot/source/azblob"
+	_ "github.com/nhatbui/captionbot/source/b2"
+	_ "github.com/nhatbui/captionbot/source/dropbox"
+	_ "github.com/nhatbui/captionbot/source/flickr"
+	_ "github.com/nhatbui/captionbot/source/ftp"
+	_ "github.com/nhatbui/captionbot/source/gcs"
+	_ "github.com/nhatbui/captionbot/source/gdrive"
+	_ "github.com/nhatbui/captionbot/source/gphotos"
+	_ "github.com/nhatbui/captionbot/source/httpindex"
+	_ "github.com/nhatbui/captionbot/source/ipfs"
+	_ "github.com/nhatbui/captionbot/source/onedrive"
+	_ "github.com/nhatbui/captionbot/source/s3"
+	_ "github.com/nhatbui/captionbot/source/sftp"
+	_ "github.com/nhatbui/captionbot/source/smb"
+	_ "github.com/nhatbui/captionbot/source/webdav"
+)
+
+func runBatch(args []string) error {
+	flags := flag.NewFlagSet("batch", flag.ExitOnError)
+	writeCaptions := flags.Bool("write", false, "store each caption on its object (metadata, tags or sidecar file)")
+	exif := flags.Bool("exif", false, "store each caption of a JPEG image in its EXIF ImageDescription")
+	manifest := flags.String("manifest", "", "store all results as a JSON object with this `name` in the source")
+	jsonOutput := flags.Bool("json", false, "print results as JSON lines")
+	webhooks := flags.String("notify", "", "comma-separated webhook URLs to POST each result to, signed with $CAPTIONBOT_WEBHOOK_SECRET")
+	seen := flags.String("seen", "", "skip images captioned in earlier runs, whose content hashes are kept in this `file`")
+	workers := flags.Int("workers", 1, "images to caption at once, each worker with its own captionbot.ai session")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot batch [flags] SOURCE\n\n")
+		fmt.Fprintf(flags.Output(), "SOURCE is a local directory or a URL with one of the schemes: %s\n\n", strings.Join(source.Schemes(), ", "))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	src, err := source.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	job := batch.NewJob().From(src).WithWorkers(*workers)
+
+	if *writeCaptions {
+		captionWriter, ok := src.(source.CaptionWriter)
+		if !ok {
+			return fmt.Errorf("%s can't store captions", flags.Arg(0))
+		}
+		job.Then(pipeline.WriteCaptions(captionWriter))
+	}
+	if *exif {
+		fileWriter, ok := src.(source.FileWriter)
+		if !ok {
+			return fmt.Errorf("%s can't store images", flags.Arg(0))
+		}
+		job.Then(pipeline.WriteEXIF(src, fileWriter))
+	}
+	if *manifest != "" {
+		fileWriter, ok := src.(source.FileWriter)
+		if !ok {
+			return fmt.Errorf("%s can't store a manifest", flags.Arg(0))
+		}
+		job.To(pipeline.ManifestSink(fileWriter, *manifest))
+	}
+
+	if urls := splitList(*webhooks); len(urls) > 0 {
+		notifier := notify.New(os.Getenv("CAPTIONBOT_WEBHOOK_SECRET"), urls...)
+		job.To(pipeline.SinkFunc(func(result pipeline.Result) error {
+			event := notify.NewEvent(result.Object.Key, result.Caption, result.Err, time.Now().Add(-result.Took))
+			if err := notifier.Notify(event); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", result.Object.Key, err)
+			}
+			return nil
+		}))
+	}
+
+	job.To(pipeline.SinkFunc(func(result pipeline.Result) error {
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", result.Object.Key, result.Err)
+		} else if !*jsonOutput {
+			fmt.Printf("%s\t%s\n", result.Object.Key, result.Caption)
+		}
+		return nil
+	}))
+	if *jsonOutput {
+		job.To(pipeline.JSONSink(os.Stdout))
+	}
+
+	if *seen != "" {
+		manifest, err := pipeline.OpenFileManifest(*seen)
+		if err != nil {
+			return err
+		}
+		defer manifest.Close()
+		job.SkipSeen(manifest)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return job.Run(ctx)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/pipeline"
+)
+
+// captionLine is a result of the url and file commands as --json prints
+// it.
+type captionLine struct {
+	Input   string `json:"input"`
+	Caption string `json:"caption,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func runURL(args []string) error {
+	return runCaption("url", "URL", args, func(url string, emit func(pipeline.Item) error) error {
+		return emit(pipeline.Item{Key: url, URL: url})
+	})
+}
+
+func runFile(args []string) error {
+	return runCaption("file", "PATH", args, func(pattern string, emit func(pipeline.Item) error) error {
+		for _, path := range expandGlob(pattern) {
+			err := emit(pipeline.Item{Key: path, Open: func() (io.ReadCloser, error) {
+				return os.Open(path)
+			}})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// runCaption runs the url or file command, captioning the items items
+// makes of its arguments, or of the lines of stdin if it has none, and
+// printing each result as it finishes.
+func runCaption(name, arg string, args []string, items func(input string, emit func(pipeline.Item) error) error) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print results as JSON lines")
+	concurrency := flags.Int("concurrency", 1, "images to caption at once, each with its own captionbot.ai session")
+	retries := flags.Int("retries", 2, "times to retry a caption that fails for a reason that may pass")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot %s [flags] [%s...]\n\n", name, arg)
+		fmt.Fprintf(flags.Output(), "Prints the caption of each %s, read one per line from stdin if none are\n", arg)
+		if name == "file" {
+			fmt.Fprintf(flags.Output(), "given. Glob patterns such as 'photos/*.jpg' are expanded.\n\n")
+		} else {
+			fmt.Fprintf(flags.Output(), "given.\n\n")
+		}
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	inputs := flags.Args()
+	if len(inputs) == 0 {
+		if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			flags.Usage()
+			os.Exit(2)
+		}
+	}
+	src := pipeline.SourceFunc(func(ctx context.Context, emit func(pipeline.Item) error) error {
+		if len(inputs) > 0 {
+			for _, input := range inputs {
+				if err := items(input, emit); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return readLines(ctx, os.Stdin, func(line string) error {
+			return items(line, emit)
+		})
+	})
+
+	enc := json.NewEncoder(os.Stdout)
+	total, failed := 0, 0
+	p := &pipeline.Pipeline{
+		Source: src,
+		NewCaptioner: func() (pipeline.Captioner, error) {
+			bot, err := captionbot.New(captionbot.WithRetry(*retries, time.Second))
+			if err != nil {
+				return nil, err
+			}
+			return bot, nil
+		},
+		Workers: *concurrency,
+		Sinks: []pipeline.Sink{pipeline.SinkFunc(func(result pipeline.Result) error {
+			total++
+			if result.Err != nil {
+				failed++
+				fmt.Fprintf(os.Stderr, "%s: %s\n", result.Key, result.Err)
+			}
+			if *jsonOutput {
+				line := captionLine{Input: result.Key, Caption: result.Caption}
+				if result.Err != nil {
+					line.Error = result.Err.Error()
+				}
+				return enc.Encode(line)
+			}
+			if result.Err == nil {
+				fmt.Printf("%s\t%s\n", result.Key, result.Caption)
+			}
+			return nil
+		})},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The first signal stops the run; a second one kills the process as
+	// usual, should stopping hang.
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	if err := p.Run(ctx); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d images failed", failed, total)
+	}
+	return nil
+}
+
+// readLines calls fn with each line of r that isn't blank, trimmed, as it
+// is read. Once ctx is done it returns ctx's error without waiting for a
+// read, such as of a terminal, to finish; the read is abandoned.
+func readLines(ctx context.Context, r io.Reader, fn func(line string) error) error {
+	lines := make(chan string)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				scanErr <- nil
+				return
+			}
+		}
+		scanErr <- scanner.Err()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case text, ok := <-lines:
+			if !ok {
+				if err := <-scanErr; err != nil {
+					return err
+				}
+				return ctx.Err()
+			}
+			if line := strings.TrimSpace(text); line != "" {
+				if err := fn(line); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// expandGlob returns the paths pattern matches, or pattern itself if it
+// matches none or isn't a valid pattern, so that opening it reports why.
+func expandGlob(pattern string) []string {
+	matches, err := filepath.Glob(pattern)
+	if err != nil || len(matches) == 0 {
+		return []string{pattern}
+	}
+	return matches
+}
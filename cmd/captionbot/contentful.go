@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/cms/contentful"
+)
+
+func runContentful(args []string) error {
+	flags := flag.NewFlagSet("contentful", flag.ExitOnError)
+	space := flags.String("space", "", "space ID (default $CONTENTFUL_SPACE_ID)")
+	environment := flags.String("env", "master", "environment ID")
+	token := flags.String("token", "", "management token (default $CONTENTFUL_MANAGEMENT_TOKEN)")
+	locales := flags.String("locales", "", "comma separated locales to fill (default: the space's default locale)")
+	entries := flags.String("entries", "", "caption entries instead of assets, as CONTENT_TYPE:IMAGE_FIELD:TEXT_FIELD")
+	publish := flags.Bool("publish", false, "republish items after updating them")
+	dryRun := flags.Bool("dry-run", false, "print captions without updating items")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot contentful [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(space, "CONTENTFUL_SPACE_ID")
+	envDefault(token, "CONTENTFUL_MANAGEMENT_TOKEN")
+
+	if *space == "" || *token == "" {
+		return fmt.Errorf("a space ID and management token are required")
+	}
+
+	opts := contentful.Options{Publish: *publish, DryRun: *dryRun}
+	if *locales != "" {
+		opts.Locales = strings.Split(*locales, ",")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+
+	report := func(result contentful.Result) {
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", result.Item.Sys.ID, result.Err)
+			return
+		}
+		for locale, caption := range result.Captions {
+			fmt.Printf("%s\t%s\t%s\n", result.Item.Sys.ID, locale, caption)
+		}
+	}
+
+	client := contentful.NewClient(*space, *environment, *token)
+	if *entries == "" {
+		return contentful.CaptionAssets(client, bot, opts, report)
+	}
+
+	parts := strings.Split(*entries, ":")
+	if len(parts) != 3 {
+		return fmt.Errorf("--entries must be CONTENT_TYPE:IMAGE_FIELD:TEXT_FIELD")
+	}
+	return contentful.CaptionEntries(client, bot, parts[0], parts[1], parts[2], opts, report)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+func runContract(args []string) error {
+	flags := flag.NewFlagSet("contract", flag.ExitOnError)
+	imageURL := flags.String("url", "https://www.nhatqbui.com/assets/me.jpg", "image `URL` to caption")
+	image := flags.String("image", "", "image `file` to also upload and caption")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot contract [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Calls captionbot.ai as the library does and reports how its answers have\n")
+		fmt.Fprintf(flags.Output(), "drifted from what the library expects, exiting 1 if they have.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	report, err := captionbottest.CheckContract(*imageURL, *image)
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		for _, endpoint := range report.Checked {
+			fmt.Printf("checked %s\n", endpoint)
+		}
+		for _, drift := range report.Drifts {
+			fmt.Printf("drift: %s\n", drift)
+		}
+	}
+	if len(report.Drifts) > 0 {
+		return fmt.Errorf("%d ways captionbot.ai has drifted", len(report.Drifts))
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/discord"
+	"github.com/nhatbui/captionbot/server"
+)
+
+func runDiscord(args []string) error {
+	flags := flag.NewFlagSet("discord", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	publicKey := flags.String("public-key", "", "application public key (default $DISCORD_PUBLIC_KEY)")
+	register := flags.String("register", "", "register commands for this application ID and exit")
+	botToken := flags.String("token", "", "bot token used by --register and --channels (default $DISCORD_BOT_TOKEN)")
+	channels := flags.String("channels", "", "comma-separated IDs of channels to caption every image posted in")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot discord [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(publicKey, "DISCORD_PUBLIC_KEY")
+	envDefault(botToken, "DISCORD_BOT_TOKEN")
+
+	if *register != "" {
+		if *botToken == "" {
+			return fmt.Errorf("a bot token is required to register commands")
+		}
+		return discord.RegisterCommands(nil, *register, *botToken)
+	}
+
+	if *publicKey == "" {
+		return fmt.Errorf("an application public key is required")
+	}
+	if *channels != "" && *botToken == "" {
+		return fmt.Errorf("a bot token is required to watch channels")
+	}
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	// A Session rates its captions as well as making them one at a time.
+	handler, err := discord.NewHandler(*publicKey, server.NewSession(bot))
+	if err != nil {
+		return err
+	}
+	if *channels != "" {
+		handler.BotToken = *botToken
+		handler.Channels = strings.Split(*channels, ",")
+		go func() {
+			log.Fatal(handler.Watch())
+		}()
+	}
+
+	http.Handle("/discord", handler)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/cms/ghost"
+)
+
+func runGhost(args []string) error {
+	flags := flag.NewFlagSet("ghost", flag.ExitOnError)
+	adminKey := flags.String("key", "", "Admin API key id:secret (default $GHOST_ADMIN_KEY)")
+	interval := flags.Duration("interval", time.Second, "minimum delay between Admin API calls")
+	logFile := flags.String("log", "", "append a JSON lines change log to this file")
+	dryRun := flags.Bool("dry-run", false, "print captions without updating posts")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot ghost [flags] SITE\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(adminKey, "GHOST_ADMIN_KEY")
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	site := flags.Arg(0)
+	if *adminKey == "" {
+		return fmt.Errorf("an Admin API key is required")
+	}
+
+	var changeLog io.Writer = io.Discard
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		changeLog = f
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+
+	client := ghost.NewClient(site, *adminKey, *interval)
+	return ghost.CaptionMissing(client, bot, *dryRun, func(result ghost.Result) {
+		for _, change := range result.Changes {
+			fmt.Printf("%s\t%s\t%s\n", result.Post.ID, change.Image, change.Caption)
+		}
+		if result.Err != nil {
+			fmt.Fprintf(os.Stderr, "post %s: %s\n", result.Post.ID, result.Err)
+			return
+		}
+		if result.Updated {
+			if err := ghost.WriteChangeLog(changeLog, result); err != nil {
+				fmt.Fprintf(os.Stderr, "writing change log: %s\n", err)
+			}
+		}
+	})
+}
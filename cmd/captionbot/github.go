@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/github"
+)
+
+func runGitHub(args []string) error {
+	flags := flag.NewFlagSet("github", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	appID := flags.Int64("app-id", 0, "GitHub App ID; authenticate as the app instead of with a token")
+	keyFile := flags.String("app-key", "", "GitHub App private key file")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot github [flags]\n")
+		fmt.Fprintf(flags.Output(), "The webhook secret is read from GITHUB_WEBHOOK_SECRET, and without --app-id a token from GITHUB_TOKEN.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	handler := &github.Handler{
+		Secret: os.Getenv("GITHUB_WEBHOOK_SECRET"),
+		Token:  os.Getenv("GITHUB_TOKEN"),
+	}
+	if handler.Secret == "" {
+		return fmt.Errorf("GITHUB_WEBHOOK_SECRET must be set")
+	}
+	if *appID != 0 {
+		key, err := os.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		if handler.App, err = github.NewApp(*appID, key); err != nil {
+			return err
+		}
+	} else if handler.Token == "" {
+		return fmt.Errorf("--app-id or GITHUB_TOKEN is required")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	handler.Captioner = captionbot.NewSerial(bot)
+
+	http.Handle("/github", handler)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/gitlab"
+)
+
+func runGitLab(args []string) error {
+	flags := flag.NewFlagSet("gitlab", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	baseURL := flags.String("url", "https://gitlab.com", "GitLab instance URL")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot gitlab [flags]\n")
+		fmt.Fprintf(flags.Output(), "The webhook secret token is read from GITLAB_WEBHOOK_SECRET and the access token from GITLAB_TOKEN.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	secret, token := os.Getenv("GITLAB_WEBHOOK_SECRET"), os.Getenv("GITLAB_TOKEN")
+	if secret == "" || token == "" {
+		return fmt.Errorf("GITLAB_WEBHOOK_SECRET and GITLAB_TOKEN must be set")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	handler := gitlab.NewHandler(secret, token, bot)
+	handler.BaseURL = *baseURL
+
+	http.Handle("/gitlab", handler)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
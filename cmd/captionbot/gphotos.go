@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/pipeline"
+	"github.com/nhatbui/captionbot/source"
+	"github.com/nhatbui/captionbot/source/gphotos"
+)
+
+// gphotosAlbum is one album of the manifest written by the gphotos command.
+type gphotosAlbum struct {
+	ID    string           `json:"id"`
+	Title string           `json:"title"`
+	Items []pipeline.Entry `json:"items"`
+}
+
+func runGPhotos(args []string) error {
+	flags := flag.NewFlagSet("gphotos", flag.ExitOnError)
+	albumID := flags.String("album", "", "caption only the album with this ID")
+	output := flags.String("o", "", "write the manifest to this file instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot gphotos [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Captions the images of every Google Photos album and prints an album to caption manifest.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	library, err := gphotos.NewLibrary()
+	if err != nil {
+		return err
+	}
+
+	albums := []*gphotos.Album{library.Album(*albumID)}
+	if *albumID == "" {
+		if albums, err = library.Albums(); err != nil {
+			return err
+		}
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	// Albums are written as they finish, rather than the whole library
+	// being held in memory.
+	sep := "[\n  "
+	for _, album := range albums {
+		entry := gphotosAlbum{ID: album.ID, Title: album.Title}
+		err := album.Walk(func(obj source.Object) error {
+			item := pipeline.Entry{Key: obj.Key}
+			if caption, err := source.Caption(bot, album, obj); err != nil {
+				item.Error = err.Error()
+				fmt.Fprintf(os.Stderr, "%s/%s: %s\n", album.Title, obj.Key, err)
+			} else {
+				item.Caption = caption
+			}
+			entry.Items = append(entry.Items, item)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("album %q: %s", album.Title, err)
+		}
+		data, err := json.MarshalIndent(entry, "  ", "  ")
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s%s", sep, data); err != nil {
+			return err
+		}
+		sep = ",\n  "
+	}
+	if sep == "[\n  " {
+		_, err = fmt.Fprintln(w, "[]")
+	} else {
+		_, err = fmt.Fprintln(w, "\n]")
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/mailbox"
+)
+
+func runIMAP(args []string) error {
+	flags := flag.NewFlagSet("imap", flag.ExitOnError)
+	smtpAddr := flags.String("smtp", "", "SMTP submission server host:port (STARTTLS)")
+	user := flags.String("user", "", "mailbox username (default $MAIL_USER)")
+	password := flags.String("password", "", "mailbox password (default $MAIL_PASSWORD)")
+	folder := flags.String("folder", "INBOX", "folder to watch")
+	from := flags.String("from", "", "sender address of replies (default the username)")
+	forward := flags.String("forward", "", "send captions to this address instead of replying")
+	interval := flags.Duration("interval", time.Minute, "how often to check for new mail")
+	once := flags.Bool("once", false, "check once and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot imap [flags] HOST:PORT\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(user, "MAIL_USER")
+	envDefault(password, "MAIL_PASSWORD")
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *smtpAddr == "" || *user == "" || *password == "" {
+		return fmt.Errorf("an SMTP server, username and password are required")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	m := &mailbox.Mailbox{
+		IMAPAddr:  flags.Arg(0),
+		SMTPAddr:  *smtpAddr,
+		Username:  *user,
+		Password:  *password,
+		Folder:    *folder,
+		From:      *from,
+		Forward:   *forward,
+		Captioner: bot,
+		Interval:  *interval,
+	}
+	if *once {
+		return m.Check()
+	}
+	return m.Run()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/irc"
+)
+
+func runIRC(args []string) error {
+	flags := flag.NewFlagSet("irc", flag.ExitOnError)
+	nick := flags.String("nick", "captionbot", "nickname")
+	channels := flags.String("channels", "", "comma-separated channels to join and caption links in")
+	ignore := flags.String("ignore", "", "comma-separated nicks to ignore")
+	useTLS := flags.Bool("tls", true, "connect with TLS")
+	password := flags.String("password", "", "server password (default $IRC_PASSWORD)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot irc [flags] HOST:PORT\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(password, "IRC_PASSWORD")
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	client := irc.NewBot(flags.Arg(0), *nick, splitList(*channels), bot)
+	client.TLS = *useTLS
+	client.Password = *password
+	client.Ignore = splitList(*ignore)
+	return client.Run()
+}
+
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/queue"
+	"github.com/nhatbui/captionbot/queue/kafka"
+)
+
+func runKafka(args []string) error {
+	flags := flag.NewFlagSet("kafka", flag.ExitOnError)
+	brokers := flags.String("brokers", "localhost:9092", "comma-separated broker addresses")
+	group := flags.String("group", "captionbot", "consumer group ID")
+	topic := flags.String("topic", "caption-requests", "topic to consume jobs from")
+	results := flags.String("results", "caption-results", "topic to produce results to")
+	deadLetter := flags.String("dead-letter", "", "topic for jobs that fail (default: report failures in --results)")
+	attempts := flags.Int("attempts", 3, "times to try a failing job")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot kafka [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	worker := &kafka.Worker{
+		Brokers:         splitList(*brokers),
+		GroupID:         *group,
+		Topic:           *topic,
+		ResultTopic:     *results,
+		DeadLetterTopic: *deadLetter,
+		MaxAttempts:     *attempts,
+		Captioner:       queue.NewCaptioner(bot),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return worker.Run(ctx)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+	"github.com/nhatbui/captionbot/server"
+	"github.com/nhatbui/captionbot/server/client"
+)
+
+// loadReport is the result of a load test, printed at its end.
+type loadReport struct {
+	Target    string           `json:"target"`
+	RPS       float64          `json:"rps"`
+	Duration  string           `json:"duration"`
+	Sent      int              `json:"sent"`
+	OK        int              `json:"ok"`
+	Failed    int              `json:"failed"`
+	Dropped   int              `json:"dropped"`
+	Achieved  float64          `json:"achieved_rps"`
+	Latencies map[string]int64 `json:"latency_ms"`
+	Errors    map[string]int   `json:"errors,omitempty"`
+}
+
+func runLoadTest(args []string) error {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	rps := flags.Float64("rps", 5, "requests to start per second")
+	duration := flags.Duration("duration", time.Minute, "how long to send requests for")
+	image := flags.String("image", "", "image `file` to upload with each request")
+	imageURL := flags.String("url", "", "image `URL` to caption with each request, instead of --image")
+	serverURL := flags.String("server", "", "load a captionbot server at this `URL` instead of captionbot.ai")
+	sessions := flags.Int("sessions", 1, "captionbot.ai sessions to spread requests over; serve has one, or one per client with --tenant-sessions")
+	fake := flags.Bool("fake", false, "load an in-process fake of captionbot.ai instead, to test the load test")
+	fakeLatency := flags.Duration("fake-latency", 500*time.Millisecond, "how long the --fake service takes to caption")
+	maxInFlight := flags.Int("max-in-flight", 64, "requests to have outstanding at once; more are dropped and counted")
+	jsonOutput := flags.Bool("json", false, "print the report as JSON")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot loadtest [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Starts requests at a steady rate whether or not earlier ones have finished,\n")
+		fmt.Fprintf(flags.Output(), "then reports latency percentiles and errors. The --server API key is read\n")
+		fmt.Fprintf(flags.Output(), "from $CAPTIONBOT_API_KEY.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 || (*image == "") == (*imageURL == "") || *rps <= 0 || *sessions < 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var data []byte
+	if *image != "" {
+		var err error
+		data, err = os.ReadFile(*image)
+		if err != nil {
+			return err
+		}
+	}
+
+	target := "captionbot.ai"
+	var captioners []server.Captioner
+	switch {
+	case *serverURL != "":
+		target = *serverURL
+		c := client.New(*serverURL)
+		if key := os.Getenv("CAPTIONBOT_API_KEY"); key != "" {
+			c.SetAPIKey(key)
+		}
+		captioners = append(captioners, c)
+	default:
+		if *fake {
+			target = "fake captionbot.ai"
+			service := captionbottest.NewServer()
+			defer service.Close()
+			defer service.Use()()
+			service.SetDelay("message", *fakeLatency)
+		}
+		for i := 0; i < *sessions; i++ {
+			bot, err := captionbot.New()
+			if err != nil {
+				return err
+			}
+			captioners = append(captioners, server.NewSession(bot))
+		}
+	}
+	caption := func(captioner server.Captioner) error {
+		var err error
+		if *imageURL != "" {
+			_, err = captioner.CaptionURL(*imageURL)
+		} else {
+			_, err = captioner.CaptionReader(bytes.NewReader(data), filepath.Base(*image))
+		}
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errs      = map[string]int{}
+		wg        sync.WaitGroup
+	)
+	report := loadReport{Target: target, RPS: *rps, Duration: duration.String()}
+	slots := make(chan struct{}, *maxInFlight)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rps))
+	defer ticker.Stop()
+	start := time.Now()
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			report.Dropped++
+			continue
+		}
+		report.Sent++
+		wg.Add(1)
+		go func(captioner server.Captioner) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			began := time.Now()
+			err := caption(captioner)
+			took := time.Since(began)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs[loadError(err)]++
+				return
+			}
+			latencies = append(latencies, took)
+		}(captioners[n%len(captioners)])
+	}
+	if !*jsonOutput {
+		fmt.Fprintf(os.Stderr, "waiting for %d requests in flight\n", len(slots))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	report.OK = len(latencies)
+	report.Failed = report.Sent - report.OK
+	report.Achieved = math.Round(float64(report.OK)/elapsed.Seconds()*100) / 100
+	report.Latencies = percentiles(latencies)
+	if len(errs) > 0 {
+		report.Errors = errs
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+	printLoadReport(report)
+	return nil
+}
+
+// loadError returns the part of err that tells failures apart, without
+// the URL a request error names.
+func loadError(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Sprintf("%s: %s", urlErr.Op, urlErr.Err)
+	}
+	return err.Error()
+}
+
+// percentiles returns the p50, p90, p95 and p99 and the extremes of
+// latencies, in milliseconds.
+func percentiles(latencies []time.Duration) map[string]int64 {
+	result := map[string]int64{}
+	if len(latencies) == 0 {
+		return result
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	for _, p := range []int{50, 90, 95, 99} {
+		i := int(math.Ceil(float64(p)/100*float64(len(latencies)))) - 1
+		result[fmt.Sprintf("p%d", p)] = latencies[i].Milliseconds()
+	}
+	result["min"] = latencies[0].Milliseconds()
+	result["max"] = latencies[len(latencies)-1].Milliseconds()
+	return result
+}
+
+// printLoadReport prints report as text.
+func printLoadReport(report loadReport) {
+	fmt.Printf("target:      %s at %g/s for %s\n", report.Target, report.RPS, report.Duration)
+	fmt.Printf("requests:    %d sent, %d ok, %d failed, %d dropped at --max-in-flight\n", report.Sent, report.OK, report.Failed, report.Dropped)
+	fmt.Printf("throughput:  %g captions/s\n", report.Achieved)
+	if report.OK > 0 {
+		fmt.Printf("latency:    ")
+		for _, name := range []string{"min", "p50", "p90", "p95", "p99", "max"} {
+			fmt.Printf(" %s %dms", name, report.Latencies[name])
+		}
+		fmt.Println()
+	}
+	if len(report.Errors) == 0 {
+		return
+	}
+	messages := make([]string, 0, len(report.Errors))
+	for message := range report.Errors {
+		messages = append(messages, message)
+	}
+	sort.Slice(messages, func(i, j int) bool { return report.Errors[messages[i]] > report.Errors[messages[j]] })
+	fmt.Println("errors:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, message := range messages {
+		fmt.Fprintf(w, "  %d\t%s\n", report.Errors[message], message)
+	}
+	w.Flush()
+}
@@ -0,0 +1,116 @@
+// Command captionbot captions images with captionbot.ai and wires the
+// results into other services.
+//
+// Usage:
+//
+//	captionbot <command> [flags] [args]
+//
+// Run "captionbot <command> -h" for the flags of a command. Setting
+// $CAPTIONBOT_BASE_URL points every command at another captionbot.ai API,
+// such as the fake one captionbot-fakeserver serves, and
+// $CAPTIONBOT_USER_AGENT replaces the User-Agent its requests send.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// command is a captionbot subcommand. run receives the arguments that follow
+// the command name.
+type command struct {
+	summary string
+	run     func(args []string) error
+}
+
+var commands = map[string]command{
+	"batch":       {"caption every image in a directory or storage bucket", runBatch},
+	"contentful":  {"fill in empty asset and entry descriptions in Contentful", runContentful},
+	"contract":    {"check captionbot.ai still answers as the library expects", runContract},
+	"discord":     {"serve Discord caption commands", runDiscord},
+	"file":        {"caption image files, given or read from stdin", runFile},
+	"ghost":       {"fill in missing alt text in Ghost posts", runGhost},
+	"github":      {"suggest alt text for images in GitHub issues and PRs", runGitHub},
+	"gitlab":      {"suggest alt text for images in GitLab issues and MRs", runGitLab},
+	"gphotos":     {"caption Google Photos albums into a manifest", runGPhotos},
+	"imap":        {"reply to emailed images with captions", runIMAP},
+	"irc":         {"describe image links posted in IRC channels", runIRC},
+	"kafka":       {"caption jobs from a Kafka topic", runKafka},
+	"loadtest":    {"measure caption latency and errors at a steady request rate", runLoadTest},
+	"mastodon":    {"reply to Mastodon mentions with alt text", runMastodon},
+	"matrix":      {"caption images posted in Matrix rooms", runMatrix},
+	"native-host": {"answer caption requests from a browser extension", runNativeHost},
+	"nats":        {"serve captions over NATS and JetStream", runNATS},
+	"rabbitmq":    {"caption jobs from a RabbitMQ queue", runRabbitMQ},
+	"reddit":      {"reply to Reddit image posts and mentions", runReddit},
+	"redis":       {"caption jobs from a Redis stream", runRedis},
+	"schedule":    {"run captionbot commands on cron schedules", runSchedule},
+	"serve":       {"serve a JSON HTTP caption API", runServe},
+	"slack":       {"run a Slack app that captions shared images", runSlack},
+	"sqs":         {"caption jobs from an SQS queue", runSQS},
+	"teams":       {"serve a Microsoft Teams bot endpoint", runTeams},
+	"telegram":    {"run a Telegram bot that captions photos", runTelegram},
+	"twilio":      {"answer MMS photos with captions via Twilio", runTwilio},
+	"url":         {"caption image URLs, given or read from stdin", runURL},
+	"whatsapp":    {"reply to WhatsApp images with captions", runWhatsApp},
+	"wordpress":   {"fill in missing alt text in WordPress media libraries", runWordPress},
+	"x":           {"reply to X mentions with image descriptions", runTwitter},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: captionbot <command> [flags] [args]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].summary)
+	}
+}
+
+// envDefault sets value to the environment variable name if the flag was
+// left empty. Flags take credentials from the environment this way rather
+// than as their defaults, which usage messages print.
+func envDefault(value *string, name string) {
+	if *value == "" {
+		*value = os.Getenv(name)
+	}
+}
+
+func main() {
+	if isBrowserLaunch(os.Args[1:]) {
+		if err := runNativeHost(nil); err != nil {
+			fmt.Fprintf(os.Stderr, "captionbot native-host: %s\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if base := os.Getenv("CAPTIONBOT_BASE_URL"); base != "" {
+		captionbot.BaseURL = base
+	}
+	if ua := os.Getenv("CAPTIONBOT_USER_AGENT"); ua != "" {
+		captionbot.UserAgent = ua
+	}
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "captionbot: unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "captionbot %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/mastodon"
+)
+
+func runMastodon(args []string) error {
+	flags := flag.NewFlagSet("mastodon", flag.ExitOnError)
+	token := flags.String("token", "", "access token (default $MASTODON_ACCESS_TOKEN)")
+	interval := flags.Duration("interval", time.Minute, "how often to check for mentions")
+	watch := flags.Bool("watch-own-posts", false, "DM suggestions for the account's own posts that lack alt text")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot mastodon [flags] SERVER\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(token, "MASTODON_ACCESS_TOKEN")
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		return fmt.Errorf("an access token is required")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	m := mastodon.NewBot(flags.Arg(0), *token, bot)
+	m.Interval = *interval
+	m.WatchOwnPosts = *watch
+	return m.Run()
+}
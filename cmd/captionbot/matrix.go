@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/matrix"
+)
+
+func runMatrix(args []string) error {
+	flags := flag.NewFlagSet("matrix", flag.ExitOnError)
+	token := flags.String("token", "", "access token (default $MATRIX_ACCESS_TOKEN)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot matrix [flags] HOMESERVER\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(token, "MATRIX_ACCESS_TOKEN")
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *token == "" {
+		return fmt.Errorf("an access token is required")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	return matrix.NewBot(flags.Arg(0), *token, bot).Run()
+}
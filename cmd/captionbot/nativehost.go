@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/nativehost"
+)
+
+// isBrowserLaunch reports whether the arguments are the ones a browser passes
+// when it starts a native messaging host: the caller's origin for Chrome, or
+// the manifest path and extension ID for Firefox. Browsers can't pass a
+// subcommand, so main uses this to enter native-host mode directly.
+func isBrowserLaunch(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+	return strings.HasPrefix(args[0], "chrome-extension://") || strings.HasSuffix(args[0], ".json")
+}
+
+func runNativeHost(args []string) error {
+	flags := flag.NewFlagSet("native-host", flag.ExitOnError)
+	manifest := flags.String("manifest", "", "print the host manifest for `browser` (chrome or firefox) and exit")
+	extensionID := flags.String("extension-id", "", "ID of the companion extension, for --manifest")
+	flags.String("parent-window", "", "window handle passed by Chrome on Windows (ignored)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot native-host [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *manifest != "" {
+		path, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		m, err := nativehost.NewManifest(*manifest, path, *extensionID)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	return nativehost.Serve(os.Stdin, os.Stdout, bot)
+}
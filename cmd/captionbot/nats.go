@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/queue"
+	"github.com/nhatbui/captionbot/queue/nats"
+)
+
+func runNATS(args []string) error {
+	flags := flag.NewFlagSet("nats", flag.ExitOnError)
+	url := flags.String("url", "nats://127.0.0.1:4222", "server URL")
+	subject := flags.String("subject", "caption", "request/reply subject (empty to disable)")
+	group := flags.String("queue-group", "captionbot", "queue group shared by instances")
+	stream := flags.String("stream", "", "JetStream stream of batch jobs (empty to disable)")
+	consumer := flags.String("consumer", "captionbot", "durable consumer name for --stream")
+	results := flags.String("results", "caption.results", "subject to publish batch results to")
+	attempts := flags.Int("attempts", 3, "deliveries of a failing batch job")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot nats [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	service := &nats.Service{
+		URL:           *url,
+		Subject:       *subject,
+		QueueGroup:    *group,
+		Stream:        *stream,
+		Consumer:      *consumer,
+		ResultSubject: *results,
+		MaxAttempts:   *attempts,
+		Captioner:     queue.NewCaptioner(bot),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return service.Run(ctx)
+}
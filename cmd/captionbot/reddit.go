@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/reddit"
+)
+
+func runReddit(args []string) error {
+	flags := flag.NewFlagSet("reddit", flag.ExitOnError)
+	subreddits := flags.String("subreddits", "", "comma-separated subreddits to watch for image posts")
+	optOut := flags.String("opt-out", "reddit-optout.txt", "file of opted-out usernames")
+	interval := flags.Duration("interval", time.Minute, "how often to poll")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot reddit [flags]\n")
+		fmt.Fprintf(flags.Output(), "Credentials are read from REDDIT_CLIENT_ID, REDDIT_CLIENT_SECRET, REDDIT_USERNAME and REDDIT_PASSWORD.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	clientID, clientSecret := os.Getenv("REDDIT_CLIENT_ID"), os.Getenv("REDDIT_CLIENT_SECRET")
+	username, password := os.Getenv("REDDIT_USERNAME"), os.Getenv("REDDIT_PASSWORD")
+	if clientID == "" || clientSecret == "" || username == "" || password == "" {
+		return fmt.Errorf("REDDIT_CLIENT_ID, REDDIT_CLIENT_SECRET, REDDIT_USERNAME and REDDIT_PASSWORD must be set")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	r := reddit.NewBot(clientID, clientSecret, username, password, bot)
+	r.Subreddits = splitList(*subreddits)
+	r.OptOutFile = *optOut
+	r.Interval = *interval
+	return r.Run()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/queue"
+	"github.com/nhatbui/captionbot/queue/redis"
+)
+
+func runRedis(args []string) error {
+	hostname, _ := os.Hostname()
+
+	flags := flag.NewFlagSet("redis", flag.ExitOnError)
+	url := flags.String("url", "", "server URL (default $REDIS_URL)")
+	stream := flags.String("stream", "caption-jobs", "stream to read jobs from")
+	group := flags.String("group", "captionbot", "consumer group")
+	consumer := flags.String("consumer", hostname, "consumer name, unique within the group")
+	results := flags.String("results", "", "stream to add results to (default STREAM:results)")
+	deadLetter := flags.String("dead-letter", "", "stream to add failed jobs to")
+	maxLen := flags.Int64("maxlen", 0, "approximate length to trim the result streams to (0 for no limit)")
+	claimIdle := flags.Duration("claim-idle", time.Minute, "idle time after which pending jobs are retried")
+	attempts := flags.Int("attempts", 3, "times to try a failing job")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot redis [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(url, "REDIS_URL")
+
+	if *url == "" {
+		*url = "redis://localhost:6379/0"
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	worker, err := redis.NewWorker(*url, *stream, *group, *consumer, queue.NewCaptioner(bot))
+	if err != nil {
+		return err
+	}
+	defer worker.Client.Close()
+	if *results != "" {
+		worker.ResultStream = *results
+	}
+	worker.DeadLetterStream = *deadLetter
+	worker.MaxLen = *maxLen
+	worker.ClaimIdle = *claimIdle
+	worker.MaxAttempts = *attempts
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return worker.Run(ctx)
+}
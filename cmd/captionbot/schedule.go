@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nhatbui/captionbot/notify"
+	"github.com/nhatbui/captionbot/schedule"
+)
+
+// scheduleConfig is the JSON file of the schedule command.
+type scheduleConfig struct {
+	Jobs []struct {
+		Name     string `json:"name"`
+		Schedule string `json:"schedule"`
+		// Command is a captionbot command and its arguments, such as
+		// ["batch", "--write", "s3://bucket/photos/"].
+		Command []string `json:"command"`
+	} `json:"jobs"`
+}
+
+func runSchedule(args []string) error {
+	flags := flag.NewFlagSet("schedule", flag.ExitOnError)
+	history := flags.String("history", "", "append every run to this `file` as JSON lines")
+	webhooks := flags.String("notify", "", "comma-separated webhook URLs to POST failed runs to, signed with $CAPTIONBOT_WEBHOOK_SECRET")
+	list := flags.Bool("list", false, "print when each job is next due and exit")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot schedule [flags] CONFIG\n\n")
+		fmt.Fprintf(flags.Output(), "Runs captionbot commands on cron schedules from the JSON file CONFIG:\n\n")
+		fmt.Fprintf(flags.Output(), "  {\"jobs\": [{\"name\": \"photos\", \"schedule\": \"0 3 * * *\", \"command\": [\"batch\", \"--write\", \"s3://bucket/photos/\"]}]}\n\n")
+		fmt.Fprintf(flags.Output(), "A job still running when it is due again is skipped.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	data, err := os.ReadFile(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var config scheduleConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("%s: %w", flags.Arg(0), err)
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	scheduler := schedule.New()
+	for _, job := range config.Jobs {
+		if len(job.Command) == 0 {
+			return fmt.Errorf("job %s has no command", job.Name)
+		}
+		if job.Command[0] == "schedule" {
+			return fmt.Errorf("job %s can't run schedule", job.Name)
+		}
+		name, command := job.Name, job.Command
+		err := scheduler.Add(name, job.Schedule, func(ctx context.Context) error {
+			return runScheduledCommand(ctx, self, name, command)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if *list {
+		next := scheduler.Next(time.Now())
+		names := make([]string, 0, len(next))
+		for name := range next {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return next[names[i]].Before(next[names[j]]) })
+		for _, name := range names {
+			fmt.Printf("%s\t%s\n", next[name].Format(time.RFC3339), name)
+		}
+		return nil
+	}
+
+	if *history != "" {
+		f, err := os.OpenFile(*history, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		scheduler.History = f
+	}
+	if urls := splitList(*webhooks); len(urls) > 0 {
+		scheduler.Notifier = notify.New(os.Getenv("CAPTIONBOT_WEBHOOK_SECRET"), urls...)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return scheduler.Run(ctx)
+}
+
+// runScheduledCommand runs a captionbot command in its own process, so
+// that commands exiting on errors don't stop the scheduler. Its output is
+// passed through with the job's name in front, and a failure's error ends
+// with the last line the command wrote to stderr.
+func runScheduledCommand(ctx context.Context, self, name string, command []string) error {
+	cmd := exec.CommandContext(ctx, self, command...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = 30 * time.Second
+	stderr := &lastLine{}
+	cmd.Stdout = &prefixWriter{w: os.Stdout, prefix: name + ": "}
+	cmd.Stderr = io.MultiWriter(&prefixWriter{w: os.Stderr, prefix: name + ": "}, stderr)
+	if err := cmd.Run(); err != nil {
+		if line := stderr.String(); line != "" {
+			return fmt.Errorf("%w: %s", err, line)
+		}
+		return err
+	}
+	return nil
+}
+
+// prefixWriter writes each line with a prefix.
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+	mid    bool
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, b := range p {
+		if !pw.mid {
+			buf.WriteString(pw.prefix)
+			pw.mid = true
+		}
+		buf.WriteByte(b)
+		if b == '\n' {
+			pw.mid = false
+		}
+	}
+	if _, err := pw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// lastLine keeps the last non-empty line written to it.
+type lastLine struct {
+	line, partial []byte
+}
+
+func (ll *lastLine) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\n' {
+			if len(ll.partial) < 1024 {
+				ll.partial = append(ll.partial, b)
+			}
+			continue
+		}
+		if len(bytes.TrimSpace(ll.partial)) > 0 {
+			ll.line = append(ll.line[:0], ll.partial...)
+		}
+		ll.partial = ll.partial[:0]
+	}
+	return len(p), nil
+}
+
+func (ll *lastLine) String() string {
+	if len(bytes.TrimSpace(ll.partial)) > 0 {
+		return strings.TrimSpace(string(ll.partial))
+	}
+	return strings.TrimSpace(string(ll.line))
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/server"
+	rediscache "github.com/nhatbui/captionbot/server/cache/redis"
+	"github.com/nhatbui/captionbot/server/client"
+	"github.com/nhatbui/captionbot/server/graphqlapi"
+	"github.com/nhatbui/captionbot/server/grpcapi"
+	jobqueue "github.com/nhatbui/captionbot/server/jobqueue/redis"
+	"github.com/nhatbui/captionbot/server/jobstore/bolt"
+	"github.com/nhatbui/captionbot/server/jobstore/postgres"
+	"github.com/nhatbui/captionbot/server/jobstore/redis"
+	keystore "github.com/nhatbui/captionbot/server/keystore/redis"
+	ratelimit "github.com/nhatbui/captionbot/server/ratelimit/redis"
+)
+
+func runServe(args []string) error {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on: host:port, unix:`path` for a Unix socket, or systemd[:name] for a socket systemd passes in")
+	tlsCert := flags.String("tls-cert", "", "serve HTTPS with the certificate in this PEM `file`")
+	tlsKey := flags.String("tls-key", "", "private key `file` for --tls-cert")
+	autocertDomains := flags.String("autocert", "", "serve HTTPS with Let's Encrypt certificates for these comma-separated domains")
+	autocertEmail := flags.String("autocert-email", "", "contact address for the Let's Encrypt account")
+	autocertCache := flags.String("autocert-cache", "captionbot-certs", "`directory` to keep Let's Encrypt certificates in")
+	httpAddr := flags.String("http-addr", ":80", "with --autocert, address to answer HTTP-01 challenges and redirect to HTTPS on")
+	socketMode := flags.String("socket-mode", "0660", "permissions of Unix sockets the server creates")
+	graphql := flags.Bool("graphql", false, "also serve a GraphQL endpoint at /graphql")
+	apiKeys := flags.String("api-keys", "", "require API keys from a key `file` or a redis:// URL")
+	oidcIssuer := flags.String("oidc-issuer", "", "accept bearer JWTs from this OIDC issuer `URL`")
+	oidcJWKS := flags.String("oidc-jwks", "", "`URL` of the issuer's signing keys (default found by OIDC discovery)")
+	oidcAudience := flags.String("oidc-audience", "", "audience tokens must be issued for (default any)")
+	ipLimit := flags.String("ip-rate-limit", "", "limit requests from each address, as N/s, N/m or N/h")
+	clientLimit := flags.String("client-rate-limit", "", "limit requests from each API key or token subject, as N/s, N/m or N/h")
+	trustProxy := flags.Bool("trust-proxy", false, "take client addresses from X-Forwarded-For, behind a reverse proxy")
+	corsOrigins := flags.String("cors-origins", "", "comma-separated origins browser apps may call the API from, such as https://app.example.com or *")
+	corsMaxAge := flags.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache CORS preflights")
+	cache := flags.String("cache", "", "cache captions in \"memory\", a `directory`, or a redis:// URL")
+	cacheTTL := flags.Duration("cache-ttl", server.DefaultCacheTTL, "how long to cache captions")
+	maxIdleConns := flags.Int("upstream-idle-conns", 0, "idle connections to keep open to captionbot.ai and --fallback (0 for Go's default of 2)")
+	idleConnTimeout := flags.Duration("upstream-idle-timeout", 0, "how long idle upstream connections stay open (0 for Go's default of 90s)")
+	upstreamHTTP2 := flags.Bool("upstream-http2", true, "use HTTP/2 to captionbot.ai and --fallback where they offer it")
+	sessionIdle := flags.Duration("session-idle", 0, "start a new captionbot.ai conversation for sessions idle this long, so the next caption doesn't hit an expired one (0 to keep conversations)")
+	tenantSessions := flags.Bool("tenant-sessions", false, "give each API key or token subject its own captionbot.ai session and cache entries")
+	maxTenants := flags.Int("max-tenants", server.DefaultMaxTenants, "with --tenant-sessions, how many clients' sessions to keep, dropping the least recently used")
+	fallback := flags.String("fallback", "", "`URL` of another captionbot server to fail over to when captionbot.ai fails")
+	admins := flags.String("admins", "", "comma-separated clients that may use the /admin/ endpoints: API key clients, or oidc:SUBJECT for tokens")
+	logLevel := flags.String("log-level", "info", "what to log: error, info, or debug for every request")
+	ui := flags.Bool("ui", true, "serve a web page at / for captioning images by hand")
+	serveMetrics := flags.Bool("metrics", false, "serve Prometheus metrics at /metrics")
+	grpcAddr := flags.String("grpc-addr", "", "address to also serve the gRPC CaptionService on, in the forms of --addr")
+	maxUpload := flags.Int64("max-upload", server.DefaultMaxUploadSize, "largest image upload to accept, in bytes")
+	maxArchive := flags.Int64("max-archive", server.DefaultMaxArchiveSize, "largest job archive to accept, in bytes")
+	maxConcurrent := flags.Int("max-concurrent", 1, "captions to make at once; more are queued (0 for no limit)")
+	maxWaiting := flags.Int("max-waiting", server.DefaultMaxWaiting, "caption requests that may queue before new ones are refused with 503")
+	maxQueueWait := flags.Duration("max-queue-wait", server.DefaultMaxQueueWait, "how long a caption request may queue before it is refused with 503")
+	jobStore := flags.String("job-store", defaultJobStore(), "where to keep jobs: a BoltDB `file`, a redis:// or postgres:// URL, or \"memory\"")
+	jobWorkers := flags.Int("job-workers", 1, "number of jobs to run at once")
+	maxQueued := flags.Int("max-queued-jobs", server.DefaultMaxQueuedJobs, "number of queued jobs at which new jobs are refused and /readyz reports not ready (0 for no limit)")
+	jobRetention := flags.Duration("job-retention", server.DefaultJobRetention, "how long to keep finished jobs")
+	archiveDir := flags.String("archive-dir", "", "directory to spool job archives in (default the system temporary directory)")
+	shared := flags.String("shared", "", "share rate limits and the job queue with other replicas through this redis:// `URL`; use with a shared --job-store and --cache")
+	drainTimeout := flags.Duration("drain-timeout", 30*time.Second, "on SIGINT or SIGTERM, how long to let requests, streams and the current job images finish")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot serve [flags]\n\n")
+		fmt.Fprintf(flags.Output(), "Job callbacks are signed with $CAPTIONBOT_WEBHOOK_SECRET. API keys can instead\n")
+		fmt.Fprintf(flags.Output(), "be given in $CAPTIONBOT_API_KEYS as comma-separated CLIENT=KEY pairs. The\n")
+		fmt.Fprintf(flags.Output(), "--fallback server's API key is read from $CAPTIONBOT_FALLBACK_API_KEY.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var metrics *server.Metrics
+	if *serveMetrics {
+		metrics = server.NewMetrics()
+	}
+	level, err := server.ParseLogLevel(*logLevel)
+	if err != nil {
+		return err
+	}
+	if (*tlsCert == "") != (*tlsKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key go together")
+	}
+	if *tlsCert != "" && *autocertDomains != "" {
+		return fmt.Errorf("use either --tls-cert or --autocert")
+	}
+	transport := captionbot.TransportOptions{
+		MaxIdleConnsPerHost: *maxIdleConns,
+		IdleConnTimeout:     *idleConnTimeout,
+		DisableHTTP2:        !*upstreamHTTP2,
+	}
+	// Every session shares one client, so that they share its tuned
+	// connections.
+	var botOptions []captionbot.Option
+	if transport != (captionbot.TransportOptions{}) {
+		upstream := &http.Client{Transport: captionbot.NewTransport(transport)}
+		botOptions = append(botOptions, captionbot.WithHTTPClient(upstream))
+	}
+	cacheStore, err := openCache(*cache)
+	if err != nil {
+		return err
+	}
+	var providers *server.ProviderSwitch
+	var secondary server.Captioner
+	if *fallback != "" {
+		fallbackClient := client.New(*fallback)
+		if transport != (captionbot.TransportOptions{}) {
+			fallbackClient.ConfigureTransport(transport)
+		}
+		if key := os.Getenv("CAPTIONBOT_FALLBACK_API_KEY"); key != "" {
+			fallbackClient.SetAPIKey(key)
+		}
+		secondary = fallbackClient
+		if metrics != nil {
+			secondary = metrics.Instrument(secondary, "fallback")
+		}
+		providers = &server.ProviderSwitch{}
+	}
+	// newCaptioner creates the Captioner of a client, or the shared one
+	// for "", each with its own session and cache entries.
+	var stopKeepAlive func()
+	newCaptioner := func(client string) (server.Captioner, error) {
+		bot, err := captionbot.New(botOptions...)
+		if err != nil {
+			return nil, err
+		}
+		session := server.NewSession(bot)
+		if *sessionIdle > 0 {
+			// Refreshed before a caption once idle. The shared session
+			// is also refreshed in the background, so that it's ready;
+			// a loop per client would outlive the clients.
+			bot.RefreshAfter = *sessionIdle
+			if client == "" {
+				stopKeepAlive = session.KeepAlive(*sessionIdle)
+			}
+		}
+		var captioner server.Captioner = session
+		if metrics != nil {
+			captioner = metrics.Instrument(captioner, "captionbot.ai")
+		}
+		if secondary != nil {
+			captioner = server.NewFailover(captioner, secondary, providers)
+		}
+		if cacheStore != nil {
+			store := cacheStore
+			if client != "" {
+				store = server.PrefixCache(store, "client:"+client+":")
+			}
+			cached := server.NewCachedCaptioner(captioner, store)
+			cached.TTL = *cacheTTL
+			cached.Metrics = metrics
+			captioner = cached
+		}
+		return captioner, nil
+	}
+	captioner, err := newCaptioner("")
+	if err != nil {
+		return err
+	}
+	if stopKeepAlive != nil {
+		defer stopKeepAlive()
+	}
+	var tenants *server.Tenants
+	if *tenantSessions {
+		tenants = server.NewTenants(newCaptioner)
+		tenants.MaxClients = *maxTenants
+		defer tenants.Close()
+	}
+
+	mode, err := strconv.ParseUint(*socketMode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid --socket-mode %q", *socketMode)
+	}
+
+	keys, err := openKeyStore(*apiKeys, os.Getenv("CAPTIONBOT_API_KEYS"))
+	if err != nil {
+		return err
+	}
+
+	var grpcServer *grpc.Server
+	if *grpcAddr != "" {
+		lis, err := listen(*grpcAddr, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		var opts []grpc.ServerOption
+		if keys != nil {
+			opts = grpcapi.Authenticate(keys)
+		}
+		grpcServer = grpc.NewServer(opts...)
+		service := grpcapi.Register(grpcServer, captioner)
+		service.MaxUploadSize = *maxUpload
+		service.Tenants = tenants
+		reflection.Register(grpcServer)
+		log.Printf("serving gRPC on %s", lis.Addr())
+		go func() {
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	srv := server.New(captioner)
+	srv.Keys = keys
+	srv.Tenants = tenants
+	srv.Providers = providers
+	srv.Admins = splitList(*admins)
+	srv.SetLogLevel(level)
+	srv.TrustProxy = *trustProxy
+	if origins := splitList(*corsOrigins); len(origins) > 0 {
+		srv.CORS = &server.CORS{AllowedOrigins: origins, MaxAge: *corsMaxAge}
+	}
+	if *ipLimit != "" {
+		if srv.IPRateLimit, err = server.ParseRateLimit(*ipLimit); err != nil {
+			return err
+		}
+	}
+	if *clientLimit != "" {
+		if srv.ClientRateLimit, err = server.ParseRateLimit(*clientLimit); err != nil {
+			return err
+		}
+	}
+	if *oidcIssuer != "" {
+		srv.Tokens, err = server.NewTokenVerifier(context.Background(), *oidcIssuer, *oidcJWKS, *oidcAudience)
+		if err != nil {
+			return err
+		}
+	}
+	if metrics != nil {
+		srv.ServeMetrics(metrics)
+	}
+	if *ui {
+		srv.ServeUI()
+	}
+	srv.MaxUploadSize = *maxUpload
+	srv.MaxArchiveSize = *maxArchive
+	srv.MaxConcurrent = *maxConcurrent
+	srv.MaxWaiting = *maxWaiting
+	srv.MaxQueueWait = *maxQueueWait
+	srv.JobWorkers = *jobWorkers
+	srv.JobRetention = *jobRetention
+	srv.MaxQueuedJobs = *maxQueued
+	srv.ArchiveDir = *archiveDir
+	srv.CallbackSecret = os.Getenv("CAPTIONBOT_WEBHOOK_SECRET")
+	srv.JobStore, err = openJobStore(*jobStore, *jobRetention)
+	if err != nil {
+		return err
+	}
+	if *shared != "" {
+		if !strings.Contains(*jobStore, "://") {
+			return fmt.Errorf("--shared needs a redis:// or postgres:// --job-store")
+		}
+		srv.Limiter, err = ratelimit.Open(*shared)
+		if err != nil {
+			return err
+		}
+		srv.JobQueue, err = jobqueue.Open(*shared)
+		if err != nil {
+			return err
+		}
+	}
+	if err := srv.Resume(); err != nil {
+		return err
+	}
+	if *graphql {
+		handler := graphqlapi.New(captioner)
+		handler.MaxUploadSize = *maxUpload
+		handler.Tenants = tenants
+		srv.Handle("/graphql", handler)
+	}
+	http.Handle("/", srv)
+	lis, err := listen(*addr, os.FileMode(mode))
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	httpServer := &http.Server{TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	servers := []*http.Server{httpServer}
+	serveErr := make(chan error, 2)
+	switch {
+	case *tlsCert != "":
+		go func() {
+			log.Printf("listening for HTTPS on %s", lis.Addr())
+			serveErr <- httpServer.ServeTLS(lis, *tlsCert, *tlsKey)
+		}()
+	case *autocertDomains != "":
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(splitList(*autocertDomains)...),
+			Cache:      autocert.DirCache(*autocertCache),
+			Email:      *autocertEmail,
+		}
+		httpServer.TLSConfig = manager.TLSConfig()
+		httpServer.TLSConfig.MinVersion = tls.VersionTLS12
+		// HTTP-01 challenges come over plain HTTP, which otherwise
+		// redirects to HTTPS.
+		challengeServer := &http.Server{Addr: *httpAddr, Handler: manager.HTTPHandler(nil)}
+		servers = append(servers, challengeServer)
+		go func() {
+			log.Printf("answering ACME challenges on %s", *httpAddr)
+			serveErr <- challengeServer.ListenAndServe()
+		}()
+		go func() {
+			log.Printf("listening for HTTPS on %s", lis.Addr())
+			serveErr <- httpServer.ServeTLS(lis, "", "")
+		}()
+	default:
+		go func() {
+			log.Printf("listening on %s", lis.Addr())
+			serveErr <- httpServer.Serve(lis)
+		}()
+	}
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	stop()
+
+	log.Printf("draining for up to %s", *drainTimeout)
+	return drain(srv, servers, grpcServer, *drainTimeout)
+}
+
+// drain shuts the serve command down: it stops accepting connections,
+// lets requests, streams and the current job images finish within timeout,
+// then closes the job store so unfinished jobs resume on the next start.
+func drain(srv *server.Server, httpServers []*http.Server, grpcServer *grpc.Server, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	errs := make(chan error, len(httpServers)+1)
+	go func() { errs <- srv.Shutdown(ctx) }()
+	for _, httpServer := range httpServers {
+		httpServer := httpServer
+		go func() { errs <- httpServer.Shutdown(ctx) }()
+	}
+	if grpcServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			grpcServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			grpcServer.Stop()
+		}
+	}
+	var err error
+	for i := 0; i < cap(errs); i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err == context.DeadlineExceeded {
+		log.Printf("drain timed out after %s; unfinished jobs resume on restart", timeout)
+		err = nil
+	}
+	if closer, ok := srv.JobStore.(io.Closer); ok {
+		if e := closer.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// listen opens a listener for the serve command's --addr or --grpc-addr:
+// a TCP address, unix:PATH for a Unix socket made with the given mode, or
+// systemd or systemd:NAME for a socket passed in by systemd.
+func listen(addr string, mode os.FileMode) (net.Listener, error) {
+	switch {
+	case addr == "systemd" || strings.HasPrefix(addr, "systemd:"):
+		return activatedListener(strings.TrimPrefix(strings.TrimPrefix(addr, "systemd"), ":"))
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		// Remove the socket a previous run left behind, but nothing else.
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(path)
+		}
+		lis, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			lis.Close()
+			return nil, err
+		}
+		return lis, nil
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// activatedFiles holds the sockets systemd passed in by name, following
+// sd_listen_fds(3): LISTEN_FDS of them from file descriptor 3, named by
+// LISTEN_FDNAMES. Unnamed sockets are named by their position.
+var activatedFiles struct {
+	once  sync.Once
+	files map[string]*os.File
+	names []string
+}
+
+// activatedListener returns the systemd-activated socket called name, or
+// the first unused one if name is empty. Each can be used once; the
+// passed-in descriptor is closed, so commands the server runs don't
+// inherit it.
+func activatedListener(name string) (net.Listener, error) {
+	activatedFiles.once.Do(func() {
+		activatedFiles.files = map[string]*os.File{}
+		pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if pid != os.Getpid() {
+			return
+		}
+		names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+		for i := 0; i < n; i++ {
+			fdName := strconv.Itoa(i)
+			if i < len(names) && names[i] != "" && names[i] != "unknown" {
+				fdName = names[i]
+			}
+			activatedFiles.files[fdName] = os.NewFile(uintptr(3+i), fdName)
+			activatedFiles.names = append(activatedFiles.names, fdName)
+		}
+		// Children mustn't take the sockets for their own.
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	})
+
+	if name == "" {
+		for _, fdName := range activatedFiles.names {
+			if activatedFiles.files[fdName] != nil {
+				name = fdName
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("systemd passed in no unused sockets")
+		}
+	}
+	file := activatedFiles.files[name]
+	if file == nil {
+		return nil, fmt.Errorf("systemd passed in no socket named %q", name)
+	}
+	delete(activatedFiles.files, name)
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// defaultJobStore is the --job-store of the serve command if none is
+// given: a file in the user's cache directory, so that jobs outlive a
+// restart without leaving a database in the working directory, or memory
+// if there is no such directory.
+func defaultJobStore() string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "memory"
+	}
+	return filepath.Join(cacheDir, "captionbot", "jobs.db")
+}
+
+// openJobStore opens the --job-store of the serve command.
+func openJobStore(name string, retention time.Duration) (server.JobStore, error) {
+	switch {
+	case name == "memory":
+		return server.NewMemoryJobStore(), nil
+	case strings.HasPrefix(name, "redis://"), strings.HasPrefix(name, "rediss://"):
+		store, err := redis.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		store.Retention = retention
+		return store, nil
+	case strings.HasPrefix(name, "postgres://"), strings.HasPrefix(name, "postgresql://"):
+		return postgres.Open(name)
+	default:
+		if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+			return nil, err
+		}
+		return bolt.Open(name)
+	}
+}
+
+// openCache opens the --cache of the serve command, if any.
+func openCache(name string) (server.Cache, error) {
+	switch {
+	case name == "":
+		return nil, nil
+	case name == "memory":
+		return server.NewMemoryCache(server.DefaultCacheEntries), nil
+	case strings.HasPrefix(name, "redis://"), strings.HasPrefix(name, "rediss://"):
+		return rediscache.Open(name)
+	default:
+		return &server.DirCache{Dir: name}, nil
+	}
+}
+
+// openKeyStore opens the serve command's API keys: --api-keys, a file or
+// Redis URL, or static keys from the environment.
+func openKeyStore(name, static string) (server.KeyStore, error) {
+	switch {
+	case name != "" && static != "":
+		return nil, fmt.Errorf("use either --api-keys or $CAPTIONBOT_API_KEYS")
+	case static != "":
+		return server.ParseStaticKeys(static)
+	case strings.HasPrefix(name, "redis://"), strings.HasPrefix(name, "rediss://"):
+		return keystore.Open(name)
+	case name != "":
+		return server.OpenKeyFile(name)
+	}
+	return nil, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/slack"
+)
+
+func runSlack(args []string) error {
+	flags := flag.NewFlagSet("slack", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	signingSecret := flags.String("signing-secret", "", "app signing secret (default $SLACK_SIGNING_SECRET)")
+	botToken := flags.String("token", "", "bot token (default $SLACK_BOT_TOKEN)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot slack [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(signingSecret, "SLACK_SIGNING_SECRET")
+	envDefault(botToken, "SLACK_BOT_TOKEN")
+
+	if *signingSecret == "" || *botToken == "" {
+		return fmt.Errorf("a signing secret and bot token are required")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+
+	http.Handle("/slack", slack.NewHandler(*signingSecret, *botToken, bot))
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/queue"
+	"github.com/nhatbui/captionbot/queue/sqs"
+	"github.com/nhatbui/captionbot/source"
+)
+
+func runSQS(args []string) error {
+	flags := flag.NewFlagSet("sqs", flag.ExitOnError)
+	resultQueue := flags.String("results-queue", "", "queue `URL` to send results to")
+	results := flags.String("results", "", "store results as ID.json in this writable `source`, such as s3://bucket/captions/")
+	table := flags.String("dynamodb-table", "", "DynamoDB `table` to put results into, keyed by \"id\"")
+	visibility := flags.Duration("visibility", time.Minute, "visibility timeout of received jobs, extended while captioning")
+	attempts := flags.Int("attempts", 0, "receives before a failing job is reported and deleted (0 leaves it to the queue's redrive policy)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot sqs [flags] QUEUE_URL\n")
+		fmt.Fprintf(flags.Output(), "AWS credentials are read from the environment or ~/.aws/credentials.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	worker, err := sqs.NewWorker(flags.Arg(0), queue.NewCaptioner(bot))
+	if err != nil {
+		return err
+	}
+	worker.ResultQueueURL = *resultQueue
+	worker.Table = *table
+	worker.VisibilityTimeout = *visibility
+	worker.MaxAttempts = *attempts
+	if *results != "" {
+		src, err := source.Open(*results)
+		if err != nil {
+			return err
+		}
+		writer, ok := src.(source.FileWriter)
+		if !ok {
+			return fmt.Errorf("%s can't store results", *results)
+		}
+		worker.Results = writer
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return worker.Run(ctx)
+}
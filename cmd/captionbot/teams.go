@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/teams"
+)
+
+func runTeams(args []string) error {
+	flags := flag.NewFlagSet("teams", flag.ExitOnError)
+	addr := flags.String("addr", ":3978", "address to listen on")
+	tenant := flags.String("tenant", "", "tenant ID of a single-tenant bot registration")
+	allow := flags.String("allow-tenants", "", "comma-separated tenant IDs allowed to use the bot (default all)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot teams [flags]\n")
+		fmt.Fprintf(flags.Output(), "Credentials are read from MICROSOFT_APP_ID and MICROSOFT_APP_PASSWORD.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	appID, appPassword := os.Getenv("MICROSOFT_APP_ID"), os.Getenv("MICROSOFT_APP_PASSWORD")
+	if appID == "" || appPassword == "" {
+		return fmt.Errorf("MICROSOFT_APP_ID and MICROSOFT_APP_PASSWORD must be set")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	handler := teams.NewHandler(appID, appPassword, *tenant, bot)
+	handler.Tenants = splitList(*allow)
+
+	http.Handle("/api/messages", handler)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/telegram"
+)
+
+func runTelegram(args []string) error {
+	flags := flag.NewFlagSet("telegram", flag.ExitOnError)
+	token := flags.String("token", "", "bot token (default $TELEGRAM_BOT_TOKEN)")
+	addr := flags.String("addr", "", "receive updates by webhook on this address instead of polling")
+	secret := flags.String("secret", "", "webhook secret token (default $TELEGRAM_SECRET_TOKEN)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot telegram [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(token, "TELEGRAM_BOT_TOKEN")
+	envDefault(secret, "TELEGRAM_SECRET_TOKEN")
+
+	if *token == "" {
+		return fmt.Errorf("a bot token is required")
+	}
+	if *addr != "" && *secret == "" {
+		return fmt.Errorf("a webhook secret token is required with --addr")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	tg := telegram.NewBot(*token, bot)
+	tg.SecretToken = *secret
+
+	if *addr == "" {
+		return tg.Poll()
+	}
+	http.Handle("/telegram", tg)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
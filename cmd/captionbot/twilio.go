@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/twilio"
+)
+
+func runTwilio(args []string) error {
+	flags := flag.NewFlagSet("twilio", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	publicURL := flags.String("url", "", "webhook URL as configured in Twilio, if behind a proxy")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot twilio [flags]\n")
+		fmt.Fprintf(flags.Output(), "Credentials are read from TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	accountSID, authToken := os.Getenv("TWILIO_ACCOUNT_SID"), os.Getenv("TWILIO_AUTH_TOKEN")
+	if accountSID == "" || authToken == "" {
+		return fmt.Errorf("TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN must be set")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	handler := twilio.NewHandler(accountSID, authToken, bot)
+	handler.PublicURL = *publicURL
+
+	http.Handle("/twilio", handler)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/twitter"
+	"github.com/nhatbui/captionbot/internal/oauth1"
+)
+
+func runTwitter(args []string) error {
+	flags := flag.NewFlagSet("x", flag.ExitOnError)
+	interval := flags.Duration("interval", 90*time.Second, "how often to check for mentions")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot x [flags]\n")
+		fmt.Fprintf(flags.Output(), "Credentials are read from X_API_KEY, X_API_SECRET, X_ACCESS_TOKEN and X_ACCESS_TOKEN_SECRET.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	credentials := oauth1.Credentials{
+		ConsumerKey:    os.Getenv("X_API_KEY"),
+		ConsumerSecret: os.Getenv("X_API_SECRET"),
+		Token:          os.Getenv("X_ACCESS_TOKEN"),
+		TokenSecret:    os.Getenv("X_ACCESS_TOKEN_SECRET"),
+	}
+	if credentials.ConsumerKey == "" || credentials.ConsumerSecret == "" || credentials.Token == "" || credentials.TokenSecret == "" {
+		return fmt.Errorf("X_API_KEY, X_API_SECRET, X_ACCESS_TOKEN and X_ACCESS_TOKEN_SECRET must be set")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	t := twitter.NewBot(credentials, bot)
+	t.Interval = *interval
+	return t.Run()
+}
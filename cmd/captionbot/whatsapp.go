@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/bot/whatsapp"
+)
+
+func runWhatsApp(args []string) error {
+	flags := flag.NewFlagSet("whatsapp", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	template := flags.String("template", "", "template with one body parameter to use outside the 24 hour window")
+	language := flags.String("template-language", "en_US", "language code of --template")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot whatsapp [flags]\n")
+		fmt.Fprintf(flags.Output(), "Credentials are read from WHATSAPP_TOKEN, WHATSAPP_APP_SECRET and WHATSAPP_VERIFY_TOKEN.\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	token, appSecret, verifyToken := os.Getenv("WHATSAPP_TOKEN"), os.Getenv("WHATSAPP_APP_SECRET"), os.Getenv("WHATSAPP_VERIFY_TOKEN")
+	if token == "" || appSecret == "" || verifyToken == "" {
+		return fmt.Errorf("WHATSAPP_TOKEN, WHATSAPP_APP_SECRET and WHATSAPP_VERIFY_TOKEN must be set")
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+	handler := whatsapp.NewHandler(token, appSecret, verifyToken, bot)
+	handler.TemplateName = *template
+	handler.TemplateLanguage = *language
+
+	http.Handle("/whatsapp", handler)
+	log.Printf("listening on %s", *addr)
+	return http.ListenAndServe(*addr, nil)
+}
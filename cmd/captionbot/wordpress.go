@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/cms/wordpress"
+)
+
+// wordPressCredentials is one entry of the --credentials file, which maps
+// site URLs to application passwords:
+//
+//	{"https://example.com": {"username": "editor", "password": "xxxx xxxx"}}
+type wordPressCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func runWordPress(args []string) error {
+	flags := flag.NewFlagSet("wordpress", flag.ExitOnError)
+	username := flags.String("user", "", "WordPress username (default $WORDPRESS_USER)")
+	password := flags.String("password", "", "application password (default $WORDPRESS_APP_PASSWORD)")
+	credentialsFile := flags.String("credentials", "", "JSON file of per-site credentials")
+	dryRun := flags.Bool("dry-run", false, "print captions without updating media")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: captionbot wordpress [flags] SITE...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	envDefault(username, "WORDPRESS_USER")
+	envDefault(password, "WORDPRESS_APP_PASSWORD")
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	credentials := map[string]wordPressCredentials{}
+	if *credentialsFile != "" {
+		data, err := os.ReadFile(*credentialsFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &credentials); err != nil {
+			return fmt.Errorf("parsing %s: %s", *credentialsFile, err)
+		}
+	}
+
+	bot, err := captionbot.New()
+	if err != nil {
+		return err
+	}
+
+	for _, site := range flags.Args() {
+		creds, ok := credentials[strings.TrimRight(site, "/")]
+		if !ok {
+			creds = wordPressCredentials{Username: *username, Password: *password}
+		}
+		if creds.Username == "" && !*dryRun {
+			return fmt.Errorf("no credentials for %s", site)
+		}
+
+		client := wordpress.NewClient(site, creds.Username, creds.Password)
+		err := wordpress.CaptionMissing(client, bot, *dryRun, func(result wordpress.Result) {
+			if result.Err != nil {
+				fmt.Fprintf(os.Stderr, "%s: media %d: %s\n", site, result.Media.ID, result.Err)
+				return
+			}
+			fmt.Printf("%s\t%d\t%s\n", site, result.Media.ID, result.Caption)
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", site, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,344 @@
+// Package contentful fills in empty asset and entry descriptions in a
+// Contentful space using captions generated by captionbot.
+package contentful
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// BaseURL is the root of the Contentful Content Management API.
+var BaseURL = "https://api.contentful.com"
+
+// Client talks to the Management API for one space environment.
+type Client struct {
+	SpaceID     string
+	Environment string
+	Token       string
+	HTTPClient  *http.Client
+}
+
+// Sys is the metadata block shared by all Contentful objects.
+type Sys struct {
+	ID       string `json:"id"`
+	Type     string `json:"type,omitempty"`
+	LinkType string `json:"linkType,omitempty"`
+	Version  int    `json:"version,omitempty"`
+}
+
+// Fields maps field IDs to their per-locale values.
+type Fields map[string]map[string]json.RawMessage
+
+// Item is an asset or entry.
+type Item struct {
+	Sys    Sys    `json:"sys"`
+	Fields Fields `json:"fields"`
+}
+
+// Translator turns a caption into the language of locale. It is used to fill
+// locales other than the space's default one.
+type Translator func(caption, locale string) (string, error)
+
+// Options controls CaptionAssets and CaptionEntries.
+type Options struct {
+	// Locales to fill. Empty means only the space's default locale.
+	Locales []string
+	// Translate is required to fill any locale other than the default one;
+	// without it those locales are skipped.
+	Translate Translator
+	// Publish republishes items after updating them.
+	Publish bool
+	DryRun  bool
+}
+
+// Result reports what happened to one item. Captions maps locales to the
+// text written.
+type Result struct {
+	Item     Item
+	Captions map[string]string
+	Updated  bool
+	Err      error
+}
+
+// NewClient creates a Client for the given space and environment.
+func NewClient(spaceID, environment, token string) *Client {
+	return &Client{SpaceID: spaceID, Environment: environment, Token: token}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (client *Client) do(method, path string, query url.Values, version int, body interface{}, out interface{}) error {
+	endpoint := fmt.Sprintf("%s/spaces/%s/environments/%s/%s", BaseURL, client.SpaceID, client.Environment, path)
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var data bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&data).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(method, endpoint, &data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+client.Token)
+	req.Header.Set("Content-Type", "application/vnd.contentful.management.v1+json")
+	if version > 0 {
+		req.Header.Set("X-Contentful-Version", strconv.Itoa(version))
+	}
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("contentful: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// DefaultLocale returns the code of the environment's default locale.
+func (client *Client) DefaultLocale() (string, error) {
+	var response struct {
+		Items []struct {
+			Code    string `json:"code"`
+			Default bool   `json:"default"`
+		} `json:"items"`
+	}
+	if err := client.do("GET", "locales", nil, 0, nil, &response); err != nil {
+		return "", err
+	}
+	for _, locale := range response.Items {
+		if locale.Default {
+			return locale.Code, nil
+		}
+	}
+	return "", fmt.Errorf("contentful: no default locale")
+}
+
+// list calls fn for every item of a collection ("assets" or "entries").
+func (client *Client) list(collection string, query url.Values, fn func(Item) error) error {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("limit", "100")
+
+	for skip := 0; ; {
+		query.Set("skip", strconv.Itoa(skip))
+
+		var response struct {
+			Items []Item `json:"items"`
+			Total int    `json:"total"`
+		}
+		if err := client.do("GET", collection, query, 0, nil, &response); err != nil {
+			return err
+		}
+		for _, item := range response.Items {
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+
+		skip += len(response.Items)
+		if len(response.Items) == 0 || skip >= response.Total {
+			return nil
+		}
+	}
+}
+
+// Asset fetches a single asset.
+func (client *Client) Asset(id string) (Item, error) {
+	var item Item
+	err := client.do("GET", "assets/"+id, nil, 0, nil, &item)
+	return item, err
+}
+
+// update writes the fields of item and optionally publishes the new version.
+func (client *Client) update(collection string, item Item, publish bool) error {
+	var updated Item
+	body := map[string]Fields{"fields": item.Fields}
+	path := collection + "/" + item.Sys.ID
+	if err := client.do("PUT", path, nil, item.Sys.Version, body, &updated); err != nil {
+		return err
+	}
+	if publish {
+		return client.do("PUT", path+"/published", nil, updated.Sys.Version, nil, nil)
+	}
+	return nil
+}
+
+// stringField returns the string value of field in locale.
+func (item Item) stringField(field, locale string) string {
+	var s string
+	json.Unmarshal(item.Fields[field][locale], &s)
+	return s
+}
+
+func (item Item) setStringField(field, locale, value string) {
+	if item.Fields[field] == nil {
+		item.Fields[field] = map[string]json.RawMessage{}
+	}
+	raw, _ := json.Marshal(value)
+	item.Fields[field][locale] = raw
+}
+
+// fileURL returns the absolute URL of an image asset's file in locale, or ""
+// if the asset is not an image.
+func (item Item) fileURL(locale string) string {
+	var file struct {
+		URL         string `json:"url"`
+		ContentType string `json:"contentType"`
+	}
+	json.Unmarshal(item.Fields["file"][locale], &file)
+	if file.URL == "" || !strings.HasPrefix(file.ContentType, "image/") {
+		return ""
+	}
+	if strings.HasPrefix(file.URL, "//") {
+		return "https:" + file.URL
+	}
+	return file.URL
+}
+
+// filler fills one text field of an item across the requested locales.
+type filler struct {
+	client        *Client
+	bot           captionbot.CaptionBotConnection
+	opts          Options
+	defaultLocale string
+	locales       []string
+}
+
+func newFiller(client *Client, bot captionbot.CaptionBotConnection, opts Options) (*filler, error) {
+	defaultLocale, err := client.DefaultLocale()
+	if err != nil {
+		return nil, err
+	}
+	locales := opts.Locales
+	if len(locales) == 0 {
+		locales = []string{defaultLocale}
+	}
+	return &filler{client, bot, opts, defaultLocale, locales}, nil
+}
+
+// fill captions imageURL into the empty locales of field and writes the
+// item back.
+func (f *filler) fill(collection string, item Item, field, imageURL string) *Result {
+	var empty []string
+	for _, locale := range f.locales {
+		if strings.TrimSpace(item.stringField(field, locale)) != "" {
+			continue
+		}
+		if locale != f.defaultLocale && f.opts.Translate == nil {
+			continue
+		}
+		empty = append(empty, locale)
+	}
+	if len(empty) == 0 {
+		return nil
+	}
+
+	if item.Fields == nil {
+		item.Fields = Fields{}
+	}
+	result := &Result{Item: item, Captions: map[string]string{}}
+	caption, err := f.bot.URLCaption(imageURL)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	for _, locale := range empty {
+		text := caption
+		if locale != f.defaultLocale {
+			if text, err = f.opts.Translate(caption, locale); err != nil {
+				result.Err = fmt.Errorf("translating to %s: %s", locale, err)
+				return result
+			}
+		}
+		item.setStringField(field, locale, text)
+		result.Captions[locale] = text
+	}
+
+	if !f.opts.DryRun {
+		result.Err = f.client.update(collection, item, f.opts.Publish)
+		result.Updated = result.Err == nil
+	}
+	return result
+}
+
+// CaptionAssets fills the empty description fields of all image assets.
+// fn, if non-nil, is called for every asset that needed a caption.
+func CaptionAssets(client *Client, bot captionbot.CaptionBotConnection, opts Options, fn func(Result)) error {
+	f, err := newFiller(client, bot, opts)
+	if err != nil {
+		return err
+	}
+
+	return client.list("assets", nil, func(item Item) error {
+		imageURL := item.fileURL(f.defaultLocale)
+		if imageURL == "" {
+			return nil
+		}
+		if result := f.fill("assets", item, "description", imageURL); result != nil && fn != nil {
+			fn(*result)
+		}
+		return nil
+	})
+}
+
+// CaptionEntries fills textField of every entry of contentType whose
+// imageField links to an image asset and whose textField is empty.
+func CaptionEntries(client *Client, bot captionbot.CaptionBotConnection, contentType, imageField, textField string, opts Options, fn func(Result)) error {
+	f, err := newFiller(client, bot, opts)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("content_type", contentType)
+	return client.list("entries", query, func(item Item) error {
+		var link struct {
+			Sys Sys `json:"sys"`
+		}
+		json.Unmarshal(item.Fields[imageField][f.defaultLocale], &link)
+		if link.Sys.LinkType != "Asset" {
+			return nil
+		}
+
+		asset, err := client.Asset(link.Sys.ID)
+		if err != nil {
+			if fn != nil {
+				fn(Result{Item: item, Err: err})
+			}
+			return nil
+		}
+		imageURL := asset.fileURL(f.defaultLocale)
+		if imageURL == "" {
+			return nil
+		}
+		if result := f.fill("entries", item, textField, imageURL); result != nil && fn != nil {
+			fn(*result)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,293 @@
+// Package ghost fills in missing image alt text in Ghost posts using
+// captions generated by captionbot.
+package ghost
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// Client talks to the Ghost Admin API of a single site.
+// AdminKey is the "id:secret" key of a custom integration.
+// Interval is the minimum delay between two API calls.
+type Client struct {
+	SiteURL    string
+	AdminKey   string
+	Interval   time.Duration
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	lastCall time.Time
+}
+
+// Post is the subset of a Ghost post used here.
+type Post struct {
+	ID        string `json:"id"`
+	Title     string `json:"title"`
+	HTML      string `json:"html"`
+	UpdatedAt string `json:"updated_at"`
+}
+
+// Change records one image whose alt text was generated.
+type Change struct {
+	PostID  string    `json:"post_id"`
+	Title   string    `json:"title"`
+	Image   string    `json:"image"`
+	Caption string    `json:"caption"`
+	Time    time.Time `json:"time"`
+}
+
+// Result reports what happened to one post.
+type Result struct {
+	Post    Post
+	Changes []Change
+	Updated bool
+	Err     error
+}
+
+// NewClient creates a Client for the site rooted at siteURL that makes at
+// most one API call per interval.
+func NewClient(siteURL, adminKey string, interval time.Duration) *Client {
+	return &Client{
+		SiteURL:  strings.TrimRight(siteURL, "/"),
+		AdminKey: adminKey,
+		Interval: interval,
+	}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// wait blocks until Interval has passed since the previous API call.
+func (client *Client) wait() {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if delay := client.Interval - time.Since(client.lastCall); delay > 0 {
+		time.Sleep(delay)
+	}
+	client.lastCall = time.Now()
+}
+
+// token creates the short-lived JWT Ghost expects from Admin API clients.
+func (client *Client) token() (string, error) {
+	parts := strings.SplitN(client.AdminKey, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("ghost: admin key must be of the form id:secret")
+	}
+	secret, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("ghost: decoding admin key secret: %s", err)
+	}
+
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT", "kid": parts[0]})
+	claims, _ := json.Marshal(map[string]interface{}{"iat": now, "exp": now + 300, "aud": "/admin/"})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (client *Client) do(method, path string, query url.Values, body interface{}, out interface{}) error {
+	endpoint := client.SiteURL + "/ghost/api/admin/" + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var data bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&data).Encode(body); err != nil {
+			return err
+		}
+	}
+
+	token, err := client.token()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(method, endpoint, &data)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Ghost "+token)
+	req.Header.Set("Accept-Version", "v5.0")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client.wait()
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("ghost: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// ListPosts returns one page of posts, with their HTML, and the number of the
+// next page (0 on the last page).
+func (client *Client) ListPosts(page int) ([]Post, int, error) {
+	query := url.Values{}
+	query.Set("formats", "html")
+	query.Set("limit", "15")
+	query.Set("page", strconv.Itoa(page))
+
+	var response struct {
+		Posts []Post `json:"posts"`
+		Meta  struct {
+			Pagination struct {
+				Next int `json:"next"`
+			} `json:"pagination"`
+		} `json:"meta"`
+	}
+	if err := client.do("GET", "posts/", query, nil, &response); err != nil {
+		return nil, 0, err
+	}
+	return response.Posts, response.Meta.Pagination.Next, nil
+}
+
+// UpdatePostHTML replaces the content of a post with html. updatedAt must be
+// the post's current updated_at value; Ghost uses it to detect conflicts.
+func (client *Client) UpdatePostHTML(id, html, updatedAt string) error {
+	query := url.Values{}
+	query.Set("source", "html")
+
+	body := map[string][]map[string]string{
+		"posts": {{"html": html, "updated_at": updatedAt}},
+	}
+	return client.do("PUT", "posts/"+id+"/", query, body, nil)
+}
+
+var (
+	imgTag  = regexp.MustCompile(`(?i)<img\b[^>]*>`)
+	srcAttr = regexp.MustCompile(`(?i)\ssrc\s*=\s*("[^"]*"|'[^']*')`)
+	altAttr = regexp.MustCompile(`(?i)\salt\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+func attrValue(match []string) string {
+	if match == nil {
+		return ""
+	}
+	return strings.Trim(match[1], `"'`)
+}
+
+// fillAltText captions each <img> in the post's html that lacks alt text and
+// returns the rewritten html along with the changes made.
+func fillAltText(post Post, base *url.URL, bot captionbot.CaptionBotConnection) (string, []Change, error) {
+	var changes []Change
+	var firstErr error
+
+	rewritten := imgTag.ReplaceAllStringFunc(post.HTML, func(tag string) string {
+		if firstErr != nil || strings.TrimSpace(attrValue(altAttr.FindStringSubmatch(tag))) != "" {
+			return tag
+		}
+		src := attrValue(srcAttr.FindStringSubmatch(tag))
+		if src == "" {
+			return tag
+		}
+		if ref, err := url.Parse(src); err == nil {
+			src = base.ResolveReference(ref).String()
+		}
+
+		caption, err := bot.URLCaption(src)
+		if err != nil {
+			firstErr = fmt.Errorf("captioning %s: %s", src, err)
+			return tag
+		}
+		changes = append(changes, Change{
+			PostID:  post.ID,
+			Title:   post.Title,
+			Image:   src,
+			Caption: caption,
+			Time:    time.Now(),
+		})
+
+		alt := ` alt="` + escapeAttr(caption) + `"`
+		if altAttr.MatchString(tag) {
+			return altAttr.ReplaceAllLiteralString(tag, alt)
+		}
+		return strings.Replace(tag, "<img", "<img"+alt, 1)
+	})
+	return rewritten, changes, firstErr
+}
+
+func escapeAttr(s string) string {
+	return strings.NewReplacer(`&`, "&amp;", `"`, "&quot;", `<`, "&lt;", `>`, "&gt;").Replace(s)
+}
+
+// CaptionMissing captions every image without alt text in every post and
+// updates the posts with the new alt attributes. With dryRun set nothing is
+// written. fn, if non-nil, is called with the outcome for each post that had
+// images to caption. Only listing errors abort the run.
+func CaptionMissing(client *Client, bot captionbot.CaptionBotConnection, dryRun bool, fn func(Result)) error {
+	base, err := url.Parse(client.SiteURL + "/")
+	if err != nil {
+		return err
+	}
+
+	for page := 1; page != 0; {
+		var posts []Post
+		posts, page, err = client.ListPosts(page)
+		if err != nil {
+			return err
+		}
+
+		for _, post := range posts {
+			html, changes, err := fillAltText(post, base, bot)
+			if len(changes) == 0 && err == nil {
+				continue
+			}
+
+			result := Result{Post: post, Changes: changes, Err: err}
+			if result.Err == nil && !dryRun {
+				result.Err = client.UpdatePostHTML(post.ID, html, post.UpdatedAt)
+				result.Updated = result.Err == nil
+			}
+			if fn != nil {
+				fn(result)
+			}
+		}
+	}
+	return nil
+}
+
+// WriteChangeLog appends the changes of result to w as JSON lines.
+func WriteChangeLog(w io.Writer, result Result) error {
+	enc := json.NewEncoder(w)
+	for _, change := range result.Changes {
+		if err := enc.Encode(change); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package ghost
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	keyID     = "6489b4b1b7a3b1f2"
+	keySecret = "a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90"
+)
+
+// newAdmin returns a fake Admin API that, as Ghost does, accepts only
+// HS256 tokens for keyID, signed with keySecret, for /admin/, expiring
+// within five minutes.
+func newAdmin(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Ghost ")
+		parts := strings.Split(raw, ".")
+		if !ok || len(parts) != 3 {
+			http.Error(w, "no token", http.StatusUnauthorized)
+			return
+		}
+		secret, _ := hex.DecodeString(keySecret)
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		var header struct{ Alg, Kid string }
+		var claims struct {
+			Iat, Exp int64
+			Aud      string
+		}
+		headerJSON, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(headerJSON, &header)
+		json.Unmarshal(claimsJSON, &claims)
+		now := time.Now().Unix()
+		if !hmac.Equal(signature, mac.Sum(nil)) || header.Alg != "HS256" || header.Kid != keyID ||
+			claims.Aud != "/admin/" || claims.Exp < now || claims.Exp-claims.Iat > 300 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"posts":[{"id":"1","title":"Hello"}],"meta":{"pagination":{"next":null}}}`))
+	}))
+}
+
+func TestAdminToken(t *testing.T) {
+	admin := newAdmin(t)
+	defer admin.Close()
+
+	tests := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"valid", keyID + ":" + keySecret, true},
+		{"other secret", keyID + ":" + strings.Repeat("00", 32), false},
+		{"other id", "other:" + keySecret, false},
+		{"no secret", keyID, false},
+		{"secret not hex", keyID + ":not-hex", false},
+	}
+	for _, test := range tests {
+		posts, _, err := NewClient(admin.URL, test.key, 0).ListPosts(1)
+		if test.ok && (err != nil || len(posts) != 1) {
+			t.Errorf("%s: ListPosts = %v, %v, want a post", test.name, posts, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: ListPosts succeeded", test.name)
+		}
+	}
+}
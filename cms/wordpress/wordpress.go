@@ -0,0 +1,159 @@
+// Package wordpress fills in missing image alt text in a WordPress media
+// library using captions generated by captionbot.
+package wordpress
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// Client talks to the WordPress REST API (wp-json/wp/v2) of a single site.
+// Username and Password are the credentials of an application password;
+// they are only needed to update media.
+type Client struct {
+	SiteURL    string
+	Username   string
+	Password   string
+	HTTPClient *http.Client
+}
+
+// Media is the subset of a WordPress media object used here.
+type Media struct {
+	ID        int    `json:"id"`
+	SourceURL string `json:"source_url"`
+	AltText   string `json:"alt_text"`
+	MediaType string `json:"media_type"`
+	MimeType  string `json:"mime_type"`
+}
+
+// Result reports what happened to one media item.
+type Result struct {
+	Media   Media
+	Caption string
+	Updated bool
+	Err     error
+}
+
+// NewClient creates a Client for the site rooted at siteURL.
+func NewClient(siteURL, username, password string) *Client {
+	return &Client{
+		SiteURL:  strings.TrimRight(siteURL, "/"),
+		Username: username,
+		Password: password,
+	}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (client *Client) do(method, path string, query url.Values, body interface{}, out interface{}) (*http.Response, error) {
+	endpoint := client.SiteURL + "/wp-json/wp/v2/" + path
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+
+	var data bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&data).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	req, err := http.NewRequest(method, endpoint, &data)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.Username != "" {
+		req.SetBasicAuth(client.Username, client.Password)
+	}
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, fmt.Errorf("wordpress: %s %s: status %d", method, path, resp.StatusCode)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// ListMedia returns one page of image media along with the total number of
+// pages reported by the server.
+func (client *Client) ListMedia(page int) ([]Media, int, error) {
+	query := url.Values{}
+	query.Set("media_type", "image")
+	query.Set("per_page", "100")
+	query.Set("page", strconv.Itoa(page))
+
+	var media []Media
+	resp, err := client.do("GET", "media", query, nil, &media)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	totalPages, err := strconv.Atoi(resp.Header.Get("X-WP-TotalPages"))
+	if err != nil {
+		totalPages = page
+	}
+	return media, totalPages, nil
+}
+
+// UpdateAltText sets the alt_text field of the media item with the given ID.
+func (client *Client) UpdateAltText(id int, altText string) error {
+	body := map[string]string{"alt_text": altText}
+	_, err := client.do("POST", "media/"+strconv.Itoa(id), nil, body, nil)
+	return err
+}
+
+// CaptionMissing captions every image in the media library that has no alt
+// text and writes the caption back as its alt_text. With dryRun set nothing
+// is written. fn, if non-nil, is called with the outcome for each item.
+// Per-item failures are reported through fn; only listing errors abort.
+func CaptionMissing(client *Client, bot captionbot.CaptionBotConnection, dryRun bool, fn func(Result)) error {
+	for page, totalPages := 1, 1; page <= totalPages; page++ {
+		var media []Media
+		var err error
+		media, totalPages, err = client.ListMedia(page)
+		if err != nil {
+			return err
+		}
+
+		for _, item := range media {
+			if strings.TrimSpace(item.AltText) != "" {
+				continue
+			}
+
+			result := Result{Media: item}
+			result.Caption, result.Err = bot.URLCaption(item.SourceURL)
+			if result.Err == nil && !dryRun {
+				result.Err = client.UpdateAltText(item.ID, result.Caption)
+				result.Updated = result.Err == nil
+			}
+			if fn != nil {
+				fn(result)
+			}
+		}
+	}
+	return nil
+}
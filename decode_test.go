@@ -0,0 +1,238 @@
+package captionbot_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+func TestParseMessageResponseFixtures(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		caption   string
+		waterMark string
+		status    string
+	}{
+		{"message", "I think it's a man wearing glasses and smiling at the camera.", "1", ""},
+		{"message-unicode", "I really can't describe the picture \U0001f633", "2", ""},
+		{"message-status", "I am not really confident, but I think it's a cat sitting on a couch.", "3", "Complete"},
+		{"message-once", "I think it's a dog lying on the grass.", "4", ""},
+		{"message-newlines", "I think it's a group of people on a beach.\nYou look happy.", "6", ""},
+		{"message-twice", "I think it's a cat.", "7", ""},
+		{"message-unquoted", "I think it's a cat.", "7", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			response, err := captionbot.ParseMessageResponse(bytes.NewReader(captionbottest.Fixture(test.fixture)))
+			if err != nil {
+				t.Fatalf("ParseMessageResponse: %v", err)
+			}
+			if got := response.Caption(); got != test.caption {
+				t.Errorf("Caption() = %q, want %q", got, test.caption)
+			}
+			if response.WaterMark != test.waterMark {
+				t.Errorf("WaterMark = %q, want %q", response.WaterMark, test.waterMark)
+			}
+			if response.Status != test.status {
+				t.Errorf("Status = %q, want %q", response.Status, test.status)
+			}
+			if response.ConversationID != "Gb5vl7kNlF6Bk2KuQI1Ssn" {
+				t.Errorf("ConversationID = %q", response.ConversationID)
+			}
+			if err := response.CheckSchema(); err != nil {
+				t.Errorf("CheckSchema: %v", err)
+			}
+			if !json.Valid(response.Raw) {
+				t.Errorf("Raw isn't JSON: %s", response.Raw)
+			}
+		})
+	}
+}
+
+func TestParseMessageResponseNoCaption(t *testing.T) {
+	_, err := captionbot.ParseMessageResponse(bytes.NewReader(captionbottest.Fixture("message-no-caption")))
+	var schemaErr *captionbot.SchemaError
+	if !errors.As(err, &schemaErr) {
+		t.Fatalf("err = %v, want a *SchemaError", err)
+	}
+	if !reflect.DeepEqual(schemaErr.Missing, []string{"BotMessages"}) {
+		t.Errorf("Missing = %q", schemaErr.Missing)
+	}
+}
+
+func TestDecodeResponseStrings(t *testing.T) {
+	tests := []struct {
+		fixture string
+		want    string
+	}{
+		{"init", "Gb5vl7kNlF6Bk2KuQI1Ssn"},
+		{"upload", "https://captionbot.blob.core.windows.net/images-container/2ojq5ex4.jpg"},
+	}
+	for _, test := range tests {
+		var got string
+		if err := captionbot.DecodeResponse(captionbottest.Fixture(test.fixture), &got); err != nil {
+			t.Errorf("%s: DecodeResponse: %v", test.fixture, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: got %q, want %q", test.fixture, got, test.want)
+		}
+	}
+}
+
+func TestDecodeResponse(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"plain", `{"WaterMark":"1"}`, "1"},
+		{"encoded", `"{\"WaterMark\":\"1\"}"`, "1"},
+		{"byte order mark", "\ufeff" + `"{\"WaterMark\":\"1\"}"`, "1"},
+		{"escaped newlines around", `\n{"WaterMark":"1"}\r\n`, "1"},
+		{"escaped newlines between tokens", `{\n"WaterMark":\t"1"\n}`, "1"},
+		{"escapes without their string", `{\"WaterMark\":\"1\"}`, "1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response captionbot.CaptionBotResponse
+			if err := captionbot.DecodeResponse([]byte(test.body), &response); err != nil {
+				t.Fatalf("DecodeResponse: %v", err)
+			}
+			if response.WaterMark != test.want {
+				t.Errorf("WaterMark = %q, want %q", response.WaterMark, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeResponseMalformed(t *testing.T) {
+	for _, body := range []string{``, `{"WaterMark":`, `"{\"WaterMark\":"`, `<html>Service Unavailable</html>`} {
+		var response captionbot.CaptionBotResponse
+		err := captionbot.DecodeResponse([]byte(body), &response)
+		if !errors.Is(err, captionbot.ErrMalformedResponse) {
+			t.Errorf("%q: err = %v, want ErrMalformedResponse", body, err)
+			continue
+		}
+		var malformed *captionbot.MalformedResponseError
+		if !errors.As(err, &malformed) || string(malformed.Body) != body {
+			t.Errorf("%q: err = %#v, want a *MalformedResponseError with the body", body, err)
+		}
+	}
+}
+
+func TestCaptionBotResponseUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    captionbot.CaptionBotResponse
+		unknown []string
+		renamed []string
+	}{
+		{
+			name: "own names",
+			body: `{"ConversationID":"c","WaterMark":"2","Status":null,"BotMessages":["u","a cat"]}`,
+			want: captionbot.CaptionBotResponse{ConversationID: "c", WaterMark: "2", BotMessages: []string{"u", "a cat"}},
+		},
+		{
+			name:    "other naming styles",
+			body:    `{"conversation_id":"c","water_mark":"2","bot-messages":["u","a cat"]}`,
+			want:    captionbot.CaptionBotResponse{ConversationID: "c", WaterMark: "2", BotMessages: []string{"u", "a cat"}},
+			renamed: []string{"BotMessages as bot-messages", "ConversationID as conversation_id", "WaterMark as water_mark"},
+		},
+		{
+			name:    "other names",
+			body:    `{"conversation":"c","state":"Complete","messages":["u","a cat"]}`,
+			want:    captionbot.CaptionBotResponse{ConversationID: "c", Status: "Complete", BotMessages: []string{"u", "a cat"}},
+			renamed: []string{"BotMessages as messages", "ConversationID as conversation", "Status as state"},
+		},
+		{
+			name:    "own name wins",
+			body:    `{"WaterMark":"2","water_mark":"9"}`,
+			want:    captionbot.CaptionBotResponse{WaterMark: "2"},
+			renamed: []string{"WaterMark as water_mark"},
+		},
+		{
+			name: "numbers as text",
+			body: `{"WaterMark":2,"BotMessages":["u",3]}`,
+			want: captionbot.CaptionBotResponse{WaterMark: "2", BotMessages: []string{"u", "3"}},
+		},
+		{
+			name: "messages as objects",
+			body: `{"BotMessages":[{"text":"u"},{"caption":"a cat"},{"message":"nice"}]}`,
+			want: captionbot.CaptionBotResponse{BotMessages: []string{"u", "a cat", "nice"}},
+		},
+		{
+			name:    "unknown and undecodable fields",
+			body:    `{"WaterMark":"2","Confidence":0.9,"BotMessages":{"text":"a cat"}}`,
+			want:    captionbot.CaptionBotResponse{WaterMark: "2"},
+			unknown: []string{"BotMessages", "Confidence"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var response captionbot.CaptionBotResponse
+			if err := json.Unmarshal([]byte(test.body), &response); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if string(response.Raw) != test.body {
+				t.Errorf("Raw = %s, want %s", response.Raw, test.body)
+			}
+			if response.ConversationID != test.want.ConversationID || response.WaterMark != test.want.WaterMark ||
+				response.Status != test.want.Status || !reflect.DeepEqual(response.BotMessages, test.want.BotMessages) {
+				t.Errorf("got %+v, want %+v", response, test.want)
+			}
+
+			err := response.CheckSchema()
+			if test.unknown == nil && test.renamed == nil {
+				if err != nil {
+					t.Errorf("CheckSchema: %v", err)
+				}
+				return
+			}
+			var schemaErr *captionbot.SchemaError
+			if !errors.As(err, &schemaErr) {
+				t.Fatalf("CheckSchema = %v, want a *SchemaError", err)
+			}
+			if !reflect.DeepEqual(schemaErr.Unknown, test.unknown) {
+				t.Errorf("Unknown = %q, want %q", schemaErr.Unknown, test.unknown)
+			}
+			if !sameStrings(schemaErr.Renamed, test.renamed) {
+				t.Errorf("Renamed = %q, want %q", schemaErr.Renamed, test.renamed)
+			}
+		})
+	}
+}
+
+func TestCaptionBotResponseUnmarshalJSONNotObject(t *testing.T) {
+	var response captionbot.CaptionBotResponse
+	if err := json.Unmarshal([]byte(`["a cat"]`), &response); err == nil {
+		t.Error("Unmarshal of an array succeeded")
+	}
+	if err := json.Unmarshal([]byte(`null`), &response); err != nil {
+		t.Errorf("Unmarshal of null: %v", err)
+	}
+}
+
+// sameStrings reports whether a and b hold the same strings in any order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := map[string]int{}
+	for _, s := range a {
+		seen[s]++
+	}
+	for _, s := range b {
+		if seen[s] == 0 {
+			return false
+		}
+		seen[s]--
+	}
+	return true
+}
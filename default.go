@@ -0,0 +1,58 @@
+package captionbot
+
+import (
+	"context"
+	"net/http/cookiejar"
+)
+
+// defaultBot holds the client Caption and CaptionFile share, nil until
+// one of them first initializes it. Taking the client from the channel
+// is what lets one caption at a time use its session.
+var defaultBot = make(chan *CaptionBot, 1)
+
+func init() {
+	defaultBot <- nil
+}
+
+// Caption captions the image at url with a default client, created on
+// first use and shared by every call, as http.Get shares
+// http.DefaultClient. It is safe for concurrent use, though captions are
+// made one at a time since the client has a single session. When ctx is
+// done, Caption stops waiting for the client and cancels its requests.
+func Caption(ctx context.Context, url string) (string, error) {
+	return withDefault(ctx, func(bot *CaptionBot) (string, error) {
+		return bot.URLCaptionContext(ctx, url)
+	})
+}
+
+// CaptionFile uploads the image file at path and captions it with the
+// default client Caption uses.
+// The file is streamed to the upload, not read into memory first.
+func CaptionFile(ctx context.Context, path string) (string, error) {
+	return withDefault(ctx, func(bot *CaptionBot) (string, error) {
+		return bot.UploadCaptionContext(ctx, path)
+	})
+}
+
+// withDefault runs caption with the default client, initializing it
+// first if no call has yet. The client is put back even if caption
+// panics, so later calls don't wait for it forever.
+func withDefault(ctx context.Context, caption func(*CaptionBot) (string, error)) (string, error) {
+	var bot *CaptionBot
+	select {
+	case bot = <-defaultBot:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { defaultBot <- bot }()
+
+	if bot == nil {
+		initialized := &CaptionBot{}
+		initialized.Jar, _ = cookiejar.New(nil)
+		if err := initialized.InitializeContext(ctx); err != nil {
+			return "", err
+		}
+		bot = initialized
+	}
+	return caption(bot)
+}
@@ -0,0 +1,47 @@
+package captionbot_test
+
+import (
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+func TestCaptionFile(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	defer server.Use()()
+	server.SetCaption("cat.png", "a cat")
+
+	dir := t.TempDir()
+	file, err := os.Create(filepath.Join(dir, "cat.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := png.Encode(file, image.NewGray(image.Rect(0, 0, 4, 4))); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := captionbot.CaptionFile(ctx, filepath.Join(dir, "missing.png")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("missing file: err = %v, want fs.ErrNotExist", err)
+	}
+	// The failed call gave the default client back.
+	caption, err := captionbot.CaptionFile(ctx, filepath.Join(dir, "cat.png"))
+	if err != nil {
+		t.Fatalf("CaptionFile: %v", err)
+	}
+	if caption != "a cat" {
+		t.Errorf("caption = %q, want %q", caption, "a cat")
+	}
+}
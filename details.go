@@ -0,0 +1,47 @@
+package captionbot
+
+import "context"
+
+// CaptionDetails is a caption with the rest of the response it came in,
+// for callers who want more than the text URLCaption returns.
+type CaptionDetails struct {
+	Caption        string `json:"caption"`
+	Status         string `json:"status,omitempty"`
+	ConversationID string `json:"conversation_id"`
+	WaterMark      string `json:"watermark"`
+	// EchoedURL is the image URL captionbot.ai echoed back, and Remarks
+	// the messages after the caption.
+	EchoedURL string   `json:"echoed_url,omitempty"`
+	Remarks   []string `json:"remarks,omitempty"`
+	// RawMessages are all of the response's BotMessages, in order.
+	RawMessages []string `json:"raw_messages"`
+}
+
+// Details returns the response's caption and the rest of its fields.
+func (response *CaptionBotResponse) Details() *CaptionDetails {
+	return &CaptionDetails{
+		Caption:        response.Caption(),
+		Status:         response.Status,
+		ConversationID: response.ConversationID,
+		WaterMark:      response.WaterMark,
+		EchoedURL:      response.EchoedURL(),
+		Remarks:        response.Remarks(),
+		RawMessages:    append([]string(nil), response.BotMessages...),
+	}
+}
+
+// CaptionDetailed captions the image at url as URLCaption does, but
+// returns the caption's details.
+func (captionBot *CaptionBot) CaptionDetailed(url string) (*CaptionDetails, error) {
+	return captionBot.CaptionDetailedContext(context.Background(), url)
+}
+
+// CaptionDetailedContext is CaptionDetailed with a context for its
+// requests.
+func (captionBot *CaptionBot) CaptionDetailedContext(ctx context.Context, url string) (*CaptionDetails, error) {
+	response, err := captionBot.URLCaptionResponseContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return response.Details(), nil
+}
@@ -0,0 +1,75 @@
+package captionbot
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Errors that failed requests match with errors.Is.
+var (
+	// ErrNotInitialized is the error of a caption or rating made before
+	// Initialize has started the session.
+	ErrNotInitialized = errors.New("captionbot: session not initialized")
+	// ErrRateLimited matches an *APIError of a 429.
+	ErrRateLimited = errors.New("captionbot: rate limited")
+	// ErrBadImage matches an *APIError of an image captionbot.ai won't
+	// caption: a 400 that starting a new conversation didn't cure, a 413,
+	// 415 or 422.
+	ErrBadImage = errors.New("captionbot: bad image")
+)
+
+// maxErrorBody is how much of a failed response's body an APIError
+// keeps.
+const maxErrorBody = 512
+
+// APIError is the error of a request captionbot.ai answered with a
+// status other than 2XX.
+type APIError struct {
+	Method string
+	// Endpoint is "init", "message" or "upload".
+	Endpoint   string
+	StatusCode int
+	Status     string
+	// Body is the start of the response's body.
+	Body string
+}
+
+func (err *APIError) Error() string {
+	if err.Body == "" {
+		return fmt.Sprintf("captionbot: %s %s answered %s", err.Method, err.Endpoint, err.Status)
+	}
+	return fmt.Sprintf("captionbot: %s %s answered %s: %s", err.Method, err.Endpoint, err.Status, err.Body)
+}
+
+// Is reports whether target is ErrRateLimited or ErrBadImage and err's
+// status is one it covers.
+func (err *APIError) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return err.StatusCode == http.StatusTooManyRequests
+	case ErrBadImage:
+		switch err.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity:
+			return true
+		}
+	}
+	return false
+}
+
+// checkStatus returns an *APIError if resp, from endpoint, isn't 2XX.
+func checkStatus(resp *http.Response, endpoint string) error {
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &APIError{
+		Method:     resp.Request.Method,
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Body:       strings.TrimSpace(string(body)),
+	}
+}
@@ -0,0 +1,114 @@
+package captionbot
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The phases of a session's requests, as a RequestEvent gives them.
+const (
+	// PhaseInit starts the session's conversation.
+	PhaseInit = "init"
+	// PhaseTask starts captioning an image, and PhaseResult fetches its
+	// caption.
+	PhaseTask   = "task"
+	PhaseResult = "result"
+	// PhaseUpload uploads an image to caption.
+	PhaseUpload = "upload"
+	// PhaseRate rates the session's last caption.
+	PhaseRate = "rate"
+)
+
+// RequestEvent describes a request a session makes, for its Hooks.
+type RequestEvent struct {
+	// Phase is what the request is for: PhaseInit, PhaseTask,
+	// PhaseResult, PhaseUpload or PhaseRate.
+	Phase  string
+	Method string
+	URL    string
+	Start  time.Time
+	// Duration, StatusCode and Err, the error of a request that got no
+	// response, are set once the request ends.
+	Duration   time.Duration
+	StatusCode int
+	Err        error
+}
+
+// Hooks are called around each request a CaptionBot makes. Either may be
+// nil.
+type Hooks struct {
+	// OnRequestStart is called before a request is sent. The context it
+	// returns, if not nil, becomes the request's, such as to carry a
+	// tracing span.
+	OnRequestStart func(ctx context.Context, event RequestEvent) context.Context
+	// OnRequestEnd is called once the request has its response or has
+	// failed, with the request's context.
+	OnRequestEnd func(ctx context.Context, event RequestEvent)
+}
+
+// LogRequests returns Hooks logging each request's end to logger, or the
+// standard logger if it is nil. Only the scheme, host and path of URLs
+// are logged, since their queries can hold image URLs or tokens.
+func LogRequests(logger *log.Logger) Hooks {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return Hooks{
+		OnRequestEnd: func(ctx context.Context, event RequestEvent) {
+			target := logURL(event.URL)
+			if event.Err != nil {
+				logger.Printf("captionbot: %s %s %s: %s (%s)", event.Phase, event.Method, target, event.Err, event.Duration)
+				return
+			}
+			logger.Printf("captionbot: %s %s %s: %d (%s)", event.Phase, event.Method, target, event.StatusCode, event.Duration)
+		},
+	}
+}
+
+// logURL returns the scheme, host and path of rawURL.
+func logURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		before, _, _ := strings.Cut(rawURL, "?")
+		return before
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// wrapClient returns a copy of client with the session's
+// TransportMiddleware around its transport. The wrapped transport is
+// made again only when client's transport or the middleware change.
+func (captionBot *CaptionBot) wrapClient(client *http.Client) *http.Client {
+	if len(captionBot.TransportMiddleware) == 0 {
+		return client
+	}
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if captionBot.wrapped == nil || captionBot.wrappedCount != len(captionBot.TransportMiddleware) ||
+		!sameTransport(captionBot.wrappedFrom, transport) {
+		captionBot.wrappedFrom, captionBot.wrappedCount = transport, len(captionBot.TransportMiddleware)
+		for i := len(captionBot.TransportMiddleware) - 1; i >= 0; i-- {
+			transport = captionBot.TransportMiddleware[i](transport)
+		}
+		captionBot.wrapped = transport
+	}
+	wrapped := *client
+	wrapped.Transport = captionBot.wrapped
+	return &wrapped
+}
+
+// sameTransport reports whether a and b are the same pointer. Transports
+// of other kinds, which == may not compare, are taken as different.
+func sameTransport(a, b http.RoundTripper) bool {
+	if a == nil || b == nil || reflect.TypeOf(a) != reflect.TypeOf(b) || reflect.TypeOf(a).Kind() != reflect.Pointer {
+		return false
+	}
+	return a == b
+}
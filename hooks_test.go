@@ -0,0 +1,85 @@
+package captionbot_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+// roundTripperFunc is an http.RoundTripper that calls a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+// counting returns middleware counting the requests through it in n.
+func counting(n *int64) func(http.RoundTripper) http.RoundTripper {
+	return func(next http.RoundTripper) http.RoundTripper {
+		return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			atomic.AddInt64(n, 1)
+			return next.RoundTrip(req)
+		})
+	}
+}
+
+func TestTransportMiddlewareAddedLater(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	var first, second int64
+	bot, err := captionbot.New(server.Option(), captionbot.WithTransportMiddleware(counting(&first)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	captionbot.WithTransportMiddleware(counting(&second))(bot)
+	if _, err := bot.URLCaption(testImage); err != nil {
+		t.Fatalf("URLCaption: %v", err)
+	}
+	if second == 0 || second != first-1 {
+		t.Errorf("requests through the middleware = %d and %d, want the second to see all but init", first, second)
+	}
+}
+
+func TestTransportMiddlewareClientTransportChanged(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	var wrapped, direct int64
+	bot, err := captionbot.New(server.Option(), captionbot.WithHTTPClient(&http.Client{}),
+		captionbot.WithTransportMiddleware(counting(&wrapped)))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	bot.HTTPClient.Transport = counting(&direct)(http.DefaultTransport)
+	if _, err := bot.URLCaption(testImage); err != nil {
+		t.Fatalf("URLCaption: %v", err)
+	}
+	if direct == 0 || direct != wrapped-1 {
+		t.Errorf("requests through the middleware = %d, through the new transport = %d", wrapped, direct)
+	}
+}
+
+func TestLogRequestsOmitsQuery(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	var buf bytes.Buffer
+	bot, err := captionbot.New(server.Option(), captionbot.WithHooks(captionbot.LogRequests(log.New(&buf, "", 0))))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := bot.URLCaption(testImage + "?token=secret"); err != nil {
+		t.Fatalf("URLCaption: %v", err)
+	}
+	logged := buf.String()
+	if !strings.Contains(logged, server.BaseURL()) {
+		t.Errorf("log doesn't name the requests:\n%s", logged)
+	}
+	if strings.Contains(logged, "?") || strings.Contains(logged, "secret") {
+		t.Errorf("log has a query:\n%s", logged)
+	}
+}
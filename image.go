@@ -0,0 +1,213 @@
+package captionbot
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	// Registered for image.Decode, to resize uploads.
+	_ "image/gif"
+	_ "image/png"
+)
+
+// DefaultMaxUploadSize is the largest image an upload sends by default,
+// the limit of the Azure service behind captionbot.ai.
+const DefaultMaxUploadSize = 4 << 20
+
+// Errors of uploads refused before they are sent.
+var (
+	// ErrUnsupportedImageType is the error of an upload that isn't a
+	// JPEG, PNG or GIF image.
+	ErrUnsupportedImageType = errors.New("captionbot: unsupported image type")
+	// ErrImageTooLarge is the error of an upload larger than the
+	// CaptionBot's MaxUploadSize.
+	ErrImageTooLarge = errors.New("captionbot: image too large")
+)
+
+// uploadTypes are the image types captionbot.ai captions.
+var uploadTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// resizeQuality is the JPEG quality of resized uploads.
+const resizeQuality = 85
+
+// maxResizeFactor bounds the image of unknown size ResizeUploads reads
+// into memory, to this many times MaxUploadSize; past it, resizing can't
+// be expected to fit the image anyway.
+const maxResizeFactor = 16
+
+func (captionBot *CaptionBot) maxUploadSize() int64 {
+	if captionBot.MaxUploadSize == 0 {
+		return DefaultMaxUploadSize
+	}
+	return captionBot.MaxUploadSize
+}
+
+// prepareUpload checks the image read from file before it is uploaded:
+// its type, sniffed from its first bytes, must be one captionbot.ai
+// captions, and its size no more than MaxUploadSize, or if ResizeUploads
+// is set, it is shrunk to fit. It returns the image to send, with its
+// file name and type.
+func (captionBot *CaptionBot) prepareUpload(file io.Reader, name, contentType string) (io.Reader, string, string, error) {
+	size, known := readerSize(file)
+	// DetectContentType looks at no more than 512 bytes.
+	buffered := bufio.NewReaderSize(file, 512)
+	head, _ := buffered.Peek(512)
+	sniffed := http.DetectContentType(head)
+	if !uploadTypes[sniffed] {
+		return nil, "", "", fmt.Errorf("%w: %s", ErrUnsupportedImageType, sniffed)
+	}
+	if contentType == "" {
+		contentType = sniffed
+	}
+
+	limit := captionBot.maxUploadSize()
+	if limit < 0 {
+		return buffered, name, contentType, nil
+	}
+	if !known && captionBot.ResizeUploads {
+		data, err := io.ReadAll(&limitedReader{r: buffered, left: limit * maxResizeFactor})
+		if errors.Is(err, ErrImageTooLarge) {
+			return nil, "", "", fmt.Errorf("%w: over %d bytes, too large to resize to %d", ErrImageTooLarge, limit*maxResizeFactor, limit)
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+		buffered, size, known = bufio.NewReader(bytes.NewReader(data)), int64(len(data)), true
+	}
+	if !known {
+		// The image is cut off at the limit as it is sent.
+		return &limitedReader{r: buffered, left: limit}, name, contentType, nil
+	}
+	if size <= limit {
+		return buffered, name, contentType, nil
+	}
+	if !captionBot.ResizeUploads {
+		return nil, "", "", fmt.Errorf("%w: %d bytes, over the limit of %d", ErrImageTooLarge, size, limit)
+	}
+	data, err := resizeImage(buffered, size, limit)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return bytes.NewReader(data), strings.TrimSuffix(name, filepath.Ext(name)) + ".jpg", "image/jpeg", nil
+}
+
+// readerSize returns the size of what is left to read from r, if r can
+// tell.
+func readerSize(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case *os.File:
+		info, err := r.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return 0, false
+		}
+		offset, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return info.Size() - offset, true
+	}
+	return 0, false
+}
+
+// limitedReader reads from r, failing with ErrImageTooLarge past left
+// bytes.
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (limited *limitedReader) Read(p []byte) (int, error) {
+	if limited.left < 0 {
+		return 0, ErrImageTooLarge
+	}
+	if int64(len(p)) > limited.left+1 {
+		p = p[:limited.left+1]
+	}
+	n, err := limited.r.Read(p)
+	limited.left -= int64(n)
+	if limited.left < 0 {
+		return n, ErrImageTooLarge
+	}
+	return n, err
+}
+
+// resizeImage decodes the image of size bytes read from r and encodes it
+// as a JPEG of no more than limit bytes, scaling it down as far as that
+// takes.
+func resizeImage(r io.Reader, size, limit int64) ([]byte, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("captionbot: resizing the image: %w", err)
+	}
+	bounds := img.Bounds()
+	// Encoded size goes with the number of pixels, so the sides are first
+	// scaled by the square root of how far over the limit the image is.
+	scale := math.Min(1, math.Sqrt(float64(limit)/float64(size)))
+	for attempt := 0; attempt < 8; attempt++ {
+		width := int(float64(bounds.Dx()) * scale)
+		height := int(float64(bounds.Dy()) * scale)
+		if width < 1 || height < 1 {
+			break
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, downscale(img, width, height), &jpeg.Options{Quality: resizeQuality}); err != nil {
+			return nil, err
+		}
+		if int64(buf.Len()) <= limit {
+			return buf.Bytes(), nil
+		}
+		scale *= 0.75
+	}
+	return nil, fmt.Errorf("%w: it can't be shrunk under %d bytes", ErrImageTooLarge, limit)
+}
+
+// downscale returns img scaled down to width by height, each pixel the
+// average of those of img it covers. Transparent parts are made white,
+// since a JPEG has no transparency and would show them black.
+func downscale(img image.Image, width, height int) image.Image {
+	bounds := img.Bounds()
+	src := image.NewRGBA(bounds)
+	draw.Draw(src, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(src, bounds, img, bounds.Min, draw.Over)
+	if width >= bounds.Dx() && height >= bounds.Dy() {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+			var r, g, b, a, n uint32
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					c := src.RGBAAt(sx, sy)
+					r, g, b, a = r+uint32(c.R), g+uint32(c.G), b+uint32(c.B), a+uint32(c.A)
+					n++
+				}
+			}
+			if n > 0 {
+				dst.SetRGBA(x, y, color.RGBA{uint8(r / n), uint8(g / n), uint8(b / n), uint8(a / n)})
+			}
+		}
+	}
+	return dst
+}
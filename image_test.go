@@ -0,0 +1,186 @@
+package captionbot
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// noisePNG returns a PNG of random pixels, which doesn't compress, of
+// width by height.
+func noisePNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	rng.Read(img.Pix)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// unsized hides the size of a reader from readerSize.
+type unsized struct{ r io.Reader }
+
+func (u unsized) Read(p []byte) (int, error) { return u.r.Read(p) }
+
+func TestPrepareUploadUnsupportedType(t *testing.T) {
+	for _, data := range []string{"hello, world", "BM\x00\x00\x00\x00\x00\x00\x00\x00"} {
+		captionBot := &CaptionBot{}
+		_, _, _, err := captionBot.prepareUpload(strings.NewReader(data), "a.bmp", "")
+		if !errors.Is(err, ErrUnsupportedImageType) {
+			t.Errorf("%q: err = %v, want ErrUnsupportedImageType", data, err)
+		}
+	}
+}
+
+func TestPrepareUploadUnderLimit(t *testing.T) {
+	data := noisePNG(t, 16, 16)
+	for _, r := range []io.Reader{bytes.NewReader(data), unsized{bytes.NewReader(data)}} {
+		captionBot := &CaptionBot{}
+		upload, name, contentType, err := captionBot.prepareUpload(r, "a.png", "")
+		if err != nil {
+			t.Fatalf("prepareUpload: %v", err)
+		}
+		if name != "a.png" || contentType != "image/png" {
+			t.Errorf("name, type = %q, %q, want %q, %q", name, contentType, "a.png", "image/png")
+		}
+		got, err := io.ReadAll(upload)
+		if err != nil {
+			t.Fatalf("reading the upload: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Error("upload isn't the image")
+		}
+	}
+}
+
+func TestPrepareUploadKeepsContentType(t *testing.T) {
+	captionBot := &CaptionBot{}
+	_, _, contentType, err := captionBot.prepareUpload(bytes.NewReader(noisePNG(t, 4, 4)), "a.png", "image/x-png")
+	if err != nil {
+		t.Fatalf("prepareUpload: %v", err)
+	}
+	if contentType != "image/x-png" {
+		t.Errorf("type = %q, want the one given", contentType)
+	}
+}
+
+func TestPrepareUploadTooLarge(t *testing.T) {
+	data := noisePNG(t, 64, 64)
+	captionBot := &CaptionBot{MaxUploadSize: 1000}
+	_, _, _, err := captionBot.prepareUpload(bytes.NewReader(data), "a.png", "")
+	if !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("err = %v, want ErrImageTooLarge", err)
+	}
+
+	// An image of unknown size fails as it is read.
+	upload, _, _, err := captionBot.prepareUpload(unsized{bytes.NewReader(data)}, "a.png", "")
+	if err != nil {
+		t.Fatalf("prepareUpload: %v", err)
+	}
+	if _, err := io.ReadAll(upload); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("reading the upload: err = %v, want ErrImageTooLarge", err)
+	}
+
+	// No limit.
+	captionBot.MaxUploadSize = -1
+	if _, _, _, err := captionBot.prepareUpload(bytes.NewReader(data), "a.png", ""); err != nil {
+		t.Errorf("prepareUpload without a limit: %v", err)
+	}
+}
+
+func TestPrepareUploadResizes(t *testing.T) {
+	data := noisePNG(t, 200, 200)
+	const limit = 20000
+	for _, r := range []io.Reader{bytes.NewReader(data), unsized{bytes.NewReader(data)}} {
+		captionBot := &CaptionBot{MaxUploadSize: limit, ResizeUploads: true}
+		upload, name, contentType, err := captionBot.prepareUpload(r, "photos/a.png", "")
+		if err != nil {
+			t.Fatalf("prepareUpload: %v", err)
+		}
+		if name != "photos/a.jpg" || contentType != "image/jpeg" {
+			t.Errorf("name, type = %q, %q, want %q, %q", name, contentType, "photos/a.jpg", "image/jpeg")
+		}
+		got, err := io.ReadAll(upload)
+		if err != nil {
+			t.Fatalf("reading the upload: %v", err)
+		}
+		if len(got) > limit {
+			t.Errorf("resized to %d bytes, over the limit of %d", len(got), limit)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(got)); err != nil {
+			t.Errorf("resized image isn't a JPEG: %v", err)
+		}
+	}
+}
+
+// zeros is an endless reader of zero bytes.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func TestPrepareUploadResizeBounded(t *testing.T) {
+	// An endless image would be read forever if the read weren't cut
+	// off.
+	r := io.MultiReader(bytes.NewReader(noisePNG(t, 4, 4)), zeros{})
+	captionBot := &CaptionBot{MaxUploadSize: 1000, ResizeUploads: true}
+	if _, _, _, err := captionBot.prepareUpload(r, "a.png", ""); !errors.Is(err, ErrImageTooLarge) {
+		t.Errorf("err = %v, want ErrImageTooLarge", err)
+	}
+}
+
+func TestLimitedReader(t *testing.T) {
+	tests := []struct {
+		size, limit int
+		err         error
+	}{
+		{0, 0, nil},
+		{10, 10, nil},
+		{9, 10, nil},
+		{11, 10, ErrImageTooLarge},
+		{1000, 10, ErrImageTooLarge},
+	}
+	for _, test := range tests {
+		data := bytes.Repeat([]byte{'x'}, test.size)
+		r := &limitedReader{r: unsized{bytes.NewReader(data)}, left: int64(test.limit)}
+		got, err := io.ReadAll(r)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%d bytes, limit %d: err = %v, want %v", test.size, test.limit, err, test.err)
+		}
+		if test.err == nil && len(got) != test.size {
+			t.Errorf("%d bytes, limit %d: read %d", test.size, test.limit, len(got))
+		}
+		if len(got) > test.limit+1 {
+			t.Errorf("%d bytes, limit %d: read %d, past the limit", test.size, test.limit, len(got))
+		}
+	}
+}
+
+func TestDownscaleTransparent(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	img.SetNRGBA(0, 0, color.NRGBA{R: 0xff, A: 0xff})
+	for _, size := range []int{4, 2} {
+		got := downscale(img, size, size)
+		if c := color.RGBAModel.Convert(got.At(size-1, size-1)).(color.RGBA); c != (color.RGBA{0xff, 0xff, 0xff, 0xff}) {
+			t.Errorf("%dx%d: transparent pixel is %v, want white", size, size, c)
+		}
+		if _, _, _, a := got.At(0, 0).RGBA(); a != 0xffff {
+			t.Errorf("%dx%d: pixel isn't opaque", size, size)
+		}
+	}
+}
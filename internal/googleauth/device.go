@@ -0,0 +1,121 @@
+package googleauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const deviceCodeURL = "https://oauth2.googleapis.com/device/code"
+
+// Prompt tells the user where to approve a device flow request.
+type Prompt func(verificationURL, userCode string)
+
+// DeviceTokenSource authorizes with the OAuth device flow for clients of
+// the "TVs and Limited Input devices" type. The refresh token it obtains is
+// cached in cacheFile, so the user only has to approve access once.
+func DeviceTokenSource(clientID, clientSecret, cacheFile string, prompt Prompt, scopes ...string) (TokenSource, error) {
+	refreshToken := ""
+	if data, err := os.ReadFile(cacheFile); err == nil {
+		refreshToken = strings.TrimSpace(string(data))
+	}
+
+	if refreshToken == "" {
+		tok, err := deviceFlow(clientID, clientSecret, prompt, scopes)
+		if err != nil {
+			return nil, err
+		}
+		refreshToken = tok.RefreshToken
+		if err := os.MkdirAll(filepath.Dir(cacheFile), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(cacheFile, []byte(refreshToken+"\n"), 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	return &cachingSource{fetch: func() (token, error) {
+		return postToken(tokenURL, url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+			"refresh_token": {refreshToken},
+		})
+	}}, nil
+}
+
+// UserTokenSource authorizes as a user through the device flow when clientID
+// is set, caching the refresh token under cacheName in the captionbot config
+// directory, and falls back to application default credentials otherwise.
+func UserTokenSource(clientID, clientSecret, cacheName string, prompt Prompt, scopes ...string) (TokenSource, error) {
+	if clientID == "" {
+		return DefaultTokenSource(scopes...)
+	}
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	cacheFile := filepath.Join(configDir, "captionbot", cacheName)
+	return DeviceTokenSource(clientID, clientSecret, cacheFile, prompt, scopes...)
+}
+
+// deviceFlow asks for a user code, shows it with prompt and polls the token
+// endpoint until the user approves or the code expires.
+func deviceFlow(clientID, clientSecret string, prompt Prompt, scopes []string) (token, error) {
+	resp, err := http.PostForm(deviceCodeURL, url.Values{
+		"client_id": {clientID},
+		"scope":     {strings.Join(scopes, " ")},
+	})
+	if err != nil {
+		return token{}, err
+	}
+	defer resp.Body.Close()
+
+	var code struct {
+		DeviceCode      string `json:"device_code"`
+		UserCode        string `json:"user_code"`
+		VerificationURL string `json:"verification_url"`
+		ExpiresIn       int    `json:"expires_in"`
+		Interval        int    `json:"interval"`
+		Error           string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&code); err != nil {
+		return token{}, err
+	}
+	if code.Error != "" {
+		return token{}, fmt.Errorf("googleauth: device code request: %s", code.Error)
+	}
+
+	prompt(code.VerificationURL, code.UserCode)
+
+	interval := time.Duration(code.Interval) * time.Second
+	if interval == 0 {
+		interval = 5 * time.Second
+	}
+	deadline := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(deadline) {
+		time.Sleep(interval)
+
+		tok, err := postToken(tokenURL, url.Values{
+			"grant_type":    {"urn:ietf:params:oauth:grant-type:device_code"},
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+			"device_code":   {code.DeviceCode},
+		})
+		switch {
+		case err == nil:
+			return tok, nil
+		case tok.Error == "authorization_pending":
+		case tok.Error == "slow_down":
+			interval += 5 * time.Second
+		default:
+			return tok, err
+		}
+	}
+	return token{}, fmt.Errorf("googleauth: device code expired before it was approved")
+}
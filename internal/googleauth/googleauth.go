@@ -0,0 +1,243 @@
+// Package googleauth obtains OAuth2 access tokens for Google APIs using
+// application default credentials.
+package googleauth
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	tokenURL    = "https://oauth2.googleapis.com/token"
+	metadataURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// TokenSource returns valid access tokens, refreshing them as needed.
+type TokenSource interface {
+	Token() (string, error)
+}
+
+// token is an OAuth2 token endpoint response.
+type token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+}
+
+// cachingSource reuses a token until shortly before it expires.
+type cachingSource struct {
+	mu      sync.Mutex
+	fetch   func() (token, error)
+	current string
+	expiry  time.Time
+}
+
+func (source *cachingSource) Token() (string, error) {
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	if source.current != "" && time.Until(source.expiry) > time.Minute {
+		return source.current, nil
+	}
+	tok, err := source.fetch()
+	if err != nil {
+		return "", err
+	}
+	source.current = tok.AccessToken
+	source.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return source.current, nil
+}
+
+// postToken posts form to an OAuth2 token endpoint and decodes the response.
+func postToken(endpoint string, form url.Values) (token, error) {
+	var tok token
+	resp, err := http.PostForm(endpoint, form)
+	if err != nil {
+		return tok, err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return tok, err
+	}
+	if tok.Error != "" {
+		return tok, fmt.Errorf("googleauth: %s", tok.Error)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tok, fmt.Errorf("googleauth: token endpoint returned status %d", resp.StatusCode)
+	}
+	return tok, nil
+}
+
+// credentialsFile is the JSON of a service account key or of the file
+// written by "gcloud auth application-default login".
+type credentialsFile struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// DefaultTokenSource finds application default credentials: the file named
+// by GOOGLE_APPLICATION_CREDENTIALS, then gcloud's well-known file, then the
+// GCE metadata server.
+func DefaultTokenSource(scopes ...string) (TokenSource, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err == nil {
+			wellKnown := filepath.Join(configDir, "gcloud", "application_default_credentials.json")
+			if _, err := os.Stat(wellKnown); err == nil {
+				path = wellKnown
+			}
+		}
+	}
+	if path == "" {
+		return &cachingSource{fetch: metadataToken}, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var creds credentialsFile
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return nil, fmt.Errorf("googleauth: %s: %s", path, err)
+	}
+
+	switch creds.Type {
+	case "service_account":
+		key, err := parseKey(creds.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		if creds.TokenURI == "" {
+			creds.TokenURI = tokenURL
+		}
+		return &cachingSource{fetch: func() (token, error) {
+			return serviceAccountToken(creds, key, scopes)
+		}}, nil
+	case "authorized_user":
+		return &cachingSource{fetch: func() (token, error) {
+			return postToken(tokenURL, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {creds.ClientID},
+				"client_secret": {creds.ClientSecret},
+				"refresh_token": {creds.RefreshToken},
+			})
+		}}, nil
+	}
+	return nil, fmt.Errorf("googleauth: unsupported credentials type %q in %s", creds.Type, path)
+}
+
+func parseKey(pemKey string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(pemKey))
+	if block == nil {
+		return nil, fmt.Errorf("googleauth: invalid private key")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("googleauth: parsing private key: %s", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("googleauth: private key is not RSA")
+	}
+	return key, nil
+}
+
+// serviceAccountToken exchanges a self-signed JWT for an access token.
+func serviceAccountToken(creds credentialsFile, key *rsa.PrivateKey, scopes []string) (token, error) {
+	now := time.Now().Unix()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   creds.ClientEmail,
+		"scope": strings.Join(scopes, " "),
+		"aud":   creds.TokenURI,
+		"iat":   now,
+		"exp":   now + 3600,
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return token{}, err
+	}
+
+	return postToken(creds.TokenURI, url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {unsigned + "." + enc.EncodeToString(signature)},
+	})
+}
+
+// metadataToken asks the GCE metadata server for the default service
+// account's token.
+func metadataToken() (token, error) {
+	var tok token
+	req, err := http.NewRequest("GET", metadataURL, nil)
+	if err != nil {
+		return tok, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return tok, fmt.Errorf("googleauth: no application default credentials found: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return tok, fmt.Errorf("googleauth: metadata server returned status %d", resp.StatusCode)
+	}
+	return tok, json.NewDecoder(resp.Body).Decode(&tok)
+}
+
+// Transport adds an Authorization header with a token from Source to every
+// request.
+type Transport struct {
+	Source TokenSource
+	Base   http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (transport *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := transport.Source.Token()
+	if err != nil {
+		return nil, err
+	}
+	base := transport.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+tok)
+	return base.RoundTrip(req)
+}
+
+// NewClient returns an HTTP client that authenticates with source.
+func NewClient(source TokenSource) *http.Client {
+	return &http.Client{Transport: &Transport{Source: source}}
+}
@@ -0,0 +1,131 @@
+package googleauth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyAssertion checks a JWT bearer assertion against key and returns
+// its claims.
+func verifyAssertion(assertion string, key *rsa.PublicKey) (map[string]interface{}, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed assertion")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, err
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	return claims, json.Unmarshal(payload, &claims)
+}
+
+func TestServiceAccountToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A token endpoint trusting key, as Google trusts a service
+	// account's public key.
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := verifyAssertion(r.FormValue("assertion"), &key.PublicKey)
+		exp, _ := claims["exp"].(float64)
+		if err != nil || r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" ||
+			time.Unix(int64(exp), 0).Before(time.Now()) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(token{Error: "invalid_grant"})
+			return
+		}
+		if claims["iss"] != "bot@example.iam.gserviceaccount.com" || claims["scope"] != "a b" {
+			t.Errorf("claims = %v", claims)
+		}
+		json.NewEncoder(w).Encode(token{AccessToken: "access", ExpiresIn: 3600})
+	}))
+	defer endpoint.Close()
+	creds := credentialsFile{ClientEmail: "bot@example.iam.gserviceaccount.com", TokenURI: endpoint.URL}
+
+	tests := []struct {
+		name  string
+		key   *rsa.PrivateKey
+		valid bool
+	}{
+		{"service account key", key, true},
+		{"other key", other, false},
+	}
+	for _, test := range tests {
+		tok, err := serviceAccountToken(creds, test.key, []string{"a", "b"})
+		if test.valid && (err != nil || tok.AccessToken != "access") {
+			t.Errorf("%s: token = %+v, %v, want an access token", test.name, tok, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: token endpoint accepted the assertion", test.name)
+		}
+	}
+}
+
+func TestCachingSourceRefreshes(t *testing.T) {
+	var fetches int
+	source := &cachingSource{fetch: func() (token, error) {
+		fetches++
+		return token{AccessToken: fmt.Sprint("access", fetches), ExpiresIn: 3600}, nil
+	}}
+	for i := 0; i < 2; i++ {
+		if tok, _ := source.Token(); tok != "access1" {
+			t.Errorf("token = %q, want the cached access1", tok)
+		}
+	}
+
+	// A token about to expire is replaced.
+	source.expiry = time.Now().Add(30 * time.Second)
+	if tok, _ := source.Token(); tok != "access2" {
+		t.Errorf("token = %q, want a fresh access2", tok)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, block := range map[string]*pem.Block{
+		"PKCS #1": {Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)},
+		"PKCS #8": {Type: "PRIVATE KEY", Bytes: pkcs8},
+	} {
+		parsed, err := parseKey(string(pem.EncodeToMemory(block)))
+		if err != nil || !parsed.Equal(key) {
+			t.Errorf("%s: parseKey = %v", name, err)
+		}
+	}
+	if _, err := parseKey("not a key"); err == nil {
+		t.Error("parseKey accepted garbage")
+	}
+}
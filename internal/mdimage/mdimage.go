@@ -0,0 +1,75 @@
+// Package mdimage finds images in Markdown, including inline HTML <img>
+// tags, for the bots that suggest alt text on code hosting sites.
+package mdimage
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Image is an image reference in Markdown text.
+type Image struct {
+	Alt string
+	URL string
+}
+
+var (
+	markdownImage = regexp.MustCompile(`!\[([^\]]*)\]\((\S+?)(?:\s+"[^"]*")?\)`)
+	htmlImage     = regexp.MustCompile(`(?i)<img\s[^>]*>`)
+	htmlSrc       = regexp.MustCompile(`(?i)\ssrc\s*=\s*"([^"]*)"`)
+	htmlAlt       = regexp.MustCompile(`(?i)\salt\s*=\s*"([^"]*)"`)
+)
+
+// Find returns the images in text.
+func Find(text string) []Image {
+	var found []Image
+	for _, m := range markdownImage.FindAllStringSubmatch(text, -1) {
+		found = append(found, Image{Alt: m[1], URL: m[2]})
+	}
+	for _, tag := range htmlImage.FindAllString(text, -1) {
+		src := htmlSrc.FindStringSubmatch(tag)
+		if src == nil {
+			continue
+		}
+		img := Image{URL: src[1]}
+		if alt := htmlAlt.FindStringSubmatch(tag); alt != nil {
+			img.Alt = alt[1]
+		}
+		found = append(found, img)
+	}
+	return found
+}
+
+// MissingAlt returns the images in text whose alt text is a placeholder.
+func MissingAlt(text string) []Image {
+	var missing []Image
+	for _, img := range Find(text) {
+		if Placeholder(img.Alt) {
+			missing = append(missing, img)
+		}
+	}
+	return missing
+}
+
+// Placeholder reports whether alt is empty or one of the defaults code
+// hosts fill in for uploads, such as "image" or a file name.
+func Placeholder(alt string) bool {
+	alt = strings.ToLower(strings.TrimSpace(alt))
+	switch {
+	case alt == "", alt == "image", alt == "img":
+		return true
+	case strings.HasPrefix(alt, "screenshot"), strings.HasPrefix(alt, "screen shot"):
+		return true
+	}
+	switch path.Ext(alt) {
+	case ".png", ".jpg", ".jpeg", ".gif", ".bmp", ".webp":
+		return true
+	}
+	return false
+}
+
+// Suggestion formats caption as a Markdown image with url, ready to paste.
+func Suggestion(caption, url string) string {
+	return "```markdown\n![" + strings.ReplaceAll(caption, "]", "") + "](" + url + ")\n```\n\n"
+}
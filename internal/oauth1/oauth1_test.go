@@ -0,0 +1,94 @@
+package oauth1
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The example from the X API's "Creating a signature" documentation.
+var (
+	exampleCredentials = Credentials{
+		ConsumerKey:    "xvz1evFS4wEEPTGEFPHBog",
+		ConsumerSecret: "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw",
+		Token:          "370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb",
+		TokenSecret:    "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE",
+	}
+	exampleParams = url.Values{
+		"status":           {"Hello Ladies + Gentlemen, a signed OAuth request!"},
+		"include_entities": {"true"},
+	}
+)
+
+const (
+	exampleURL   = "https://api.twitter.com/1.1/statuses/update.json"
+	exampleNonce = "kYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg"
+)
+
+var exampleTime = time.Unix(1318622958, 0)
+
+func TestSign(t *testing.T) {
+	tokenSecret := exampleCredentials
+	tokenSecret.TokenSecret = "guess"
+	consumerSecret := exampleCredentials
+	consumerSecret.ConsumerSecret = "guess"
+	tampered := url.Values{"status": {"Hello Ladies + Gentlemen, a forged OAuth request!"}, "include_entities": {"true"}}
+
+	const want = "hCtSmYh+iHYCEqBWrE7C7hYmtUk="
+	tests := []struct {
+		name        string
+		credentials Credentials
+		method      string
+		params      url.Values
+		valid       bool
+	}{
+		{"example", exampleCredentials, "POST", exampleParams, true},
+		{"other token secret", tokenSecret, "POST", exampleParams, false},
+		{"other consumer secret", consumerSecret, "POST", exampleParams, false},
+		{"other method", exampleCredentials, "GET", exampleParams, false},
+		{"other parameters", exampleCredentials, "POST", tampered, false},
+	}
+	for _, test := range tests {
+		oauth := test.credentials.sign(test.method, exampleURL, test.params, exampleNonce, exampleTime)
+		if got := oauth.Get("oauth_signature"); (got == want) != test.valid {
+			t.Errorf("%s: signature = %s, want it to match %s: %v", test.name, got, want, test.valid)
+		}
+	}
+
+	// A later timestamp, as on a replay of the request, changes the
+	// signature.
+	later := exampleCredentials.sign("POST", exampleURL, exampleParams, exampleNonce, exampleTime.Add(time.Second))
+	if later.Get("oauth_signature") == want {
+		t.Error("the signature doesn't cover the timestamp")
+	}
+}
+
+func TestHeader(t *testing.T) {
+	header, err := exampleCredentials.Header("POST", exampleURL+"?include_entities=true", url.Values{"status": exampleParams["status"]})
+	if err != nil {
+		t.Fatalf("Header: %v", err)
+	}
+	if !strings.HasPrefix(header, "OAuth ") {
+		t.Fatalf("header = %q, want an OAuth header", header)
+	}
+	for _, field := range []string{`oauth_consumer_key="xvz1evFS4wEEPTGEFPHBog"`, `oauth_signature_method="HMAC-SHA1"`, `oauth_signature="`} {
+		if !strings.Contains(header, field) {
+			t.Errorf("header %q lacks %s", header, field)
+		}
+	}
+}
+
+func TestPercentEncode(t *testing.T) {
+	for in, want := range map[string]string{
+		"Ladies + Gentlemen": "Ladies%20%2B%20Gentlemen",
+		"An encoded string!": "An%20encoded%20string%21",
+		"Dogs, Cats & Mice":  "Dogs%2C%20Cats%20%26%20Mice",
+		"☃":                  "%E2%98%83",
+		"a-b.c_d~e":          "a-b.c_d~e",
+	} {
+		if got := PercentEncode(in); got != want {
+			t.Errorf("PercentEncode(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+// Package nativehost implements the Chrome/Firefox native messaging protocol
+// so a browser extension can caption images through the local captionbot
+// binary.
+//
+// Messages in both directions are a 32-bit length in native byte order
+// (little endian on every platform browsers support) followed by that many
+// bytes of UTF-8 JSON.
+package nativehost
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// Name is the native messaging host name used in the host manifest.
+const Name = "com.github.nhatbui.captionbot"
+
+// MaxResponseSize is the largest message a host may send to the browser.
+const MaxResponseSize = 1 << 20
+
+// maxRequestSize bounds the messages accepted from the browser.
+const maxRequestSize = 64 << 20
+
+// Request is a caption request sent by the extension. URL may be an http(s)
+// URL or a data: URL holding the image itself. ID is echoed back so the
+// extension can match responses to requests.
+type Request struct {
+	ID  json.RawMessage `json:"id,omitempty"`
+	URL string          `json:"url"`
+}
+
+// Response is sent back for every Request.
+type Response struct {
+	ID      json.RawMessage `json:"id,omitempty"`
+	Caption string          `json:"caption,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Manifest is the host manifest a browser needs to find the host binary.
+type Manifest struct {
+	Name              string   `json:"name"`
+	Description       string   `json:"description"`
+	Path              string   `json:"path"`
+	Type              string   `json:"type"`
+	AllowedOrigins    []string `json:"allowed_origins,omitempty"`
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
+}
+
+// NewManifest returns the manifest for a host binary at path. browser is
+// "chrome" or "firefox"; extensionID is the ID of the companion extension.
+func NewManifest(browser, path, extensionID string) (Manifest, error) {
+	manifest := Manifest{
+		Name:        Name,
+		Description: "Caption images with captionbot",
+		Path:        path,
+		Type:        "stdio",
+	}
+	switch browser {
+	case "chrome":
+		manifest.AllowedOrigins = []string{"chrome-extension://" + extensionID + "/"}
+	case "firefox":
+		manifest.AllowedExtensions = []string{extensionID}
+	default:
+		return manifest, fmt.Errorf("nativehost: unknown browser %q", browser)
+	}
+	return manifest, nil
+}
+
+// ReadMessage reads one length-prefixed message from r into v.
+// It returns io.EOF when the browser closes the connection.
+func ReadMessage(r io.Reader, v interface{}) error {
+	var length uint32
+	if err := binary.Read(r, binary.LittleEndian, &length); err != nil {
+		return err
+	}
+	if length > maxRequestSize {
+		return fmt.Errorf("nativehost: message of %d bytes is too large", length)
+	}
+	// The whole message is read, so that the next length is read from
+	// where the browser wrote it even if JSON ends before the message.
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// WriteMessage writes v to w as one length-prefixed message.
+func WriteMessage(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(data) > MaxResponseSize {
+		return fmt.Errorf("nativehost: message of %d bytes is too large", len(data))
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(len(data))); err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Serve answers caption requests read from r on w until r is exhausted.
+// Captioning failures are reported to the extension, not returned.
+func Serve(r io.Reader, w io.Writer, bot *captionbot.CaptionBot) error {
+	for {
+		var req Request
+		if err := ReadMessage(r, &req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		resp := Response{ID: req.ID}
+		caption, err := caption(bot, req.URL)
+		if err != nil {
+			resp.Error = err.Error()
+		} else {
+			resp.Caption = caption
+		}
+		if err := WriteMessage(w, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func caption(bot *captionbot.CaptionBot, url string) (string, error) {
+	if !strings.HasPrefix(url, "data:") {
+		return bot.URLCaption(url)
+	}
+
+	// data:[<mediatype>][;base64],<data>
+	comma := strings.IndexByte(url, ',')
+	if comma < 0 || !strings.HasSuffix(url[:comma], ";base64") {
+		return "", fmt.Errorf("unsupported data URL")
+	}
+	data, err := base64.StdEncoding.DecodeString(url[comma+1:])
+	if err != nil {
+		return "", err
+	}
+
+	ext := ".jpg"
+	if exts, _ := mime.ExtensionsByType(strings.TrimSuffix(url[len("data:"):comma], ";base64")); len(exts) > 0 {
+		ext = exts[0]
+	}
+	return bot.UploadCaptionBytes(data, "image"+ext)
+}
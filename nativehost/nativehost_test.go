@@ -0,0 +1,82 @@
+package nativehost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+)
+
+// frame returns body as one message, with a length prefix.
+func frame(body string) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(len(body)))
+	buf.WriteString(body)
+	return buf.Bytes()
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	sent := []Request{
+		{ID: json.RawMessage(`1`), URL: "https://example.com/cat.jpg"},
+		{ID: json.RawMessage(`"two"`), URL: "data:image/png;base64,iVBORw0KGgo="},
+	}
+	for _, req := range sent {
+		if err := WriteMessage(&buf, req); err != nil {
+			t.Fatalf("WriteMessage: %v", err)
+		}
+	}
+	for _, want := range sent {
+		var got Request
+		if err := ReadMessage(&buf, &got); err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if string(got.ID) != string(want.ID) || got.URL != want.URL {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+	var req Request
+	if err := ReadMessage(&buf, &req); err != io.EOF {
+		t.Errorf("ReadMessage at the end = %v, want io.EOF", err)
+	}
+}
+
+func TestReadMessagePadded(t *testing.T) {
+	stream := append(frame(`{"id":1,"url":"a.jpg"}`+" \n\t"), frame(`{"id":2,"url":"b.jpg"}`+"\r\n")...)
+	r := bytes.NewReader(stream)
+	for _, want := range []string{"a.jpg", "b.jpg"} {
+		var req Request
+		if err := ReadMessage(r, &req); err != nil {
+			t.Fatalf("ReadMessage: %v", err)
+		}
+		if req.URL != want {
+			t.Errorf("URL = %q, want %q", req.URL, want)
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tooLarge := make([]byte, 4)
+	binary.LittleEndian.PutUint32(tooLarge, maxRequestSize+1)
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"truncated length", []byte{1, 0}, io.ErrUnexpectedEOF},
+		{"truncated message", frame(`{"url":"a.jpg"}`)[:10], io.ErrUnexpectedEOF},
+		{"missing message", frame(`{"url":"a.jpg"}`)[:4], io.ErrUnexpectedEOF},
+		{"too large", tooLarge, nil},
+		{"not JSON", frame(`url=a.jpg`), nil},
+		{"two values", frame(`{"url":"a.jpg"} {"url":"b.jpg"}`), nil},
+	}
+	for _, test := range tests {
+		var req Request
+		err := ReadMessage(bytes.NewReader(test.stream), &req)
+		if err == nil || test.err != nil && !errors.Is(err, test.err) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		}
+	}
+}
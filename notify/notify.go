@@ -0,0 +1,258 @@
+// Package notify POSTs caption results to webhooks, so other systems can
+// react to them without polling.
+//
+// Each delivery is a JSON Event signed with HMAC-SHA256. Receivers should
+// recompute
+//
+//	hex(HMAC-SHA256(secret, timestamp + "." + body))
+//
+// from the X-Captionbot-Timestamp header and the raw body, compare it to
+// X-Captionbot-Signature (after its "sha256=" prefix), and reject old
+// timestamps to prevent replays. Verify does both for Go receivers.
+package notify
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+var (
+	// ErrBadSignature is returned by Verify for a delivery that wasn't
+	// signed with the secret.
+	ErrBadSignature = errors.New("notify: bad signature")
+	// ErrStale is returned by Verify for a delivery whose timestamp is
+	// too far from now.
+	ErrStale = errors.New("notify: stale timestamp")
+)
+
+// Event describes one completed caption.
+type Event struct {
+	// Input is the image URL or name that was captioned.
+	Input   string `json:"input"`
+	Caption string `json:"caption,omitempty"`
+	// Confidence is the provider's confidence from 0 to 1, when it
+	// reports one.
+	Confidence float64   `json:"confidence,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// Notifier delivers events to webhook URLs.
+type Notifier struct {
+	URLs   []string
+	Secret string
+	// MaxAttempts is how many times a delivery is tried before giving
+	// up. Attempts are spaced by exponential backoff from one second.
+	MaxAttempts int
+
+	HTTPClient *http.Client
+	Logger     *log.Logger
+}
+
+// New creates a Notifier that delivers to urls.
+func New(secret string, urls ...string) *Notifier {
+	return &Notifier{
+		URLs:        urls,
+		Secret:      secret,
+		MaxAttempts: 5,
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (notifier *Notifier) httpClient() *http.Client {
+	if notifier.HTTPClient != nil {
+		return notifier.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (notifier *Notifier) logf(format string, args ...interface{}) {
+	if notifier.Logger != nil {
+		notifier.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Notify delivers e to every URL, retrying failed deliveries, and
+// returns the last error if any URL couldn't be reached.
+func (notifier *Notifier) Notify(e Event) error {
+	return notifier.Post(e)
+}
+
+// Post delivers any JSON value the way Notify delivers an Event, signed
+// the same way.
+func (notifier *Notifier) Post(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for _, u := range notifier.URLs {
+		if err := notifier.deliver(u, body); err != nil {
+			lastErr = fmt.Errorf("notifying %s: %s", u, err)
+		}
+	}
+	return lastErr
+}
+
+func (notifier *Notifier) deliver(u string, body []byte) error {
+	attempts := notifier.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	var err error
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = notifier.post(u, body)
+		if err == nil || !retry || attempt == attempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// post makes one delivery attempt and reports whether a failure is worth
+// retrying: network errors, 429s and 5xxs are; other statuses aren't.
+func (notifier *Notifier) post(u string, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Captionbot-Timestamp", timestamp)
+	if notifier.Secret != "" {
+		req.Header.Set("X-Captionbot-Signature", sign(notifier.Secret, timestamp, body))
+	}
+
+	resp, err := notifier.httpClient().Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("status %d", resp.StatusCode)
+}
+
+// sign returns the X-Captionbot-Signature of body sent at timestamp.
+func sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks that a delivery with header and the raw body was signed
+// with secret no more than maxAge ago, or ahead of the receiver's clock
+// by as much. An empty secret verifies nothing.
+func Verify(secret string, header http.Header, body []byte, maxAge time.Duration) error {
+	timestamp := header.Get("X-Captionbot-Timestamp")
+	expected := sign(secret, timestamp, body)
+	if secret == "" || !hmac.Equal([]byte(expected), []byte(header.Get("X-Captionbot-Signature"))) {
+		return ErrBadSignature
+	}
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > maxAge || age < -maxAge {
+		return ErrStale
+	}
+	return nil
+}
+
+// Connection is a CaptionBotConnection that notifies about every caption.
+type Connection struct {
+	captionbot.CaptionBotConnection
+	Notifier *Notifier
+}
+
+var _ captionbot.CaptionBotConnection = (*Connection)(nil)
+
+// Wrap returns a connection that sends an event after each caption, by
+// URL or upload.
+func (notifier *Notifier) Wrap(conn captionbot.CaptionBotConnection) *Connection {
+	return &Connection{CaptionBotConnection: conn, Notifier: notifier}
+}
+
+// URLCaption captions url and notifies the webhooks of the result.
+// Delivery failures are logged rather than returned, so a slow or broken
+// receiver doesn't fail the caption.
+func (connection *Connection) URLCaption(url string) (string, error) {
+	start := time.Now()
+	caption, err := connection.CaptionBotConnection.URLCaption(url)
+	connection.Notifier.Send(NewEvent(url, caption, err, start))
+	return caption, err
+}
+
+// UploadCaption captions the image file and notifies the webhooks of the
+// result, with the file name as the event's input.
+func (connection *Connection) UploadCaption(fileName string) (string, error) {
+	start := time.Now()
+	caption, err := connection.CaptionBotConnection.UploadCaption(fileName)
+	connection.Notifier.Send(NewEvent(fileName, caption, err, start))
+	return caption, err
+}
+
+// UploadCaptionReader captions the image read from r and notifies the
+// webhooks of the result, with name as the event's input.
+func (connection *Connection) UploadCaptionReader(r io.Reader, name string) (string, error) {
+	start := time.Now()
+	caption, err := connection.CaptionBotConnection.UploadCaptionReader(r, name)
+	connection.Notifier.Send(NewEvent(name, caption, err, start))
+	return caption, err
+}
+
+// UploadCaptionBytes captions image data and notifies the webhooks of the
+// result, with name as the event's input.
+func (connection *Connection) UploadCaptionBytes(data []byte, name string) (string, error) {
+	start := time.Now()
+	caption, err := connection.CaptionBotConnection.UploadCaptionBytes(data, name)
+	connection.Notifier.Send(NewEvent(name, caption, err, start))
+	return caption, err
+}
+
+// NewEvent builds an Event for a caption that started at start and just
+// finished.
+func NewEvent(input, caption string, err error, start time.Time) Event {
+	e := Event{
+		Input:      input,
+		Caption:    caption,
+		StartedAt:  start.UTC(),
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	return e
+}
+
+// Send delivers e in the background, logging failures.
+func (notifier *Notifier) Send(e Event) {
+	go func() {
+		if err := notifier.Notify(e); err != nil {
+			notifier.logf("notify: %s", err)
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestDeliveryVerifies(t *testing.T) {
+	var verr error
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verr = Verify("s3cret", r.Header, body, time.Minute)
+	}))
+	defer receiver.Close()
+
+	if err := New("s3cret", receiver.URL).Notify(Event{Input: "a.jpg", Caption: "a cat"}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if verr != nil {
+		t.Errorf("Verify: %v", verr)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"input":"a.jpg","caption":"a cat"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	ahead := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		err       error
+	}{
+		{"valid", "s3cret", now, sign("s3cret", now, body), nil},
+		{"other secret", "s3cret", now, sign("guess", now, body), ErrBadSignature},
+		{"other timestamp", "s3cret", now, sign("s3cret", old, body), ErrBadSignature},
+		{"missing signature", "s3cret", now, "", ErrBadSignature},
+		{"no secret", "", now, sign("", now, body), ErrBadSignature},
+		{"bad timestamp", "s3cret", "soon", sign("s3cret", "soon", body), ErrBadSignature},
+		{"expired", "s3cret", old, sign("s3cret", old, body), ErrStale},
+		{"from the future", "s3cret", ahead, sign("s3cret", ahead, body), ErrStale},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set("X-Captionbot-Timestamp", test.timestamp)
+		if test.signature != "" {
+			header.Set("X-Captionbot-Signature", test.signature)
+		}
+		if err := Verify(test.secret, header, body, 5*time.Minute); !errors.Is(err, test.err) {
+			t.Errorf("%s: err = %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// A signature doesn't carry over to another body.
+	header := http.Header{}
+	header.Set("X-Captionbot-Timestamp", now)
+	header.Set("X-Captionbot-Signature", sign("s3cret", now, body))
+	if err := Verify("s3cret", header, []byte(`{}`), 5*time.Minute); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("tampered body: err = %v, want ErrBadSignature", err)
+	}
+}
@@ -0,0 +1,120 @@
+package captionbot
+
+import (
+	"net/http"
+	"time"
+)
+
+// Option configures a CaptionBot made by New, before its session is
+// initialized.
+type Option func(*CaptionBot)
+
+// WithHTTPClient sends the session's requests with client, such as one
+// with a proxy, custom TLS config or timeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(captionBot *CaptionBot) { captionBot.HTTPClient = client }
+}
+
+// WithTransport sends the session's requests over a transport tuned by
+// opts, with a client of its own that keeps the other settings of the
+// session's HTTPClient, if it has one, such as its timeout. To share
+// tuned connections between sessions, give them one client made with
+// NewTransport instead.
+func WithTransport(opts TransportOptions) Option {
+	return func(captionBot *CaptionBot) {
+		var client http.Client
+		if captionBot.HTTPClient != nil {
+			client = *captionBot.HTTPClient
+		}
+		client.Transport = NewTransport(opts)
+		captionBot.HTTPClient = &client
+	}
+}
+
+// WithBaseURL sends the session's requests to the API rooted at url,
+// such as a captionbottest.Server's BaseURL.
+func WithBaseURL(url string) Option {
+	return func(captionBot *CaptionBot) { captionBot.BaseURL = url }
+}
+
+// WithUserAgent sets the User-Agent of the session's requests.
+func WithUserAgent(userAgent string) Option {
+	return func(captionBot *CaptionBot) { captionBot.UserAgent = userAgent }
+}
+
+// WithLocale asks for captions in locale, such as "fr-FR".
+func WithLocale(locale string) Option {
+	return func(captionBot *CaptionBot) { captionBot.Locale = locale }
+}
+
+// WithHeader adds a header to every request of the session.
+func WithHeader(key, value string) Option {
+	return func(captionBot *CaptionBot) {
+		if captionBot.Header == nil {
+			captionBot.Header = http.Header{}
+		}
+		captionBot.Header.Add(key, value)
+	}
+}
+
+// WithCookieJar keeps the session's cookies in jar instead of a jar of
+// its own. A nil jar keeps no cookies.
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(captionBot *CaptionBot) { captionBot.Jar = jar }
+}
+
+// WithRefreshAfter sets the session's RefreshAfter.
+func WithRefreshAfter(d time.Duration) Option {
+	return func(captionBot *CaptionBot) { captionBot.RefreshAfter = d }
+}
+
+// WithRetry tries captions and initializations failing for reasons that
+// may pass up to max more times, waiting backoff before the first retry
+// and twice as long before each after it.
+func WithRetry(max int, backoff time.Duration) Option {
+	return func(captionBot *CaptionBot) {
+		captionBot.MaxRetries = max
+		captionBot.RetryBackoff = backoff
+	}
+}
+
+// WithCache answers repeated captions from cache, such as a MemoryCache,
+// instead of captionbot.ai.
+func WithCache(cache Cache) Option {
+	return func(captionBot *CaptionBot) { captionBot.Cache = cache }
+}
+
+// WithCacheTTL sets how long captions are cached.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(captionBot *CaptionBot) { captionBot.CacheTTL = ttl }
+}
+
+// WithMaxUploadSize sets the largest image an upload sends.
+func WithMaxUploadSize(size int64) Option {
+	return func(captionBot *CaptionBot) { captionBot.MaxUploadSize = size }
+}
+
+// WithResizeUploads shrinks images larger than the session's
+// MaxUploadSize to fit instead of failing.
+func WithResizeUploads() Option {
+	return func(captionBot *CaptionBot) { captionBot.ResizeUploads = true }
+}
+
+// WithHooks calls hooks around each of the session's requests.
+func WithHooks(hooks Hooks) Option {
+	return func(captionBot *CaptionBot) { captionBot.Hooks = hooks }
+}
+
+// WithTransportMiddleware wraps the transport of the session's HTTP
+// client with middleware, inside any given before.
+func WithTransportMiddleware(middleware func(http.RoundTripper) http.RoundTripper) Option {
+	return func(captionBot *CaptionBot) {
+		captionBot.TransportMiddleware = append(captionBot.TransportMiddleware, middleware)
+	}
+}
+
+// WithStrict fails captions of responses that differ from what the
+// library expects, as Strict does.
+func WithStrict() Option {
+	return func(captionBot *CaptionBot) { captionBot.Strict = true }
+}
@@ -0,0 +1,191 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+// tagImageDescription is the EXIF tag of an image's title or description.
+const tagImageDescription = 0x010E
+
+// byteOrder is the byte order of EXIF data.
+type byteOrder interface {
+	binary.ByteOrder
+	binary.AppendByteOrder
+}
+
+var (
+	exifHeader   = []byte("Exif\x00\x00")
+	errNotJPEG   = errors.New("pipeline: not a JPEG image")
+	errBadEXIF   = errors.New("pipeline: malformed EXIF data")
+	errEXIFLarge = errors.New("pipeline: EXIF data is too large for a JPEG segment")
+)
+
+// WriteEXIF is a stage that stores each caption of a JPEG image as the
+// image's EXIF ImageDescription, reading it from src and writing it back
+// with w, such as a source.Dir for both. Other images are left alone.
+func WriteEXIF(src source.Source, w source.FileWriter) Stage {
+	return StageFunc(func(ctx context.Context, result *Result) error {
+		ext := strings.ToLower(path.Ext(result.Object.Key))
+		if ext != ".jpg" && ext != ".jpeg" {
+			return nil
+		}
+		r, err := src.Open(result.Object)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+		if data, err = SetJPEGDescription(data, result.Caption); err != nil {
+			return err
+		}
+		return w.WriteFile(result.Object.Key, data)
+	})
+}
+
+// SetJPEGDescription returns a copy of the JPEG image data with its EXIF
+// ImageDescription set to description. The rest of the image's EXIF data
+// is kept: a new first IFD, with the description, is added after it.
+func SetJPEGDescription(data []byte, description string) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errNotJPEG
+	}
+	description = strings.ReplaceAll(description, "\x00", "")
+
+	// Find the EXIF segment, or where one goes: after SOI and any JFIF
+	// APP0 segment, which must come first.
+	insert, start, end := 2, -1, -1
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, errNotJPEG
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			// Start of scan or end of image: no more metadata.
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, errNotJPEG
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE0 && i == insert {
+			insert = i + 2 + length
+		}
+		if marker == 0xE1 && bytes.HasPrefix(segment, exifHeader) {
+			start, end = i, i+2+length
+			break
+		}
+		i += 2 + length
+	}
+
+	var tiff []byte
+	if start >= 0 {
+		var err error
+		tiff, err = describeTIFF(data[start+4+len(exifHeader):end], description)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		start, end = insert, insert
+		tiff = newTIFF(description)
+	}
+
+	length := 2 + len(exifHeader) + len(tiff)
+	if length > 0xFFFF {
+		return nil, errEXIFLarge
+	}
+	out := make([]byte, 0, len(data)-(end-start)+2+length)
+	out = append(out, data[:start]...)
+	out = append(out, 0xFF, 0xE1, byte(length>>8), byte(length))
+	out = append(out, exifHeader...)
+	out = append(out, tiff...)
+	return append(out, data[end:]...), nil
+}
+
+// newTIFF returns EXIF data holding only description.
+func newTIFF(description string) []byte {
+	tiff := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	return appendIFD(tiff, binary.BigEndian, nil, 0, description)
+}
+
+// describeTIFF returns the EXIF data tiff with a new first IFD, a copy of
+// the old one with description as its ImageDescription, appended to it.
+// Nothing in tiff moves, so the offsets of the old data stay valid.
+func describeTIFF(tiff []byte, description string) ([]byte, error) {
+	if len(tiff) < 8 {
+		return nil, errBadEXIF
+	}
+	var order byteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errBadEXIF
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return nil, errBadEXIF
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	entriesEnd := ifd + 2 + 12*count
+	if entriesEnd+4 > len(tiff) {
+		return nil, errBadEXIF
+	}
+	var entries [][]byte
+	for i := ifd + 2; i < entriesEnd; i += 12 {
+		if order.Uint16(tiff[i:]) != tagImageDescription {
+			entries = append(entries, tiff[i:i+12])
+		}
+	}
+	next := order.Uint32(tiff[entriesEnd:])
+
+	out := append([]byte(nil), tiff...)
+	if len(out)%2 != 0 {
+		// IFDs start on a word boundary.
+		out = append(out, 0)
+	}
+	order.PutUint32(out[4:], uint32(len(out)))
+	return appendIFD(out, order, entries, next, description), nil
+}
+
+// appendIFD appends an IFD of entries and an ImageDescription entry for
+// description, whose text follows it, to tiff, which it must end.
+func appendIFD(tiff []byte, order byteOrder, entries [][]byte, next uint32, description string) []byte {
+	text := append([]byte(description), 0)
+	entry := make([]byte, 12)
+	order.PutUint16(entry, tagImageDescription)
+	order.PutUint16(entry[2:], 2) // ASCII
+	order.PutUint32(entry[4:], uint32(len(text)))
+	ifdLength := 2 + 12*(len(entries)+1) + 4
+	if len(text) <= 4 {
+		copy(entry[8:], text)
+	} else {
+		order.PutUint32(entry[8:], uint32(len(tiff)+ifdLength))
+	}
+	entries = append(entries, entry)
+	sort.Slice(entries, func(i, j int) bool { return order.Uint16(entries[i]) < order.Uint16(entries[j]) })
+
+	tiff = order.AppendUint16(tiff, uint16(len(entries)))
+	for _, entry := range entries {
+		tiff = append(tiff, entry...)
+	}
+	tiff = order.AppendUint32(tiff, next)
+	if len(text) > 4 {
+		tiff = append(tiff, text...)
+	}
+	return tiff
+}
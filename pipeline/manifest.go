@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Manifest records the images a pipeline has captioned, by a hash of
+// their content, so that running it again over a growing archive only
+// captions new images. Implementations must be safe for concurrent use.
+// It is kept apart from any cache of captions: an image in the manifest
+// isn't captioned at all.
+type Manifest interface {
+	// Has reports whether the content with hash was captioned.
+	Has(hash string) (bool, error)
+	// Add records that the content with hash, from the item key, was
+	// captioned.
+	Add(hash, key string) error
+}
+
+// manifestLine is a line of a FileManifest.
+type manifestLine struct {
+	Hash string    `json:"hash"`
+	Key  string    `json:"key"`
+	At   time.Time `json:"at"`
+}
+
+// FileManifest is a Manifest in a file of JSON lines, which is read when
+// it is opened and appended to.
+type FileManifest struct {
+	mu   sync.Mutex
+	file *os.File
+	// hashes holds the SHA-256 of each hash rather than the hash itself,
+	// which keeps a manifest of a million images to some 50MB.
+	hashes map[[sha256.Size]byte]struct{}
+}
+
+// OpenFileManifest opens the manifest in the file at path, creating it if
+// it doesn't exist.
+func OpenFileManifest(path string) (*FileManifest, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &FileManifest{file: file, hashes: map[[sha256.Size]byte]struct{}{}}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var line manifestLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("%s:%d: %w", path, n, err)
+		}
+		manifest.hashes[sha256.Sum256([]byte(line.Hash))] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Has reports whether the content with hash was captioned.
+func (manifest *FileManifest) Has(hash string) (bool, error) {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	_, ok := manifest.hashes[sha256.Sum256([]byte(hash))]
+	return ok, nil
+}
+
+// Add records hash, appending it to the file.
+func (manifest *FileManifest) Add(hash, key string) error {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	sum := sha256.Sum256([]byte(hash))
+	if _, ok := manifest.hashes[sum]; ok {
+		return nil
+	}
+	data, err := json.Marshal(manifestLine{Hash: hash, Key: key, At: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if _, err := manifest.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	manifest.hashes[sum] = struct{}{}
+	return nil
+}
+
+// Len returns how many images the manifest holds.
+func (manifest *FileManifest) Len() int {
+	manifest.mu.Lock()
+	defer manifest.mu.Unlock()
+	return len(manifest.hashes)
+}
+
+// Close closes the manifest's file.
+func (manifest *FileManifest) Close() error {
+	return manifest.file.Close()
+}
+
+// contentHash returns the hash a Manifest records item by: the SHA-256 of
+// its content, or of its URL for items with no content to read. The
+// content read is returned, so that it needn't be read again to upload.
+func contentHash(item Item) (string, []byte, error) {
+	if item.Open == nil {
+		sum := sha256.Sum256([]byte(item.URL))
+		return "url:" + hex.EncodeToString(sum[:]), nil, nil
+	}
+	r, err := item.Open()
+	if err != nil {
+		return "", nil, err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), data, nil
+}
@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// contentItem returns an item whose content is data.
+func contentItem(key, data string) Item {
+	return Item{Key: key, Open: func() (io.ReadCloser, error) {
+		return io.NopCloser(strings.NewReader(data)), nil
+	}}
+}
+
+func TestContentHash(t *testing.T) {
+	hash := func(item Item) string {
+		t.Helper()
+		h, _, err := contentHash(item)
+		if err != nil {
+			t.Fatalf("contentHash: %v", err)
+		}
+		return h
+	}
+	original := hash(contentItem("a.jpg", "pixels"))
+
+	tests := []struct {
+		name string
+		item Item
+		same bool
+	}{
+		{"renamed", contentItem("b/a.jpg", "pixels"), true},
+		{"edited", contentItem("a.jpg", "pixels!"), false},
+		{"URL", Item{Key: "a.jpg", URL: "pixels"}, false},
+	}
+	for _, test := range tests {
+		if got := hash(test.item); (got == original) != test.same {
+			t.Errorf("%s: hash %s, original %s, want equal %v", test.name, got, original, test.same)
+		}
+	}
+}
+
+func TestFileManifestReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "manifest.jsonl")
+	manifest, err := OpenFileManifest(path)
+	if err != nil {
+		t.Fatalf("OpenFileManifest: %v", err)
+	}
+	manifest.Add("aaa", "a.jpg")
+	manifest.Add("aaa", "copy of a.jpg")
+	manifest.Add("bbb", "b.jpg")
+	manifest.Close()
+
+	manifest, err = OpenFileManifest(path)
+	if err != nil {
+		t.Fatalf("reopening: %v", err)
+	}
+	defer manifest.Close()
+	if manifest.Len() != 2 {
+		t.Errorf("Len = %d, want 2", manifest.Len())
+	}
+	for hash, want := range map[string]bool{"aaa": true, "bbb": true, "ccc": false} {
+		if has, _ := manifest.Has(hash); has != want {
+			t.Errorf("Has(%q) = %v, want %v", hash, has, want)
+		}
+	}
+
+	// A damaged manifest names the bad line rather than being ignored.
+	os.WriteFile(path, []byte(`{"hash":"aaa"}`+"\n"+"not json\n"), 0644)
+	if _, err := OpenFileManifest(path); err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Errorf("err = %v, want one naming line 2", err)
+	}
+}
@@ -0,0 +1,370 @@
+// Package pipeline connects sources of images, such as the backends of the
+// source package and lists of URLs, through a Captioner and stages of
+// post-processing into sinks, such as JSON lines, a database or the images'
+// own EXIF metadata.
+//
+// A Pipeline captions with a fixed number of workers. Each step holds at
+// most Buffer items, so a slow captioner or sink holds the source back
+// rather than letting items pile up in memory. Results go to the sinks as
+// they finish and aren't kept after, so a run's memory doesn't grow with
+// its number of items, and a million-image run needs no more than a small
+// one. OnError decides what a failed item does to the rest of the run.
+//
+//	p := &pipeline.Pipeline{
+//		Source:  pipeline.FromSource(source.Dir("photos")),
+//		Workers: 4,
+//		Sinks:   []pipeline.Sink{pipeline.JSONSink(os.Stdout)},
+//		OnError: pipeline.Stop,
+//	}
+//	err := p.Run(ctx)
+//
+// The batch package builds pipelines with a fluent API.
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"iter"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// Item is an image for a pipeline to caption, either by URL or by
+// uploading what Open reads.
+type Item struct {
+	// Index is the item's position in the order the source gave it,
+	// from 0. The pipeline sets it.
+	Index int
+	// Key identifies the item, such as an object's key or a URL.
+	Key string
+	URL string
+	// Open, if not nil, returns the image's content, for items without a
+	// URL.
+	Open func() (io.ReadCloser, error)
+	// Object is the item as an object of the source package, for filters
+	// and stages written for those.
+	Object source.Object
+}
+
+// Result is the outcome of one item of a pipeline.
+type Result struct {
+	Item
+	Caption string
+	Err     error
+	// Attempts is how many times the item was captioned, more than one
+	// when it was retried.
+	Attempts int
+	// Took is how long captioning and the stages took.
+	Took time.Duration
+}
+
+// Captioner captions images. It is captionbot.Captioner, so
+// server.Session, server/client.Client and captionbottest.FakeCaptioner
+// serve as they are.
+type Captioner = captionbot.Captioner
+
+// ContextCaptioner is a Captioner whose captions the pipeline can cancel
+// when it stops early; captions by other Captioners run to completion.
+// The workers' own sessions are ContextCaptioners.
+type ContextCaptioner = captionbot.ContextCaptioner
+
+// Stage processes a captioned result before it reaches the sinks, such as
+// to rewrite the caption or store it. An error is recorded on the result
+// and skips the stages after.
+type Stage interface {
+	Process(ctx context.Context, result *Result) error
+}
+
+// StageFunc is a Stage that calls a function.
+type StageFunc func(ctx context.Context, result *Result) error
+
+// Process calls fn(ctx, result).
+func (fn StageFunc) Process(ctx context.Context, result *Result) error {
+	return fn(ctx, result)
+}
+
+// Sink receives a pipeline's results. Write is called for one result at
+// a time, and Flush once when the run ends, even if it fails.
+type Sink interface {
+	Write(result Result) error
+	Flush() error
+}
+
+// ErrorPolicy is what a pipeline does with items that fail.
+type ErrorPolicy int
+
+const (
+	// Continue passes failed results to the sinks and carries on.
+	Continue ErrorPolicy = iota
+	// Skip carries on without passing failed results to the sinks.
+	Skip
+	// Stop passes the first failed result to the sinks, cancels the
+	// items still being captioned by a ContextCaptioner, skips the rest
+	// and returns its error.
+	Stop
+)
+
+// Pipeline captions the items of a source. Its fields must not change
+// while it runs.
+type Pipeline struct {
+	Source Source
+	// NewCaptioner returns a captioner for each worker. If nil, each
+	// worker has its own captionbot.ai session.
+	NewCaptioner func() (Captioner, error)
+	// Workers is how many items are captioned at once; at least one.
+	Workers int
+	// Buffer is how many items may wait between steps; 0 hands each
+	// item straight on.
+	Buffer int
+	Stages []Stage
+	Sinks  []Sink
+	// OnError is the policy for items that fail to caption or in a
+	// stage.
+	OnError ErrorPolicy
+	// Retries is how many more times captioning an item is tried,
+	// RetryDelay apart, before it fails.
+	Retries    int
+	RetryDelay time.Duration
+	// Manifest, if not nil, skips the items it holds, which aren't
+	// captioned or passed to the stages and sinks, and records those
+	// captioned successfully. Reading an item's content to hash it means
+	// downloading items that would otherwise be captioned by URL.
+	Manifest Manifest
+
+	// runErr is the error of the last All.
+	runErr error
+}
+
+// Run runs the pipeline until every item is through it or ctx is done,
+// and flushes its sinks. It returns the first error reading the source
+// or writing a sink, the error of the first failed item with the Stop
+// policy, or ctx.Err().
+func (p *Pipeline) Run(ctx context.Context) error {
+	return p.run(ctx, nil)
+}
+
+// All returns an iterator over the pipeline's items and their results,
+// in the order they finish, which runs the pipeline as Run does each time
+// it is ranged over. Results the Skip policy drops aren't yielded.
+// Breaking out of the loop cancels the items still being captioned by a
+// ContextCaptioner and skips the rest. Err returns the error that ended the last iteration
+// early, if any.
+func (p *Pipeline) All(ctx context.Context) iter.Seq2[Item, Result] {
+	return func(yield func(Item, Result) bool) {
+		p.runErr = p.run(ctx, yield)
+	}
+}
+
+// Err returns the error Run would have returned for the last iteration of
+// All. Stopping the iteration isn't an error.
+func (p *Pipeline) Err() error {
+	return p.runErr
+}
+
+// run runs the pipeline, passing each result to yield, if not nil, after
+// the sinks, until yield returns false.
+func (p *Pipeline) run(ctx context.Context, yield func(Item, Result) bool) error {
+	if p.Source == nil {
+		return fmt.Errorf("pipeline: no source")
+	}
+	workers := p.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	captioners := make([]Captioner, workers)
+	for i := range captioners {
+		var err error
+		if p.NewCaptioner != nil {
+			captioners[i], err = p.NewCaptioner()
+		} else {
+			captioners[i], err = newSession()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	items := make(chan Item, p.Buffer)
+	results := make(chan Result, p.Buffer)
+	sourceErr := make(chan error, 1)
+	go func() {
+		defer close(items)
+		index := 0
+		sourceErr <- p.Source.Items(ctx, func(item Item) error {
+			item.Index = index
+			index++
+			select {
+			case items <- item:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	var wg sync.WaitGroup
+	for _, captioner := range captioners {
+		wg.Add(1)
+		go func(captioner Captioner) {
+			defer wg.Done()
+			for item := range items {
+				if ctx.Err() != nil {
+					continue
+				}
+				result, ok := p.process(ctx, captioner, item)
+				if !ok {
+					continue
+				}
+				select {
+				case results <- result:
+				case <-ctx.Done():
+				}
+			}
+		}(captioner)
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	var failed, sinkErr error
+	stopped := false
+	for result := range results {
+		if failed != nil || sinkErr != nil || stopped {
+			continue
+		}
+		if result.Err != nil {
+			if p.OnError == Skip {
+				continue
+			}
+			if p.OnError == Stop {
+				failed = fmt.Errorf("pipeline: %s: %w", result.Key, result.Err)
+				cancel()
+			}
+		}
+		for _, sink := range p.Sinks {
+			if err := sink.Write(result); err != nil {
+				sinkErr = err
+				cancel()
+				break
+			}
+		}
+		if sinkErr == nil && failed == nil && yield != nil && !yield(result.Item, result) {
+			stopped = true
+			cancel()
+		}
+	}
+	for _, sink := range p.Sinks {
+		if err := sink.Flush(); err != nil && sinkErr == nil {
+			sinkErr = err
+		}
+	}
+
+	switch err := <-sourceErr; {
+	case sinkErr != nil:
+		return sinkErr
+	case failed != nil:
+		return failed
+	case stopped:
+		return nil
+	case err != nil:
+		return err
+	}
+	return ctx.Err()
+}
+
+// process captions item, retrying as configured, and runs the stages on
+// it. It reports false if the item is in the manifest.
+func (p *Pipeline) process(ctx context.Context, captioner Captioner, item Item) (Result, bool) {
+	start := time.Now()
+	result := Result{Item: item}
+	var hash string
+	if p.Manifest != nil {
+		var data []byte
+		var err error
+		hash, data, err = contentHash(item)
+		if err == nil {
+			var seen bool
+			if seen, err = p.Manifest.Has(hash); seen {
+				return result, false
+			}
+		}
+		if err != nil {
+			result.Err = err
+			result.Took = time.Since(start)
+			return result, true
+		}
+		if data != nil {
+			item.Open = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(data)), nil
+			}
+		}
+	}
+
+	for {
+		result.Attempts++
+		result.Caption, result.Err = caption(ctx, captioner, item)
+		if result.Err == nil || result.Attempts > p.Retries {
+			break
+		}
+		select {
+		case <-time.After(p.RetryDelay):
+			continue
+		case <-ctx.Done():
+		}
+		break
+	}
+	for _, stage := range p.Stages {
+		if result.Err != nil {
+			break
+		}
+		result.Err = stage.Process(ctx, &result)
+	}
+	if result.Err == nil && p.Manifest != nil {
+		result.Err = p.Manifest.Add(hash, item.Key)
+	}
+	result.Took = time.Since(start)
+	return result, true
+}
+
+// caption captions item, by URL when it has one and by uploading its
+// content otherwise, with ctx if captioner is a ContextCaptioner.
+func caption(ctx context.Context, captioner Captioner, item Item) (string, error) {
+	withContext, hasContext := captioner.(ContextCaptioner)
+	if item.URL != "" {
+		if hasContext {
+			return withContext.CaptionURLContext(ctx, item.URL)
+		}
+		return captioner.CaptionURL(item.URL)
+	}
+	if item.Open == nil {
+		return "", fmt.Errorf("%s has no URL or content", item.Key)
+	}
+	r, err := item.Open()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	if hasContext {
+		return withContext.CaptionReaderContext(ctx, r, item.Key)
+	}
+	return captioner.CaptionReader(r, item.Key)
+}
+
+// newSession creates a captionbot.ai session for one worker, which needs
+// no lock since only that worker uses it.
+func newSession() (Captioner, error) {
+	bot, err := captionbot.New()
+	if err != nil {
+		return nil, err
+	}
+	return bot, nil
+}
@@ -0,0 +1,184 @@
+package pipeline
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+// SinkFunc is a Sink that calls a function for each result and has
+// nothing to flush.
+type SinkFunc func(result Result) error
+
+// Write calls fn(result).
+func (fn SinkFunc) Write(result Result) error {
+	return fn(result)
+}
+
+// Flush does nothing.
+func (fn SinkFunc) Flush() error {
+	return nil
+}
+
+// Entry is a result as sinks store it, with its error as text.
+type Entry struct {
+	Key     string `json:"key"`
+	Caption string `json:"caption,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Entry returns the result as sinks store it.
+func (result Result) Entry() Entry {
+	entry := Entry{Key: result.Key}
+	if result.Err != nil {
+		entry.Error = result.Err.Error()
+	} else {
+		entry.Caption = result.Caption
+	}
+	return entry
+}
+
+type csvSink struct {
+	w      *csv.Writer
+	header bool
+}
+
+// CSVSink writes results to w as CSV, with the columns key, caption and
+// error after a header row.
+func CSVSink(w io.Writer) Sink {
+	return &csvSink{w: csv.NewWriter(w)}
+}
+
+func (sink *csvSink) Write(result Result) error {
+	if !sink.header {
+		sink.header = true
+		if err := sink.w.Write([]string{"key", "caption", "error"}); err != nil {
+			return err
+		}
+	}
+	entry := result.Entry()
+	if err := sink.w.Write([]string{entry.Key, entry.Caption, entry.Error}); err != nil {
+		return err
+	}
+	// Each row is written out as it comes, so that an interrupted run
+	// keeps its results.
+	sink.w.Flush()
+	return sink.w.Error()
+}
+
+func (sink *csvSink) Flush() error {
+	sink.w.Flush()
+	return sink.w.Error()
+}
+
+// JSONSink writes each result to w as a line of JSON.
+func JSONSink(w io.Writer) Sink {
+	enc := json.NewEncoder(w)
+	return SinkFunc(func(result Result) error {
+		return enc.Encode(result.Entry())
+	})
+}
+
+type manifestSink struct {
+	w    source.FileWriter
+	name string
+	// spool holds the array written so far, in a temporary file rather
+	// than memory.
+	spool *os.File
+	err   error
+}
+
+// ManifestSink stores every result as a JSON array in a file named name,
+// written with w when the run ends. The results are kept in a temporary
+// file until then, and copied into place in parts if w is a
+// source.FileCreator.
+func ManifestSink(w source.FileWriter, name string) Sink {
+	return &manifestSink{w: w, name: name}
+}
+
+func (sink *manifestSink) Write(result Result) error {
+	if sink.err != nil {
+		return sink.err
+	}
+	sep := ",\n  "
+	if sink.spool == nil {
+		if sink.spool, sink.err = os.CreateTemp("", "captionbot-manifest-*.json"); sink.err != nil {
+			return sink.err
+		}
+		sep = "[\n  "
+	}
+	data, err := json.MarshalIndent(result.Entry(), "  ", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := sink.spool.WriteString(sep); err != nil {
+		sink.err = err
+		return err
+	}
+	_, sink.err = sink.spool.Write(data)
+	return sink.err
+}
+
+func (sink *manifestSink) Flush() error {
+	if sink.spool == nil {
+		return sink.w.WriteFile(sink.name, []byte("[]"))
+	}
+	defer os.Remove(sink.spool.Name())
+	defer sink.spool.Close()
+	if sink.err != nil {
+		return sink.err
+	}
+	if _, err := sink.spool.WriteString("\n]"); err != nil {
+		return err
+	}
+	if _, err := sink.spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	creator, ok := sink.w.(source.FileCreator)
+	if !ok {
+		data, err := io.ReadAll(sink.spool)
+		if err != nil {
+			return err
+		}
+		return sink.w.WriteFile(sink.name, data)
+	}
+	f, err := creator.CreateFile(sink.name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, sink.spool); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// SQLSink stores each result by running query on db with the result's
+// key, caption and error as its arguments, in the placeholder syntax of
+// db's driver, such as:
+//
+//	INSERT INTO captions (key, caption, error) VALUES ($1, $2, $3)
+//	ON CONFLICT (key) DO UPDATE SET caption = $2, error = $3
+func SQLSink(db *sql.DB, query string) Sink {
+	return SinkFunc(func(result Result) error {
+		entry := result.Entry()
+		if _, err := db.Exec(query, entry.Key, entry.Caption, entry.Error); err != nil {
+			return fmt.Errorf("pipeline: storing %s: %w", entry.Key, err)
+		}
+		return nil
+	})
+}
+
+// WriteCaptions is a stage that stores each caption on its object with w,
+// usually the source of the pipeline's objects.
+func WriteCaptions(w source.CaptionWriter) Stage {
+	return StageFunc(func(ctx context.Context, result *Result) error {
+		return w.WriteCaption(result.Object, result.Caption)
+	})
+}
@@ -0,0 +1,91 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+// Source gives a pipeline its items, calling emit for each in turn until
+// it runs out or emit returns an error, which it returns. emit blocks
+// while the pipeline is busy.
+type Source interface {
+	Items(ctx context.Context, emit func(Item) error) error
+}
+
+// SourceFunc is a Source that calls a function.
+type SourceFunc func(ctx context.Context, emit func(Item) error) error
+
+// Items calls fn(ctx, emit).
+func (fn SourceFunc) Items(ctx context.Context, emit func(Item) error) error {
+	return fn(ctx, emit)
+}
+
+// FromSource returns a Source of the images of src, the objects
+// source.IsImage accepts, such as those of a local directory or an S3
+// bucket.
+func FromSource(src source.Source) Source {
+	return SourceFunc(func(ctx context.Context, emit func(Item) error) error {
+		return src.Walk(func(obj source.Object) error {
+			if !source.IsImage(obj.Key) {
+				return nil
+			}
+			return emit(Item{
+				Key:    obj.Key,
+				URL:    obj.URL,
+				Object: obj,
+				Open:   func() (io.ReadCloser, error) { return src.Open(obj) },
+			})
+		})
+	})
+}
+
+// URLs returns a Source of the images at urls.
+func URLs(urls ...string) Source {
+	return SourceFunc(func(ctx context.Context, emit func(Item) error) error {
+		for _, url := range urls {
+			if err := emit(urlItem(url)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// urlItem returns the item of the image at url, whose key is url.
+func urlItem(url string) Item {
+	return Item{Key: url, URL: url, Object: source.Object{Key: url, URL: url}}
+}
+
+// URLList returns a Source of the image URLs read from r, one per line.
+// Blank lines and lines starting with # are skipped.
+func URLList(r io.Reader) Source {
+	return SourceFunc(func(ctx context.Context, emit func(Item) error) error {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			url := strings.TrimSpace(scanner.Text())
+			if url == "" || strings.HasPrefix(url, "#") {
+				continue
+			}
+			if err := emit(urlItem(url)); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	})
+}
+
+// Filter returns a Source of the items of src keep returns true for.
+func Filter(src Source, keep func(Item) bool) Source {
+	return SourceFunc(func(ctx context.Context, emit func(Item) error) error {
+		return src.Items(ctx, func(item Item) error {
+			if !keep(item) {
+				return nil
+			}
+			return emit(item)
+		})
+	})
+}
@@ -0,0 +1,181 @@
+// Package azure captions images with the Describe Image operation of Azure
+// AI Vision (Computer Vision), the service behind captionbot.ai. A Client
+// is a captionbot.Captioner, so it can stand in for a CaptionBot or back
+// one up:
+//
+//	client := azure.New(os.Getenv("AZURE_VISION_KEY"), "https://example.cognitiveservices.azure.com")
+//	captioner := captionbot.Fallback{bot, client}
+//	caption, err := captioner.CaptionURL("https://example.com/cat.jpg")
+package azure
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// describePath is the path of the Describe Image operation, under a
+// resource's endpoint.
+const describePath = "/vision/v3.2/describe"
+
+// Client captions images with one Azure AI Vision resource. It is safe
+// for concurrent use.
+type Client struct {
+	// Endpoint is the resource's endpoint, such as
+	// https://example.cognitiveservices.azure.com.
+	Endpoint string
+	Key      string
+	// Language is the language of captions, "en" if empty; the service
+	// also supports "es", "ja", "pt" and "zh".
+	Language   string
+	HTTPClient *http.Client
+}
+
+var _ captionbot.Captioner = (*Client)(nil)
+
+// New creates a Client for the resource at endpoint with the key key.
+func New(key, endpoint string) *Client {
+	return &Client{Endpoint: strings.TrimRight(endpoint, "/"), Key: key}
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Caption is a caption the service gave an image, with its confidence
+// from 0 to 1.
+type Caption struct {
+	Text       string  `json:"text"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Description is the service's description of an image.
+type Description struct {
+	Tags     []string  `json:"tags"`
+	Captions []Caption `json:"captions"`
+}
+
+// Error is the error the service answers a failed request with.
+type Error struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+}
+
+func (err *Error) Error() string {
+	if err.Code == "" {
+		return fmt.Sprintf("azure: status %d", err.StatusCode)
+	}
+	return fmt.Sprintf("azure: %s: %s", err.Code, err.Message)
+}
+
+// Describe describes the image in body, which is a JSON object with the
+// image's url if contentType is "application/json", and the image's data
+// otherwise.
+func (client *Client) Describe(ctx context.Context, body io.Reader, contentType string) (*Description, error) {
+	query := url.Values{}
+	query.Set("maxCandidates", "1")
+	if client.Language != "" {
+		query.Set("language", client.Language)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", client.Endpoint+describePath+"?"+query.Encode(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Ocp-Apim-Subscription-Key", client.Key)
+	req.Header.Set("User-Agent", captionbot.UserAgent)
+
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var failure struct {
+			Error *Error `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&failure) != nil || failure.Error == nil {
+			failure.Error = &Error{}
+		}
+		failure.Error.StatusCode = resp.StatusCode
+		return nil, failure.Error
+	}
+	var result struct {
+		Description Description `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	return &result.Description, nil
+}
+
+// CaptionURL captions the image at url.
+func (client *Client) CaptionURL(url string) (string, error) {
+	return client.CaptionURLContext(context.Background(), url)
+}
+
+// CaptionURLContext is CaptionURL with a context for its request.
+func (client *Client) CaptionURLContext(ctx context.Context, url string) (string, error) {
+	data, err := json.Marshal(map[string]string{"url": url})
+	if err != nil {
+		return "", err
+	}
+	return client.caption(client.Describe(ctx, bytes.NewReader(data), "application/json"))
+}
+
+// CaptionReader captions the image read from r. The service tells its
+// type from its data, so name is unused.
+func (client *Client) CaptionReader(r io.Reader, name string) (string, error) {
+	return client.CaptionReaderContext(context.Background(), r, name)
+}
+
+// CaptionReaderContext is CaptionReader with a context for its request.
+func (client *Client) CaptionReaderContext(ctx context.Context, r io.Reader, name string) (string, error) {
+	return client.caption(client.Describe(ctx, r, "application/octet-stream"))
+}
+
+// languages are the languages the service captions in.
+var languages = map[string]bool{"en": true, "es": true, "ja": true, "pt": true, "zh": true}
+
+// Localized returns a copy of the client asking for captions in the
+// language of locale, such as "es" for "es-MX", or the client itself if
+// the service doesn't caption in it. It makes a Client a
+// server.Localizer.
+func (client *Client) Localized(locale string) captionbot.Captioner {
+	language, _, _ := strings.Cut(strings.ToLower(locale), "-")
+	if !languages[language] {
+		return client
+	}
+	localized := *client
+	localized.Language = language
+	return &localized
+}
+
+// caption returns the text of the most confident caption of description.
+func (client *Client) caption(description *Description, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	best := -1
+	for i, caption := range description.Captions {
+		if best < 0 || caption.Confidence > description.Captions[best].Confidence {
+			best = i
+		}
+	}
+	if best < 0 || description.Captions[best].Text == "" {
+		return "", fmt.Errorf("azure: no caption for the image")
+	}
+	return description.Captions[best].Text, nil
+}
@@ -0,0 +1,131 @@
+// Package kafka runs a caption worker on Kafka. It consumes jobs from a
+// topic as part of a consumer group, so instances scale up to the number
+// of partitions, and produces results to an output topic keyed by the
+// job's message key.
+//
+// Offsets are committed only after a job's result (or dead letter) is
+// written, so delivery is at least once: a crash may caption a job twice
+// but never loses one. Jobs that can't be parsed, or still fail after
+// MaxAttempts, are copied to the dead-letter topic with an "error"
+// header.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	kafkago "github.com/segmentio/kafka-go"
+
+	"github.com/nhatbui/captionbot/notify"
+	"github.com/nhatbui/captionbot/queue"
+)
+
+// Worker consumes jobs and produces results.
+type Worker struct {
+	Brokers     []string
+	GroupID     string
+	Topic       string
+	ResultTopic string
+	// DeadLetterTopic receives failed jobs. If empty, failures are
+	// produced to ResultTopic like successes.
+	DeadLetterTopic string
+	// MaxAttempts is how many times a failing job is tried.
+	MaxAttempts int
+
+	Captioner *queue.Captioner
+	Logger    *log.Logger
+}
+
+func (worker *Worker) logf(format string, args ...interface{}) {
+	if worker.Logger != nil {
+		worker.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Run processes jobs until ctx is canceled or Kafka fails.
+func (worker *Worker) Run(ctx context.Context) error {
+	reader := kafkago.NewReader(kafkago.ReaderConfig{
+		Brokers:  worker.Brokers,
+		GroupID:  worker.GroupID,
+		Topic:    worker.Topic,
+		MaxBytes: 1 << 20,
+	})
+	defer reader.Close()
+
+	writer := &kafkago.Writer{
+		Addr:         kafkago.TCP(worker.Brokers...),
+		Balancer:     &kafkago.Hash{},
+		RequiredAcks: kafkago.RequireAll,
+	}
+	defer writer.Close()
+
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		out := worker.process(msg)
+		if err := writer.WriteMessages(ctx, out); err != nil {
+			return err
+		}
+		if err := reader.CommitMessages(ctx, msg); err != nil {
+			return err
+		}
+	}
+}
+
+// process captions a message and returns the message to produce.
+func (worker *Worker) process(msg kafkago.Message) kafkago.Message {
+	job, err := queue.ParseJob(msg.Value)
+	if err != nil {
+		worker.logf("kafka: %s/%d@%d: %s", msg.Topic, msg.Partition, msg.Offset, err)
+		result := queue.Result{Event: notify.Event{Input: string(msg.Value), Error: err.Error()}}
+		return worker.failed(msg, result, 0)
+	}
+
+	attempts := worker.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var result queue.Result
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if result = worker.Captioner.Caption(job); result.Error == "" {
+			value, _ := json.Marshal(result)
+			return kafkago.Message{Topic: worker.ResultTopic, Key: msg.Key, Value: value}
+		}
+		worker.logf("kafka: %s attempt %d: %s", job.Input(), attempt, result.Error)
+		if attempt < attempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+	return worker.failed(msg, result, attempts)
+}
+
+// failed returns the original message for the dead-letter topic, or the
+// failed result for the result topic if there is no dead-letter topic.
+func (worker *Worker) failed(msg kafkago.Message, result queue.Result, attempts int) kafkago.Message {
+	if worker.DeadLetterTopic == "" {
+		value, _ := json.Marshal(result)
+		return kafkago.Message{Topic: worker.ResultTopic, Key: msg.Key, Value: value}
+	}
+	return kafkago.Message{
+		Topic: worker.DeadLetterTopic,
+		Key:   msg.Key,
+		Value: msg.Value,
+		Headers: []kafkago.Header{
+			{Key: "error", Value: []byte(result.Error)},
+			{Key: "attempts", Value: []byte(strconv.Itoa(attempts))},
+			{Key: "source-topic", Value: []byte(msg.Topic)},
+			{Key: "source-offset", Value: []byte(strconv.FormatInt(msg.Offset, 10))},
+		},
+	}
+}
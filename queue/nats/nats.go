@@ -0,0 +1,181 @@
+// Package nats exposes captioning on NATS, both as a request/reply
+// service and as a JetStream work queue for batches.
+//
+// Requests to Subject are answered with the JSON result, and instances
+// sharing QueueGroup split the load. Jobs published to Stream are pulled
+// by a durable consumer, acknowledged once their result is published to
+// ResultSubject, and redelivered with backoff on failure up to
+// MaxAttempts times before being terminated.
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	natsgo "github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+
+	"github.com/nhatbui/captionbot/notify"
+	"github.com/nhatbui/captionbot/queue"
+)
+
+// progressInterval is how often a JetStream job in progress extends its
+// ack deadline, which must be shorter than the consumer's AckWait.
+const progressInterval = 10 * time.Second
+
+// Service answers caption requests and works through a job stream.
+type Service struct {
+	URL string
+
+	// Subject and QueueGroup configure the request/reply service; it
+	// is disabled if Subject is empty.
+	Subject    string
+	QueueGroup string
+
+	// Stream, Consumer and ResultSubject configure the JetStream work
+	// queue; it is disabled if Stream is empty.
+	Stream        string
+	Consumer      string
+	ResultSubject string
+	MaxAttempts   int
+
+	Captioner *queue.Captioner
+	Logger    *log.Logger
+}
+
+func (service *Service) logf(format string, args ...interface{}) {
+	if service.Logger != nil {
+		service.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Run serves until ctx is canceled, then drains the connection so
+// requests in flight are finished.
+func (service *Service) Run(ctx context.Context) error {
+	nc, err := natsgo.Connect(service.URL, natsgo.Name("captionbot"), natsgo.MaxReconnects(-1))
+	if err != nil {
+		return err
+	}
+	defer nc.Drain()
+
+	if service.Subject != "" {
+		if _, err := nc.QueueSubscribe(service.Subject, service.QueueGroup, service.respond); err != nil {
+			return err
+		}
+	}
+
+	if service.Stream != "" {
+		js, err := jetstream.New(nc)
+		if err != nil {
+			return err
+		}
+		consumer, err := js.CreateOrUpdateConsumer(ctx, service.Stream, jetstream.ConsumerConfig{
+			Durable:    service.Consumer,
+			AckPolicy:  jetstream.AckExplicitPolicy,
+			AckWait:    3 * progressInterval,
+			MaxDeliver: service.maxAttempts(),
+		})
+		if err != nil {
+			return err
+		}
+		consuming, err := consumer.Consume(func(msg jetstream.Msg) {
+			service.work(ctx, js, msg)
+		})
+		if err != nil {
+			return err
+		}
+		defer consuming.Stop()
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (service *Service) maxAttempts() int {
+	if service.MaxAttempts < 1 {
+		return 1
+	}
+	return service.MaxAttempts
+}
+
+// respond answers a request with its result.
+func (service *Service) respond(msg *natsgo.Msg) {
+	var result queue.Result
+	if job, err := queue.ParseJob(msg.Data); err != nil {
+		result.Event = notify.Event{Input: string(msg.Data), Error: err.Error()}
+	} else {
+		result = service.Captioner.Caption(job)
+	}
+
+	data, _ := json.Marshal(result)
+	if err := msg.Respond(data); err != nil {
+		service.logf("nats: responding to %s: %s", msg.Subject, err)
+	}
+}
+
+// work processes a job from the stream.
+func (service *Service) work(ctx context.Context, js jetstream.JetStream, msg jetstream.Msg) {
+	job, err := queue.ParseJob(msg.Data())
+	if err != nil {
+		service.logf("nats: terminating malformed job on %s: %s", msg.Subject(), err)
+		msg.Term()
+		return
+	}
+
+	// Keep the job from being redelivered while it's being captioned.
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				msg.InProgress()
+			}
+		}
+	}()
+	result := service.Captioner.Caption(job)
+	close(done)
+
+	attempt := uint64(1)
+	if meta, err := msg.Metadata(); err == nil {
+		attempt = meta.NumDelivered
+	}
+	if result.Error != "" && attempt < uint64(service.maxAttempts()) {
+		service.logf("nats: %s attempt %d: %s", job.Input(), attempt, result.Error)
+		msg.NakWithDelay(time.Duration(attempt) * 5 * time.Second)
+		return
+	}
+
+	if err := service.publish(ctx, js, result); err != nil {
+		service.logf("nats: publishing result for %s: %s", job.Input(), err)
+		msg.Nak()
+		return
+	}
+	if result.Error != "" {
+		msg.Term()
+		return
+	}
+	msg.Ack()
+}
+
+func (service *Service) publish(ctx context.Context, js jetstream.JetStream, result queue.Result) error {
+	if service.ResultSubject == "" {
+		return nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	if _, err := js.Publish(ctx, service.ResultSubject, data); err != nil {
+		return fmt.Errorf("publishing to %s: %s", service.ResultSubject, err)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+// Package queue holds what the message queue workers in its subpackages
+// share: the job and result formats, and captioning a job.
+//
+// A job message is either a bare image URL, or a JSON Job naming a URL or
+// an object in any source the source package can open:
+//
+//	https://example.com/photo.jpg
+//	{"id": "42", "url": "https://example.com/photo.jpg"}
+//	{"id": "43", "source": "s3://bucket/photos/", "key": "2024/beach.jpg"}
+//
+// Results are JSON Results, which carry the job's ID.
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/notify"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// Job is a caption request.
+type Job struct {
+	// ID is an optional caller-chosen ID, copied to the result.
+	ID string `json:"id,omitempty"`
+	// URL is an image URL. Either URL or Source and Key are set.
+	URL string `json:"url,omitempty"`
+	// Source is a source URL, as accepted by source.Open.
+	Source string `json:"source,omitempty"`
+	// Key names the object in Source. Backends that address objects by
+	// ID, such as Google Drive, also need ObjectID.
+	Key      string `json:"key,omitempty"`
+	ObjectID string `json:"object_id,omitempty"`
+}
+
+// Input returns what the job captions, for logs and results.
+func (job Job) Input() string {
+	if job.URL != "" {
+		return job.URL
+	}
+	return strings.TrimRight(job.Source, "/") + "/" + job.Key
+}
+
+// Result is the outcome of a Job.
+type Result struct {
+	ID string `json:"id,omitempty"`
+	notify.Event
+}
+
+// ParseJob parses a job message. Malformed messages can never succeed, so
+// callers should dead-letter them rather than retry.
+func ParseJob(data []byte) (Job, error) {
+	data = bytes.TrimSpace(data)
+	if !bytes.HasPrefix(data, []byte("{")) {
+		u := string(data)
+		if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+			return Job{}, fmt.Errorf("message is neither JSON nor an image URL")
+		}
+		return Job{URL: u}, nil
+	}
+
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, err
+	}
+	if job.URL == "" && (job.Source == "" || job.Key == "") {
+		return Job{}, fmt.Errorf("job needs a url, or a source and key")
+	}
+	return job, nil
+}
+
+// Captioner captions jobs, caching opened sources. It is safe for
+// concurrent use if its Captioner is, as the captionbot.Serial
+// NewCaptioner makes is.
+type Captioner struct {
+	Captioner captionbot.Captioner
+
+	mu      sync.Mutex
+	sources map[string]source.Source
+}
+
+// NewCaptioner creates a Captioner making one caption at a time with bot.
+func NewCaptioner(bot *captionbot.CaptionBot) *Captioner {
+	return &Captioner{Captioner: captionbot.NewSerial(bot)}
+}
+
+// Caption captions a job. Failures are reported in the result's Error.
+func (captioner *Captioner) Caption(job Job) Result {
+	start := time.Now()
+	caption, err := captioner.caption(job)
+	return Result{ID: job.ID, Event: notify.NewEvent(job.Input(), caption, err, start)}
+}
+
+func (captioner *Captioner) caption(job Job) (string, error) {
+	if job.URL != "" {
+		return captioner.Captioner.CaptionURL(job.URL)
+	}
+	src, err := captioner.source(job.Source)
+	if err != nil {
+		return "", err
+	}
+	return source.Caption(captioner.Captioner, src, source.Object{Key: job.Key, ID: job.ObjectID})
+}
+
+// source returns the source opened from rawurl, opening it the first
+// time.
+func (captioner *Captioner) source(rawurl string) (source.Source, error) {
+	captioner.mu.Lock()
+	defer captioner.mu.Unlock()
+	if src, ok := captioner.sources[rawurl]; ok {
+		return src, nil
+	}
+	src, err := source.Open(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if captioner.sources == nil {
+		captioner.sources = map[string]source.Source{}
+	}
+	captioner.sources[rawurl] = src
+	return src, nil
+}
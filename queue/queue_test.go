@@ -0,0 +1,30 @@
+package queue
+
+import "testing"
+
+func TestParseJob(t *testing.T) {
+	tests := []struct {
+		name    string
+		message string
+		want    Job
+		ok      bool
+	}{
+		{"bare URL", " https://example.com/a.jpg\n", Job{URL: "https://example.com/a.jpg"}, true},
+		{"URL job", `{"id":"42","url":"https://example.com/a.jpg"}`, Job{ID: "42", URL: "https://example.com/a.jpg"}, true},
+		{"source job", `{"source":"s3://bucket/","key":"a.jpg"}`, Job{Source: "s3://bucket/", Key: "a.jpg"}, true},
+		{"other scheme", "file:///etc/passwd", Job{}, false},
+		{"text", "caption this", Job{}, false},
+		{"bad JSON", `{"url":`, Job{}, false},
+		{"source without key", `{"source":"s3://bucket/"}`, Job{}, false},
+		{"empty job", `{"id":"42"}`, Job{}, false},
+	}
+	for _, test := range tests {
+		job, err := ParseJob([]byte(test.message))
+		if (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want success %v", test.name, err, test.ok)
+		}
+		if job != test.want {
+			t.Errorf("%s: job = %+v, want %+v", test.name, job, test.want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+// Package rabbitmq runs a caption worker on RabbitMQ (AMQP 0-9-1). It
+// consumes jobs from a queue with manual acknowledgements, publishes
+// results to an exchange with publisher confirms, and acks each job only
+// once its result is confirmed.
+//
+// Jobs that can't be parsed, or still fail after MaxAttempts, are
+// rejected without requeueing, so RabbitMQ routes them to the queue's
+// dead-letter exchange if it has one. Attempts are counted with the
+// x-delivery-count header of quorum queues; on classic queues a failed
+// job is requeued once.
+//
+// If a job has a reply-to property, its result is also sent there with
+// the job's correlation ID, so the worker can serve RPC-style callers.
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+
+	"github.com/nhatbui/captionbot/queue"
+)
+
+// Worker consumes jobs and publishes results.
+type Worker struct {
+	// URL is an amqp:// or amqps:// broker URL.
+	URL   string
+	Queue string
+	// Exchange and RoutingKey are where results are published.
+	Exchange   string
+	RoutingKey string
+	// Prefetch is how many unacknowledged jobs the broker sends ahead.
+	Prefetch    int
+	MaxAttempts int
+
+	Captioner *queue.Captioner
+	Logger    *log.Logger
+}
+
+func (worker *Worker) logf(format string, args ...interface{}) {
+	if worker.Logger != nil {
+		worker.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Run processes jobs until ctx is canceled or the connection fails.
+func (worker *Worker) Run(ctx context.Context) error {
+	conn, err := amqp.Dial(worker.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	prefetch := worker.Prefetch
+	if prefetch < 1 {
+		prefetch = 1
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+
+	deliveries, err := ch.ConsumeWithContext(ctx, worker.Queue, "", false, false, false, false, nil)
+	if err != nil {
+		return err
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-closed:
+			if err == nil {
+				return nil
+			}
+			return err
+		case d, ok := <-deliveries:
+			if !ok {
+				return nil
+			}
+			if err := worker.handle(ctx, ch, d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// attempt returns which delivery of d this is, counting from 1.
+func attempt(d amqp.Delivery) int {
+	if count, ok := d.Headers["x-delivery-count"].(int64); ok {
+		return int(count) + 1
+	}
+	if d.Redelivered {
+		return 2
+	}
+	return 1
+}
+
+func (worker *Worker) handle(ctx context.Context, ch *amqp.Channel, d amqp.Delivery) error {
+	job, err := queue.ParseJob(d.Body)
+	if err != nil {
+		worker.logf("rabbitmq: rejecting message %s: %s", d.MessageId, err)
+		return d.Reject(false)
+	}
+
+	result := worker.Captioner.Caption(job)
+	if result.Error != "" {
+		maxAttempts := worker.MaxAttempts
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+		n := attempt(d)
+		worker.logf("rabbitmq: %s attempt %d: %s", job.Input(), n, result.Error)
+		if n < maxAttempts {
+			return d.Nack(false, true)
+		}
+		if err := worker.publish(ctx, ch, d, result); err != nil {
+			return err
+		}
+		return d.Nack(false, false)
+	}
+
+	if err := worker.publish(ctx, ch, d, result); err != nil {
+		return err
+	}
+	return d.Ack(false)
+}
+
+// publish sends a result to the exchange, and to the job's reply-to
+// queue if it has one, waiting for the broker's confirmation.
+func (worker *Worker) publish(ctx context.Context, ch *amqp.Channel, d amqp.Delivery, result queue.Result) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	msg := amqp.Publishing{
+		ContentType:   "application/json",
+		DeliveryMode:  amqp.Persistent,
+		CorrelationId: d.CorrelationId,
+		MessageId:     d.MessageId,
+		Body:          body,
+	}
+	if msg.CorrelationId == "" {
+		msg.CorrelationId = result.ID
+	}
+
+	targets := [][2]string{{worker.Exchange, worker.RoutingKey}}
+	if d.ReplyTo != "" {
+		targets = append(targets, [2]string{"", d.ReplyTo})
+	}
+	for _, target := range targets {
+		confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, target[0], target[1], false, false, msg)
+		if err != nil {
+			return err
+		}
+		if ok, err := confirm.WaitContext(ctx); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("broker rejected result for %s", result.Input)
+		}
+	}
+	return nil
+}
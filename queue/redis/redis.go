@@ -0,0 +1,211 @@
+// Package redis runs a caption worker on a Redis stream, for deployments
+// that already run Redis and don't want a separate broker.
+//
+// Jobs are stream entries with a "job" field holding a job message.
+// Workers read them as members of a consumer group, so each job goes to
+// one worker, and add results to a result stream with a "result" field.
+// An entry is acknowledged in the same transaction that adds its result,
+// so a crash may caption a job twice but never loses one.
+//
+// Entries left pending for ClaimIdle, by a consumer that crashed or by a
+// caption that failed, are claimed with XAUTOCLAIM and retried. After
+// MaxAttempts deliveries a failing entry is added to the dead-letter
+// stream with "error" and "attempts" fields and acknowledged.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/nhatbui/captionbot/notify"
+	"github.com/nhatbui/captionbot/queue"
+)
+
+// Worker consumes jobs from one stream and adds results to another.
+type Worker struct {
+	Client   *goredis.Client
+	Stream   string
+	Group    string
+	Consumer string
+
+	ResultStream string
+	// DeadLetterStream receives failed jobs. If empty, failures are
+	// added to ResultStream like successes.
+	DeadLetterStream string
+	// MaxLen caps the result and dead-letter streams, approximately.
+	MaxLen int64
+
+	// ClaimIdle is how long an entry stays pending before another
+	// attempt claims it.
+	ClaimIdle   time.Duration
+	MaxAttempts int
+
+	Captioner *queue.Captioner
+	Logger    *log.Logger
+}
+
+// NewWorker creates a Worker for a redis:// or rediss:// URL.
+func NewWorker(url, stream, group, consumer string, captioner *queue.Captioner) (*Worker, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Worker{
+		Client:       goredis.NewClient(opts),
+		Stream:       stream,
+		Group:        group,
+		Consumer:     consumer,
+		ResultStream: stream + ":results",
+		ClaimIdle:    time.Minute,
+		MaxAttempts:  3,
+		Captioner:    captioner,
+	}, nil
+}
+
+func (worker *Worker) logf(format string, args ...interface{}) {
+	if worker.Logger != nil {
+		worker.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Run processes jobs until ctx is canceled or Redis fails. It creates the
+// stream and consumer group if they don't exist.
+func (worker *Worker) Run(ctx context.Context) error {
+	err := worker.Client.XGroupCreateMkStream(ctx, worker.Stream, worker.Group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+
+	claimFrom := "0-0"
+	for ctx.Err() == nil {
+		// Retry stale pending entries before reading new ones.
+		claimed, next, err := worker.Client.XAutoClaim(ctx, &goredis.XAutoClaimArgs{
+			Stream:   worker.Stream,
+			Group:    worker.Group,
+			Consumer: worker.Consumer,
+			MinIdle:  worker.ClaimIdle,
+			Start:    claimFrom,
+			Count:    1,
+		}).Result()
+		if err != nil {
+			return worker.stopped(ctx, err)
+		}
+		claimFrom = next
+		if len(claimed) > 0 {
+			if err := worker.retry(ctx, claimed[0]); err != nil {
+				return worker.stopped(ctx, err)
+			}
+			continue
+		}
+
+		streams, err := worker.Client.XReadGroup(ctx, &goredis.XReadGroupArgs{
+			Group:    worker.Group,
+			Consumer: worker.Consumer,
+			Streams:  []string{worker.Stream, ">"},
+			Count:    1,
+			Block:    5 * time.Second,
+		}).Result()
+		if errors.Is(err, goredis.Nil) {
+			continue
+		}
+		if err != nil {
+			return worker.stopped(ctx, err)
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if err := worker.process(ctx, msg, 1); err != nil {
+					return worker.stopped(ctx, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// stopped returns nil for errors caused by ctx being canceled.
+func (worker *Worker) stopped(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// retry processes a claimed entry, looking up how often it was delivered.
+func (worker *Worker) retry(ctx context.Context, msg goredis.XMessage) error {
+	pending, err := worker.Client.XPendingExt(ctx, &goredis.XPendingExtArgs{
+		Stream: worker.Stream,
+		Group:  worker.Group,
+		Start:  msg.ID,
+		End:    msg.ID,
+		Count:  1,
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		// Another worker finished it in the meantime.
+		return nil
+	}
+	return worker.process(ctx, msg, int(pending[0].RetryCount))
+}
+
+// process captions an entry on its given delivery. Failures before the
+// last attempt stay pending, to be claimed again after ClaimIdle.
+func (worker *Worker) process(ctx context.Context, msg goredis.XMessage, delivery int) error {
+	value, _ := msg.Values["job"].(string)
+	job, err := queue.ParseJob([]byte(value))
+	if err != nil {
+		worker.logf("redis: %s %s: %s", worker.Stream, msg.ID, err)
+		result := queue.Result{ID: msg.ID, Event: notify.Event{Input: value, Error: err.Error()}}
+		return worker.finish(ctx, msg, result, delivery)
+	}
+	if job.ID == "" {
+		job.ID = msg.ID
+	}
+
+	result := worker.Captioner.Caption(job)
+	if result.Error != "" {
+		worker.logf("redis: %s attempt %d: %s", job.Input(), delivery, result.Error)
+		if delivery < worker.MaxAttempts {
+			return nil
+		}
+	}
+	return worker.finish(ctx, msg, result, delivery)
+}
+
+// finish adds the result, or the failed entry to the dead-letter stream,
+// and acknowledges the entry.
+func (worker *Worker) finish(ctx context.Context, msg goredis.XMessage, result queue.Result, delivery int) error {
+	out := &goredis.XAddArgs{Stream: worker.ResultStream, MaxLen: worker.MaxLen, Approx: worker.MaxLen > 0}
+	if result.Error != "" && worker.DeadLetterStream != "" {
+		out.Stream = worker.DeadLetterStream
+		out.Values = []interface{}{
+			"job", msg.Values["job"],
+			"error", result.Error,
+			"attempts", strconv.Itoa(delivery),
+			"source-id", msg.ID,
+		}
+	} else {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		out.Values = []interface{}{"result", string(data)}
+	}
+
+	_, err := worker.Client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.XAdd(ctx, out)
+		pipe.XAck(ctx, worker.Stream, worker.Group, msg.ID)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,336 @@
+// Package sqs runs a caption worker on Amazon SQS, either as a long
+// polling process (Worker.Run) or as an AWS Lambda function triggered by
+// the queue (Worker.HandleLambda).
+//
+// Results can be sent to a result queue, stored as JSON objects in any
+// writable source such as an S3 prefix, and put into a DynamoDB table
+// keyed by "id".
+//
+// While a job is being captioned its visibility timeout is extended, so
+// slow captions aren't handed to another worker. Failed jobs are left on
+// the queue to be retried after a backoff; after MaxAttempts receives
+// their failure is reported and they are deleted. With MaxAttempts zero
+// they are left for the queue's redrive policy to dead-letter.
+package sqs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot/internal/awsv4"
+	"github.com/nhatbui/captionbot/queue"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// Worker processes caption jobs from an SQS queue.
+type Worker struct {
+	QueueURL string
+	Region   string
+	// VisibilityTimeout is how long a received job is hidden from other
+	// workers; it is extended while the job is being captioned.
+	VisibilityTimeout time.Duration
+	MaxAttempts       int
+
+	// ResultQueueURL, if set, receives each result as a message.
+	ResultQueueURL string
+	// Results, if set, stores each result as ID.json.
+	Results source.FileWriter
+	// Table, if set, is a DynamoDB table that each result is put into.
+	Table string
+
+	Captioner  *queue.Captioner
+	HTTPClient *http.Client
+	Logger     *log.Logger
+
+	sqs    *awsv4.Signer
+	dynamo *awsv4.Signer
+}
+
+// NewWorker creates a Worker for a queue, with credentials from the
+// environment or shared credentials file. The region is taken from the
+// queue URL.
+func NewWorker(queueURL string, captioner *queue.Captioner) (*Worker, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	// Queue URLs look like https://sqs.REGION.amazonaws.com/ACCOUNT/NAME.
+	parts := strings.Split(u.Host, ".")
+	if len(parts) < 4 || parts[0] != "sqs" {
+		return nil, fmt.Errorf("sqs: can't find region in queue URL %s", queueURL)
+	}
+	creds, err := awsv4.LoadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	region := parts[1]
+	return &Worker{
+		QueueURL:          queueURL,
+		Region:            region,
+		VisibilityTimeout: time.Minute,
+		Captioner:         captioner,
+		sqs:               awsv4.NewSigner(creds, region, "sqs"),
+		dynamo:            awsv4.NewSigner(creds, region, "dynamodb"),
+	}, nil
+}
+
+func (worker *Worker) httpClient() *http.Client {
+	if worker.HTTPClient != nil {
+		return worker.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (worker *Worker) logf(format string, args ...interface{}) {
+	if worker.Logger != nil {
+		worker.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// call invokes an AWS JSON protocol action and decodes the response.
+func (worker *Worker) call(ctx context.Context, signer *awsv4.Signer, endpoint, target string, input, output interface{}) error {
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", target)
+	signer.Sign(req, awsv4.PayloadHash(body))
+
+	resp, err := worker.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s: %s: %s", target, apiErr.Type, apiErr.Message)
+	}
+	if output == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(output)
+}
+
+func (worker *Worker) sqsCall(ctx context.Context, action string, input, output interface{}) error {
+	return worker.call(ctx, worker.sqs, "https://sqs."+worker.Region+".amazonaws.com/", "AmazonSQS."+action, input, output)
+}
+
+type message struct {
+	MessageID     string            `json:"MessageId"`
+	ReceiptHandle string            `json:"ReceiptHandle"`
+	Body          string            `json:"Body"`
+	Attributes    map[string]string `json:"Attributes"`
+}
+
+// Run long polls the queue until ctx is canceled or a request fails.
+func (worker *Worker) Run(ctx context.Context) error {
+	for ctx.Err() == nil {
+		var received struct {
+			Messages []message `json:"Messages"`
+		}
+		err := worker.sqsCall(ctx, "ReceiveMessage", map[string]interface{}{
+			"QueueUrl":                    worker.QueueURL,
+			"MaxNumberOfMessages":         1,
+			"WaitTimeSeconds":             20,
+			"VisibilityTimeout":           int(worker.VisibilityTimeout / time.Second),
+			"MessageSystemAttributeNames": []string{"ApproximateReceiveCount"},
+		}, &received)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		for _, msg := range received.Messages {
+			if err := worker.handle(ctx, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (worker *Worker) handle(ctx context.Context, msg message) error {
+	receives, _ := strconv.Atoi(msg.Attributes["ApproximateReceiveCount"])
+
+	job, err := queue.ParseJob([]byte(msg.Body))
+	if err != nil {
+		// Malformed jobs never succeed; leave them for the redrive
+		// policy if there is one, or drop them.
+		worker.logf("sqs: message %s: %s", msg.MessageID, err)
+		if worker.MaxAttempts > 0 {
+			return worker.delete(ctx, msg)
+		}
+		return nil
+	}
+	if job.ID == "" {
+		job.ID = msg.MessageID
+	}
+
+	result := worker.captionVisible(ctx, msg, job)
+	if result.Error != "" {
+		worker.logf("sqs: %s attempt %d: %s", job.Input(), receives, result.Error)
+		if worker.MaxAttempts == 0 || receives < worker.MaxAttempts {
+			// Retry after a backoff that grows with each receive.
+			return worker.sqsCall(ctx, "ChangeMessageVisibility", map[string]interface{}{
+				"QueueUrl":          worker.QueueURL,
+				"ReceiptHandle":     msg.ReceiptHandle,
+				"VisibilityTimeout": 30 * receives,
+			}, nil)
+		}
+	}
+
+	if err := worker.store(ctx, result); err != nil {
+		return err
+	}
+	return worker.delete(ctx, msg)
+}
+
+// captionVisible captions a job, extending the message's visibility
+// timeout at half its length until the caption is done.
+func (worker *Worker) captionVisible(ctx context.Context, msg message, job queue.Job) queue.Result {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(worker.VisibilityTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				err := worker.sqsCall(ctx, "ChangeMessageVisibility", map[string]interface{}{
+					"QueueUrl":          worker.QueueURL,
+					"ReceiptHandle":     msg.ReceiptHandle,
+					"VisibilityTimeout": int(worker.VisibilityTimeout / time.Second),
+				}, nil)
+				if err != nil {
+					worker.logf("sqs: extending visibility of %s: %s", msg.MessageID, err)
+				}
+			}
+		}
+	}()
+	defer close(done)
+	return worker.Captioner.Caption(job)
+}
+
+func (worker *Worker) delete(ctx context.Context, msg message) error {
+	return worker.sqsCall(ctx, "DeleteMessage", map[string]interface{}{
+		"QueueUrl":      worker.QueueURL,
+		"ReceiptHandle": msg.ReceiptHandle,
+	}, nil)
+}
+
+// store sends a result to every configured destination.
+func (worker *Worker) store(ctx context.Context, result queue.Result) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	if worker.ResultQueueURL != "" {
+		err := worker.sqsCall(ctx, "SendMessage", map[string]interface{}{
+			"QueueUrl":    worker.ResultQueueURL,
+			"MessageBody": string(data),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	if worker.Results != nil {
+		if err := worker.Results.WriteFile(result.ID+".json", data); err != nil {
+			return err
+		}
+	}
+	if worker.Table != "" {
+		item := map[string]interface{}{
+			"id":          map[string]string{"S": result.ID},
+			"input":       map[string]string{"S": result.Input},
+			"started_at":  map[string]string{"S": result.StartedAt.Format(time.RFC3339Nano)},
+			"duration_ms": map[string]string{"N": strconv.FormatInt(result.DurationMS, 10)},
+		}
+		if result.Caption != "" {
+			item["caption"] = map[string]string{"S": result.Caption}
+		}
+		if result.Error != "" {
+			item["error"] = map[string]string{"S": result.Error}
+		}
+		err := worker.call(ctx, worker.dynamo, "https://dynamodb."+worker.Region+".amazonaws.com/",
+			"DynamoDB_20120810.PutItem", map[string]interface{}{"TableName": worker.Table, "Item": item}, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LambdaEvent is the event a Lambda function receives from an SQS
+// trigger.
+type LambdaEvent struct {
+	Records []struct {
+		MessageID     string            `json:"messageId"`
+		ReceiptHandle string            `json:"receiptHandle"`
+		Body          string            `json:"body"`
+		Attributes    map[string]string `json:"attributes"`
+	} `json:"Records"`
+}
+
+// BatchResponse reports the records of a LambdaEvent that failed, for
+// triggers with ReportBatchItemFailures enabled.
+type BatchResponse struct {
+	BatchItemFailures []BatchItemFailure `json:"batchItemFailures"`
+}
+
+// BatchItemFailure identifies a failed record.
+type BatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// HandleLambda processes an SQS batch in a Lambda function, for example
+// with lambda.Start(worker.HandleLambda). Lambda manages visibility and
+// retries, so failed records are reported back to be retried until
+// MaxAttempts receives, after which their failure is stored.
+func (worker *Worker) HandleLambda(ctx context.Context, event LambdaEvent) (BatchResponse, error) {
+	var response BatchResponse
+	for _, record := range event.Records {
+		job, err := queue.ParseJob([]byte(record.Body))
+		if err != nil {
+			worker.logf("sqs: message %s: %s", record.MessageID, err)
+			response.BatchItemFailures = append(response.BatchItemFailures, BatchItemFailure{record.MessageID})
+			continue
+		}
+		if job.ID == "" {
+			job.ID = record.MessageID
+		}
+
+		result := worker.Captioner.Caption(job)
+		receives, _ := strconv.Atoi(record.Attributes["ApproximateReceiveCount"])
+		retry := result.Error != "" && (worker.MaxAttempts == 0 || receives < worker.MaxAttempts)
+		if !retry {
+			err = worker.store(ctx, result)
+		}
+		if retry || err != nil {
+			response.BatchItemFailures = append(response.BatchItemFailures, BatchItemFailure{record.MessageID})
+		}
+	}
+	return response, nil
+}
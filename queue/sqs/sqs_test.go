@@ -0,0 +1,83 @@
+package sqs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nhatbui/captionbot/internal/awsv4"
+)
+
+// roundTripperFunc is an http.RoundTripper that calls a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+var testCredentials = awsv4.Credentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+
+// fakeSQS checks requests as SQS does: the signature must be recomputable
+// with testCredentials over the body received, and the request at most
+// fifteen minutes old.
+func fakeSQS(req *http.Request) (*http.Response, error) {
+	reject := func(kind string) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: http.StatusForbidden,
+			Body:       io.NopCloser(strings.NewReader(`{"__type":"` + kind + `","message":"rejected"}`)),
+		}, nil
+	}
+	body, _ := io.ReadAll(req.Body)
+	signed, err := time.Parse("20060102T150405Z", req.Header.Get("X-Amz-Date"))
+	if err != nil || time.Since(signed) > 15*time.Minute {
+		return reject("RequestExpired")
+	}
+
+	check := req.Clone(req.Context())
+	check.Header.Del("Authorization")
+	verifier := awsv4.NewSigner(testCredentials, "us-east-1", "sqs")
+	verifier.Now = func() time.Time { return signed }
+	verifier.Sign(check, awsv4.PayloadHash(body))
+	if check.Header.Get("Authorization") != req.Header.Get("Authorization") {
+		return reject("SignatureDoesNotMatch")
+	}
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader(nil))}, nil
+}
+
+func TestSignedCalls(t *testing.T) {
+	wrongSecret := testCredentials
+	wrongSecret.SecretAccessKey = "guess"
+
+	tests := []struct {
+		name   string
+		creds  awsv4.Credentials
+		signed time.Time
+		err    string
+	}{
+		{"valid", testCredentials, time.Now(), ""},
+		{"bad signature", wrongSecret, time.Now(), "SignatureDoesNotMatch"},
+		{"expired", testCredentials, time.Now().Add(-time.Hour), "RequestExpired"},
+	}
+	for _, test := range tests {
+		signer := awsv4.NewSigner(test.creds, "us-east-1", "sqs")
+		signed := test.signed
+		signer.Now = func() time.Time { return signed }
+		worker := &Worker{
+			QueueURL:   "https://sqs.us-east-1.amazonaws.com/123456789012/captions",
+			Region:     "us-east-1",
+			HTTPClient: &http.Client{Transport: roundTripperFunc(fakeSQS)},
+			sqs:        signer,
+		}
+		err := worker.delete(context.Background(), message{ReceiptHandle: "handle"})
+		if test.err == "" && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: err = %v, want %s", test.name, err, test.err)
+		}
+	}
+}
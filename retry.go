@@ -0,0 +1,89 @@
+package captionbot
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// temporary reports whether err may pass if the request is tried again:
+// a 429 or 5XX, a network error, or a response without a caption or that
+// isn't JSON, which captionbot.ai answers now and then.
+func temporary(err error) bool {
+	var status *APIError
+	if errors.As(err, &status) {
+		return status.StatusCode == http.StatusTooManyRequests || status.StatusCode >= 500
+	}
+	var schema *SchemaError
+	if errors.As(err, &schema) {
+		return len(schema.Missing) > 0
+	}
+	if errors.Is(err, ErrMalformedResponse) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// expired reports whether err is captionbot.ai refusing the session's
+// conversation or water mark, as it does once the conversation has
+// expired.
+func expired(err error) bool {
+	var status *APIError
+	if !errors.As(err, &status) || status.Endpoint != "message" {
+		return false
+	}
+	switch status.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusGone:
+		return true
+	}
+	return false
+}
+
+// retry calls attempt until it succeeds, fails for good, or has been
+// tried MaxRetries times after the first, waiting RetryBackoff, doubled
+// each time, between tries. When the conversation has expired, a new one
+// is started and the retry is made at once, without counting against
+// MaxRetries; this is done once, and the request failing the same way in
+// the new conversation fails for good.
+func (captionBot *CaptionBot) retry(ctx context.Context, attempt func() error) error {
+	backoff := captionBot.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	renewed := false
+	for retries := 0; ; {
+		err := attempt()
+		if err == nil || ctx.Err() != nil {
+			return err
+		}
+		if expired(err) {
+			// Refused again in a new conversation, it is the request
+			// captionbot.ai refuses, not the conversation.
+			if renewed {
+				return err
+			}
+			if captionBot.RefreshContext(ctx) == nil {
+				renewed = true
+				continue
+			}
+		} else if !temporary(err) {
+			return err
+		}
+		if retries >= captionBot.MaxRetries {
+			return err
+		}
+		retries++
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,112 @@
+package captionbot_test
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+const testImage = "https://example.com/cat.jpg"
+
+func newTestBot(t *testing.T, server *captionbottest.Server, maxRetries int) *captionbot.CaptionBot {
+	t.Helper()
+	bot, err := captionbot.New(server.Option(), captionbot.WithRetry(maxRetries, time.Millisecond))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return bot
+}
+
+func TestRetryTemporaryFailures(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	server.SetCaption(testImage, "a cat")
+	bot := newTestBot(t, server, 3)
+
+	server.Fail("message", http.StatusServiceUnavailable, 2)
+	caption, err := bot.URLCaption(testImage)
+	if err != nil {
+		t.Fatalf("URLCaption: %v", err)
+	}
+	if caption != "a cat" {
+		t.Errorf("caption = %q, want %q", caption, "a cat")
+	}
+	// Two failed tasks, then a task and its result.
+	if got := server.Requests("message"); got != 4 {
+		t.Errorf("message requests = %d, want 4", got)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	bot := newTestBot(t, server, 2)
+
+	server.Fail("message", http.StatusServiceUnavailable, -1)
+	_, err := bot.URLCaption(testImage)
+	var apiErr *captionbot.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("err = %v, want a 503 *APIError", err)
+	}
+	if got := server.Requests("message"); got != 3 {
+		t.Errorf("message requests = %d, want 3", got)
+	}
+}
+
+func TestRetryPermanentFailure(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	bot := newTestBot(t, server, 3)
+
+	server.Fail("message", http.StatusForbidden, -1)
+	if _, err := bot.URLCaption(testImage); err == nil {
+		t.Fatal("URLCaption succeeded")
+	}
+	if got := server.Requests("message"); got != 1 {
+		t.Errorf("message requests = %d, want 1", got)
+	}
+}
+
+func TestRetryRenewsExpiredConversation(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	server.SetCaption(testImage, "a cat")
+	// Renewing doesn't count against MaxRetries.
+	bot := newTestBot(t, server, 0)
+
+	server.Fail("message", http.StatusBadRequest, 1)
+	caption, err := bot.URLCaption(testImage)
+	if err != nil {
+		t.Fatalf("URLCaption: %v", err)
+	}
+	if caption != "a cat" {
+		t.Errorf("caption = %q, want %q", caption, "a cat")
+	}
+	if got := server.Requests("init"); got != 2 {
+		t.Errorf("init requests = %d, want 2", got)
+	}
+}
+
+func TestRetryRenewsOnce(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	bot := newTestBot(t, server, 3)
+
+	server.Fail("message", http.StatusBadRequest, -1)
+	_, err := bot.URLCaption(testImage)
+	var apiErr *captionbot.APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("err = %v, want a 400 *APIError", err)
+	}
+	// One conversation renewed, and the request refused in both.
+	if got := server.Requests("init"); got != 2 {
+		t.Errorf("init requests = %d, want 2", got)
+	}
+	if got := server.Requests("message"); got != 2 {
+		t.Errorf("message requests = %d, want 2", got)
+	}
+}
@@ -0,0 +1,92 @@
+package schedule
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"x * * * *",
+		"* * * foo *",
+		"@often",
+		"@every 0s",
+		"@every 500ms",
+		"@every soon",
+	} {
+		if _, err := Parse(spec); err == nil {
+			t.Errorf("Parse(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// A Monday.
+	base := time.Date(2024, 1, 15, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"* * * * *", base, time.Date(2024, 1, 15, 10, 31, 0, 0, time.UTC)},
+		{"*/15 * * * *", base, time.Date(2024, 1, 15, 10, 45, 0, 0, time.UTC)},
+		{"*/15 * * * *", base.Add(15 * time.Minute), time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"5/15 * * * *", base, time.Date(2024, 1, 15, 10, 35, 0, 0, time.UTC)},
+		{"0,20 * * * *", base, time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"0 * * * *", base, time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@hourly", base, time.Date(2024, 1, 15, 11, 0, 0, 0, time.UTC)},
+		{"@daily", base, time.Date(2024, 1, 16, 0, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", base, time.Date(2024, 1, 16, 9, 30, 0, 0, time.UTC)},
+		{"30 9 * * MON-FRI", base.AddDate(0, 0, 4), time.Date(2024, 1, 22, 9, 30, 0, 0, time.UTC)},
+		{"0 0 * * 0", base, time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", base, time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"@weekly", base, time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", base, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", base, time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jul *", base, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC)},
+		// With both days restricted, either one matching is enough.
+		{"0 12 13 * fri", base, time.Date(2024, 1, 19, 12, 0, 0, 0, time.UTC)},
+		{"0 12 16 * fri", base, time.Date(2024, 1, 16, 12, 0, 0, 0, time.UTC)},
+		// A stepped * still restricts nothing, so both days must match:
+		// odd days that are Mondays, and firsts on even weekdays.
+		{"0 0 */2 * 1", base, time.Date(2024, 1, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * */2", base, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", base, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 feb *", base, time.Time{}},
+		{"@every 90m", base.Add(500 * time.Millisecond), base.Add(90 * time.Minute)},
+	}
+	for _, test := range tests {
+		cron, err := Parse(test.spec)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", test.spec, err)
+			continue
+		}
+		if got := cron.Next(test.from); !got.Equal(test.want) {
+			t.Errorf("Parse(%q).Next(%s) = %s, want %s", test.spec, test.from, got, test.want)
+		}
+	}
+}
+
+func TestNextLocation(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	cron, err := Parse("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 1, 15, 10, 30, 0, 0, tokyo)
+	got := cron.Next(from)
+	if want := time.Date(2024, 1, 16, 9, 0, 0, 0, tokyo); !got.Equal(want) || got.Location() != tokyo {
+		t.Errorf("Next(%s) = %s, want %s", from, got, want)
+	}
+}
@@ -0,0 +1,221 @@
+// Package schedule runs recurring jobs, such as batch captioning runs or
+// contract checks, on cron expressions. A job still running when it is due
+// again is skipped rather than run twice at once, every run is kept in a
+// history, and failures can be posted to webhooks with the notify package:
+//
+//	s := schedule.New()
+//	s.Notifier = notify.New(secret, "https://example.com/hooks/failures")
+//	s.Add("photos", "0 3 * * *", func(ctx context.Context) error {
+//		return batch.NewJob().FromURL("s3://bucket/photos/").Run(ctx)
+//	})
+//	err := s.Run(ctx)
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot/notify"
+)
+
+// Run statuses.
+const (
+	StatusOK      = "ok"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// Run is one time a job was due.
+type Run struct {
+	Job string `json:"job"`
+	// Status is "ok", "failed", or "skipped" if the job's previous run
+	// was still going.
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	ScheduledAt time.Time `json:"scheduled_at"`
+	StartedAt   time.Time `json:"started_at"`
+	DurationMS  int64     `json:"duration_ms"`
+}
+
+// entry is a job of a Scheduler.
+type entry struct {
+	name string
+	cron *Cron
+	run  func(ctx context.Context) error
+
+	// running is whether a run of the job hasn't finished.
+	running bool
+	history []Run
+}
+
+// Scheduler runs jobs when their cron expressions match.
+type Scheduler struct {
+	// Notifier, if not nil, is sent every failed run, as a JSON Run.
+	Notifier *notify.Notifier
+	// History, if not nil, is written every run as a line of JSON, such
+	// as to a file opened for appending.
+	History io.Writer
+	// HistorySize is how many runs of each job Runs keeps.
+	HistorySize int
+	// Location is the time zone of the jobs' cron expressions.
+	Location *time.Location
+	Logger   *log.Logger
+
+	mu   sync.Mutex
+	jobs []*entry
+	wg   sync.WaitGroup
+}
+
+// New returns a scheduler that keeps 100 runs of each job and schedules
+// in the local time zone.
+func New() *Scheduler {
+	return &Scheduler{HistorySize: 100, Location: time.Local}
+}
+
+func (s *Scheduler) logf(format string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Add adds a job named name that calls run whenever the cron expression
+// spec, as Parse takes, matches. It must be called before Run.
+func (s *Scheduler) Add(name, spec string, run func(ctx context.Context) error) error {
+	cron, err := Parse(spec)
+	if err != nil {
+		return fmt.Errorf("job %s: %w", name, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, job := range s.jobs {
+		if job.name == name {
+			return fmt.Errorf("schedule: two jobs named %s", name)
+		}
+	}
+	s.jobs = append(s.jobs, &entry{name: name, cron: cron, run: run})
+	return nil
+}
+
+// Next returns when each job is next due after t, by name.
+func (s *Scheduler) Next(t time.Time) map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next := map[string]time.Time{}
+	for _, job := range s.jobs {
+		next[job.name] = job.cron.Next(t.In(s.Location))
+	}
+	return next
+}
+
+// Runs returns the most recent runs of every job, oldest first.
+func (s *Scheduler) Runs() []Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var runs []Run
+	for _, job := range s.jobs {
+		runs = append(runs, job.history...)
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ScheduledAt.Before(runs[j].ScheduledAt) })
+	return runs
+}
+
+// Run runs the jobs on their schedules until ctx is done, then cancels
+// the runs still going and waits for them to return.
+func (s *Scheduler) Run(ctx context.Context) error {
+	s.mu.Lock()
+	jobs := append([]*entry(nil), s.jobs...)
+	s.mu.Unlock()
+	if len(jobs) == 0 {
+		return fmt.Errorf("schedule: no jobs")
+	}
+
+	for _, job := range jobs {
+		s.wg.Add(1)
+		go func(job *entry) {
+			defer s.wg.Done()
+			s.loop(ctx, job)
+		}(job)
+	}
+	<-ctx.Done()
+	s.wg.Wait()
+	return nil
+}
+
+// loop starts job each time it is due until ctx is done.
+func (s *Scheduler) loop(ctx context.Context, job *entry) {
+	for {
+		due := job.cron.Next(time.Now().In(s.Location))
+		if due.IsZero() {
+			s.logf("schedule: job %s is never due", job.name)
+			return
+		}
+		timer := time.NewTimer(time.Until(due))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		if job.running {
+			s.mu.Unlock()
+			s.logf("schedule: job %s: skipped, the last run is still going", job.name)
+			s.record(job, Run{Job: job.name, Status: StatusSkipped, ScheduledAt: due, StartedAt: time.Now()})
+			continue
+		}
+		job.running = true
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.run(ctx, job, due)
+		}()
+	}
+}
+
+// run runs job once and records the run.
+func (s *Scheduler) run(ctx context.Context, job *entry, due time.Time) {
+	run := Run{Job: job.name, Status: StatusOK, ScheduledAt: due, StartedAt: time.Now()}
+	err := job.run(ctx)
+	run.DurationMS = time.Since(run.StartedAt).Milliseconds()
+	if err != nil {
+		run.Status = StatusFailed
+		run.Error = err.Error()
+		s.logf("schedule: job %s: %s", job.name, err)
+	}
+
+	s.mu.Lock()
+	job.running = false
+	s.mu.Unlock()
+	s.record(job, run)
+	if err != nil && s.Notifier != nil {
+		if err := s.Notifier.Post(run); err != nil {
+			s.logf("schedule: job %s: notifying: %s", job.name, err)
+		}
+	}
+}
+
+// record adds run to job's history and the History writer.
+func (s *Scheduler) record(job *entry, run Run) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job.history = append(job.history, run)
+	if n := len(job.history) - s.HistorySize; n > 0 && s.HistorySize > 0 {
+		job.history = append(job.history[:0], job.history[n:]...)
+	}
+	if s.History != nil {
+		if err := json.NewEncoder(s.History).Encode(run); err != nil {
+			s.logf("schedule: job %s: writing history: %s", job.name, err)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package captionbot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// responseFields maps the names of a /message response's fields, as
+// fieldKey gives them, to the fields. Besides the fields' own names, it
+// holds names captionbot.ai might rename them to.
+var responseFields = map[string]string{
+	"conversationid": "ConversationID",
+	"conversation":   "ConversationID",
+	"usermessage":    "UserMessage",
+	"watermark":      "WaterMark",
+	"status":         "Status",
+	"state":          "Status",
+	"botmessages":    "BotMessages",
+	"botmessage":     "BotMessages",
+	"messages":       "BotMessages",
+}
+
+// fieldKey returns name in lower case without the _, - and spaces of
+// other naming styles, so that water_mark and waterMark are both
+// watermark.
+func fieldKey(name string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "", " ", "").Replace(name))
+}
+
+// UnmarshalJSON decodes a /message response, keeping its JSON in Raw. It
+// tolerates changes captionbot.ai may make: fields are found under other
+// naming styles (water_mark) and known other names (messages), numbers
+// are taken as text, and messages may be objects with a text field.
+// Fields it doesn't know or can't decode are kept in Extra rather than
+// failing; CheckSchema reports them.
+func (response *CaptionBotResponse) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if string(data) == "null" {
+		return nil
+	}
+	if len(data) == 0 || data[0] != '{' {
+		return fmt.Errorf("response is not a JSON object")
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	*response = CaptionBotResponse{Raw: append(json.RawMessage(nil), data...)}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	// A field under its own name is decoded last, so that it wins over
+	// another name for it.
+	sort.Slice(names, func(i, j int) bool {
+		own := func(name string) bool { return strings.EqualFold(name, responseFields[fieldKey(name)]) }
+		if own(names[i]) != own(names[j]) {
+			return !own(names[i])
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		raw := fields[name]
+		var err error
+		switch field := responseFields[fieldKey(name)]; field {
+		case "ConversationID":
+			response.ConversationID, err = decodeText(raw)
+		case "UserMessage":
+			response.UserMessage, err = decodeText(raw)
+		case "WaterMark":
+			response.WaterMark, err = decodeText(raw)
+		case "Status":
+			response.Status, err = decodeText(raw)
+		case "BotMessages":
+			response.BotMessages, err = decodeMessages(raw)
+		default:
+			err = fmt.Errorf("unknown field")
+		}
+		if err != nil {
+			if response.Extra == nil {
+				response.Extra = map[string]json.RawMessage{}
+			}
+			response.Extra[name] = raw
+			continue
+		}
+		if field := responseFields[fieldKey(name)]; !strings.EqualFold(name, field) {
+			response.renamed = append(response.renamed, fmt.Sprintf("%s as %s", field, name))
+		}
+	}
+	return nil
+}
+
+// decodeText decodes a JSON string, number or boolean as text, and null
+// as "".
+func decodeText(raw json.RawMessage) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case float64, bool:
+		return string(bytes.TrimSpace(raw)), nil
+	}
+	return "", fmt.Errorf("%s isn't text", raw)
+}
+
+// decodeMessages decodes an array of messages, each text or an object
+// with its text in a text, message or caption field.
+func decodeMessages(raw json.RawMessage) ([]string, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err != nil {
+		return nil, err
+	}
+	messages := make([]string, 0, len(items))
+	for _, item := range items {
+		text, err := decodeText(item)
+		if err != nil {
+			var object map[string]json.RawMessage
+			if json.Unmarshal(item, &object) != nil {
+				return nil, err
+			}
+			for _, name := range []string{"text", "message", "caption"} {
+				if text, err = decodeText(object[name]); object[name] != nil && err == nil {
+					break
+				}
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		messages = append(messages, text)
+	}
+	return messages, nil
+}
+
+// SchemaError is the error of a response that differs from what the
+// library expects. Its raw JSON is kept, for callers to take what they
+// need from it until the library catches up.
+type SchemaError struct {
+	// Missing lists what the response needs but lacks, Unknown the fields
+	// the library doesn't know or couldn't decode, and Renamed those
+	// found under other names.
+	Missing []string
+	Unknown []string
+	Renamed []string
+	Raw     json.RawMessage
+}
+
+func (err *SchemaError) Error() string {
+	var parts []string
+	if len(err.Missing) > 0 {
+		parts = append(parts, "missing "+strings.Join(err.Missing, ", "))
+	}
+	if len(err.Unknown) > 0 {
+		parts = append(parts, "unknown "+strings.Join(err.Unknown, ", "))
+	}
+	if len(err.Renamed) > 0 {
+		parts = append(parts, "renamed "+strings.Join(err.Renamed, ", "))
+	}
+	return "captionbot: unexpected response: " + strings.Join(parts, "; ")
+}
+
+// CheckSchema returns a *SchemaError if the response has fields the
+// library doesn't know, or found under other names, and nil otherwise.
+func (response *CaptionBotResponse) CheckSchema() error {
+	if len(response.Extra) == 0 && len(response.renamed) == 0 {
+		return nil
+	}
+	err := &SchemaError{Renamed: response.renamed, Raw: response.Raw}
+	for name := range response.Extra {
+		err.Unknown = append(err.Unknown, name)
+	}
+	sort.Strings(err.Unknown)
+	return err
+}
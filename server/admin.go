@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Stats is the runtime state GET /admin/stats reports.
+type Stats struct {
+	UptimeSeconds int64 `json:"uptime_seconds"`
+	Goroutines    int   `json:"goroutines"`
+	// HeapBytes is the memory held by live objects.
+	HeapBytes uint64 `json:"heap_bytes"`
+	// Captions counts caption requests being made and queued.
+	Captions struct {
+		Running int `json:"running"`
+		Waiting int `json:"waiting"`
+	} `json:"captions"`
+	// Jobs counts the jobs in memory by status.
+	Jobs struct {
+		Queued  int `json:"queued"`
+		Running int `json:"running"`
+		Done    int `json:"done"`
+	} `json:"jobs"`
+	// Tenants is the number of clients with their own Captioner.
+	Tenants  int          `json:"tenants"`
+	Provider ProviderMode `json:"provider,omitempty"`
+	LogLevel string       `json:"log_level"`
+	Draining bool         `json:"draining"`
+}
+
+// JobSummary describes a job in GET /admin/jobs, without its items.
+type JobSummary struct {
+	ID        string      `json:"id"`
+	Client    string      `json:"client,omitempty"`
+	Status    string      `json:"status"`
+	CreatedAt time.Time   `json:"created_at"`
+	Progress  JobProgress `json:"progress"`
+}
+
+// Purger is implemented by Caches that can drop every entry, which POST
+// /admin/cache/purge does.
+type Purger interface {
+	Purge() error
+}
+
+// isAdmin reports whether the client of r may use the admin endpoints.
+func (server *Server) isAdmin(r *http.Request) bool {
+	client := ClientName(r.Context())
+	if client == "" {
+		return false
+	}
+	if token, ok := r.Context().Value(tokenKey{}).(*Token); ok && !token.HasScope(AdminScope) {
+		return false
+	}
+	for _, admin := range server.Admins {
+		if client == admin {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAdmin serves the operator endpoints under /admin/ to the clients
+// in Admins. Without authentication there are no clients, so they are
+// never served.
+func (server *Server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if !server.isAdmin(r) {
+		writeError(w, http.StatusForbidden, "admin access required")
+		return
+	}
+	method := map[string]string{
+		"stats":       "GET",
+		"jobs":        "GET",
+		"cache/purge": "POST",
+		"provider":    "GET, PUT",
+		"log-level":   "GET, PUT",
+	}
+	resource := strings.TrimPrefix(r.URL.Path, "/admin/")
+	allowed, ok := method[resource]
+	if !ok {
+		writeError(w, http.StatusNotFound, "no resource %q", resource)
+		return
+	}
+	if !strings.Contains(", "+allowed+", ", ", "+r.Method+", ") {
+		w.Header().Set("Allow", allowed)
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+
+	switch resource {
+	case "stats":
+		writeJSON(w, http.StatusOK, server.stats())
+	case "jobs":
+		writeJSON(w, http.StatusOK, server.activeJobs())
+	case "cache/purge":
+		server.purgeCache(w)
+	case "provider":
+		server.adminProvider(w, r)
+	case "log-level":
+		server.adminLogLevel(w, r)
+	}
+}
+
+func (server *Server) stats() *Stats {
+	var stats Stats
+	stats.UptimeSeconds = int64(time.Since(server.started).Seconds())
+	stats.Goroutines = runtime.NumGoroutine()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats.HeapBytes = mem.HeapAlloc
+
+	server.queue.mu.Lock()
+	stats.Captions.Running = server.queue.running
+	stats.Captions.Waiting = server.queue.waiting.Len()
+	server.queue.mu.Unlock()
+
+	server.jobsMu.Lock()
+	jobs := make([]*job, 0, len(server.jobs))
+	for _, j := range server.jobs {
+		jobs = append(jobs, j)
+	}
+	server.jobsMu.Unlock()
+	for _, j := range jobs {
+		switch j.status().Status {
+		case "queued":
+			stats.Jobs.Queued++
+		case "running":
+			stats.Jobs.Running++
+		default:
+			stats.Jobs.Done++
+		}
+	}
+
+	if server.Tenants != nil {
+		stats.Tenants = len(server.Tenants.Clients())
+	}
+	if server.Providers != nil {
+		stats.Provider = server.Providers.Mode()
+	}
+	stats.LogLevel = server.LogLevel().String()
+	stats.Draining = server.isDraining()
+	return &stats
+}
+
+// activeJobs summarizes the queued and running jobs, oldest first.
+func (server *Server) activeJobs() []JobSummary {
+	server.jobsMu.Lock()
+	jobs := make([]*job, 0, len(server.jobs))
+	for _, j := range server.jobs {
+		jobs = append(jobs, j)
+	}
+	server.jobsMu.Unlock()
+
+	summaries := []JobSummary{}
+	for _, j := range jobs {
+		status := j.status()
+		if status.Status == "done" {
+			continue
+		}
+		summaries = append(summaries, JobSummary{
+			ID:        j.ID,
+			Client:    j.client,
+			Status:    status.Status,
+			CreatedAt: j.Created,
+			Progress:  status.Progress,
+		})
+	}
+	sort.Slice(summaries, func(i, k int) bool {
+		return summaries[i].CreatedAt.Before(summaries[k].CreatedAt)
+	})
+	return summaries
+}
+
+// purgeCache empties the cache of the server's CachedCaptioner, which
+// the Captioners of Tenants share.
+func (server *Server) purgeCache(w http.ResponseWriter) {
+	cached, ok := server.Captioner.(*CachedCaptioner)
+	if !ok {
+		writeError(w, http.StatusNotFound, "the server has no cache")
+		return
+	}
+	purger, ok := cached.Cache.(Purger)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, "the cache can't be purged")
+		return
+	}
+	if err := purger.Purge(); err != nil {
+		server.logf("server: purging the cache: %s", err)
+		writeError(w, http.StatusInternalServerError, "purging the cache failed")
+		return
+	}
+	server.infof("server: cache purged")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// adminProvider reports or sets the mode of the server's Providers, as
+// {"mode": "auto"}.
+func (server *Server) adminProvider(w http.ResponseWriter, r *http.Request) {
+	if server.Providers == nil {
+		writeError(w, http.StatusNotFound, "the server has no failover provider")
+		return
+	}
+	if r.Method == "PUT" {
+		var req struct {
+			Mode ProviderMode `json:"mode"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body: %s", err)
+			return
+		}
+		if err := server.Providers.SetMode(req.Mode); err != nil {
+			writeError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		server.infof("server: provider mode set to %s by %s", req.Mode, ClientName(r.Context()))
+	}
+	writeJSON(w, http.StatusOK, map[string]ProviderMode{"mode": server.Providers.Mode()})
+}
+
+// adminLogLevel reports or sets the server's LogLevel, as
+// {"level": "info"}.
+func (server *Server) adminLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "PUT" {
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body: %s", err)
+			return
+		}
+		level, err := ParseLogLevel(req.Level)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "%s", err)
+			return
+		}
+		server.SetLogLevel(level)
+		server.logf("server: log level set to %s by %s", level, ClientName(r.Context()))
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"level": server.LogLevel().String()})
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"strings"
+)
+
+// DefaultMaxArchiveSize is the default limit on uploaded job archives.
+const DefaultMaxArchiveSize = 1 << 30
+
+// archiveTypes are the content types of job archive uploads. The format
+// is recognized from the data, since clients label archives loosely.
+var archiveTypes = map[string]bool{
+	"application/zip":          true,
+	"application/x-zip":        true,
+	"application/x-tar":        true,
+	"application/gzip":         true,
+	"application/x-gzip":       true,
+	"application/octet-stream": true,
+}
+
+// archive is an uploaded zip or tar file of images, spooled to disk
+// until its job has captioned them.
+type archive struct {
+	path   string
+	zipped bool
+	gzip   bool
+	// names are the image entries, in archive order.
+	names []string
+}
+
+// isArchiveImage reports whether an archive entry is an image to caption,
+// skipping hidden files and macOS resource forks.
+func isArchiveImage(name string) bool {
+	if strings.HasPrefix(path.Base(name), ".") || strings.Contains(name, "__MACOSX/") {
+		return false
+	}
+	return imageExtensions[mime.TypeByExtension(strings.ToLower(path.Ext(name)))] != ""
+}
+
+// spoolArchive copies an uploaded archive to a file in dir, or the
+// temporary directory if dir is empty, and lists its images.
+func spoolArchive(body io.Reader, dir string) (*archive, error) {
+	tmp, err := os.CreateTemp(dir, "captionbot-job-*")
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(tmp, body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	var a *archive
+	if err == nil {
+		a, err = openArchive(tmp.Name())
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return a, nil
+}
+
+// openArchive opens a spooled archive and lists its images.
+func openArchive(path string) (*archive, error) {
+	a := &archive{path: path}
+	if err := a.detect(); err != nil {
+		return nil, err
+	}
+	err := a.each(func(name string, r io.Reader) error {
+		a.names = append(a.names, name)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// detect recognizes the archive format from its first bytes.
+func (a *archive) detect() error {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, 262)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("PK\x03\x04")):
+		a.zipped = true
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		a.gzip = true
+	case len(header) == 262 && string(header[257:262]) == "ustar":
+	default:
+		return fmt.Errorf("upload is not a zip, tar or tar.gz archive")
+	}
+	return nil
+}
+
+// each calls fn with every image entry of the archive, in order.
+func (a *archive) each(fn func(name string, r io.Reader) error) error {
+	if a.zipped {
+		zr, err := zip.OpenReader(a.path)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, file := range zr.File {
+			if file.FileInfo().IsDir() || !isArchiveImage(file.Name) {
+				continue
+			}
+			r, err := file.Open()
+			if err != nil {
+				return err
+			}
+			err = fn(file.Name, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	f, err := os.Open(a.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if a.gzip {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg || !isArchiveImage(header.Name) {
+			continue
+		}
+		if err := fn(header.Name, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (a *archive) remove() {
+	os.Remove(a.path)
+}
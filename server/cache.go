@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+const (
+	// DefaultCacheTTL is how long captions are cached by default.
+	DefaultCacheTTL = captionbot.DefaultCacheTTL
+	// DefaultCacheEntries is the default size of a MemoryCache.
+	DefaultCacheEntries = 10000
+)
+
+// Cache stores captions by key for CachedCaptioner. It is the
+// captionbot package's Cache, so a CaptionBot and a server can share one.
+type Cache = captionbot.Cache
+
+// MemoryCache is a Cache in memory, dropping the least recently used
+// captions beyond MaxEntries.
+type MemoryCache = captionbot.MemoryCache
+
+var (
+	_ Cache  = (*MemoryCache)(nil)
+	_ Purger = (*MemoryCache)(nil)
+)
+
+// NewMemoryCache creates a MemoryCache of at most maxEntries captions.
+func NewMemoryCache(maxEntries int) *MemoryCache {
+	return captionbot.NewMemoryCache(maxEntries)
+}
+
+// CachedCaptioner is a Captioner that answers repeated requests from a
+// Cache rather than the provider: URLs by the URL, uploads by a hash of
+// their content. Failed captions aren't cached.
+type CachedCaptioner struct {
+	Captioner Captioner
+	Cache     Cache
+	TTL       time.Duration
+	// Metrics, if set, counts cache hits and misses.
+	Metrics *Metrics
+	Logger  *log.Logger
+
+	// locale is the locale of Localized's captioners, whose captions
+	// are cached apart.
+	locale string
+}
+
+var (
+	_ Captioner = (*CachedCaptioner)(nil)
+	_ Checker   = (*CachedCaptioner)(nil)
+	_ Rater     = (*CachedCaptioner)(nil)
+	_ Localizer = (*CachedCaptioner)(nil)
+)
+
+// NewCachedCaptioner creates a CachedCaptioner caching captioner's
+// captions in cache for DefaultCacheTTL.
+func NewCachedCaptioner(captioner Captioner, cache Cache) *CachedCaptioner {
+	return &CachedCaptioner{Captioner: captioner, Cache: cache, TTL: DefaultCacheTTL}
+}
+
+func (cached *CachedCaptioner) logf(format string, args ...interface{}) {
+	if cached.Logger != nil {
+		cached.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func cacheKey(kind string, data []byte) string {
+	sum := sha256.Sum256(data)
+	return kind + ":" + hex.EncodeToString(sum[:])
+}
+
+// key returns the cache key of an image, apart from other locales'.
+func (cached *CachedCaptioner) key(kind string, data []byte) string {
+	if cached.locale != "" {
+		return "locale:" + cached.locale + ":" + cacheKey(kind, data)
+	}
+	return cacheKey(kind, data)
+}
+
+// Localized returns a CachedCaptioner asking the captioner for captions
+// in locale, cached apart from those of other locales in the same Cache.
+func (cached *CachedCaptioner) Localized(locale string) Captioner {
+	localized := *cached
+	localized.Captioner = localize(cached.Captioner, locale)
+	localized.locale = locale
+	return &localized
+}
+
+// lookup returns the cached caption under key, unless refresh is set.
+// Cache failures are logged and treated as misses.
+func (cached *CachedCaptioner) lookup(key string, refresh bool) (string, bool) {
+	if refresh {
+		return "", false
+	}
+	caption, ok, err := cached.Cache.Get(key)
+	if err != nil {
+		cached.logf("server: cache: %s", err)
+	}
+	if cached.Metrics != nil {
+		cached.Metrics.observeCache(ok)
+	}
+	return caption, ok
+}
+
+func (cached *CachedCaptioner) store(key, caption string) {
+	if err := cached.Cache.Set(key, caption, cached.TTL); err != nil {
+		cached.logf("server: cache: %s", err)
+	}
+}
+
+// CaptionURLCached captions the image at url, reporting whether the
+// caption came from the cache. refresh skips the lookup, but the new
+// caption is still stored.
+func (cached *CachedCaptioner) CaptionURLCached(url string, refresh bool) (string, bool, error) {
+	key := cached.key("url", []byte(url))
+	if caption, ok := cached.lookup(key, refresh); ok {
+		return caption, true, nil
+	}
+	caption, err := cached.Captioner.CaptionURL(url)
+	if err == nil {
+		cached.store(key, caption)
+	}
+	return caption, false, err
+}
+
+// CaptionReaderCached captions the image read from r like
+// CaptionURLCached. The image is read into memory to hash it.
+func (cached *CachedCaptioner) CaptionReaderCached(r io.Reader, name string, refresh bool) (string, bool, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", false, err
+	}
+	key := cached.key("sha256", data)
+	if caption, ok := cached.lookup(key, refresh); ok {
+		return caption, true, nil
+	}
+	caption, err := cached.Captioner.CaptionReader(bytes.NewReader(data), name)
+	if err == nil {
+		cached.store(key, caption)
+	}
+	return caption, false, err
+}
+
+// CaptionURL implements Captioner.
+func (cached *CachedCaptioner) CaptionURL(url string) (string, error) {
+	caption, _, err := cached.CaptionURLCached(url, false)
+	return caption, err
+}
+
+// CaptionReader implements Captioner.
+func (cached *CachedCaptioner) CaptionReader(r io.Reader, name string) (string, error) {
+	caption, _, err := cached.CaptionReaderCached(r, name, false)
+	return caption, err
+}
+
+// Rate implements Rater by rating with the wrapped Captioner.
+func (cached *CachedCaptioner) Rate(caption string, rating int) error {
+	return rate(cached.Captioner, caption, rating)
+}
+
+// Check implements Checker by checking the wrapped Captioner, if it can
+// be checked.
+func (cached *CachedCaptioner) Check() error {
+	if checker, ok := cached.Captioner.(Checker); ok {
+		return checker.Check()
+	}
+	return nil
+}
+
+// DirCache is a Cache of files in a directory, so captions survive
+// restarts. Expired files are removed when they are next read.
+type DirCache struct {
+	Dir string
+}
+
+var (
+	_ Cache  = (*DirCache)(nil)
+	_ Purger = (*DirCache)(nil)
+)
+
+type dirEntry struct {
+	Caption string    `json:"caption"`
+	Expires time.Time `json:"expires"`
+}
+
+// path returns the file of key, spreading files over subdirectories.
+func (cache *DirCache) path(key string) string {
+	name := cacheKey("file", []byte(key))[len("file:"):]
+	return filepath.Join(cache.Dir, name[:2], name)
+}
+
+// Get implements Cache.
+func (cache *DirCache) Get(key string) (string, bool, error) {
+	path := cache.path(key)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	var entry dirEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		os.Remove(path)
+		return "", false, err
+	}
+	if time.Now().After(entry.Expires) {
+		os.Remove(path)
+		return "", false, nil
+	}
+	return entry.Caption, true, nil
+}
+
+// Set implements Cache. The file is written under a temporary name and
+// renamed, so readers never see part of it.
+func (cache *DirCache) Set(key, caption string, ttl time.Duration) error {
+	data, err := json.Marshal(dirEntry{Caption: caption, Expires: time.Now().Add(ttl)})
+	if err != nil {
+		return err
+	}
+	path := cache.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Purge implements Purger by removing the subdirectories the cache's
+// files are spread over, leaving anything else in Dir.
+func (cache *DirCache) Purge() error {
+	entries, err := os.ReadDir(cache.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && len(entry.Name()) == 2 {
+			if err := os.RemoveAll(filepath.Join(cache.Dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// refresh reports whether r asks for a fresh caption with Cache-Control:
+// no-cache or no-store.
+func refresh(r *http.Request) bool {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return true
+		}
+	}
+	return false
+}
+
+// setCacheHeaders describes a cached or fresh caption in X-Cache and
+// Cache-Control.
+func (cached *CachedCaptioner) setCacheHeaders(w http.ResponseWriter, hit bool) {
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(cached.TTL.Seconds())))
+}
+
+// captionURLFor captions url for r with the Captioner of its client,
+// through the cache if that is a CachedCaptioner.
+func (server *Server) captionURLFor(w http.ResponseWriter, r *http.Request, url string) (string, error) {
+	captioner := localize(server.captioner(ClientName(r.Context())), requestLocale(r))
+	cached, ok := captioner.(*CachedCaptioner)
+	if !ok {
+		return captioner.CaptionURL(url)
+	}
+	caption, hit, err := cached.CaptionURLCached(url, refresh(r))
+	if err == nil {
+		cached.setCacheHeaders(w, hit)
+	}
+	return caption, err
+}
+
+// captionReaderFor captions an upload for r like captionURLFor.
+func (server *Server) captionReaderFor(w http.ResponseWriter, r *http.Request, body io.Reader, name string) (string, error) {
+	captioner := localize(server.captioner(ClientName(r.Context())), requestLocale(r))
+	cached, ok := captioner.(*CachedCaptioner)
+	if !ok {
+		return captioner.CaptionReader(body, name)
+	}
+	caption, hit, err := cached.CaptionReaderCached(body, name, refresh(r))
+	if err == nil {
+		cached.setCacheHeaders(w, hit)
+	}
+	return caption, err
+}
@@ -0,0 +1,76 @@
+// Package redis is a server.Cache in Redis, so that replicas share
+// cached captions. Captions are strings at PREFIXcaption:KEY that Redis
+// expires.
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Cache stores captions in Redis.
+type Cache struct {
+	Client *goredis.Client
+	Prefix string
+}
+
+var (
+	_ server.Cache  = (*Cache)(nil)
+	_ server.Purger = (*Cache)(nil)
+)
+
+// Open creates a Cache for a redis:// or rediss:// URL, with keys under
+// "captionbot:".
+func Open(url string) (*Cache, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{Client: goredis.NewClient(opts), Prefix: "captionbot:"}, nil
+}
+
+// Get implements server.Cache.
+func (cache *Cache) Get(key string) (string, bool, error) {
+	caption, err := cache.Client.Get(context.Background(), cache.Prefix+"caption:"+key).Result()
+	if errors.Is(err, goredis.Nil) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return caption, true, nil
+}
+
+// Set implements server.Cache.
+func (cache *Cache) Set(key, caption string, ttl time.Duration) error {
+	return cache.Client.Set(context.Background(), cache.Prefix+"caption:"+key, caption, ttl).Err()
+}
+
+// Purge implements server.Purger, deleting the captions under the
+// prefix.
+func (cache *Cache) Purge() error {
+	ctx := context.Background()
+	iter := cache.Client.Scan(ctx, 0, cache.Prefix+"caption:*", 1000).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+		if len(keys) == 1000 {
+			if err := cache.Client.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+			keys = keys[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) > 0 {
+		return cache.Client.Del(ctx, keys...).Err()
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// Captioner captions images for the server. Any caption provider can back
+// the server by implementing it; Session adapts a captionbot.ai session.
+// It is captionbot.Captioner, so an azure.Client or a captionbot.Fallback
+// of them serves as well, and providers can implement Localizer without
+// importing this package. Implementations must be safe for concurrent
+// use.
+type Captioner = captionbot.Captioner
+
+// Checker is implemented by Captioners that can check that their
+// provider is reachable, which GET /readyz reports.
+type Checker interface {
+	Check() error
+}
+
+// ErrNotRatable is returned by Rater.Rate for a caption that can't be
+// rated, or no longer can.
+var ErrNotRatable = errors.New("caption can't be rated")
+
+// Rater is implemented by Captioners that can pass a rating of a caption
+// back to their provider, which POST /v1/ratings does.
+type Rater interface {
+	// Rate rates caption from 1 (poor) to 5 (great).
+	Rate(caption string, rating int) error
+}
+
+// rate rates caption with captioner if it is a Rater.
+func rate(captioner Captioner, caption string, rating int) error {
+	if rater, ok := captioner.(Rater); ok {
+		return rater.Rate(caption, rating)
+	}
+	return ErrNotRatable
+}
+
+// Localizer is implemented by Captioners that can ask their provider for
+// captions in another language, which the server does for requests with
+// an Accept-Language.
+type Localizer interface {
+	// Localized returns a Captioner asking for captions in locale, a
+	// language tag such as "fr-FR".
+	Localized(locale string) Captioner
+}
+
+// localize returns captioner asking for captions in locale, or captioner
+// itself if locale is empty or it isn't a Localizer.
+func localize(captioner Captioner, locale string) Captioner {
+	if localizer, ok := captioner.(Localizer); ok && locale != "" {
+		return localizer.Localized(locale)
+	}
+	return captioner
+}
+
+// requestLocale returns the language r's Accept-Language header prefers,
+// such as "fr-FR" for "fr-FR, fr;q=0.9, en;q=0.5", or "" for none.
+func requestLocale(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		if tag == "" || tag == "*" || len(tag) > 35 || strings.Trim(tag, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-") != "" || q <= bestQ {
+			continue
+		}
+		best, bestQ = tag, q
+	}
+	return best
+}
+
+// checkTimeout bounds the provider checks, which should fail fast.
+const checkTimeout = 5 * time.Second
+
+// Session is a Captioner backed by one captionbot.ai session. Its Serial
+// makes captions one at a time, since the session has a single
+// conversation.
+type Session struct {
+	*captionbot.Serial
+
+	// last is the session's most recent caption, the only one
+	// captionbot.ai takes a rating for. It is only used under the
+	// Serial.
+	last string
+}
+
+var (
+	_ Captioner = (*Session)(nil)
+	_ Checker   = (*Session)(nil)
+	_ Rater     = (*Session)(nil)
+	_ Localizer = (*Session)(nil)
+)
+
+// NewSession creates a Session for bot.
+func NewSession(bot *captionbot.CaptionBot) *Session {
+	return &Session{Serial: captionbot.NewSerial(bot)}
+}
+
+// CaptionURL captions the image at url.
+func (session *Session) CaptionURL(url string) (string, error) {
+	return session.caption("", func() (string, error) {
+		return session.Bot.URLCaption(url)
+	})
+}
+
+// CaptionReader uploads the image read from r and captions it.
+func (session *Session) CaptionReader(r io.Reader, name string) (string, error) {
+	return session.caption("", func() (string, error) {
+		return session.Bot.UploadCaptionReader(r, name)
+	})
+}
+
+// caption runs fn through the session's Serial, with the bot's Locale set
+// to locale if that isn't empty, and keeps its caption as the most
+// recent.
+func (session *Session) caption(locale string, fn func() (string, error)) (string, error) {
+	var caption string
+	err := session.Do(func(bot *captionbot.CaptionBot) error {
+		if locale != "" {
+			defer func(previous string) { bot.Locale = previous }(bot.Locale)
+			bot.Locale = locale
+		}
+		var err error
+		if caption, err = fn(); err == nil {
+			session.last = caption
+		}
+		return err
+	})
+	return caption, err
+}
+
+// Localized returns a Captioner captioning with the session in locale.
+func (session *Session) Localized(locale string) Captioner {
+	return &localizedSession{session, locale}
+}
+
+// localizedSession is a Session asking for captions in a locale.
+type localizedSession struct {
+	*Session
+	locale string
+}
+
+func (session *localizedSession) CaptionURL(url string) (string, error) {
+	return session.caption(session.locale, func() (string, error) {
+		return session.Bot.URLCaption(url)
+	})
+}
+
+func (session *localizedSession) CaptionReader(r io.Reader, name string) (string, error) {
+	return session.caption(session.locale, func() (string, error) {
+		return session.Bot.UploadCaptionReader(r, name)
+	})
+}
+
+// Rate rates caption if it is still the session's most recent, and
+// returns ErrNotRatable if not.
+func (session *Session) Rate(caption string, rating int) error {
+	return session.Do(func(bot *captionbot.CaptionBot) error {
+		if caption == "" || caption != session.last {
+			return ErrNotRatable
+		}
+		return bot.RateCaption(rating)
+	})
+}
+
+// KeepAlive starts a new conversation in the background whenever the
+// session has been idle for idle, so that a caption after a quiet spell
+// doesn't fail on a conversation captionbot.ai has expired. It returns a
+// function that stops it and waits for it to stop. Failures are retried
+// at the next check.
+func (session *Session) KeepAlive(idle time.Duration) (stop func()) {
+	every := idle / 4
+	if every < time.Second {
+		every = time.Second
+	}
+	ticker := time.NewTicker(every)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			session.Do(func(bot *captionbot.CaptionBot) error {
+				if time.Since(bot.LastUsed()) >= idle && bot.Refresh() == nil {
+					// The old conversation's caption can't be rated.
+					session.last = ""
+				}
+				return nil
+			})
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+		<-stopped
+	}
+}
+
+// Check reports whether captionbot.ai answers, asking through the bot's
+// HTTPClient with its User-Agent and Header, so the check takes the same
+// route as captions. It doesn't go through the Serial, so it isn't held
+// up by a slow caption, and for the same reason leaves out the bot's
+// TransportMiddleware, which captions set up.
+func (session *Session) Check() error {
+	bot := session.Bot
+	base, userAgent, client := captionbot.BaseURL, captionbot.UserAgent, http.DefaultClient
+	if bot.BaseURL != "" {
+		base = bot.BaseURL
+	}
+	if bot.UserAgent != "" {
+		userAgent = bot.UserAgent
+	}
+	if bot.HTTPClient != nil {
+		client = bot.HTTPClient
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "HEAD", base, nil)
+	if err != nil {
+		return err
+	}
+	for key, values := range bot.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s answered %s", base, resp.Status)
+	}
+	return nil
+}
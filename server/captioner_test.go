@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nhatbui/captionbot"
+)
+
+func TestSessionCheckUsesBotClient(t *testing.T) {
+	var got *http.Request
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer provider.Close()
+
+	var routed bool
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		routed = true
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	bot := &captionbot.CaptionBot{BaseURL: provider.URL, UserAgent: "test-agent", HTTPClient: client}
+	captionbot.WithHeader("X-Api-Key", "secret")(bot)
+
+	if err := NewSession(bot).Check(); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if !routed {
+		t.Error("check didn't go through the bot's HTTPClient")
+	}
+	if got == nil {
+		t.Fatal("provider wasn't asked")
+	}
+	if got.Header.Get("User-Agent") != "test-agent" || got.Header.Get("X-Api-Key") != "secret" {
+		t.Errorf("check request headers = %v, want the bot's", got.Header)
+	}
+}
+
+// roundTripperFunc is an http.RoundTripper that calls a function.
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
@@ -0,0 +1,210 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: caption.proto
+
+package captionpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	CaptionService_CaptionURL_FullMethodName    = "/captionbot.v1.CaptionService/CaptionURL"
+	CaptionService_CaptionUpload_FullMethodName = "/captionbot.v1.CaptionService/CaptionUpload"
+	CaptionService_BatchCaption_FullMethodName  = "/captionbot.v1.CaptionService/BatchCaption"
+)
+
+// CaptionServiceClient is the client API for CaptionService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// CaptionService is the gRPC form of the captionbot caption service.
+type CaptionServiceClient interface {
+	// CaptionURL captions the image at a URL.
+	CaptionURL(ctx context.Context, in *CaptionURLRequest, opts ...grpc.CallOption) (*Caption, error)
+	// CaptionUpload captions an uploaded image. The first message names the
+	// file; every message may carry a chunk of its data.
+	CaptionUpload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadChunk, Caption], error)
+	// BatchCaption captions several URLs, streaming each result as it is
+	// done. A failed image is reported in its result rather than ending
+	// the stream.
+	BatchCaption(ctx context.Context, in *BatchCaptionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BatchCaptionResult], error)
+}
+
+type captionServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCaptionServiceClient(cc grpc.ClientConnInterface) CaptionServiceClient {
+	return &captionServiceClient{cc}
+}
+
+func (c *captionServiceClient) CaptionURL(ctx context.Context, in *CaptionURLRequest, opts ...grpc.CallOption) (*Caption, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Caption)
+	err := c.cc.Invoke(ctx, CaptionService_CaptionURL_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *captionServiceClient) CaptionUpload(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[UploadChunk, Caption], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &CaptionService_ServiceDesc.Streams[0], CaptionService_CaptionUpload_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[UploadChunk, Caption]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type CaptionService_CaptionUploadClient = grpc.ClientStreamingClient[UploadChunk, Caption]
+
+func (c *captionServiceClient) BatchCaption(ctx context.Context, in *BatchCaptionRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[BatchCaptionResult], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &CaptionService_ServiceDesc.Streams[1], CaptionService_BatchCaption_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[BatchCaptionRequest, BatchCaptionResult]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type CaptionService_BatchCaptionClient = grpc.ServerStreamingClient[BatchCaptionResult]
+
+// CaptionServiceServer is the server API for CaptionService service.
+// All implementations must embed UnimplementedCaptionServiceServer
+// for forward compatibility.
+//
+// CaptionService is the gRPC form of the captionbot caption service.
+type CaptionServiceServer interface {
+	// CaptionURL captions the image at a URL.
+	CaptionURL(context.Context, *CaptionURLRequest) (*Caption, error)
+	// CaptionUpload captions an uploaded image. The first message names the
+	// file; every message may carry a chunk of its data.
+	CaptionUpload(grpc.ClientStreamingServer[UploadChunk, Caption]) error
+	// BatchCaption captions several URLs, streaming each result as it is
+	// done. A failed image is reported in its result rather than ending
+	// the stream.
+	BatchCaption(*BatchCaptionRequest, grpc.ServerStreamingServer[BatchCaptionResult]) error
+	mustEmbedUnimplementedCaptionServiceServer()
+}
+
+// UnimplementedCaptionServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedCaptionServiceServer struct{}
+
+func (UnimplementedCaptionServiceServer) CaptionURL(context.Context, *CaptionURLRequest) (*Caption, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CaptionURL not implemented")
+}
+func (UnimplementedCaptionServiceServer) CaptionUpload(grpc.ClientStreamingServer[UploadChunk, Caption]) error {
+	return status.Errorf(codes.Unimplemented, "method CaptionUpload not implemented")
+}
+func (UnimplementedCaptionServiceServer) BatchCaption(*BatchCaptionRequest, grpc.ServerStreamingServer[BatchCaptionResult]) error {
+	return status.Errorf(codes.Unimplemented, "method BatchCaption not implemented")
+}
+func (UnimplementedCaptionServiceServer) mustEmbedUnimplementedCaptionServiceServer() {}
+func (UnimplementedCaptionServiceServer) testEmbeddedByValue()                        {}
+
+// UnsafeCaptionServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CaptionServiceServer will
+// result in compilation errors.
+type UnsafeCaptionServiceServer interface {
+	mustEmbedUnimplementedCaptionServiceServer()
+}
+
+func RegisterCaptionServiceServer(s grpc.ServiceRegistrar, srv CaptionServiceServer) {
+	// If the following call pancis, it indicates UnimplementedCaptionServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&CaptionService_ServiceDesc, srv)
+}
+
+func _CaptionService_CaptionURL_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CaptionURLRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(CaptionServiceServer).CaptionURL(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: CaptionService_CaptionURL_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(CaptionServiceServer).CaptionURL(ctx, req.(*CaptionURLRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _CaptionService_CaptionUpload_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CaptionServiceServer).CaptionUpload(&grpc.GenericServerStream[UploadChunk, Caption]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type CaptionService_CaptionUploadServer = grpc.ClientStreamingServer[UploadChunk, Caption]
+
+func _CaptionService_BatchCaption_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(BatchCaptionRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(CaptionServiceServer).BatchCaption(m, &grpc.GenericServerStream[BatchCaptionRequest, BatchCaptionResult]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type CaptionService_BatchCaptionServer = grpc.ServerStreamingServer[BatchCaptionResult]
+
+// CaptionService_ServiceDesc is the grpc.ServiceDesc for CaptionService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var CaptionService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "captionbot.v1.CaptionService",
+	HandlerType: (*CaptionServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CaptionURL",
+			Handler:    _CaptionService_CaptionURL_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CaptionUpload",
+			Handler:       _CaptionService_CaptionUpload_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "BatchCaption",
+			Handler:       _CaptionService_BatchCaption_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "caption.proto",
+}
@@ -0,0 +1,5 @@
+// Package captionpb holds the gRPC CaptionService definition and the Go
+// code generated from it. Package grpcapi serves and calls it.
+package captionpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative caption.proto
@@ -0,0 +1,187 @@
+// Package client calls a captionbot caption service, as described by the
+// service's /openapi.json, from Go.
+//
+//	c := client.New("http://captions.internal:8080")
+//	result, err := c.Caption("https://example.com/photo.jpg")
+//
+// A Client is also a server.Captioner, so one service can front another.
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Error is an error answered by the service.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *Error) Error() string {
+	return fmt.Sprintf("caption service: status %d: %s", err.StatusCode, err.Message)
+}
+
+// Client calls the service at BaseURL.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Header is added to every request, for example for authentication.
+	// Requests without a User-Agent in it send captionbot.UserAgent.
+	Header http.Header
+	// Locale, if set, is sent as the Accept-Language of caption requests,
+	// for captions in that language where the service's provider
+	// supports it.
+	Locale string
+}
+
+var (
+	_ server.Captioner = (*Client)(nil)
+	_ server.Localizer = (*Client)(nil)
+)
+
+// New creates a Client for the service at baseURL.
+func New(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimRight(baseURL, "/"), Header: http.Header{}}
+}
+
+// ConfigureTransport sends the client's requests over a transport tuned by
+// opts. It gives the client an HTTPClient of its own, with the other
+// settings of the one it had, such as its timeout; that one, which may be
+// shared, is left as it was.
+func (client *Client) ConfigureTransport(opts captionbot.TransportOptions) {
+	var configured http.Client
+	if client.HTTPClient != nil {
+		configured = *client.HTTPClient
+	}
+	configured.Transport = captionbot.NewTransport(opts)
+	client.HTTPClient = &configured
+}
+
+func (client *Client) httpClient() *http.Client {
+	if client.HTTPClient != nil {
+		return client.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Localized returns a copy of the client asking for captions in locale.
+func (client *Client) Localized(locale string) server.Captioner {
+	localized := *client
+	localized.Header = client.Header.Clone()
+	localized.Locale = locale
+	return &localized
+}
+
+// do sends a request and decodes a successful response into out.
+func (client *Client) do(req *http.Request, out interface{}) error {
+	req.Header.Set("User-Agent", captionbot.UserAgent)
+	for key, values := range client.Header {
+		req.Header[key] = values
+	}
+	if client.Locale != "" {
+		req.Header.Set("Accept-Language", client.Locale)
+	}
+	resp, err := client.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Error == "" {
+			body.Error = http.StatusText(resp.StatusCode)
+		}
+		return &Error{StatusCode: resp.StatusCode, Message: body.Error}
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Caption captions the image at imageURL.
+func (client *Client) Caption(imageURL string) (*server.Caption, error) {
+	data, err := json.Marshal(server.CaptionRequest{URL: imageURL})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", client.BaseURL+"/v1/captions", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	var caption server.Caption
+	if err := client.do(req, &caption); err != nil {
+		return nil, err
+	}
+	return &caption, nil
+}
+
+// SetAPIKey authenticates the client's requests with key.
+func (client *Client) SetAPIKey(key string) {
+	client.Header.Set("Authorization", "Bearer "+key)
+}
+
+// Usage returns the usage of the client's API key.
+func (client *Client) Usage() (*server.ClientUsage, error) {
+	req, err := http.NewRequest("GET", client.BaseURL+"/v1/usage", nil)
+	if err != nil {
+		return nil, err
+	}
+	var usage server.ClientUsage
+	if err := client.do(req, &usage); err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+// Upload captions the image read from r, streaming it as a raw body.
+// name's extension gives the image type.
+func (client *Client) Upload(r io.Reader, name string) (*server.Caption, error) {
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, fmt.Errorf("caption service: %s is not an image file name", name)
+	}
+	query := url.Values{"filename": {path.Base(name)}}
+	req, err := http.NewRequest("POST", client.BaseURL+"/v1/captions?"+query.Encode(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	var caption server.Caption
+	if err := client.do(req, &caption); err != nil {
+		return nil, err
+	}
+	return &caption, nil
+}
+
+// CaptionURL implements server.Captioner.
+func (client *Client) CaptionURL(imageURL string) (string, error) {
+	caption, err := client.Caption(imageURL)
+	if err != nil {
+		return "", err
+	}
+	return caption.Caption, nil
+}
+
+// CaptionReader implements server.Captioner.
+func (client *Client) CaptionReader(r io.Reader, name string) (string, error) {
+	caption, err := client.Upload(r, name)
+	if err != nil {
+		return "", err
+	}
+	return caption.Caption, nil
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORS lets browser apps on other origins call the server.
+type CORS struct {
+	// AllowedOrigins are the origins allowed, such as
+	// "https://app.example.com". "*" allows any origin, and
+	// "https://*.example.com" any subdomain.
+	AllowedOrigins []string
+	// AllowedMethods defaults to GET and POST.
+	AllowedMethods []string
+	// AllowedHeaders defaults to the headers the API reads.
+	AllowedHeaders []string
+	// AllowCredentials lets browsers send cookies and HTTP auth.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight's answer.
+	MaxAge time.Duration
+}
+
+var (
+	defaultCORSMethods = []string{"GET", "POST"}
+	defaultCORSHeaders = []string{"Content-Type", "Authorization", "X-API-Key", "Last-Event-ID"}
+	// corsExposedHeaders are the response headers scripts may read.
+	corsExposedHeaders = "Location, Retry-After, RateLimit-Limit, RateLimit-Remaining, RateLimit-Reset"
+)
+
+// Allowed reports whether origin may call the server.
+func (cors *CORS) Allowed(origin string) bool {
+	for _, allowed := range cors.AllowedOrigins {
+		switch {
+		case allowed == "*", strings.EqualFold(allowed, origin):
+			return true
+		case strings.Contains(allowed, "://*."):
+			scheme, domain, _ := strings.Cut(allowed, "://*")
+			if strings.HasPrefix(origin, scheme+"://") && strings.HasSuffix(strings.ToLower(origin), strings.ToLower(domain)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers of a cross-origin request and answers a
+// preflight, reporting whether it did. Preflights are answered before
+// authentication, since browsers send them without credentials.
+func (cors *CORS) handle(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return false
+	}
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+	if !cors.Allowed(origin) {
+		if preflight {
+			writeError(w, http.StatusForbidden, "origin %s is not allowed", origin)
+		}
+		return preflight
+	}
+
+	if cors.AllowCredentials || !cors.Allowed("*") {
+		header.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		header.Set("Access-Control-Allow-Origin", "*")
+	}
+	if cors.AllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		return false
+	}
+
+	methods, headers := cors.AllowedMethods, cors.AllowedHeaders
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if cors.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cors.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// checkOrigin allows WebSocket connections from the server's own origin
+// and the origins CORS allows.
+func (server *Server) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return server.CORS != nil && server.CORS.Allowed(origin)
+}
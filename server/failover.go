@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// ProviderMode says which of a Failover's Captioners captions.
+type ProviderMode string
+
+const (
+	// ProviderAuto uses the primary, falling over to the secondary when
+	// the primary fails.
+	ProviderAuto ProviderMode = "auto"
+	// ProviderPrimary uses only the primary.
+	ProviderPrimary ProviderMode = "primary"
+	// ProviderSecondary uses only the secondary, for when the primary is
+	// known to be down.
+	ProviderSecondary ProviderMode = "secondary"
+)
+
+// ProviderSwitch holds the ProviderMode of one or more Failovers, so that
+// an operator can switch providers for every client at once. The zero
+// value is in ProviderAuto mode.
+type ProviderSwitch struct {
+	mu   sync.Mutex
+	mode ProviderMode
+}
+
+// Mode returns the switch's mode.
+func (s *ProviderSwitch) Mode() ProviderMode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.mode == "" {
+		return ProviderAuto
+	}
+	return s.mode
+}
+
+// SetMode sets the switch's mode.
+func (s *ProviderSwitch) SetMode(mode ProviderMode) error {
+	switch mode {
+	case ProviderAuto, ProviderPrimary, ProviderSecondary:
+	default:
+		return fmt.Errorf("unknown provider mode %q", mode)
+	}
+	s.mu.Lock()
+	s.mode = mode
+	s.mu.Unlock()
+	return nil
+}
+
+// Failover is a Captioner that captions with Primary, or with Secondary
+// when Primary fails or Switch says so.
+type Failover struct {
+	Primary   Captioner
+	Secondary Captioner
+	Switch    *ProviderSwitch
+	Logger    *log.Logger
+}
+
+var (
+	_ Captioner = (*Failover)(nil)
+	_ Checker   = (*Failover)(nil)
+	_ Rater     = (*Failover)(nil)
+	_ Localizer = (*Failover)(nil)
+)
+
+// NewFailover creates a Failover from primary to secondary, switched by s.
+func NewFailover(primary, secondary Captioner, s *ProviderSwitch) *Failover {
+	return &Failover{Primary: primary, Secondary: secondary, Switch: s}
+}
+
+func (failover *Failover) logf(format string, args ...interface{}) {
+	if failover.Logger != nil {
+		failover.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// Localized returns a Failover between the primary and secondary asking
+// for captions in locale, where they can.
+func (failover *Failover) Localized(locale string) Captioner {
+	localized := *failover
+	localized.Primary = localize(failover.Primary, locale)
+	localized.Secondary = localize(failover.Secondary, locale)
+	return &localized
+}
+
+func (failover *Failover) mode() ProviderMode {
+	if failover.Switch == nil {
+		return ProviderAuto
+	}
+	return failover.Switch.Mode()
+}
+
+// CaptionURL captions the image at url.
+func (failover *Failover) CaptionURL(url string) (string, error) {
+	switch failover.mode() {
+	case ProviderPrimary:
+		return failover.Primary.CaptionURL(url)
+	case ProviderSecondary:
+		return failover.Secondary.CaptionURL(url)
+	}
+	caption, err := failover.Primary.CaptionURL(url)
+	if err != nil {
+		failover.logf("failover: primary: %s; trying the secondary", err)
+		return failover.Secondary.CaptionURL(url)
+	}
+	return caption, nil
+}
+
+// CaptionReader captions the image read from r. In ProviderAuto mode the
+// image is buffered, to send it again to the secondary.
+func (failover *Failover) CaptionReader(r io.Reader, name string) (string, error) {
+	switch failover.mode() {
+	case ProviderPrimary:
+		return failover.Primary.CaptionReader(r, name)
+	case ProviderSecondary:
+		return failover.Secondary.CaptionReader(r, name)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	caption, err := failover.Primary.CaptionReader(bytes.NewReader(data), name)
+	if err != nil {
+		failover.logf("failover: primary: %s; trying the secondary", err)
+		return failover.Secondary.CaptionReader(bytes.NewReader(data), name)
+	}
+	return caption, nil
+}
+
+// Rate implements Rater with whichever Captioner made caption.
+func (failover *Failover) Rate(caption string, rating int) error {
+	err := rate(failover.Primary, caption, rating)
+	if err == ErrNotRatable {
+		err = rate(failover.Secondary, caption, rating)
+	}
+	return err
+}
+
+// Check implements Checker: the server is ready if the provider in use
+// is, or in ProviderAuto mode, either is.
+func (failover *Failover) Check() error {
+	check := func(captioner Captioner) error {
+		if checker, ok := captioner.(Checker); ok {
+			return checker.Check()
+		}
+		return nil
+	}
+	switch failover.mode() {
+	case ProviderPrimary:
+		return check(failover.Primary)
+	case ProviderSecondary:
+		return check(failover.Secondary)
+	}
+	err := check(failover.Primary)
+	if err != nil && check(failover.Secondary) == nil {
+		return nil
+	}
+	return err
+}
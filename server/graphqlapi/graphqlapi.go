@@ -0,0 +1,323 @@
+// Package graphqlapi serves a server.Captioner as a GraphQL endpoint, for
+// front ends that compose services through a GraphQL gateway:
+//
+//	query {
+//	  caption(url: "https://example.com/photo.jpg") { caption durationMs }
+//	  batch(urls: ["https://example.com/a.jpg", "https://example.com/b.jpg"]) {
+//	    url
+//	    caption { caption }
+//	    error
+//	  }
+//	}
+//
+// batch reports a failed image in its result's error field, so the other
+// results are still returned. Uploads use the captionUpload mutation,
+// sent as a GraphQL multipart request
+// (https://github.com/jaydenseric/graphql-multipart-request-spec).
+package graphqlapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/graph-gophers/graphql-go"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Schema is the GraphQL schema the Handler serves.
+const Schema = `
+scalar Upload
+
+type Query {
+	# Captions the image at an http or https URL.
+	caption(url: String!): Caption!
+	# Captions several URLs. Each result has either a caption or an
+	# error, so one bad image doesn't fail the batch.
+	batch(urls: [String!]!): [BatchResult!]!
+}
+
+type Mutation {
+	# Captions an uploaded image.
+	captionUpload(file: Upload!): Caption!
+}
+
+type Caption {
+	url: String
+	filename: String
+	caption: String!
+	durationMs: Int!
+}
+
+type BatchResult {
+	url: String!
+	caption: Caption
+	error: String
+}
+`
+
+// maxRequestBody limits the size of JSON request bodies.
+const maxRequestBody = 1 << 20
+
+// Handler is an http.Handler for GraphQL requests.
+type Handler struct {
+	// MaxUploadSize limits multipart request bodies, in bytes.
+	MaxUploadSize int64
+	Logger        *log.Logger
+	// Tenants, if set, gives each client the server authenticated its
+	// own Captioner.
+	Tenants *server.Tenants
+
+	schema *graphql.Schema
+}
+
+// New creates a Handler backed by captioner.
+func New(captioner server.Captioner) *Handler {
+	handler := &Handler{MaxUploadSize: server.DefaultMaxUploadSize}
+	handler.schema = graphql.MustParseSchema(Schema, &resolver{captioner: captioner, handler: handler},
+		graphql.UseFieldResolvers(), graphql.MaxDepth(5))
+	return handler
+}
+
+func (handler *Handler) logf(format string, args ...interface{}) {
+	if handler.Logger != nil {
+		handler.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+type request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// uploadsKey is the context key of a multipart request's files.
+type uploadsKey struct{}
+
+func (handler *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req request
+	ctx := r.Context()
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); {
+	case r.Method == "GET":
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if vars := r.URL.Query().Get("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				http.Error(w, "invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case r.Method != "POST":
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	case mediaType == "multipart/form-data":
+		r.Body = http.MaxBytesReader(w, r.Body, handler.MaxUploadSize)
+		uploads, err := parseMultipart(r, &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer r.MultipartForm.RemoveAll()
+		ctx = context.WithValue(ctx, uploadsKey{}, uploads)
+	default:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			http.Error(w, "invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Mutations caption uploads, which only POST requests carry.
+	if r.Method == "GET" && strings.HasPrefix(strings.TrimSpace(req.Query), "mutation") {
+		http.Error(w, "mutations must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	response := handler.schema.Exec(ctx, req.Query, req.OperationName, req.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// parseMultipart reads a GraphQL multipart request into req. Each file's
+// variable is set to its field name, which the Upload scalar resolves
+// through the returned map.
+func parseMultipart(r *http.Request, req *request) (map[string]*multipart.FileHeader, error) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(r.FormValue("operations")), req); err != nil {
+		return nil, fmt.Errorf("invalid operations field (batched operations are not supported): %s", err)
+	}
+	var fileMap map[string][]string
+	if err := json.Unmarshal([]byte(r.FormValue("map")), &fileMap); err != nil {
+		return nil, fmt.Errorf("invalid map field: %s", err)
+	}
+
+	uploads := map[string]*multipart.FileHeader{}
+	for field, paths := range fileMap {
+		files := r.MultipartForm.File[field]
+		if len(files) != 1 {
+			return nil, fmt.Errorf("map names file %q, which the request doesn't have", field)
+		}
+		uploads[field] = files[0]
+		for _, p := range paths {
+			if err := setVariable(req.Variables, p, field); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return uploads, nil
+}
+
+// setVariable sets the value at an object path such as
+// "variables.files.0" in vars.
+func setVariable(vars map[string]interface{}, objectPath string, value interface{}) error {
+	keys := strings.Split(objectPath, ".")
+	if len(keys) < 2 || keys[0] != "variables" || vars == nil {
+		return fmt.Errorf("map path %q is not in variables", objectPath)
+	}
+	var container interface{} = vars
+	for i, key := range keys[1:] {
+		last := i == len(keys)-2
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if last {
+				c[key] = value
+				return nil
+			}
+			container = c[key]
+		case []interface{}:
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 || n >= len(c) {
+				return fmt.Errorf("map path %q is not in variables", objectPath)
+			}
+			if last {
+				c[n] = value
+				return nil
+			}
+			container = c[n]
+		default:
+			return fmt.Errorf("map path %q is not in variables", objectPath)
+		}
+	}
+	return nil
+}
+
+// Upload is the Upload scalar, naming a file of a multipart request.
+type Upload struct {
+	field string
+}
+
+// ImplementsGraphQLType maps Upload to the Upload scalar.
+func (Upload) ImplementsGraphQLType(name string) bool {
+	return name == "Upload"
+}
+
+// UnmarshalGraphQL reads the field name a multipart request set.
+func (upload *Upload) UnmarshalGraphQL(input interface{}) error {
+	field, ok := input.(string)
+	if !ok {
+		return fmt.Errorf("Upload must be sent as a multipart request file")
+	}
+	upload.field = field
+	return nil
+}
+
+type caption struct {
+	URL        *string
+	Filename   *string
+	Caption    string
+	DurationMs int32
+}
+
+type batchResult struct {
+	URL     string
+	Caption *caption
+	Error   *string
+}
+
+type resolver struct {
+	captioner server.Captioner
+	handler   *Handler
+}
+
+// captionerFor returns the Captioner for the client of ctx.
+func (r *resolver) captionerFor(ctx context.Context) (server.Captioner, error) {
+	captioner, err := r.handler.Tenants.CaptionerFor(ctx, r.captioner)
+	if err != nil {
+		r.handler.logf("graphql: client %s: %s", server.ClientName(ctx), err)
+		return nil, fmt.Errorf("captioning failed: %s", err)
+	}
+	return captioner, nil
+}
+
+func (r *resolver) Caption(ctx context.Context, args struct{ URL string }) (*caption, error) {
+	if err := server.CheckURL(args.URL); err != nil {
+		return nil, err
+	}
+	captioner, err := r.captionerFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	text, err := captioner.CaptionURL(args.URL)
+	if err != nil {
+		r.handler.logf("graphql: %s: %s", args.URL, err)
+		return nil, fmt.Errorf("captioning failed: %s", err)
+	}
+	return &caption{URL: &args.URL, Caption: text, DurationMs: int32(time.Since(start).Milliseconds())}, nil
+}
+
+func (r *resolver) Batch(ctx context.Context, args struct{ URLs []string }) []*batchResult {
+	results := make([]*batchResult, len(args.URLs))
+	for i, url := range args.URLs {
+		results[i] = &batchResult{URL: url}
+		if c, err := r.Caption(ctx, struct{ URL string }{url}); err != nil {
+			msg := err.Error()
+			results[i].Error = &msg
+		} else {
+			results[i].Caption = c
+		}
+	}
+	return results
+}
+
+func (r *resolver) CaptionUpload(ctx context.Context, args struct{ File Upload }) (*caption, error) {
+	uploads, _ := ctx.Value(uploadsKey{}).(map[string]*multipart.FileHeader)
+	header := uploads[args.File.field]
+	if header == nil {
+		return nil, fmt.Errorf("file %q was not uploaded", args.File.field)
+	}
+	name := path.Base(header.Filename)
+	if !strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "image/") {
+		return nil, fmt.Errorf("%s is not an image file name", header.Filename)
+	}
+	captioner, err := r.captionerFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	start := time.Now()
+	text, err := captioner.CaptionReader(file, name)
+	if err != nil {
+		r.handler.logf("graphql: upload: %s", err)
+		return nil, fmt.Errorf("captioning failed: %s", err)
+	}
+	return &caption{Filename: &name, Caption: text, DurationMs: int32(time.Since(start).Milliseconds())}, nil
+}
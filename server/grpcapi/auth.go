@@ -0,0 +1,77 @@
+package grpcapi
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Authenticate returns server options that require every call to carry
+// one of the API keys in keys, as a bearer token in the "authorization"
+// metadata or in "x-api-key", and count each call in its client's usage.
+// The call's context names its client, as server.ClientName returns.
+func Authenticate(keys server.KeyStore) []grpc.ServerOption {
+	check := func(ctx context.Context) (context.Context, error) {
+		key := callKey(ctx)
+		if key == "" {
+			return nil, status.Error(codes.Unauthenticated, "an API key is required")
+		}
+		client, err := keys.Lookup(key)
+		if err == server.ErrUnknownKey {
+			return nil, status.Error(codes.Unauthenticated, "unknown API key")
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, "checking the API key failed")
+		}
+		keys.AddUsage(client, server.Usage{Requests: 1})
+		return server.WithClientName(ctx, client), nil
+	}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := check(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := check(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, &clientStream{stream, ctx})
+		}),
+	}
+}
+
+// clientStream is a grpc.ServerStream with the context naming its
+// client.
+type clientStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (stream *clientStream) Context() context.Context {
+	return stream.ctx
+}
+
+// callKey returns the API key in a call's metadata.
+func callKey(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		return keys[0]
+	}
+	for _, value := range md.Get("authorization") {
+		scheme, token, _ := strings.Cut(value, " ")
+		if strings.EqualFold(scheme, "Bearer") {
+			return strings.TrimSpace(token)
+		}
+	}
+	return ""
+}
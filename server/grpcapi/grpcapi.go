@@ -0,0 +1,248 @@
+// Package grpcapi serves a server.Captioner over gRPC, as the
+// CaptionService defined in server/captionpb/caption.proto, and calls
+// that service from Go.
+//
+// Errors use gRPC status codes: InvalidArgument for a malformed request,
+// ResourceExhausted for an upload over MaxUploadSize, and Unavailable
+// when the provider fails.
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/nhatbui/captionbot/server"
+	"github.com/nhatbui/captionbot/server/captionpb"
+)
+
+// chunkSize is the size of the upload chunks Client sends.
+const chunkSize = 64 << 10
+
+// errTooLarge ends an upload that exceeds MaxUploadSize.
+var errTooLarge = errors.New("upload too large")
+
+// Service implements CaptionService with a Captioner.
+type Service struct {
+	captionpb.UnimplementedCaptionServiceServer
+
+	Captioner server.Captioner
+	// MaxUploadSize limits uploaded images, in bytes.
+	MaxUploadSize int64
+	Logger        *log.Logger
+	// Tenants, if set, gives each client Authenticate names its own
+	// Captioner.
+	Tenants *server.Tenants
+}
+
+// NewService creates a Service backed by captioner.
+func NewService(captioner server.Captioner) *Service {
+	return &Service{Captioner: captioner, MaxUploadSize: server.DefaultMaxUploadSize}
+}
+
+// Register creates a Service for captioner and registers it on s.
+func Register(s *grpc.Server, captioner server.Captioner) *Service {
+	service := NewService(captioner)
+	captionpb.RegisterCaptionServiceServer(s, service)
+	return service
+}
+
+func (service *Service) logf(format string, args ...interface{}) {
+	if service.Logger != nil {
+		service.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// captionerFor returns the Captioner for the client of ctx.
+func (service *Service) captionerFor(ctx context.Context) (server.Captioner, error) {
+	captioner, err := service.Tenants.CaptionerFor(ctx, service.Captioner)
+	if err != nil {
+		service.logf("grpc: client %s: %s", server.ClientName(ctx), err)
+		return nil, status.Errorf(codes.Unavailable, "captioning failed: %s", err)
+	}
+	return captioner, nil
+}
+
+func (service *Service) captionURL(ctx context.Context, url string) (*captionpb.Caption, error) {
+	if err := server.CheckURL(url); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	captioner, err := service.captionerFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	caption, err := captioner.CaptionURL(url)
+	if err != nil {
+		service.logf("grpc: %s: %s", url, err)
+		return nil, status.Errorf(codes.Unavailable, "captioning failed: %s", err)
+	}
+	return &captionpb.Caption{
+		Url:        url,
+		Caption:    caption,
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// CaptionURL implements captionpb.CaptionServiceServer.
+func (service *Service) CaptionURL(ctx context.Context, req *captionpb.CaptionURLRequest) (*captionpb.Caption, error) {
+	return service.captionURL(ctx, req.Url)
+}
+
+// CaptionUpload implements captionpb.CaptionServiceServer. The chunks
+// are piped to the Captioner as they arrive.
+func (service *Service) CaptionUpload(stream captionpb.CaptionService_CaptionUploadServer) error {
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	name := path.Base(first.Filename)
+	if !strings.HasPrefix(mime.TypeByExtension(path.Ext(name)), "image/") {
+		return status.Errorf(codes.InvalidArgument, "filename %q is not an image file name", first.Filename)
+	}
+	captioner, err := service.captionerFor(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		chunk, size := first, int64(0)
+		for {
+			if size += int64(len(chunk.Data)); size > service.MaxUploadSize {
+				pw.CloseWithError(errTooLarge)
+				return
+			}
+			if _, err := pw.Write(chunk.Data); err != nil {
+				return
+			}
+			if chunk, err = stream.Recv(); err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	defer pr.Close()
+
+	start := time.Now()
+	caption, err := captioner.CaptionReader(pr, name)
+	if errors.Is(err, errTooLarge) {
+		return status.Errorf(codes.ResourceExhausted, "upload is larger than %d bytes", service.MaxUploadSize)
+	}
+	if err != nil {
+		service.logf("grpc: upload: %s", err)
+		return status.Errorf(codes.Unavailable, "captioning failed: %s", err)
+	}
+	return stream.SendAndClose(&captionpb.Caption{
+		Filename:   name,
+		Caption:    caption,
+		DurationMs: time.Since(start).Milliseconds(),
+	})
+}
+
+// BatchCaption implements captionpb.CaptionServiceServer.
+func (service *Service) BatchCaption(req *captionpb.BatchCaptionRequest, stream captionpb.CaptionService_BatchCaptionServer) error {
+	for i, url := range req.Urls {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		result := &captionpb.BatchCaptionResult{Index: int32(i), Url: url}
+		if caption, err := service.captionURL(stream.Context(), url); err != nil {
+			result.Error = status.Convert(err).Message()
+		} else {
+			result.Caption = caption
+		}
+		if err := stream.Send(result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Client calls a CaptionService. It is also a server.Captioner.
+type Client struct {
+	RPC captionpb.CaptionServiceClient
+}
+
+var _ server.Captioner = (*Client)(nil)
+
+// NewClient creates a Client on conn, usually a *grpc.ClientConn.
+func NewClient(conn grpc.ClientConnInterface) *Client {
+	return &Client{RPC: captionpb.NewCaptionServiceClient(conn)}
+}
+
+// CaptionURL captions the image at url.
+func (client *Client) CaptionURL(url string) (string, error) {
+	caption, err := client.RPC.CaptionURL(context.Background(), &captionpb.CaptionURLRequest{Url: url})
+	if err != nil {
+		return "", err
+	}
+	return caption.Caption, nil
+}
+
+// CaptionReader uploads the image read from r in chunks and captions it.
+func (client *Client) CaptionReader(r io.Reader, name string) (string, error) {
+	stream, err := client.RPC.CaptionUpload(context.Background())
+	if err != nil {
+		return "", err
+	}
+	chunk := &captionpb.UploadChunk{Filename: name}
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || chunk.Filename != "" {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err == io.EOF {
+				// The server ended the stream; CloseAndRecv says why.
+				break
+			} else if err != nil {
+				return "", err
+			}
+			chunk = &captionpb.UploadChunk{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			stream.CloseSend()
+			return "", err
+		}
+	}
+	caption, err := stream.CloseAndRecv()
+	if err != nil {
+		return "", err
+	}
+	return caption.Caption, nil
+}
+
+// Batch captions urls, calling fn with each result as it arrives.
+func (client *Client) Batch(ctx context.Context, urls []string, fn func(*captionpb.BatchCaptionResult)) error {
+	stream, err := client.RPC.BatchCaption(ctx, &captionpb.BatchCaptionRequest{Urls: urls})
+	if err != nil {
+		return err
+	}
+	for {
+		result, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(result)
+	}
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// DefaultMaxQueuedJobs is the default number of queued jobs at which the
+// server stops reporting itself ready.
+const DefaultMaxQueuedJobs = 100
+
+// Readiness is the answer to GET /readyz. Checks maps each check to "ok"
+// or the reason it failed.
+type Readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// handleHealth answers GET /healthz, which only shows that the process
+// is serving.
+func (server *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReady answers GET /readyz with the server's Readiness: whether
+// the server is draining, whether the provider is reachable, when the Captioner is a Checker, and whether
+// the job and caption queues have room. It answers 503 when not
+// ready, so a load balancer sends traffic elsewhere.
+func (server *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	readiness := Readiness{Ready: true, Checks: map[string]string{}}
+	check := func(name string, err error) {
+		if err != nil {
+			readiness.Ready = false
+			readiness.Checks[name] = err.Error()
+		} else {
+			readiness.Checks[name] = "ok"
+		}
+	}
+
+	var err error
+	if server.isDraining() {
+		err = fmt.Errorf("shutting down")
+	}
+	check("server", err)
+
+	if checker, ok := server.Captioner.(Checker); ok {
+		err := checker.Check()
+		if err != nil {
+			server.logf("server: provider check: %s", err)
+		}
+		check("provider", err)
+	}
+
+	queued := server.queuedJobs()
+	err = nil
+	if server.MaxQueuedJobs > 0 && queued >= server.MaxQueuedJobs {
+		err = fmt.Errorf("%d jobs queued", queued)
+	}
+	check("jobs", err)
+
+	server.queue.mu.Lock()
+	waiting := server.queue.waiting.Len()
+	server.queue.mu.Unlock()
+	err = nil
+	if server.MaxConcurrent > 0 && waiting >= server.MaxWaiting {
+		err = fmt.Errorf("%d caption requests queued", waiting)
+	}
+	check("captions", err)
+
+	status := http.StatusOK
+	if !readiness.Ready {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, readiness)
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+const (
+	// jobLeaseTTL is how long a replica's claim on a job lasts unless it
+	// renews it, as it does every third of that while the job runs.
+	jobLeaseTTL = 30 * time.Second
+	// jobPopTimeout is how long a job worker waits on the JobQueue before
+	// looking at the local queue again.
+	jobPopTimeout = time.Second
+	// jobRecoverInterval is how often a replica looks for unfinished jobs
+	// nobody holds, such as those of a replica that died.
+	jobRecoverInterval = time.Minute
+	// jobFollowInterval is how often a job running on another replica is
+	// reloaded for its event stream.
+	jobFollowInterval = time.Second
+)
+
+// JobQueue shares queued jobs between the replicas of a server. The
+// replica accepting a job pushes its ID, and whichever replica pops it
+// first runs it, holding a lease on it meanwhile so that no other replica
+// runs it too. Implementations must be safe for concurrent use. The
+// server/jobqueue/redis package holds one in Redis.
+type JobQueue interface {
+	// Push queues a job.
+	Push(id string) error
+	// Pop waits up to timeout for a queued job, returning "" if there
+	// was none.
+	Pop(timeout time.Duration) (string, error)
+	// Len returns the number of queued jobs.
+	Len() (int, error)
+	// Lease claims a job for owner until ttl passes, or extends owner's
+	// claim, and reports false if another owner holds it.
+	Lease(id, owner string, ttl time.Duration) (bool, error)
+	// Release gives up owner's claim on a job.
+	Release(id, owner string) error
+}
+
+// queuedJobs returns the number of jobs waiting for a worker, here or in
+// the JobQueue.
+func (server *Server) queuedJobs() int {
+	server.jobsMu.Lock()
+	queued := len(server.pending)
+	server.jobsMu.Unlock()
+	if server.JobQueue != nil {
+		shared, err := server.JobQueue.Len()
+		if err != nil {
+			server.logf("server: job queue: %s", err)
+		}
+		queued += shared
+	}
+	return queued
+}
+
+// sharedJob pops a job from the JobQueue and claims it, returning nil if
+// there was none or another replica holds it.
+func (server *Server) sharedJob() *job {
+	id, err := server.JobQueue.Pop(jobPopTimeout)
+	if err != nil {
+		server.logf("server: job queue: %s", err)
+		time.Sleep(jobPopTimeout)
+		return nil
+	}
+	if id == "" {
+		return nil
+	}
+	return server.claimJob(id)
+}
+
+// claimJob leases a job and loads it to run here, returning nil if
+// another replica holds it or it has finished.
+func (server *Server) claimJob(id string) *job {
+	ok, err := server.JobQueue.Lease(id, server.replica, jobLeaseTTL)
+	if err != nil {
+		server.logf("server: job %s: leasing: %s", id, err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+	record, err := server.JobStore.Load(id)
+	if err == nil && record.Archive != "" {
+		// The archive is on the replica it was uploaded to, which
+		// recovers the job itself.
+		if _, statErr := os.Stat(record.Archive); statErr != nil {
+			record = nil
+		}
+	}
+	if err == nil && record != nil && !record.Finished() {
+		j := jobFromRecord(record)
+		j.leased = true
+		server.jobsMu.Lock()
+		server.jobs[j.ID] = j
+		server.jobsMu.Unlock()
+		return j
+	}
+	if err != nil && err != ErrJobNotFound {
+		server.logf("server: job %s: %s", id, err)
+	}
+	server.JobQueue.Release(id, server.replica)
+	return nil
+}
+
+// runShared runs a job leased through the JobQueue, renewing its lease.
+// If the server drains first, a URL job is queued again for another
+// replica to finish.
+func (server *Server) runShared(j *job) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(jobLeaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := server.JobQueue.Lease(j.ID, server.replica, jobLeaseTTL); err != nil {
+					server.logf("server: job %s: renewing lease: %s", j.ID, err)
+				}
+			}
+		}
+	}()
+
+	server.run(j)
+	close(done)
+	if err := server.JobQueue.Release(j.ID, server.replica); err != nil {
+		server.logf("server: job %s: releasing: %s", j.ID, err)
+	}
+	if j.status().FinishedAt == nil && j.archive == nil && j.archivePath == "" {
+		server.jobsMu.Lock()
+		delete(server.jobs, j.ID)
+		server.jobsMu.Unlock()
+		if err := server.JobQueue.Push(j.ID); err != nil {
+			server.logf("server: job %s: requeueing: %s", j.ID, err)
+		}
+	}
+}
+
+// recoverJobs claims the unfinished jobs no replica holds, such as those
+// of a replica that died, and queues them here. An archive job is only
+// claimed where its archive is.
+func (server *Server) recoverJobs() error {
+	records, err := server.JobStore.Unfinished()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		server.jobsMu.Lock()
+		_, local := server.jobs[record.ID]
+		server.jobsMu.Unlock()
+		if local {
+			continue
+		}
+		if record.Archive != "" {
+			if _, err := os.Stat(record.Archive); err != nil {
+				continue
+			}
+		}
+		ok, err := server.JobQueue.Lease(record.ID, server.replica, jobLeaseTTL)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		server.infof("server: resuming job %s at %d of %d", record.ID, len(record.Items), record.Total)
+		j := jobFromRecord(record)
+		j.leased = true
+		server.enqueue(j)
+	}
+	return nil
+}
+
+// recoverJobsEvery runs recoverJobs every jobRecoverInterval until the
+// server drains.
+func (server *Server) recoverJobsEvery() {
+	ticker := time.NewTicker(jobRecoverInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.draining:
+			return
+		case <-ticker.C:
+			if err := server.recoverJobs(); err != nil {
+				server.logf("server: recovering jobs: %s", err)
+			}
+		}
+	}
+}
+
+// followJob keeps j, loaded from the JobStore while another replica runs
+// it, up to date for an event stream until ctx ends or the job finishes.
+func (server *Server) followJob(ctx context.Context, j *job) {
+	ticker := time.NewTicker(jobFollowInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		record, err := server.JobStore.Load(j.ID)
+		if err != nil {
+			server.logf("server: job %s: %s", j.ID, err)
+			continue
+		}
+		seen := len(j.status().Items)
+		for i := seen; i < len(record.Items); i++ {
+			j.record(record.Items[i])
+		}
+		if record.Finished() {
+			j.finish()
+			return
+		}
+	}
+}
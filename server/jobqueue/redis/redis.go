@@ -0,0 +1,96 @@
+// Package redis is a server.JobQueue in Redis, so that the replicas of a
+// server share its job queue. Job IDs are queued on the list
+// PREFIXjobs:queue, and a job's lease is a string at PREFIXjob:ID:lease
+// holding its owner, expiring with the lease.
+package redis
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// lease sets a lease to its owner unless someone else holds it.
+var lease = goredis.NewScript(`
+local owner = redis.call("GET", KEYS[1])
+if owner and owner ~= ARGV[1] then
+	return 0
+end
+redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+return 1
+`)
+
+// release deletes a lease if its owner holds it.
+var release = goredis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Queue keeps a job queue in Redis.
+type Queue struct {
+	Client *goredis.Client
+	Prefix string
+}
+
+var _ server.JobQueue = (*Queue)(nil)
+
+// Open creates a Queue for a redis:// or rediss:// URL, with keys under
+// "captionbot:".
+func Open(url string) (*Queue, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Queue{Client: goredis.NewClient(opts), Prefix: "captionbot:"}, nil
+}
+
+func (queue *Queue) queueKey() string {
+	return queue.Prefix + "jobs:queue"
+}
+
+func (queue *Queue) leaseKey(id string) string {
+	return queue.Prefix + "job:" + id + ":lease"
+}
+
+// Push implements server.JobQueue.
+func (queue *Queue) Push(id string) error {
+	return queue.Client.LPush(context.Background(), queue.queueKey(), id).Err()
+}
+
+// Pop implements server.JobQueue.
+func (queue *Queue) Pop(timeout time.Duration) (string, error) {
+	result, err := queue.Client.BRPop(context.Background(), timeout, queue.queueKey()).Result()
+	if errors.Is(err, goredis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// BRPOP answers with the list's key and the value.
+	return result[1], nil
+}
+
+// Len implements server.JobQueue.
+func (queue *Queue) Len() (int, error) {
+	n, err := queue.Client.LLen(context.Background(), queue.queueKey()).Result()
+	return int(n), err
+}
+
+// Lease implements server.JobQueue.
+func (queue *Queue) Lease(id, owner string, ttl time.Duration) (bool, error) {
+	ok, err := lease.Run(context.Background(), queue.Client,
+		[]string{queue.leaseKey(id)}, owner, ttl.Milliseconds()).Int()
+	return ok == 1, err
+}
+
+// Release implements server.JobQueue.
+func (queue *Queue) Release(id, owner string) error {
+	return release.Run(context.Background(), queue.Client,
+		[]string{queue.leaseKey(id)}, owner).Err()
+}
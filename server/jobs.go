@@ -0,0 +1,653 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot/notify"
+)
+
+// errDraining stops reading an archive when the server drains.
+var errDraining = errors.New("server draining")
+
+const (
+	// maxJobItems limits the number of images in one job.
+	maxJobItems = 10000
+	// DefaultJobRetention is how long a finished job stays available by
+	// default.
+	DefaultJobRetention = 24 * time.Hour
+	// heartbeatInterval is how often idle event streams get a comment,
+	// so proxies don't time them out.
+	heartbeatInterval = 15 * time.Second
+)
+
+// JobRequest is the JSON body of POST /v1/jobs.
+type JobRequest struct {
+	URLs []string `json:"urls"`
+	// Callback is a URL to POST the job's JobStatus to when it finishes,
+	// signed as described in the notify package.
+	Callback string `json:"callback,omitempty"`
+}
+
+// JobStatus is the answer to GET /v1/jobs/ID. Status is "queued",
+// "running" or "done", and Items holds the results so far in order.
+type JobStatus struct {
+	ID         string      `json:"id"`
+	Status     string      `json:"status"`
+	CreatedAt  time.Time   `json:"created_at"`
+	FinishedAt *time.Time  `json:"finished_at,omitempty"`
+	Progress   JobProgress `json:"progress"`
+	Items      []JobItem   `json:"items"`
+}
+
+// JobItem is the result of one image of a job.
+type JobItem struct {
+	Index int `json:"index"`
+	Caption
+	Error string `json:"error,omitempty"`
+}
+
+// JobProgress counts a job's finished images.
+type JobProgress struct {
+	Total  int `json:"total"`
+	Done   int `json:"done"`
+	Failed int `json:"failed"`
+}
+
+// job is a batch of images captioned in the background: either URLs or
+// the images of an uploaded archive. Its record is kept in the JobStore.
+type job struct {
+	ID      string
+	Created time.Time
+
+	urls    []string
+	archive *archive
+	// archivePath is set instead of archive for a resumed job, whose
+	// archive is reopened when it runs.
+	archivePath string
+	callback    string
+	// client submitted the job; only it can see the job, and the job is
+	// captioned with its Captioner.
+	client string
+	// leased is set when the server holds the job's lease in the
+	// JobQueue.
+	leased bool
+
+	mu       sync.Mutex
+	started  bool
+	items    []JobItem
+	progress JobProgress
+	finished time.Time
+	watchers map[chan JobItem]struct{}
+}
+
+func newJob(id string, created time.Time) *job {
+	return &job{ID: id, Created: created, watchers: map[chan JobItem]struct{}{}}
+}
+
+// jobFromRecord recreates a job from its stored record.
+func jobFromRecord(record *JobRecord) *job {
+	j := newJob(record.ID, record.CreatedAt)
+	j.urls = record.URLs
+	j.archivePath = record.Archive
+	j.callback = record.Callback
+	j.client = record.Client
+	j.progress.Total = record.Total
+	for _, item := range record.Items {
+		j.record(item)
+	}
+	j.finished = record.FinishedAt
+	return j
+}
+
+// jobRecord returns the job's record, without items.
+func (j *job) jobRecord() *JobRecord {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	record := &JobRecord{
+		ID:         j.ID,
+		CreatedAt:  j.Created,
+		FinishedAt: j.finished,
+		Total:      j.progress.Total,
+		URLs:       j.urls,
+		Archive:    j.archivePath,
+		Callback:   j.callback,
+		Client:     j.client,
+	}
+	if j.archive != nil {
+		record.Archive = j.archive.path
+	}
+	return record
+}
+
+func newJobID() string {
+	var b [12]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// watch returns the items finished so far and, unless the job has
+// finished, a channel receiving the rest. The channel is closed when the
+// job finishes or the watcher falls behind.
+func (j *job) watch() ([]JobItem, chan JobItem) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	items := append([]JobItem(nil), j.items...)
+	if !j.finished.IsZero() {
+		return items, nil
+	}
+	ch := make(chan JobItem, 64)
+	j.watchers[ch] = struct{}{}
+	return items, ch
+}
+
+func (j *job) unwatch(ch chan JobItem) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, ok := j.watchers[ch]; ok {
+		delete(j.watchers, ch)
+		close(ch)
+	}
+}
+
+// record adds a finished item and passes it to the watchers.
+func (j *job) record(item JobItem) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.items = append(j.items, item)
+	j.progress.Done++
+	if item.Error != "" {
+		j.progress.Failed++
+	}
+	for ch := range j.watchers {
+		select {
+		case ch <- item:
+		default:
+			delete(j.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+func (j *job) start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.started = true
+}
+
+func (j *job) finish() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.finished = time.Now()
+	for ch := range j.watchers {
+		delete(j.watchers, ch)
+		close(ch)
+	}
+}
+
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := JobStatus{
+		ID:        j.ID,
+		Status:    "queued",
+		CreatedAt: j.Created,
+		Progress:  j.progress,
+		Items:     append([]JobItem{}, j.items...),
+	}
+	if j.started {
+		status.Status = "running"
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		status.Status = "done"
+		status.FinishedAt = &finished
+	}
+	return status
+}
+
+// enqueue queues a job for the job workers, starting them first if
+// needed.
+func (server *Server) enqueue(j *job) {
+	server.startJobs.Do(func() {
+		workers := server.JobWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			go server.jobWorker()
+		}
+		go server.expireJobs()
+		if server.JobQueue != nil {
+			go server.recoverJobsEvery()
+		}
+	})
+
+	if server.JobQueue != nil && !j.leased {
+		if j.archive == nil && j.archivePath == "" {
+			err := server.JobQueue.Push(j.ID)
+			if err == nil {
+				return
+			}
+			server.logf("server: job %s: queueing: %s; running it here", j.ID, err)
+		}
+		// Jobs run here are leased so that other replicas don't
+		// recover them.
+		ok, err := server.JobQueue.Lease(j.ID, server.replica, jobLeaseTTL)
+		if err != nil {
+			server.logf("server: job %s: leasing: %s", j.ID, err)
+		}
+		j.leased = ok
+	}
+
+	server.jobsMu.Lock()
+	server.jobs[j.ID] = j
+	server.pending = append(server.pending, j)
+	server.jobsMu.Unlock()
+	server.jobsReady.Signal()
+}
+
+// jobWorker runs queued jobs until the server drains: those queued here
+// first, then those in the JobQueue if there is one.
+func (server *Server) jobWorker() {
+	for {
+		server.jobsMu.Lock()
+		for len(server.pending) == 0 && !server.isDraining() && server.JobQueue == nil {
+			server.jobsReady.Wait()
+		}
+		if server.isDraining() {
+			server.jobsMu.Unlock()
+			return
+		}
+		var j *job
+		if len(server.pending) > 0 {
+			j = server.pending[0]
+			server.pending = server.pending[1:]
+		}
+		server.active.Add(1)
+		server.jobsMu.Unlock()
+
+		if j == nil {
+			j = server.sharedJob()
+		}
+		switch {
+		case j == nil:
+		case j.leased:
+			server.runShared(j)
+		default:
+			server.run(j)
+		}
+		server.active.Done()
+	}
+}
+
+// expireJobs deletes the finished jobs past JobRetention from the store
+// every hour, including those a restart left behind.
+func (server *Server) expireJobs() {
+	for {
+		if err := server.JobStore.Expire(time.Now().Add(-server.JobRetention)); err != nil {
+			server.logf("server: expiring jobs: %s", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// Resume queues the jobs the JobStore holds unfinished, such as those
+// interrupted by a restart. Their finished images aren't captioned
+// again. With a JobQueue, only jobs no other replica holds are resumed.
+// Call it once before serving.
+func (server *Server) Resume() error {
+	if server.JobQueue != nil {
+		return server.recoverJobs()
+	}
+	records, err := server.JobStore.Unfinished()
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		server.infof("server: resuming job %s at %d of %d", record.ID, len(record.Items), record.Total)
+		server.enqueue(jobFromRecord(record))
+	}
+	return nil
+}
+
+// finishItem stores a finished item of a job and records it.
+func (server *Server) finishItem(j *job, item JobItem) {
+	if err := server.JobStore.AddItem(j.ID, item); err != nil {
+		server.logf("server: job %s: storing item %d: %s", j.ID, item.Index, err)
+	}
+	j.record(item)
+}
+
+// run captions the job's images one by one, skipping those a resumed job
+// has already finished. If the server drains, it stops after the current
+// image, leaving the job unfinished in the JobStore.
+func (server *Server) run(j *job) {
+	j.start()
+	done := j.status().Progress.Done
+	captioner := server.captioner(j.client)
+	if j.archive != nil || j.archivePath != "" {
+		if !server.runArchive(j, captioner, done) {
+			server.infof("server: job %s: stopped at %d of %d to drain", j.ID, j.status().Progress.Done, j.progress.Total)
+			return
+		}
+	}
+	for i := done; i < len(j.urls); i++ {
+		if server.isDraining() {
+			server.infof("server: job %s: stopped at %d of %d to drain", j.ID, i, len(j.urls))
+			return
+		}
+		url := j.urls[i]
+		item := JobItem{Index: i, Caption: Caption{URL: url}}
+		start := time.Now()
+		if err := CheckURL(url); err != nil {
+			item.Error = err.Error()
+		} else if caption, err := captioner.CaptionURL(url); err != nil {
+			server.logf("server: job %s: %s: %s", j.ID, url, err)
+			item.Error = "captioning failed: " + err.Error()
+		} else {
+			item.Caption.Caption = caption
+		}
+		item.DurationMS = time.Since(start).Milliseconds()
+		server.finishItem(j, item)
+	}
+	j.finish()
+	if err := server.JobStore.Save(j.jobRecord()); err != nil {
+		server.logf("server: job %s: %s", j.ID, err)
+	}
+	if j.callback != "" {
+		server.active.Add(1)
+		go func() {
+			defer server.active.Done()
+			server.callBack(j)
+		}()
+	}
+
+	time.AfterFunc(server.JobRetention, func() {
+		server.jobsMu.Lock()
+		delete(server.jobs, j.ID)
+		server.jobsMu.Unlock()
+		if err := server.JobStore.Delete(j.ID); err != nil {
+			server.logf("server: job %s: %s", j.ID, err)
+		}
+	})
+}
+
+// callBack POSTs a finished job's status to its callback URL.
+func (server *Server) callBack(j *job) {
+	notifier := notify.New(server.CallbackSecret, j.callback)
+	notifier.Logger = server.Logger
+	if err := notifier.Post(j.status()); err != nil {
+		server.logf("server: job %s: %s", j.ID, err)
+	}
+}
+
+// runArchive captions the images of an archive job with captioner from
+// the given index, then deletes the archive. It reports false, keeping the
+// archive, if it stopped for the server to drain.
+func (server *Server) runArchive(j *job, captioner Captioner, from int) bool {
+	if j.archive == nil {
+		a, err := openArchive(j.archivePath)
+		if err != nil {
+			server.logf("server: job %s: %s", j.ID, err)
+			for i := from; i < j.progress.Total; i++ {
+				server.finishItem(j, JobItem{Index: i, Error: "archive is gone: " + err.Error()})
+			}
+			return true
+		}
+		j.archive = a
+	}
+
+	i := 0
+	err := j.archive.each(func(name string, r io.Reader) error {
+		if i < from {
+			i++
+			return nil
+		}
+		if server.isDraining() {
+			return errDraining
+		}
+		item := JobItem{Index: i, Caption: Caption{Filename: name}}
+		start := time.Now()
+		if caption, err := captioner.CaptionReader(r, path.Base(name)); err != nil {
+			server.logf("server: job %s: %s: %s", j.ID, name, err)
+			item.Error = "captioning failed: " + err.Error()
+		} else {
+			item.Caption.Caption = caption
+		}
+		item.DurationMS = time.Since(start).Milliseconds()
+		server.finishItem(j, item)
+		i++
+		return nil
+	})
+	if err == errDraining {
+		return false
+	}
+	if err != nil {
+		// The archive was read once already, so this is unexpected;
+		// fail the remaining images rather than leave them pending.
+		server.logf("server: job %s: %s", j.ID, err)
+		for ; i < len(j.archive.names); i++ {
+			server.finishItem(j, JobItem{Index: i, Caption: Caption{Filename: j.archive.names[i]}, Error: err.Error()})
+		}
+	}
+	j.archive.remove()
+	return true
+}
+
+func (server *Server) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	if server.isDraining() {
+		w.Header().Set("Retry-After", "5")
+		writeError(w, http.StatusServiceUnavailable, "server shutting down")
+		return
+	}
+	queued := server.queuedJobs()
+	if server.MaxQueuedJobs > 0 && queued >= server.MaxQueuedJobs {
+		w.Header().Set("Retry-After", "60")
+		w.Header().Set("X-Queue-Depth", strconv.Itoa(queued))
+		writeError(w, http.StatusServiceUnavailable, "server busy: %d jobs queued", queued)
+		return
+	}
+
+	j := newJob(newJobID(), time.Now())
+	j.client = ClientName(r.Context())
+	j.callback = r.URL.Query().Get("callback")
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "" || mediaType == "application/json":
+		var req JobRequest
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body: %s", err)
+			return
+		}
+		j.urls = req.URLs
+		j.progress.Total = len(req.URLs)
+		if req.Callback != "" {
+			j.callback = req.Callback
+		}
+	case archiveTypes[mediaType]:
+		a, err := spoolArchive(http.MaxBytesReader(w, r.Body, server.MaxArchiveSize), server.ArchiveDir)
+		if err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeError(w, http.StatusRequestEntityTooLarge, "archive is larger than %d bytes", tooLarge.Limit)
+			} else {
+				writeError(w, http.StatusBadRequest, "%s", err)
+			}
+			return
+		}
+		j.archive = a
+		j.progress.Total = len(a.names)
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported content type %q", mediaType)
+		return
+	}
+	if j.progress.Total == 0 || j.progress.Total > maxJobItems {
+		if j.archive != nil {
+			j.archive.remove()
+		}
+		writeError(w, http.StatusBadRequest, "a job needs between 1 and %d images", maxJobItems)
+		return
+	}
+	if j.callback != "" && CheckURL(j.callback) != nil {
+		if j.archive != nil {
+			j.archive.remove()
+		}
+		writeError(w, http.StatusBadRequest, "callback must be an http or https URL")
+		return
+	}
+
+	if err := server.JobStore.Save(j.jobRecord()); err != nil {
+		if j.archive != nil {
+			j.archive.remove()
+		}
+		server.logf("server: job %s: %s", j.ID, err)
+		writeError(w, http.StatusInternalServerError, "storing the job failed")
+		return
+	}
+	server.enqueue(j)
+	server.addCaptions(r.Context(), j.progress.Total)
+
+	w.Header().Set("Location", "/v1/jobs/"+j.ID)
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"id":     j.ID,
+		"total":  j.progress.Total,
+		"events": "/v1/jobs/" + j.ID + "/events",
+	})
+}
+
+// handleJob serves the resources under /v1/jobs/ID.
+func (server *Server) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, resource, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/")
+	server.jobsMu.Lock()
+	j := server.jobs[id]
+	server.jobsMu.Unlock()
+	if j == nil {
+		// Jobs finished before a restart are only in the store.
+		record, err := server.JobStore.Load(id)
+		if err == ErrJobNotFound {
+			writeError(w, http.StatusNotFound, "no job %q", id)
+			return
+		}
+		if err != nil {
+			server.logf("server: job %s: %s", id, err)
+			writeError(w, http.StatusInternalServerError, "loading the job failed")
+			return
+		}
+		j = jobFromRecord(record)
+		if server.JobQueue != nil && resource == "events" && !record.Finished() {
+			// Another replica runs the job.
+			go server.followJob(r.Context(), j)
+		}
+	}
+	if j.client != "" && j.client != ClientName(r.Context()) {
+		// Other clients' jobs don't exist as far as this one knows.
+		writeError(w, http.StatusNotFound, "no job %q", id)
+		return
+	}
+
+	switch resource {
+	case "":
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+			return
+		}
+		writeJSON(w, http.StatusOK, j.status())
+	case "events":
+		server.jobEvents(w, r, j)
+	default:
+		writeError(w, http.StatusNotFound, "no resource %q", resource)
+	}
+}
+
+// jobEvents streams a job's progress as server-sent events: an "item"
+// event with each finished JobItem, replaying those finished before the
+// client connected, and a final "done" event with the JobProgress. Item
+// events have the number of items sent so far as their ID, so a
+// reconnecting client's Last-Event-ID skips the items it has seen.
+func (server *Server) jobEvents(w http.ResponseWriter, r *http.Request, j *job) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming is not supported")
+		return
+	}
+	var seen int
+	fmt.Sscan(r.Header.Get("Last-Event-ID"), &seen)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	sent := 0
+	send := func(item JobItem) {
+		sent++
+		if sent <= seen {
+			return
+		}
+		data, _ := json.Marshal(item)
+		fmt.Fprintf(w, "id: %d\nevent: item\ndata: %s\n\n", sent, data)
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+	items, ch := j.watch()
+	for {
+		// sent counts the items streamed so far, so it indexes the next.
+		for _, item := range items[sent:] {
+			send(item)
+		}
+		flusher.Flush()
+		if ch == nil {
+			break
+		}
+
+		caughtUp := true
+		for caughtUp {
+			select {
+			case <-r.Context().Done():
+				j.unwatch(ch)
+				return
+			case <-server.draining:
+				// The client reconnects with Last-Event-ID, to
+				// another instance or after the restart.
+				j.unwatch(ch)
+				return
+			case <-heartbeat.C:
+				fmt.Fprintf(w, ": heartbeat\n\n")
+				flusher.Flush()
+			case item, ok := <-ch:
+				if !ok {
+					// The job finished or this stream fell behind;
+					// either way, continue from the recorded items.
+					caughtUp = false
+					continue
+				}
+				send(item)
+				flusher.Flush()
+			}
+		}
+		items, ch = j.watch()
+	}
+
+	data, _ := json.Marshal(j.status().Progress)
+	fmt.Fprintf(w, "event: done\ndata: %s\n\n", data)
+	flusher.Flush()
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrJobNotFound is returned by JobStore.Load for an unknown job.
+var ErrJobNotFound = errors.New("job not found")
+
+// JobRecord is the stored form of a job. Its items are appended with
+// JobStore.AddItem as they finish, and filled in by JobStore.Load.
+type JobRecord struct {
+	ID         string    `json:"id"`
+	CreatedAt  time.Time `json:"created_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Total      int       `json:"total"`
+	URLs       []string  `json:"urls,omitempty"`
+	// Archive is the path of an archive job's spooled upload.
+	Archive  string `json:"archive,omitempty"`
+	Callback string `json:"callback,omitempty"`
+	// Client is the client that submitted the job, if the server
+	// authenticates requests.
+	Client string `json:"client,omitempty"`
+
+	Items []JobItem `json:"-"`
+}
+
+// Finished reports whether the job has finished.
+func (record *JobRecord) Finished() bool {
+	return !record.FinishedAt.IsZero()
+}
+
+// JobStore persists jobs, so that queued and running jobs survive a
+// restart and are resumed by Server.Resume. Implementations must be safe
+// for concurrent use. The server/jobstore packages hold BoltDB, Redis and
+// PostgreSQL implementations.
+type JobStore interface {
+	// Save creates or updates a job's record, apart from its items.
+	Save(record *JobRecord) error
+	// AddItem appends a finished item to a job.
+	AddItem(id string, item JobItem) error
+	// Load returns a job with its items, or ErrJobNotFound.
+	Load(id string) (*JobRecord, error)
+	// Unfinished returns the jobs that haven't finished, oldest first.
+	Unfinished() ([]*JobRecord, error)
+	// Delete removes a job and its items.
+	Delete(id string) error
+	// Expire deletes the jobs that finished before t.
+	Expire(t time.Time) error
+}
+
+// MemoryJobStore is a JobStore that keeps jobs in memory, so they don't
+// survive a restart. It is the default.
+type MemoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[string]*JobRecord
+}
+
+var _ JobStore = (*MemoryJobStore)(nil)
+
+// NewMemoryJobStore creates an empty MemoryJobStore.
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{jobs: map[string]*JobRecord{}}
+}
+
+// Save implements JobStore.
+func (store *MemoryJobStore) Save(record *JobRecord) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	saved := *record
+	if old := store.jobs[record.ID]; old != nil {
+		saved.Items = old.Items
+	} else {
+		saved.Items = nil
+	}
+	store.jobs[record.ID] = &saved
+	return nil
+}
+
+// AddItem implements JobStore.
+func (store *MemoryJobStore) AddItem(id string, item JobItem) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	record := store.jobs[id]
+	if record == nil {
+		return ErrJobNotFound
+	}
+	record.Items = append(record.Items, item)
+	return nil
+}
+
+// Load implements JobStore.
+func (store *MemoryJobStore) Load(id string) (*JobRecord, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	record := store.jobs[id]
+	if record == nil {
+		return nil, ErrJobNotFound
+	}
+	loaded := *record
+	loaded.Items = append([]JobItem(nil), record.Items...)
+	return &loaded, nil
+}
+
+// Unfinished implements JobStore.
+func (store *MemoryJobStore) Unfinished() ([]*JobRecord, error) {
+	store.mu.Lock()
+	var ids []string
+	for id, record := range store.jobs {
+		if !record.Finished() {
+			ids = append(ids, id)
+		}
+	}
+	store.mu.Unlock()
+
+	var records []*JobRecord
+	for _, id := range ids {
+		if record, err := store.Load(id); err == nil {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records, nil
+}
+
+// Delete implements JobStore.
+func (store *MemoryJobStore) Delete(id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.jobs, id)
+	return nil
+}
+
+// Expire implements JobStore.
+func (store *MemoryJobStore) Expire(t time.Time) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for id, record := range store.jobs {
+		if record.Finished() && record.FinishedAt.Before(t) {
+			delete(store.jobs, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+// Package bolt is a server.JobStore in a BoltDB file, so jobs survive a
+// restart without running another service. It is the serve command's
+// default.
+package bolt
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+var (
+	jobsBucket  = []byte("jobs")
+	itemsBucket = []byte("items")
+)
+
+// Store keeps job records in the "jobs" bucket, and each job's items in
+// a bucket named by the job ID inside the "items" bucket.
+type Store struct {
+	DB *bbolt.DB
+}
+
+var _ server.JobStore = (*Store)(nil)
+
+// Open opens or creates the database file at path.
+func Open(path string) (*Store, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(jobsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(itemsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{DB: db}, nil
+}
+
+// Close closes the database.
+func (store *Store) Close() error {
+	return store.DB.Close()
+}
+
+func itemKey(index int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(index))
+	return key
+}
+
+// Save implements server.JobStore.
+func (store *Store) Save(record *server.JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return store.DB.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(record.ID), data)
+	})
+}
+
+// AddItem implements server.JobStore.
+func (store *Store) AddItem(id string, item server.JobItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return store.DB.Update(func(tx *bbolt.Tx) error {
+		if tx.Bucket(jobsBucket).Get([]byte(id)) == nil {
+			return server.ErrJobNotFound
+		}
+		items, err := tx.Bucket(itemsBucket).CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+		return items.Put(itemKey(item.Index), data)
+	})
+}
+
+func load(tx *bbolt.Tx, id []byte) (*server.JobRecord, error) {
+	data := tx.Bucket(jobsBucket).Get(id)
+	if data == nil {
+		return nil, server.ErrJobNotFound
+	}
+	var record server.JobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+	if items := tx.Bucket(itemsBucket).Bucket(id); items != nil {
+		err := items.ForEach(func(_, data []byte) error {
+			var item server.JobItem
+			if err := json.Unmarshal(data, &item); err != nil {
+				return err
+			}
+			record.Items = append(record.Items, item)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &record, nil
+}
+
+// Load implements server.JobStore.
+func (store *Store) Load(id string) (*server.JobRecord, error) {
+	var record *server.JobRecord
+	err := store.DB.View(func(tx *bbolt.Tx) error {
+		var err error
+		record, err = load(tx, []byte(id))
+		return err
+	})
+	return record, err
+}
+
+// Unfinished implements server.JobStore.
+func (store *Store) Unfinished() ([]*server.JobRecord, error) {
+	var records []*server.JobRecord
+	err := store.DB.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(id, data []byte) error {
+			var record server.JobRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.Finished() {
+				return nil
+			}
+			full, err := load(tx, id)
+			if err != nil {
+				return err
+			}
+			records = append(records, full)
+			return nil
+		})
+	})
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records, err
+}
+
+func remove(tx *bbolt.Tx, id []byte) error {
+	if err := tx.Bucket(jobsBucket).Delete(id); err != nil {
+		return err
+	}
+	if err := tx.Bucket(itemsBucket).DeleteBucket(id); err != nil && err != bbolt.ErrBucketNotFound {
+		return err
+	}
+	return nil
+}
+
+// Delete implements server.JobStore.
+func (store *Store) Delete(id string) error {
+	return store.DB.Update(func(tx *bbolt.Tx) error {
+		return remove(tx, []byte(id))
+	})
+}
+
+// Expire implements server.JobStore.
+func (store *Store) Expire(t time.Time) error {
+	return store.DB.Update(func(tx *bbolt.Tx) error {
+		var expired [][]byte
+		err := tx.Bucket(jobsBucket).ForEach(func(id, data []byte) error {
+			var record server.JobRecord
+			if err := json.Unmarshal(data, &record); err != nil {
+				return err
+			}
+			if record.Finished() && record.FinishedAt.Before(t) {
+				expired = append(expired, append([]byte(nil), id...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range expired {
+			if err := remove(tx, id); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,187 @@
+// Package postgres is a server.JobStore in PostgreSQL, for servers that
+// already keep their state there.
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Schema creates the tables Store uses. Migrate runs it.
+const Schema = `
+CREATE TABLE IF NOT EXISTS captionbot_jobs (
+	id          text PRIMARY KEY,
+	created_at  timestamptz NOT NULL,
+	finished_at timestamptz,
+	record      jsonb NOT NULL
+);
+CREATE INDEX IF NOT EXISTS captionbot_jobs_unfinished
+	ON captionbot_jobs (created_at) WHERE finished_at IS NULL;
+CREATE TABLE IF NOT EXISTS captionbot_job_items (
+	job_id   text NOT NULL REFERENCES captionbot_jobs (id) ON DELETE CASCADE,
+	position integer NOT NULL,
+	item     jsonb NOT NULL,
+	PRIMARY KEY (job_id, position)
+);
+`
+
+// Store keeps jobs in the captionbot_jobs and captionbot_job_items
+// tables.
+type Store struct {
+	DB *sql.DB
+}
+
+var _ server.JobStore = (*Store)(nil)
+
+// Open connects to the database at a postgres:// URL and creates the
+// tables if needed.
+func Open(dsn string) (*Store, error) {
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	store := New(db)
+	if err := store.Migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// New returns a Store using db. Call Migrate if the tables may not
+// exist yet.
+func New(db *sql.DB) *Store {
+	return &Store{DB: db}
+}
+
+// Migrate creates the tables if they don't exist.
+func (store *Store) Migrate() error {
+	_, err := store.DB.Exec(Schema)
+	return err
+}
+
+// Close closes the database.
+func (store *Store) Close() error {
+	return store.DB.Close()
+}
+
+// Save implements server.JobStore.
+func (store *Store) Save(record *server.JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var finishedAt sql.NullTime
+	if record.Finished() {
+		finishedAt = sql.NullTime{Time: record.FinishedAt, Valid: true}
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO captionbot_jobs (id, created_at, finished_at, record)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE
+		SET finished_at = EXCLUDED.finished_at, record = EXCLUDED.record`,
+		record.ID, record.CreatedAt, finishedAt, data)
+	return err
+}
+
+// AddItem implements server.JobStore.
+func (store *Store) AddItem(id string, item server.JobItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = store.DB.Exec(`
+		INSERT INTO captionbot_job_items (job_id, position, item)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (job_id, position) DO UPDATE SET item = EXCLUDED.item`,
+		id, item.Index, data)
+	return err
+}
+
+// Load implements server.JobStore.
+func (store *Store) Load(id string) (*server.JobRecord, error) {
+	var data []byte
+	err := store.DB.QueryRow(`SELECT record FROM captionbot_jobs WHERE id = $1`, id).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, server.ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record server.JobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	rows, err := store.DB.Query(`
+		SELECT item FROM captionbot_job_items
+		WHERE job_id = $1 ORDER BY position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item server.JobItem
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &item); err != nil {
+			return nil, err
+		}
+		record.Items = append(record.Items, item)
+	}
+	return &record, rows.Err()
+}
+
+// Unfinished implements server.JobStore.
+func (store *Store) Unfinished() ([]*server.JobRecord, error) {
+	rows, err := store.DB.Query(`
+		SELECT id FROM captionbot_jobs
+		WHERE finished_at IS NULL ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var records []*server.JobRecord
+	for _, id := range ids {
+		record, err := store.Load(id)
+		if err == server.ErrJobNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Delete implements server.JobStore.
+func (store *Store) Delete(id string) error {
+	_, err := store.DB.Exec(`DELETE FROM captionbot_jobs WHERE id = $1`, id)
+	return err
+}
+
+// Expire implements server.JobStore.
+func (store *Store) Expire(t time.Time) error {
+	_, err := store.DB.Exec(`DELETE FROM captionbot_jobs WHERE finished_at < $1`, t)
+	return err
+}
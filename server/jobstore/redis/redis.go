@@ -0,0 +1,155 @@
+// Package redis is a server.JobStore in Redis, for servers that already
+// run Redis or that share jobs between replicas.
+//
+// A job's record is a JSON string at PREFIXjob:ID and its items a list of
+// JSON strings at PREFIXjob:ID:items. Unfinished jobs are members of the
+// sorted set PREFIXjobs:unfinished, scored by creation time. Finished jobs
+// are given a TTL of Retention rather than being expired by Expire.
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Store keeps jobs in Redis.
+type Store struct {
+	Client    *goredis.Client
+	Prefix    string
+	Retention time.Duration
+}
+
+var _ server.JobStore = (*Store)(nil)
+
+// Open creates a Store for a redis:// or rediss:// URL, with keys under
+// "captionbot:".
+func Open(url string) (*Store, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{
+		Client:    goredis.NewClient(opts),
+		Prefix:    "captionbot:",
+		Retention: server.DefaultJobRetention,
+	}, nil
+}
+
+func (store *Store) jobKey(id string) string {
+	return store.Prefix + "job:" + id
+}
+
+func (store *Store) itemsKey(id string) string {
+	return store.Prefix + "job:" + id + ":items"
+}
+
+func (store *Store) unfinishedKey() string {
+	return store.Prefix + "jobs:unfinished"
+}
+
+// Save implements server.JobStore.
+func (store *Store) Save(record *server.JobRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	_, err = store.Client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Set(ctx, store.jobKey(record.ID), data, 0)
+		if !record.Finished() {
+			pipe.ZAdd(ctx, store.unfinishedKey(), goredis.Z{
+				Score:  float64(record.CreatedAt.UnixNano()),
+				Member: record.ID,
+			})
+			return nil
+		}
+		pipe.ZRem(ctx, store.unfinishedKey(), record.ID)
+		if store.Retention > 0 {
+			pipe.Expire(ctx, store.jobKey(record.ID), store.Retention)
+			pipe.Expire(ctx, store.itemsKey(record.ID), store.Retention)
+		}
+		return nil
+	})
+	return err
+}
+
+// AddItem implements server.JobStore.
+func (store *Store) AddItem(id string, item server.JobItem) error {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	return store.Client.RPush(context.Background(), store.itemsKey(id), data).Err()
+}
+
+// Load implements server.JobStore.
+func (store *Store) Load(id string) (*server.JobRecord, error) {
+	ctx := context.Background()
+	data, err := store.Client.Get(ctx, store.jobKey(id)).Bytes()
+	if errors.Is(err, goredis.Nil) {
+		return nil, server.ErrJobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var record server.JobRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, err
+	}
+
+	items, err := store.Client.LRange(ctx, store.itemsKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, data := range items {
+		var item server.JobItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, err
+		}
+		record.Items = append(record.Items, item)
+	}
+	return &record, nil
+}
+
+// Unfinished implements server.JobStore.
+func (store *Store) Unfinished() ([]*server.JobRecord, error) {
+	ids, err := store.Client.ZRange(context.Background(), store.unfinishedKey(), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var records []*server.JobRecord
+	for _, id := range ids {
+		record, err := store.Load(id)
+		if err == server.ErrJobNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// Delete implements server.JobStore.
+func (store *Store) Delete(id string) error {
+	ctx := context.Background()
+	_, err := store.Client.TxPipelined(ctx, func(pipe goredis.Pipeliner) error {
+		pipe.Del(ctx, store.jobKey(id), store.itemsKey(id))
+		pipe.ZRem(ctx, store.unfinishedKey(), id)
+		return nil
+	})
+	return err
+}
+
+// Expire implements server.JobStore. Finished jobs expire by their TTL,
+// so it does nothing.
+func (store *Store) Expire(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUnknownKey is returned by KeyStore.Lookup for a key it doesn't hold.
+var ErrUnknownKey = errors.New("unknown API key")
+
+// publicPaths are served without an API key, so probes, scrapers and API
+// tooling work unauthenticated.
+var publicPaths = map[string]bool{
+	"/healthz":      true,
+	"/readyz":       true,
+	"/metrics":      true,
+	"/openapi.json": true,
+}
+
+// keyFileCheckInterval is how often a KeyFile looks for changes.
+const keyFileCheckInterval = 5 * time.Second
+
+// Usage counts a client's use of the server: its authenticated requests,
+// and the images captioned for it. A job's images count when the job is
+// submitted.
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Captions int64 `json:"captions"`
+}
+
+// ClientUsage is the answer to GET /v1/usage.
+type ClientUsage struct {
+	Client string `json:"client"`
+	Usage
+}
+
+// KeyStore holds the API keys clients authenticate with, each naming a
+// client, and accounts for each client's usage. Implementations must be
+// safe for concurrent use. The server/keystore/redis package holds one in
+// Redis.
+type KeyStore interface {
+	// Lookup returns the client holding key, or ErrUnknownKey.
+	Lookup(key string) (string, error)
+	// AddUsage adds usage to a client's total.
+	AddUsage(client string, usage Usage) error
+	// Usage returns a client's total usage.
+	Usage(client string) (Usage, error)
+}
+
+// usageCounter counts usage in memory for the KeyStores that only hold
+// keys.
+type usageCounter struct {
+	mu    sync.Mutex
+	usage map[string]Usage
+}
+
+func (counter *usageCounter) AddUsage(client string, usage Usage) error {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	if counter.usage == nil {
+		counter.usage = map[string]Usage{}
+	}
+	total := counter.usage[client]
+	total.Requests += usage.Requests
+	total.Captions += usage.Captions
+	counter.usage[client] = total
+	return nil
+}
+
+func (counter *usageCounter) Usage(client string) (Usage, error) {
+	counter.mu.Lock()
+	defer counter.mu.Unlock()
+	return counter.usage[client], nil
+}
+
+// StaticKeys is a KeyStore of a fixed map from key to client, counting
+// usage in memory.
+type StaticKeys struct {
+	usageCounter
+	keys map[string]string
+}
+
+var _ KeyStore = (*StaticKeys)(nil)
+
+// NewStaticKeys creates a StaticKeys holding keys, which maps each key to
+// its client.
+func NewStaticKeys(keys map[string]string) *StaticKeys {
+	return &StaticKeys{keys: keys}
+}
+
+// ParseStaticKeys parses a comma-separated list of CLIENT=KEY pairs, as
+// in $CAPTIONBOT_API_KEYS.
+func ParseStaticKeys(list string) (*StaticKeys, error) {
+	keys := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		client, key, ok := strings.Cut(pair, "=")
+		if !ok || client == "" || key == "" {
+			return nil, fmt.Errorf("API keys must be CLIENT=KEY pairs")
+		}
+		keys[key] = client
+	}
+	return NewStaticKeys(keys), nil
+}
+
+// Lookup implements KeyStore.
+func (keys *StaticKeys) Lookup(key string) (string, error) {
+	if client, ok := keys.keys[key]; ok {
+		return client, nil
+	}
+	return "", ErrUnknownKey
+}
+
+// KeyFile is a KeyStore reading keys from a file, counting usage in
+// memory. Each line of the file holds a client name and its key separated
+// by whitespace; blank lines and lines starting with # are skipped. The
+// file is read again when it changes, so keys can be added and revoked
+// without a restart.
+type KeyFile struct {
+	usageCounter
+	path string
+
+	mu      sync.Mutex
+	keys    map[string]string
+	modTime time.Time
+	checked time.Time
+}
+
+var _ KeyStore = (*KeyFile)(nil)
+
+// OpenKeyFile reads the keys in the file at path.
+func OpenKeyFile(path string) (*KeyFile, error) {
+	file := &KeyFile{path: path}
+	if err := file.load(); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// load reads the file if it changed since it was last read.
+func (file *KeyFile) load() error {
+	info, err := os.Stat(file.path)
+	if err != nil {
+		return err
+	}
+	file.checked = time.Now()
+	if info.ModTime().Equal(file.modTime) && file.keys != nil {
+		return nil
+	}
+
+	f, err := os.Open(file.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	keys := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: want a client name and a key", file.path, n)
+		}
+		keys[fields[1]] = fields[0]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	file.keys = keys
+	file.modTime = info.ModTime()
+	return nil
+}
+
+// Lookup implements KeyStore. A file that has become unreadable or
+// invalid keeps its last keys, so a botched edit doesn't lock every
+// client out.
+func (file *KeyFile) Lookup(key string) (string, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if time.Since(file.checked) > keyFileCheckInterval {
+		file.load()
+	}
+	if client, ok := file.keys[key]; ok {
+		return client, nil
+	}
+	return "", ErrUnknownKey
+}
+
+// clientKey is the context key of the authenticated client's name.
+type clientKey struct{}
+
+// ClientName returns the name of the client that authenticated the
+// request ctx belongs to, the subject of its token if it sent one, or ""
+// if the server doesn't authenticate requests.
+func ClientName(ctx context.Context) string {
+	client, _ := ctx.Value(clientKey{}).(string)
+	return client
+}
+
+// WithClientName returns a copy of ctx naming client as its client, for
+// other transports authenticating calls to share the server's Tenants.
+func WithClientName(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientKey{}, client)
+}
+
+// withClient returns r with client as the name of its client.
+func withClient(r *http.Request, client string) *http.Request {
+	return r.WithContext(WithClientName(r.Context(), client))
+}
+
+// bearer returns the bearer credential of r, an API key or a JWT.
+func bearer(r *http.Request) string {
+	scheme, credential, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(credential)
+	}
+	return ""
+}
+
+// authenticate checks the credential of r: an API key sent as a bearer
+// token or an X-API-Key header, or a bearer JWT when the server has a
+// TokenVerifier. It answers 401 if the credential is missing or invalid,
+// and returns r with the client's name in its context.
+func (server *Server) authenticate(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	key := r.Header.Get("X-API-Key")
+	if key == "" {
+		key = bearer(r)
+		if key != "" && server.Tokens != nil && (server.Keys == nil || isJWT(key)) {
+			return server.authenticateToken(w, r, key)
+		}
+	}
+	if key == "" {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="captionbot"`)
+		writeError(w, http.StatusUnauthorized, "an API key or token is required")
+		return nil, false
+	}
+	if server.Keys == nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="captionbot", error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "the server takes tokens, not API keys")
+		return nil, false
+	}
+	client, err := server.Keys.Lookup(key)
+	if err == ErrUnknownKey {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="captionbot", error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "unknown API key")
+		return nil, false
+	}
+	if err != nil {
+		server.logf("server: checking API key: %s", err)
+		writeError(w, http.StatusInternalServerError, "checking the API key failed")
+		return nil, false
+	}
+	server.addUsage(client, Usage{Requests: 1})
+	return withClient(r, client), true
+}
+
+// addUsage accounts for usage by client, logging failures rather than
+// failing the request.
+func (server *Server) addUsage(client string, usage Usage) {
+	if err := server.Keys.AddUsage(client, usage); err != nil {
+		server.logf("server: accounting usage of %s: %s", client, err)
+	}
+}
+
+// addCaptions accounts for n images captioned for the client of ctx.
+func (server *Server) addCaptions(ctx context.Context, n int) {
+	if client := ClientName(ctx); client != "" && server.Keys != nil {
+		server.addUsage(client, Usage{Captions: int64(n)})
+	}
+}
+
+// handleUsage answers GET /v1/usage with the calling client's usage.
+func (server *Server) handleUsage(w http.ResponseWriter, r *http.Request) {
+	client := ClientName(r.Context())
+	if server.Keys == nil || client == "" {
+		writeError(w, http.StatusNotFound, "the server has no API keys")
+		return
+	}
+	usage, err := server.Keys.Usage(client)
+	if err != nil {
+		server.logf("server: usage of %s: %s", client, err)
+		writeError(w, http.StatusInternalServerError, "reading usage failed")
+		return
+	}
+	writeJSON(w, http.StatusOK, ClientUsage{Client: client, Usage: usage})
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	server := New(&captionbottest.FakeCaptioner{})
+	server.Keys = NewStaticKeys(map[string]string{"alice-key": "alice"})
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"X-API-Key", "X-API-Key", "alice-key", http.StatusOK},
+		{"bearer", "Authorization", "Bearer alice-key", http.StatusOK},
+		{"lowercase bearer", "Authorization", "bearer alice-key", http.StatusOK},
+		{"unknown key", "X-API-Key", "mallory-key", http.StatusUnauthorized},
+		{"unknown bearer", "Authorization", "Bearer mallory-key", http.StatusUnauthorized},
+		{"basic", "Authorization", "Basic YWxpY2U6a2V5", http.StatusUnauthorized},
+		{"missing", "", "", http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/v1/usage", nil)
+		if test.header != "" {
+			req.Header.Set(test.header, test.value)
+		}
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.name, rec.Code, test.status)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: 401 without WWW-Authenticate", test.name)
+		}
+	}
+}
+
+func TestParseStaticKeys(t *testing.T) {
+	keys, err := ParseStaticKeys(" alice=a1, bob=b2,")
+	if err != nil {
+		t.Fatalf("ParseStaticKeys: %v", err)
+	}
+	for key, want := range map[string]string{"a1": "alice", "b2": "bob"} {
+		if client, err := keys.Lookup(key); err != nil || client != want {
+			t.Errorf("Lookup(%q) = %q, %v, want %q", key, client, err, want)
+		}
+	}
+	for _, list := range []string{"alice", "=a1", "alice="} {
+		if _, err := ParseStaticKeys(list); err == nil {
+			t.Errorf("ParseStaticKeys(%q) succeeded", list)
+		}
+	}
+}
+
+func TestKeyFileRevokes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys")
+	write := func(content string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("# clients\nalice a1\n\nbob b2\n", start)
+	file, err := OpenKeyFile(path)
+	if err != nil {
+		t.Fatalf("OpenKeyFile: %v", err)
+	}
+	if client, err := file.Lookup("b2"); err != nil || client != "bob" {
+		t.Fatalf("Lookup = %q, %v, want bob", client, err)
+	}
+
+	// Revoking bob takes effect once the file is checked again.
+	write("alice a1\n", start.Add(time.Minute))
+	file.checked = time.Now().Add(-2 * keyFileCheckInterval)
+	if _, err := file.Lookup("b2"); err != ErrUnknownKey {
+		t.Errorf("revoked key: err = %v, want ErrUnknownKey", err)
+	}
+
+	// A broken edit keeps the last keys.
+	write("alice\n", start.Add(2*time.Minute))
+	file.checked = time.Now().Add(-2 * keyFileCheckInterval)
+	if client, err := file.Lookup("a1"); err != nil || client != "alice" {
+		t.Errorf("after a broken edit: Lookup = %q, %v, want alice", client, err)
+	}
+}
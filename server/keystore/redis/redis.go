@@ -0,0 +1,75 @@
+// Package redis is a server.KeyStore in Redis, so that replicas share
+// keys and usage, and keys can be issued and revoked while serving.
+//
+// The keys are fields of the hash PREFIXapikeys, each holding its client's
+// name:
+//
+//	HSET captionbot:apikeys KEY CLIENT
+//
+// and each client's usage is counted in the hash PREFIXusage:CLIENT.
+package redis
+
+import (
+	"context"
+	"errors"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// Store reads keys and counts usage in Redis.
+type Store struct {
+	Client *goredis.Client
+	Prefix string
+}
+
+var _ server.KeyStore = (*Store)(nil)
+
+// Open creates a Store for a redis:// or rediss:// URL, with keys under
+// "captionbot:".
+func Open(url string) (*Store, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Client: goredis.NewClient(opts), Prefix: "captionbot:"}, nil
+}
+
+func (store *Store) usageKey(client string) string {
+	return store.Prefix + "usage:" + client
+}
+
+// Lookup implements server.KeyStore.
+func (store *Store) Lookup(key string) (string, error) {
+	client, err := store.Client.HGet(context.Background(), store.Prefix+"apikeys", key).Result()
+	if errors.Is(err, goredis.Nil) {
+		return "", server.ErrUnknownKey
+	}
+	return client, err
+}
+
+// AddUsage implements server.KeyStore.
+func (store *Store) AddUsage(client string, usage server.Usage) error {
+	ctx := context.Background()
+	_, err := store.Client.Pipelined(ctx, func(pipe goredis.Pipeliner) error {
+		if usage.Requests != 0 {
+			pipe.HIncrBy(ctx, store.usageKey(client), "requests", usage.Requests)
+		}
+		if usage.Captions != 0 {
+			pipe.HIncrBy(ctx, store.usageKey(client), "captions", usage.Captions)
+		}
+		return nil
+	})
+	return err
+}
+
+// Usage implements server.KeyStore.
+func (store *Store) Usage(client string) (server.Usage, error) {
+	var counts struct {
+		Requests int64 `redis:"requests"`
+		Captions int64 `redis:"captions"`
+	}
+	err := store.Client.HMGet(context.Background(), store.usageKey(client), "requests", "captions").Scan(&counts)
+	return server.Usage{Requests: counts.Requests, Captions: counts.Captions}, err
+}
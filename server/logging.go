@@ -0,0 +1,77 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+)
+
+// LogLevel filters what the server logs. It can be changed while the
+// server runs, with SetLogLevel or PUT /admin/log-level.
+type LogLevel int32
+
+const (
+	// LogError logs failures only.
+	LogError LogLevel = iota
+	// LogInfo also logs events such as resumed and drained jobs. It is
+	// the default.
+	LogInfo
+	// LogDebug also logs every request.
+	LogDebug
+)
+
+var logLevelNames = map[LogLevel]string{
+	LogError: "error",
+	LogInfo:  "info",
+	LogDebug: "debug",
+}
+
+// ParseLogLevel parses "error", "info" or "debug".
+func ParseLogLevel(s string) (LogLevel, error) {
+	for level, name := range logLevelNames {
+		if s == name {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", s)
+}
+
+func (level LogLevel) String() string {
+	if name, ok := logLevelNames[level]; ok {
+		return name
+	}
+	return fmt.Sprintf("LogLevel(%d)", int32(level))
+}
+
+// LogLevel returns the server's log level.
+func (server *Server) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt32(&server.logLevel))
+}
+
+// SetLogLevel sets the server's log level.
+func (server *Server) SetLogLevel(level LogLevel) {
+	atomic.StoreInt32(&server.logLevel, int32(level))
+}
+
+// logf logs a failure, at every level.
+func (server *Server) logf(format string, args ...interface{}) {
+	if server.Logger != nil {
+		server.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// infof logs an event at LogInfo and above.
+func (server *Server) infof(format string, args ...interface{}) {
+	if server.LogLevel() >= LogInfo {
+		server.logf(format, args...)
+	}
+}
+
+// debugf logs at LogDebug.
+func (server *Server) debugf(format string, args ...interface{}) {
+	if server.LogLevel() >= LogDebug {
+		server.logf(format, args...)
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds a server's Prometheus metrics: requests and their
+// latency by route, captions and their latency by provider, cache hits
+// and misses, and the job queue's depth. Server.ServeMetrics serves them at /metrics.
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	captions        *prometheus.CounterVec
+	captionDuration *prometheus.HistogramVec
+	cache           *prometheus.CounterVec
+
+	// handlers caches the instrumented handler of each route.
+	handlers sync.Map
+}
+
+// NewMetrics creates Metrics in a new registry, along with the Go
+// runtime and process metrics.
+func NewMetrics() *Metrics {
+	metrics := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "captionbot_http_requests_total",
+			Help: "HTTP requests by route, method and status code.",
+		}, []string{"handler", "method", "code"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "captionbot_http_request_duration_seconds",
+			Help:    "HTTP request latency by route.",
+			Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+		}, []string{"handler"}),
+		captions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "captionbot_captions_total",
+			Help: "Captions by provider and result, ok or error.",
+		}, []string{"provider", "result"}),
+		captionDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "captionbot_caption_duration_seconds",
+			Help:    "Caption latency by provider.",
+			Buckets: prometheus.ExponentialBuckets(0.25, 2, 8),
+		}, []string{"provider"}),
+		cache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "captionbot_cache_requests_total",
+			Help: "Caption cache lookups by result, hit or miss.",
+		}, []string{"result"}),
+	}
+	metrics.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.requests,
+		metrics.requestDuration,
+		metrics.captions,
+		metrics.captionDuration,
+		metrics.cache,
+	)
+	return metrics
+}
+
+// handler returns next instrumented as the route pattern.
+func (metrics *Metrics) handler(pattern string, next http.Handler) http.Handler {
+	if pattern == "" {
+		pattern = "other"
+	}
+	if h, ok := metrics.handlers.Load(pattern); ok {
+		return h.(http.Handler)
+	}
+	labels := prometheus.Labels{"handler": pattern}
+	h := promhttp.InstrumentHandlerCounter(metrics.requests.MustCurryWith(labels),
+		promhttp.InstrumentHandlerDuration(metrics.requestDuration.MustCurryWith(labels), next))
+	stored, _ := metrics.handlers.LoadOrStore(pattern, http.Handler(h))
+	return stored.(http.Handler)
+}
+
+// observe records one caption by provider.
+func (metrics *Metrics) observe(provider string, start time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	metrics.captions.WithLabelValues(provider, result).Inc()
+	metrics.captionDuration.WithLabelValues(provider).Observe(time.Since(start).Seconds())
+}
+
+// observeCache records a cache lookup.
+func (metrics *Metrics) observeCache(hit bool) {
+	if hit {
+		metrics.cache.WithLabelValues("hit").Inc()
+	} else {
+		metrics.cache.WithLabelValues("miss").Inc()
+	}
+}
+
+// Instrument returns captioner counting and timing its captions under the
+// provider name. The result is a Checker if captioner is.
+func (metrics *Metrics) Instrument(captioner Captioner, provider string) Captioner {
+	instrumented := &instrumentedCaptioner{Captioner: captioner, metrics: metrics, provider: provider}
+	if checker, ok := captioner.(Checker); ok {
+		return &instrumentedChecker{instrumented, checker}
+	}
+	return instrumented
+}
+
+type instrumentedCaptioner struct {
+	Captioner
+	metrics  *Metrics
+	provider string
+}
+
+func (captioner *instrumentedCaptioner) CaptionURL(url string) (string, error) {
+	start := time.Now()
+	caption, err := captioner.Captioner.CaptionURL(url)
+	captioner.metrics.observe(captioner.provider, start, err)
+	return caption, err
+}
+
+func (captioner *instrumentedCaptioner) CaptionReader(r io.Reader, name string) (string, error) {
+	start := time.Now()
+	caption, err := captioner.Captioner.CaptionReader(r, name)
+	captioner.metrics.observe(captioner.provider, start, err)
+	return caption, err
+}
+
+func (captioner *instrumentedCaptioner) Rate(caption string, rating int) error {
+	return rate(captioner.Captioner, caption, rating)
+}
+
+func (captioner *instrumentedCaptioner) Localized(locale string) Captioner {
+	return captioner.metrics.Instrument(localize(captioner.Captioner, locale), captioner.provider)
+}
+
+type instrumentedChecker struct {
+	*instrumentedCaptioner
+	Checker
+}
+
+// ServeMetrics serves metrics at /metrics and starts recording the
+// server's requests and job queue in them. Wrap the Captioner with
+// metrics.Instrument to record captions too.
+func (server *Server) ServeMetrics(metrics *Metrics) {
+	metrics.Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "captionbot_jobs_queued",
+		Help: "Jobs waiting for a job worker.",
+	}, func() float64 {
+		return float64(server.queuedJobs())
+	}))
+	server.mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	server.metrics = metrics
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxWaiting is the default number of caption requests that
+	// may wait for a slot.
+	DefaultMaxWaiting = 64
+	// DefaultMaxQueueWait is how long a caption request waits for a slot
+	// by default.
+	DefaultMaxQueueWait = 30 * time.Second
+)
+
+// BusyError is returned when a caption request is shed because the
+// queue is full or it waited too long.
+type BusyError struct {
+	// Queued is the number of requests waiting.
+	Queued int
+	// RetryAfter estimates when the queue will have room.
+	RetryAfter time.Duration
+	// Waited is how long the request queued before giving up, zero if
+	// the queue was full.
+	Waited time.Duration
+}
+
+func (err *BusyError) Error() string {
+	if err.Waited > 0 {
+		return fmt.Sprintf("server busy: gave up after %s in the queue", err.Waited.Round(time.Millisecond))
+	}
+	return fmt.Sprintf("server busy: %d requests queued", err.Queued)
+}
+
+// waiter is a request waiting in the queue. ready is closed when it is
+// handed a slot.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// queue admits at most a number of captions at once, queueing the rest
+// in order up to a bounded depth.
+type queue struct {
+	mu      sync.Mutex
+	running int
+	waiting list.List
+	// average is a moving average of how long captions take, for
+	// estimating waits.
+	average time.Duration
+}
+
+// estimate guesses how long until queued requests are admitted, with
+// the lock held.
+func (q *queue) estimate(queued, slots int) time.Duration {
+	average := q.average
+	if average == 0 {
+		average = time.Second
+	}
+	return time.Duration(queued/slots+1) * average
+}
+
+// admit waits for a slot to caption in, shedding the request with a
+// BusyError if MaxWaiting requests are already queued or it waits longer
+// than MaxQueueWait. It returns the request's place in the queue, zero if
+// it didn't wait, and a function that frees the slot.
+func (server *Server) admit(ctx context.Context) (func(), int, error) {
+	slots := server.MaxConcurrent
+	if slots <= 0 {
+		return func() {}, 0, nil
+	}
+	q := &server.queue
+	start := time.Now()
+	release := func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if took := time.Since(start); q.average == 0 {
+			q.average = took
+		} else {
+			q.average = (q.average*7 + took) / 8
+		}
+		if front := q.waiting.Front(); front != nil {
+			w := q.waiting.Remove(front).(*waiter)
+			w.granted = true
+			close(w.ready)
+			return
+		}
+		q.running--
+	}
+
+	q.mu.Lock()
+	if q.running < slots {
+		q.running++
+		q.mu.Unlock()
+		return release, 0, nil
+	}
+	if queued := q.waiting.Len(); queued >= server.MaxWaiting {
+		err := &BusyError{Queued: queued, RetryAfter: q.estimate(queued, slots)}
+		q.mu.Unlock()
+		return nil, 0, err
+	}
+	w := &waiter{ready: make(chan struct{})}
+	elem := q.waiting.PushBack(w)
+	position := q.waiting.Len()
+	q.mu.Unlock()
+
+	timeout := server.MaxQueueWait
+	if timeout <= 0 {
+		timeout = DefaultMaxQueueWait
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		start = time.Now()
+		return release, position, nil
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+
+	q.mu.Lock()
+	if w.granted {
+		// The slot arrived as the wait ended; pass it on.
+		q.mu.Unlock()
+		release()
+		return nil, 0, ctx.Err()
+	}
+	q.waiting.Remove(elem)
+	err := &BusyError{
+		Queued:     q.waiting.Len(),
+		RetryAfter: q.estimate(q.waiting.Len(), slots),
+		Waited:     time.Since(start),
+	}
+	q.mu.Unlock()
+	if ctx.Err() != nil {
+		return nil, 0, ctx.Err()
+	}
+	return nil, 0, err
+}
+
+// admitRequest admits a caption request with admit, answering 503 with
+// Retry-After and X-Queue-Depth if it is shed. An admitted request that
+// waited is told its place in X-Queue-Position.
+func (server *Server) admitRequest(w http.ResponseWriter, r *http.Request) (func(), bool) {
+	release, position, err := server.admit(r.Context())
+	if busy, ok := err.(*BusyError); ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(busy.RetryAfter.Seconds()))))
+		w.Header().Set("X-Queue-Depth", strconv.Itoa(busy.Queued))
+		writeError(w, http.StatusServiceUnavailable, "%s", err)
+		return nil, false
+	}
+	if err != nil {
+		// The client went away while queued.
+		return nil, false
+	}
+	if position > 0 {
+		w.Header().Set("X-Queue-Position", strconv.Itoa(position))
+	}
+	return release, true
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often idle, full buckets are dropped.
+const sweepInterval = time.Minute
+
+// RateLimit is a token bucket limit: Burst requests at once, refilled at
+// Rate requests a second. The zero RateLimit is no limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// ParseRateLimit parses a limit of N requests per second, minute or hour
+// written as "N/s", "N/m" or "N/h". Up to N requests may be made at once.
+func ParseRateLimit(s string) (RateLimit, error) {
+	count, unit, ok := strings.Cut(s, "/")
+	n, err := strconv.Atoi(count)
+	periods := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+	if !ok || err != nil || n < 1 || periods[unit] == 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q is not N/s, N/m or N/h", s)
+	}
+	return RateLimit{Rate: float64(n) / periods[unit].Seconds(), Burst: n}, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// buckets holds a token bucket for each client or address.
+type buckets struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// LimitState is the result of taking a token: whether there was one,
+// how many are left, and how long until the next one and until the bucket
+// is full again.
+type LimitState struct {
+	OK        bool
+	Remaining int
+	Retry     time.Duration
+	Reset     time.Duration
+}
+
+// Limiter takes tokens from rate limit buckets kept outside the server,
+// so that its replicas share their limits. Implementations must be safe
+// for concurrent use. The server/ratelimit/redis package holds one in
+// Redis.
+type Limiter interface {
+	// Take takes a token from key's bucket under limit.
+	Take(limit RateLimit, key string) (LimitState, error)
+}
+
+// NewLimitState computes the LimitState of a bucket left with tokens
+// under limit, for Limiters.
+func NewLimitState(limit RateLimit, tokens float64, ok bool) LimitState {
+	state := LimitState{OK: ok, Remaining: int(tokens)}
+	if !ok {
+		state.Retry = time.Duration((1 - tokens) / limit.Rate * float64(time.Second))
+	}
+	state.Reset = time.Duration((float64(limit.Burst) - tokens) / limit.Rate * float64(time.Second))
+	return state
+}
+
+// take takes a token from key's bucket under limit.
+func (b *buckets) take(limit RateLimit, key string, now time.Time) LimitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.buckets == nil {
+		b.buckets = map[string]*bucket{}
+	}
+	if now.Sub(b.swept) > sweepInterval {
+		for k, bk := range b.buckets {
+			if bk.tokens+now.Sub(bk.last).Seconds()*limit.Rate >= float64(limit.Burst) {
+				delete(b.buckets, k)
+			}
+		}
+		b.swept = now
+	}
+
+	bk := b.buckets[key]
+	if bk == nil {
+		bk = &bucket{tokens: float64(limit.Burst), last: now}
+		b.buckets[key] = bk
+	}
+	bk.tokens = math.Min(float64(limit.Burst), bk.tokens+now.Sub(bk.last).Seconds()*limit.Rate)
+	bk.last = now
+
+	ok := bk.tokens >= 1
+	if ok {
+		bk.tokens--
+	}
+	return NewLimitState(limit, bk.tokens, ok)
+}
+
+// clientIP returns the address r came from: its peer's, or the one the
+// proxy in front of the server added to X-Forwarded-For if TrustProxy is
+// set.
+func (server *Server) clientIP(r *http.Request) string {
+	if server.TrustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			hops := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(hops[len(hops)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit takes a token for key from b under limit, or from the
+// server's Limiter under "scope:key", setting the RateLimit headers, and
+// answers 429 if there was none. The tightest of several limits is
+// reported. If the Limiter fails, the request is let through.
+func (server *Server) rateLimit(w http.ResponseWriter, b *buckets, scope string, limit RateLimit, key string) bool {
+	if limit.Rate <= 0 || limit.Burst < 1 {
+		return true
+	}
+	var state LimitState
+	if server.Limiter != nil {
+		var err error
+		if state, err = server.Limiter.Take(limit, scope+":"+key); err != nil {
+			server.logf("server: rate limiting %s %s: %s", scope, key, err)
+			return true
+		}
+	} else {
+		state = b.take(limit, key, time.Now())
+	}
+	header := w.Header()
+	if remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining")); err != nil || state.Remaining < remaining {
+		header.Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		header.Set("RateLimit-Remaining", strconv.Itoa(state.Remaining))
+		header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(state.Reset.Seconds()))))
+	}
+	if !state.OK {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(state.Retry.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded; retry in %s", state.Retry.Round(time.Second))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+// Package redis is a server.Limiter in Redis, so that the replicas of a
+// server share their rate limits. Each bucket is a hash at
+// PREFIXratelimit:SCOPE:KEY holding its tokens and when it was last
+// taken from, expiring once it would be full again.
+package redis
+
+import (
+	"context"
+	"strconv"
+
+	goredis "github.com/redis/go-redis/v9"
+
+	"github.com/nhatbui/captionbot/server"
+)
+
+// take refills a bucket for the time since it was last taken from, by
+// the Redis server's clock so that replicas agree, and takes a token if
+// there is one. It returns 1 or 0 for whether it took one, and the tokens
+// left as a string, since Lua numbers are truncated to integers.
+var take = goredis.NewScript(`
+local rate, burst = tonumber(ARGV[1]), tonumber(ARGV[2])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1]) or burst
+local last = tonumber(bucket[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - last) * rate)
+local ok = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	ok = 1
+end
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(now))
+redis.call("EXPIRE", KEYS[1], math.ceil((burst - tokens) / rate) + 1)
+return {ok, tostring(tokens)}
+`)
+
+// Limiter keeps rate limit buckets in Redis.
+type Limiter struct {
+	Client *goredis.Client
+	Prefix string
+}
+
+var _ server.Limiter = (*Limiter)(nil)
+
+// Open creates a Limiter for a redis:// or rediss:// URL, with keys under
+// "captionbot:".
+func Open(url string) (*Limiter, error) {
+	opts, err := goredis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	return &Limiter{Client: goredis.NewClient(opts), Prefix: "captionbot:"}, nil
+}
+
+// Take implements server.Limiter.
+func (limiter *Limiter) Take(limit server.RateLimit, key string) (server.LimitState, error) {
+	result, err := take.Run(context.Background(), limiter.Client,
+		[]string{limiter.Prefix + "ratelimit:" + key},
+		strconv.FormatFloat(limit.Rate, 'g', -1, 64), limit.Burst).Slice()
+	if err != nil {
+		return server.LimitState{}, err
+	}
+	ok, _ := result[0].(int64)
+	text, _ := result[1].(string)
+	tokens, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return server.LimitState{}, err
+	}
+	return server.NewLimitState(limit, tokens, ok == 1), nil
+}
@@ -0,0 +1,513 @@
+// Package server exposes a Captioner as a JSON HTTP service, so other
+// services can caption images without embedding captionbot.
+//
+//	POST /v1/captions
+//	{"url": "https://example.com/photo.jpg"}
+//
+// answers with a Caption:
+//
+//	{"url": "https://example.com/photo.jpg", "caption": "...", "duration_ms": 2140}
+//
+// The same endpoint accepts an image upload, either as the "file" field
+// of a multipart/form-data body, as browser forms send, or as a raw body
+// with an image Content-Type and an optional filename query parameter.
+// Uploads are streamed to the Captioner rather than buffered.
+//
+// Clients captioning many images at once can instead open a WebSocket at
+// /v1/stream, send StreamRequests and receive StreamResults as the
+// captions complete.
+//
+// Batches too long to wait for are submitted as jobs to POST /v1/jobs,
+// either as a JSON JobRequest listing URLs or as a zip, tar or tar.gz
+// archive of images. The answer names the job's ID; GET /v1/jobs/ID
+// returns its JobStatus with the results so far, and its progress streams
+// as server-sent events from /v1/jobs/ID/events.
+//
+// GET /healthz answers 200 while the process serves, and GET /readyz 200
+// only while the provider is reachable and the job queue isn't full, for
+// liveness and readiness probes.
+//
+// Shutdown drains the server for a restart: /readyz starts failing, new
+// jobs are refused, running jobs stop after their current image and are
+// resumed from the JobStore on the next start, and WebSocket streams
+// finish their captions and close with 1001 (going away).
+//
+// When the Captioner is a CachedCaptioner, captions are answered with an
+// X-Cache header saying whether they came from the cache, and requests
+// with Cache-Control: no-cache skip it.
+//
+// With CORS set, browser apps on the origins it allows can call the API
+// directly, including the WebSocket.
+//
+// Requests can be rate limited by address and by client. Limited
+// responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers, and are answered 429 with a Retry-After header once a limit is
+// reached.
+//
+// With ServeMetrics, Prometheus metrics are served at /metrics.
+//
+// Replicas behind a load balancer act as one service when they share a
+// JobStore, a Cache, a Limiter and a JobQueue: any replica answers for
+// any job, rate limits count across all of them, and URL jobs run on
+// whichever replica pops them, moving to another if that replica dies.
+//
+// The clients in Admins can manage the server under /admin/: GET
+// /admin/stats reports its Stats and GET /admin/jobs its queued and
+// running jobs, POST /admin/cache/purge empties the cache, and PUT
+// /admin/provider and /admin/log-level switch the Providers and LogLevel.
+//
+// When the server has a KeyStore, requests other than the probes, metrics
+// and OpenAPI document need an API key, sent as a bearer token or an
+// X-API-Key header, and are answered 401 without one. Each client's
+// requests and captions are counted; GET /v1/usage returns the caller's.
+// With a TokenVerifier, bearer JWTs from an OIDC issuer are accepted too,
+// and answered 403 unless they carry the scope of their route. Jobs are
+// visible only to the client that submitted them, and with Tenants each
+// client has its own Captioner, and so its own provider session and cache.
+//
+// POST /v1/captions asks for captions in the language of its
+// Accept-Language header, from Captioners that are Localizers, such as a
+// Session; each language's captions are cached apart.
+//
+// With ServeUI, a web page at / captions images dropped on it or named by
+// URL, and rates the captions with POST /v1/ratings.
+//
+// The API is described by the OpenAPI document served at /openapi.json.
+// The server/client package calls it from Go.
+//
+// Errors are answered with a JSON object with an "error" field: 400 for a
+// malformed request, 413 for an upload over MaxUploadSize, 415 for a body
+// that isn't JSON or a supported image, 502 when the provider fails, and
+// 503 with a Retry-After header when the server is too busy to queue the
+// request.
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/nhatbui/captionbot"
+)
+
+//go:embed openapi.json
+var openAPI []byte
+
+// maxRequestBody limits the size of JSON request bodies.
+const maxRequestBody = 1 << 20
+
+// DefaultMaxUploadSize is the default limit on upload request bodies.
+const DefaultMaxUploadSize = 10 << 20
+
+// imageExtensions maps the image types the server accepts, those
+// captionbot.ai captions, to the file extension they are uploaded with.
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// CaptionRequest is the JSON body of POST /v1/captions.
+type CaptionRequest struct {
+	URL string `json:"url"`
+}
+
+// Caption is the result of captioning one image. URL is set for URL
+// requests and Filename for uploads.
+type Caption struct {
+	URL        string `json:"url,omitempty"`
+	Filename   string `json:"filename,omitempty"`
+	Caption    string `json:"caption"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// Server is an http.Handler serving the caption API.
+type Server struct {
+	Captioner Captioner
+	// Tenants, if set, gives each authenticated client its own
+	// Captioner in place of Captioner.
+	Tenants *Tenants
+	// Providers, if set, switches the Failovers behind Captioner, which
+	// PUT /admin/provider changes.
+	Providers *ProviderSwitch
+	// Admins names the clients that may use the /admin/ endpoints. Clients
+	// authenticating with a bearer JWT are named with TokenClientPrefix,
+	// and also need its AdminScope.
+	Admins []string
+	// Keys, if set, requires requests to carry one of its API keys, and
+	// accounts for each client's usage.
+	Keys KeyStore
+	// Tokens, if set, accepts bearer JWTs, which need the scope Scopes
+	// gives their route.
+	Tokens *TokenVerifier
+	// Scopes maps route patterns to the scope a token needs for them;
+	// DefaultScopes is used if it's nil.
+	Scopes map[string]string
+
+	// CORS, if set, lets browser apps on other origins call the server.
+	CORS *CORS
+
+	// IPRateLimit limits the requests from each address, and
+	// ClientRateLimit those of each authenticated client. Probes, metrics
+	// and the OpenAPI document aren't limited.
+	IPRateLimit     RateLimit
+	ClientRateLimit RateLimit
+	// Limiter, if set, keeps the rate limit buckets, so that replicas
+	// share them; otherwise each server keeps its own.
+	Limiter Limiter
+	// TrustProxy takes client addresses from the X-Forwarded-For header
+	// added by a reverse proxy, rather than from the connection. Only set
+	// it behind a proxy, since clients can send the header themselves.
+	TrustProxy bool
+	// MaxUploadSize limits upload request bodies, in bytes.
+	MaxUploadSize int64
+	// MaxArchiveSize limits job archive uploads, in bytes.
+	MaxArchiveSize int64
+
+	// MaxConcurrent limits the captions requested over HTTP and the
+	// WebSocket that are made at once, matching the provider's capacity;
+	// zero means no limit. Up to MaxWaiting more wait for a slot, in
+	// order, for up to MaxQueueWait; the rest are answered 503.
+	MaxConcurrent int
+	MaxWaiting    int
+	MaxQueueWait  time.Duration
+
+	// JobStore keeps jobs; it is a MemoryJobStore unless set.
+	JobStore JobStore
+	// JobQueue, if set, shares the queue of URL jobs between replicas
+	// with the same JobStore, so that any of them can run a job and
+	// report on it. Archive jobs still run where they were uploaded.
+	JobQueue JobQueue
+	// JobWorkers is the number of jobs run at once.
+	JobWorkers int
+	// MaxQueuedJobs is the number of jobs waiting for a worker at which
+	// new jobs are refused with 503 and GET /readyz reports the server not
+	// ready. Zero means no limit.
+	MaxQueuedJobs int
+	// JobRetention is how long finished jobs stay available.
+	JobRetention time.Duration
+	// ArchiveDir is where job archives are spooled until their job
+	// finishes, the temporary directory if empty. With a persistent
+	// JobStore it should survive restarts too.
+	ArchiveDir string
+	// CallbackSecret signs the POSTs to job callback URLs, as the notify
+	// package signs webhooks. Callbacks are unsigned if it's empty.
+	CallbackSecret string
+
+	Logger *log.Logger
+
+	mux           *http.ServeMux
+	metrics       *Metrics
+	queue         queue
+	ipBuckets     buckets
+	clientBuckets buckets
+	startJobs     sync.Once
+	jobsMu        sync.Mutex
+	jobsReady     *sync.Cond
+	jobs          map[string]*job
+	pending       []*job
+	started       time.Time
+	ui            bool
+	logLevel      int32
+	// replica identifies the server as a JobQueue lease owner.
+	replica string
+	// active counts the running jobs, streams and callbacks Shutdown
+	// waits for.
+	active    sync.WaitGroup
+	draining  chan struct{}
+	drainOnce sync.Once
+	streamsMu sync.Mutex
+	streams   map[*websocket.Conn]struct{}
+}
+
+// New creates a Server backed by captioner.
+func New(captioner Captioner) *Server {
+	server := &Server{
+		Captioner:      captioner,
+		MaxUploadSize:  DefaultMaxUploadSize,
+		MaxArchiveSize: DefaultMaxArchiveSize,
+		JobStore:       NewMemoryJobStore(),
+		JobWorkers:     1,
+		MaxQueuedJobs:  DefaultMaxQueuedJobs,
+		MaxWaiting:     DefaultMaxWaiting,
+		MaxQueueWait:   DefaultMaxQueueWait,
+		JobRetention:   DefaultJobRetention,
+		mux:            http.NewServeMux(),
+		jobs:           map[string]*job{},
+		draining:       make(chan struct{}),
+		streams:        map[*websocket.Conn]struct{}{},
+		started:        time.Now(),
+		replica:        newJobID(),
+		logLevel:       int32(LogInfo),
+	}
+	server.jobsReady = sync.NewCond(&server.jobsMu)
+	server.mux.HandleFunc("/v1/captions", server.handleCaptions)
+	server.mux.HandleFunc("/v1/stream", server.handleStream)
+	server.mux.HandleFunc("/v1/jobs", server.handleJobs)
+	server.mux.HandleFunc("/v1/jobs/", server.handleJob)
+	server.mux.HandleFunc("/openapi.json", server.handleOpenAPI)
+	server.mux.HandleFunc("/v1/usage", server.handleUsage)
+	server.mux.HandleFunc("/v1/ratings", server.handleRatings)
+	server.mux.HandleFunc("/healthz", server.handleHealth)
+	server.mux.HandleFunc("/readyz", server.handleReady)
+	server.mux.HandleFunc("/admin/", server.handleAdmin)
+	return server
+}
+
+// Handle serves another API, such as a GraphQL endpoint, on pattern
+// alongside the server's own.
+func (server *Server) Handle(pattern string, handler http.Handler) {
+	server.mux.Handle(pattern, handler)
+}
+
+// ServeHTTP implements http.Handler.
+func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.debugf("server: %s %s from %s", r.Method, r.URL.Path, server.clientIP(r))
+	if server.metrics == nil {
+		server.serve(w, r)
+		return
+	}
+	_, pattern := server.mux.Handler(r)
+	server.metrics.handler(pattern, http.HandlerFunc(server.serve)).ServeHTTP(w, r)
+}
+
+// serve authenticates and rate limits r, as configured, and routes it.
+func (server *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if server.CORS != nil && server.CORS.handle(w, r) {
+		return
+	}
+	if publicPaths[r.URL.Path] || server.ui && r.URL.Path == "/" {
+		server.mux.ServeHTTP(w, r)
+		return
+	}
+	if !server.rateLimit(w, &server.ipBuckets, "ip", server.IPRateLimit, server.clientIP(r)) {
+		return
+	}
+	if server.Keys != nil || server.Tokens != nil {
+		var ok bool
+		if r, ok = server.authenticate(w, r); !ok {
+			return
+		}
+		if !server.rateLimit(w, &server.clientBuckets, "client", server.ClientRateLimit, ClientName(r.Context())) {
+			return
+		}
+	}
+	server.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, map[string]string{"error": fmt.Sprintf(format, args...)})
+}
+
+func (server *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPI)
+}
+
+func (server *Server) handleCaptions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	release, ok := server.admitRequest(w, r)
+	if !ok {
+		return
+	}
+	defer release()
+
+	w.Header().Add("Vary", "Accept-Language")
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "" || mediaType == "application/json":
+		server.captionURL(w, r)
+	case mediaType == "multipart/form-data":
+		server.captionForm(w, r, params["boundary"])
+	case imageExtensions[mediaType] != "":
+		body := http.MaxBytesReader(w, r.Body, server.MaxUploadSize)
+		name := path.Base(r.URL.Query().Get("filename"))
+		server.captionUpload(w, r, body, uploadName(name, mediaType))
+	default:
+		writeError(w, http.StatusUnsupportedMediaType, "unsupported content type %q", mediaType)
+	}
+}
+
+func (server *Server) captionURL(w http.ResponseWriter, r *http.Request) {
+	var req CaptionRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: %s", err)
+		return
+	}
+	if err := CheckURL(req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+
+	start := time.Now()
+	caption, err := server.captionURLFor(w, r, req.URL)
+	if err != nil {
+		server.logf("server: %s: %s", req.URL, err)
+		writeError(w, http.StatusBadGateway, "captioning failed: %s", err)
+		return
+	}
+	server.addCaptions(r.Context(), 1)
+	writeJSON(w, http.StatusOK, Caption{
+		URL:        req.URL,
+		Caption:    caption,
+		DurationMS: time.Since(start).Milliseconds(),
+	})
+}
+
+// captionForm captions the "file" field of a multipart form, reading the
+// parts as they arrive.
+func (server *Server) captionForm(w http.ResponseWriter, r *http.Request, boundary string) {
+	if boundary == "" {
+		writeError(w, http.StatusBadRequest, "multipart body has no boundary")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, server.MaxUploadSize)
+	form, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "%s", err)
+		return
+	}
+	for {
+		part, err := form.NextPart()
+		if err == io.EOF {
+			writeError(w, http.StatusBadRequest, "form has no file field")
+			return
+		}
+		if err != nil {
+			server.uploadError(w, err)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		name := path.Base(part.FileName())
+		if imageExtensions[mediaType] == "" && imageExtensions[mime.TypeByExtension(path.Ext(name))] == "" {
+			writeError(w, http.StatusUnsupportedMediaType, "file is not a supported image")
+			return
+		}
+		server.captionUpload(w, r, part, uploadName(name, mediaType))
+		return
+	}
+}
+
+// captionUpload captions an uploaded image read from body.
+func (server *Server) captionUpload(w http.ResponseWriter, r *http.Request, body io.Reader, name string) {
+	start := time.Now()
+	caption, err := server.captionReaderFor(w, r, body, name)
+	if err != nil {
+		server.uploadError(w, err)
+		return
+	}
+	server.addCaptions(r.Context(), 1)
+	writeJSON(w, http.StatusOK, Caption{
+		Filename:   name,
+		Caption:    caption,
+		DurationMS: time.Since(start).Milliseconds(),
+	})
+}
+
+// uploadError answers a failed upload, telling oversized bodies apart
+// from provider errors.
+func (server *Server) uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "upload is larger than %d bytes", tooLarge.Limit)
+		return
+	}
+	// The provider's own checks of the image, made before sending it.
+	if errors.Is(err, captionbot.ErrImageTooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "%s", err)
+		return
+	}
+	if errors.Is(err, captionbot.ErrUnsupportedImageType) {
+		writeError(w, http.StatusUnsupportedMediaType, "%s", err)
+		return
+	}
+	server.logf("server: upload: %s", err)
+	writeError(w, http.StatusBadGateway, "captioning failed: %s", err)
+}
+
+// RatingRequest is the body of POST /v1/ratings, rating a caption the
+// client was just given from 1 (poor) to 5 (great).
+type RatingRequest struct {
+	Caption string `json:"caption"`
+	Rating  int    `json:"rating"`
+}
+
+// handleRatings passes a rating of a caption to the provider. Only a
+// caption the client's Captioner made last can be rated, so ratings of
+// older or cached captions are answered 409.
+func (server *Server) handleRatings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	var req RatingRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body: %s", err)
+		return
+	}
+	if req.Rating < 1 || req.Rating > 5 {
+		writeError(w, http.StatusBadRequest, "rating must be between 1 and 5")
+		return
+	}
+	err := rate(server.captioner(ClientName(r.Context())), req.Caption, req.Rating)
+	if err == ErrNotRatable {
+		writeError(w, http.StatusConflict, "the caption can no longer be rated")
+		return
+	}
+	if err != nil {
+		server.logf("server: rating: %s", err)
+		writeError(w, http.StatusBadGateway, "rating failed: %s", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// CheckURL reports whether rawURL is an image URL the server accepts.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	return nil
+}
+
+// uploadName returns the name to upload an image as, giving it the
+// extension of its media type when it has none.
+func uploadName(name, mediaType string) string {
+	if name == "." || name == "/" {
+		name = "upload"
+	}
+	if path.Ext(name) == "" {
+		if ext := imageExtensions[mediaType]; ext != "" {
+			name += ext
+		}
+	}
+	return name
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// isDraining reports whether Shutdown has been called.
+func (server *Server) isDraining() bool {
+	select {
+	case <-server.draining:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown drains the server for a restart: GET /readyz starts failing,
+// new jobs are refused, job workers stop taking queued jobs, running jobs
+// stop after their current image, WebSocket streams stop reading and
+// finish the captions they have started, and event streams end so their
+// clients reconnect elsewhere. Jobs left unfinished stay in the JobStore
+// to be resumed. It returns when all of that is done, or ctx's error if
+// ctx ends first.
+//
+// It doesn't stop the http.Server serving the Server; call that's
+// Shutdown alongside it to finish in-flight requests.
+func (server *Server) Shutdown(ctx context.Context) error {
+	server.drainOnce.Do(func() {
+		close(server.draining)
+		server.jobsMu.Lock()
+		server.jobsReady.Broadcast()
+		server.jobsMu.Unlock()
+
+		server.streamsMu.Lock()
+		for conn := range server.streams {
+			// Reading stops; the stream finishes what it started.
+			conn.SetReadDeadline(time.Now())
+		}
+		server.streamsMu.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		server.active.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// trackStream registers a WebSocket for Shutdown, returning false if the
+// server is already draining.
+func (server *Server) trackStream(conn *websocket.Conn) bool {
+	server.streamsMu.Lock()
+	defer server.streamsMu.Unlock()
+	if server.isDraining() {
+		return false
+	}
+	server.streams[conn] = struct{}{}
+	server.active.Add(1)
+	return true
+}
+
+func (server *Server) untrackStream(conn *websocket.Conn) {
+	server.streamsMu.Lock()
+	delete(server.streams, conn)
+	server.streamsMu.Unlock()
+	server.active.Done()
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// streamInFlight is how many requests one stream client may have
+	// captioning at once; reading waits beyond that.
+	streamInFlight = 8
+	// pingInterval is how often idle stream connections are pinged.
+	pingInterval = 30 * time.Second
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+}
+
+// StreamRequest is a message sent to /v1/stream: an image URL, or an
+// upload with its file name and base64 data. ID is chosen by the client
+// to match the result to the request.
+type StreamRequest struct {
+	ID       string `json:"id"`
+	URL      string `json:"url,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+// StreamResult is a message sent back by /v1/stream for each request,
+// in the order they complete.
+type StreamResult struct {
+	ID string `json:"id"`
+	*Caption
+	Error string `json:"error,omitempty"`
+}
+
+// handleStream serves a WebSocket on which clients send StreamRequests
+// and receive StreamResults as their captions finish, for UIs captioning
+// many images at once.
+func (server *Server) handleStream(w http.ResponseWriter, r *http.Request) {
+	upgrader := upgrader
+	upgrader.CheckOrigin = server.checkOrigin
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has answered the request.
+		return
+	}
+	defer conn.Close()
+	if !server.trackStream(conn) {
+		conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+		return
+	}
+	defer server.untrackStream(conn)
+
+	// Base64 grows uploads by a third.
+	conn.SetReadLimit(server.MaxUploadSize*4/3 + 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	conn.SetPongHandler(func(string) error {
+		if server.isDraining() {
+			return nil
+		}
+		return conn.SetReadDeadline(time.Now().Add(2 * pingInterval))
+	})
+
+	var writeMu sync.Mutex
+	write := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteMessage(messageType, data)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if write(websocket.PingMessage, nil) != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	captioner := server.captioner(ClientName(r.Context()))
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	slots := make(chan struct{}, streamInFlight)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			if server.isDraining() {
+				wg.Wait()
+				write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+			}
+			return
+		}
+		var req StreamRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			result, _ := json.Marshal(StreamResult{Error: "invalid message: " + err.Error()})
+			write(websocket.TextMessage, result)
+			continue
+		}
+
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			release, _, err := server.admit(r.Context())
+			if err != nil {
+				data, _ := json.Marshal(StreamResult{ID: req.ID, Error: err.Error()})
+				write(websocket.TextMessage, data)
+				return
+			}
+			result := server.streamCaption(captioner, req)
+			release()
+			if result.Caption != nil {
+				server.addCaptions(r.Context(), 1)
+			}
+			data, _ := json.Marshal(result)
+			write(websocket.TextMessage, data)
+		}()
+	}
+}
+
+// streamCaption captions the image a StreamRequest names with captioner.
+func (server *Server) streamCaption(captioner Captioner, req StreamRequest) StreamResult {
+	result := StreamResult{ID: req.ID}
+	start := time.Now()
+	var caption Caption
+	var err error
+	switch {
+	case req.URL != "":
+		if err := CheckURL(req.URL); err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		caption.URL = req.URL
+		caption.Caption, err = captioner.CaptionURL(req.URL)
+	case req.Filename != "":
+		name := path.Base(req.Filename)
+		if imageExtensions[mime.TypeByExtension(path.Ext(name))] == "" {
+			result.Error = "filename is not a supported image file name"
+			return result
+		}
+		caption.Filename = name
+		caption.Caption, err = captioner.CaptionReader(bytes.NewReader(req.Data), name)
+	default:
+		result.Error = "request needs a url, or a filename and data"
+		return result
+	}
+	if err != nil {
+		server.logf("server: stream %s: %s", req.ID, err)
+		result.Error = "captioning failed: " + err.Error()
+		return result
+	}
+	caption.DurationMS = time.Since(start).Milliseconds()
+	result.Caption = &caption
+	return result
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// Tenants gives each client of the server its own Captioner, created on
+// first use, so that clients never share a provider session or cached
+// captions. Requests without a client, when the server doesn't
+// authenticate them, use the server's Captioner.
+//
+// Rate limits and usage are already kept per client; with Tenants the
+// rest of a client's state is too.
+type Tenants struct {
+	// New creates the Captioner of a client.
+	New func(client string) (Captioner, error)
+	// MaxClients is how many clients' Captioners are kept,
+	// DefaultMaxTenants if 0. Past it the least recently used is
+	// dropped, and closed if it is an io.Closer; its client gets a new
+	// one on its next request.
+	MaxClients int
+
+	mu      sync.Mutex
+	tenants map[string]*list.Element
+	lru     *list.List
+}
+
+// DefaultMaxTenants is the default MaxClients of Tenants.
+const DefaultMaxTenants = 1000
+
+type tenant struct {
+	client    string
+	once      sync.Once
+	captioner Captioner
+	err       error
+}
+
+// NewTenants creates Tenants whose Captioners are made by newCaptioner.
+func NewTenants(newCaptioner func(client string) (Captioner, error)) *Tenants {
+	return &Tenants{New: newCaptioner}
+}
+
+// Captioner returns client's Captioner, creating it on first use. If
+// creating it fails, the next call tries again.
+func (tenants *Tenants) Captioner(client string) (Captioner, error) {
+	for {
+		t := tenants.get(client)
+		// Creating a Captioner may reach the provider, so it is done
+		// outside the lock, holding up only the client's own requests.
+		t.once.Do(func() {
+			t.captioner, t.err = tenants.New(client)
+		})
+		switch {
+		case t.err == errDropped:
+			// Dropped before it was created; make the client another.
+			continue
+		case t.err != nil:
+			tenants.mu.Lock()
+			tenants.remove(t)
+			tenants.mu.Unlock()
+			return nil, t.err
+		}
+		return t.captioner, nil
+	}
+}
+
+// errDropped is the error of a tenant dropped before its Captioner was
+// created.
+var errDropped = errors.New("server: tenant dropped")
+
+// get returns client's tenant, adding it if it has none and dropping the
+// least recently used past MaxClients.
+func (tenants *Tenants) get(client string) *tenant {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	if tenants.tenants == nil {
+		tenants.tenants = map[string]*list.Element{}
+		tenants.lru = list.New()
+	}
+	if elem := tenants.tenants[client]; elem != nil {
+		tenants.lru.MoveToFront(elem)
+		return elem.Value.(*tenant)
+	}
+	t := &tenant{client: client}
+	tenants.tenants[client] = tenants.lru.PushFront(t)
+	max := tenants.MaxClients
+	if max <= 0 {
+		max = DefaultMaxTenants
+	}
+	for tenants.lru.Len() > max {
+		oldest := tenants.lru.Back().Value.(*tenant)
+		tenants.remove(oldest)
+		go oldest.close()
+	}
+	return t
+}
+
+// remove drops t, if it is still its client's tenant. The caller holds mu.
+func (tenants *Tenants) remove(t *tenant) {
+	if elem := tenants.tenants[t.client]; elem != nil && elem.Value == t {
+		tenants.lru.Remove(elem)
+		delete(tenants.tenants, t.client)
+	}
+}
+
+// close closes the tenant's Captioner if it is an io.Closer, once a
+// request creating it has.
+func (t *tenant) close() {
+	t.once.Do(func() { t.err = errDropped })
+	if closer, ok := t.captioner.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// Close drops every client's Captioner, closing those that are
+// io.Closers.
+func (tenants *Tenants) Close() error {
+	tenants.mu.Lock()
+	var dropped []*tenant
+	for _, elem := range tenants.tenants {
+		dropped = append(dropped, elem.Value.(*tenant))
+	}
+	tenants.tenants, tenants.lru = nil, nil
+	tenants.mu.Unlock()
+	for _, t := range dropped {
+		t.close()
+	}
+	return nil
+}
+
+// Clients returns the names of the clients with a Captioner.
+func (tenants *Tenants) Clients() []string {
+	tenants.mu.Lock()
+	defer tenants.mu.Unlock()
+	var clients []string
+	for client := range tenants.tenants {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// CaptionerFor returns the Captioner for the client of ctx: its own if
+// tenants is non-nil and ctx has a client, or else fallback.
+func (tenants *Tenants) CaptionerFor(ctx context.Context, fallback Captioner) (Captioner, error) {
+	client := ClientName(ctx)
+	if tenants == nil || client == "" {
+		return fallback, nil
+	}
+	return tenants.Captioner(client)
+}
+
+// PrefixCache returns a Cache storing its entries in cache under keys
+// starting with prefix, so that tenants can share one cache without
+// seeing each other's captions.
+func PrefixCache(cache Cache, prefix string) Cache {
+	if prefix == "" {
+		return cache
+	}
+	return &prefixCache{cache: cache, prefix: prefix}
+}
+
+type prefixCache struct {
+	cache  Cache
+	prefix string
+}
+
+func (cache *prefixCache) Get(key string) (string, bool, error) {
+	return cache.cache.Get(cache.prefix + key)
+}
+
+func (cache *prefixCache) Set(key, caption string, ttl time.Duration) error {
+	return cache.cache.Set(cache.prefix+key, caption, ttl)
+}
+
+// failedCaptioner fails every caption with the error creating a tenant's
+// Captioner, so callers treat it like a provider failure.
+type failedCaptioner struct {
+	err error
+}
+
+func (captioner failedCaptioner) CaptionURL(url string) (string, error) {
+	return "", captioner.err
+}
+
+func (captioner failedCaptioner) CaptionReader(r io.Reader, name string) (string, error) {
+	return "", captioner.err
+}
+
+// captioner returns the Captioner for client, the server's own if it has
+// no Tenants or client is "".
+func (server *Server) captioner(client string) Captioner {
+	if server.Tenants == nil || client == "" {
+		return server.Captioner
+	}
+	captioner, err := server.Tenants.Captioner(client)
+	if err != nil {
+		server.logf("server: client %s: %s", client, err)
+		return failedCaptioner{err}
+	}
+	return captioner
+}
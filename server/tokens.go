@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+)
+
+// DefaultScopes are the scopes a bearer JWT needs for each route, keyed
+// by the route's pattern.
+var DefaultScopes = map[string]string{
+	"/v1/captions": "caption",
+	"/v1/stream":   "caption",
+	"/graphql":     "caption",
+	"/v1/ratings":  "caption",
+	"/v1/jobs":     "jobs:write",
+	"/v1/jobs/":    "jobs:read",
+	"/admin/":      AdminScope,
+}
+
+// AdminScope is the scope a bearer JWT needs for the /admin/ endpoints,
+// whatever Scopes says, on top of its client being in Admins.
+const AdminScope = "admin"
+
+// TokenClientPrefix starts the client name of a request made with a
+// bearer JWT, followed by the token's subject, as in "oidc:alice". It
+// keeps token subjects apart from API key clients, so a subject can't
+// reach the jobs, usage, session or cache entries of the API key client
+// of the same name. Admins lists token clients by these names.
+const TokenClientPrefix = "oidc:"
+
+// Token is a verified bearer JWT.
+type Token struct {
+	Subject string
+	Scopes  []string
+}
+
+// HasScope reports whether the token was granted scope.
+func (token *Token) HasScope(scope string) bool {
+	for _, s := range token.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// TokenVerifier verifies bearer JWTs from an OIDC issuer, for servers
+// behind an organization's single sign-on.
+type TokenVerifier struct {
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewTokenVerifier creates a TokenVerifier for tokens from issuer for
+// audience, finding the issuer's keys by OIDC discovery, or at jwksURL
+// if it isn't empty. An empty audience accepts tokens for any audience.
+func NewTokenVerifier(ctx context.Context, issuer, jwksURL, audience string) (*TokenVerifier, error) {
+	config := &oidc.Config{ClientID: audience, SkipClientIDCheck: audience == ""}
+	if jwksURL != "" {
+		config.SupportedSigningAlgs = []string{
+			oidc.RS256, oidc.RS384, oidc.RS512,
+			oidc.ES256, oidc.ES384, oidc.ES512,
+			oidc.PS256, oidc.PS384, oidc.PS512,
+		}
+		keySet := oidc.NewRemoteKeySet(ctx, jwksURL)
+		return &TokenVerifier{verifier: oidc.NewVerifier(issuer, keySet, config)}, nil
+	}
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenVerifier{verifier: provider.Verifier(config)}, nil
+}
+
+// Verify checks raw's signature, issuer, audience and expiry, and
+// returns its subject and scopes. Scopes are read from a space-separated
+// "scope" claim or an "scp" list, as providers differ.
+func (tokens *TokenVerifier) Verify(ctx context.Context, raw string) (*Token, error) {
+	idToken, err := tokens.verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	var claims struct {
+		Scope string          `json:"scope"`
+		SCP   json.RawMessage `json:"scp"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, err
+	}
+	token := &Token{Subject: idToken.Subject, Scopes: strings.Fields(claims.Scope)}
+	var scp []string
+	if json.Unmarshal(claims.SCP, &scp) == nil {
+		token.Scopes = append(token.Scopes, scp...)
+	} else {
+		var s string
+		if json.Unmarshal(claims.SCP, &s) == nil {
+			token.Scopes = append(token.Scopes, strings.Fields(s)...)
+		}
+	}
+	return token, nil
+}
+
+// isJWT reports whether a bearer credential looks like a JWT rather than
+// an API key.
+func isJWT(credential string) bool {
+	return strings.Count(credential, ".") == 2
+}
+
+// authenticateToken verifies a bearer JWT and checks that it has the
+// scope the route needs, answering 401 or 403 if not, and returns r with
+// TokenClientPrefix and the token's subject as its client.
+func (server *Server) authenticateToken(w http.ResponseWriter, r *http.Request, raw string) (*http.Request, bool) {
+	token, err := server.Tokens.Verify(r.Context(), raw)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="captionbot", error="invalid_token"`)
+		writeError(w, http.StatusUnauthorized, "invalid token: %s", err)
+		return nil, false
+	}
+
+	scopes := server.Scopes
+	if scopes == nil {
+		scopes = DefaultScopes
+	}
+	_, pattern := server.mux.Handler(r)
+	if scope := scopes[pattern]; scope != "" && !token.HasScope(scope) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="captionbot", error="insufficient_scope", scope="`+scope+`"`)
+		writeError(w, http.StatusForbidden, "token lacks the %s scope", scope)
+		return nil, false
+	}
+
+	client := TokenClientPrefix + token.Subject
+	if server.Keys != nil {
+		server.addUsage(client, Usage{Requests: 1})
+	}
+	r = withClient(r, client)
+	return r.WithContext(context.WithValue(r.Context(), tokenKey{}, token)), true
+}
+
+// tokenKey is the context key of the bearer JWT a request authenticated
+// with.
+type tokenKey struct{}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+const testIssuer = "https://login.example.com/"
+
+// signJWT returns claims as an RS256 JWT signed with key.
+func signJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// testTokens returns a TokenVerifier trusting key's tokens for the
+// captionbot audience.
+func testTokens(key *rsa.PrivateKey) *TokenVerifier {
+	keySet := &oidc.StaticKeySet{PublicKeys: []crypto.PublicKey{&key.PublicKey}}
+	return &TokenVerifier{verifier: oidc.NewVerifier(testIssuer, keySet, &oidc.Config{ClientID: "captionbot"})}
+}
+
+// claims returns the claims of a token for subject, valid for an hour.
+func claims(subject string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   testIssuer,
+		"aud":   "captionbot",
+		"sub":   subject,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "caption jobs:read",
+	}
+}
+
+func TestTokenClientSeparateFromKeyClient(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(&captionbottest.FakeCaptioner{})
+	server.Keys = NewStaticKeys(map[string]string{"alice-key": "alice"})
+	server.Tokens = testTokens(key)
+
+	usage := func(credential string) ClientUsage {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/v1/usage", nil)
+		req.Header.Set("Authorization", "Bearer "+credential)
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET /v1/usage: status %d: %s", rec.Code, rec.Body)
+		}
+		var got ClientUsage
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	// A token whose subject is the key's client name.
+	token := signJWT(t, key, claims("alice"))
+	for i := 0; i < 3; i++ {
+		usage(token)
+	}
+	if got := usage(token); got.Client != TokenClientPrefix+"alice" || got.Requests != 4 {
+		t.Errorf("token usage = %+v, want 4 requests by %s", got, TokenClientPrefix+"alice")
+	}
+	if got := usage("alice-key"); got.Client != "alice" || got.Requests != 1 {
+		t.Errorf("key usage = %+v, want 1 request by alice", got)
+	}
+}
+
+func TestAuthenticateToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := New(&captionbottest.FakeCaptioner{})
+	server.Keys = NewStaticKeys(map[string]string{})
+	server.Tokens = testTokens(key)
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		c := claims("alice")
+		c[name] = value
+		return c
+	}
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		claims map[string]interface{}
+		path   string
+		status int
+	}{
+		{"valid", key, claims("alice"), "/v1/usage", http.StatusOK},
+		{"bad signature", other, claims("alice"), "/v1/usage", http.StatusUnauthorized},
+		{"expired", key, with("exp", time.Now().Add(-time.Hour).Unix()), "/v1/usage", http.StatusUnauthorized},
+		{"wrong audience", key, with("aud", "someone-else"), "/v1/usage", http.StatusUnauthorized},
+		{"wrong issuer", key, with("iss", "https://evil.example.com/"), "/v1/usage", http.StatusUnauthorized},
+		{"missing scope", key, with("scope", "caption"), "/v1/jobs/1", http.StatusForbidden},
+		{"scp list", key, with("scp", []string{"jobs:read"}), "/v1/jobs/1", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Header.Set("Authorization", "Bearer "+signJWT(t, test.key, test.claims))
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		if rec.Code != test.status {
+			t.Errorf("%s: status = %d, want %d: %s", test.name, rec.Code, test.status, rec.Body)
+		}
+	}
+
+	// A token altered after signing.
+	token := signJWT(t, key, claims("alice"))
+	parts := strings.Split(token, ".")
+	forged, _ := json.Marshal(claims("admin"))
+	parts[1] = base64.RawURLEncoding.EncodeToString(forged)
+	req := httptest.NewRequest("GET", "/v1/usage", nil)
+	req.Header.Set("Authorization", "Bearer "+strings.Join(parts, "."))
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("altered token: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var uiPage []byte
+
+// ServeUI serves a web page at / for captioning images by upload or URL
+// and rating the captions, for demos and for people who would rather not
+// call the API. The page itself needs no credentials; its API calls send
+// the key entered on it.
+func (server *Server) ServeUI() {
+	server.mux.HandleFunc("/", server.handleUI)
+	server.ui = true
+}
+
+func (server *Server) handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, "no resource %q", r.URL.Path)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; img-src * blob: data:; style-src 'unsafe-inline'; script-src 'unsafe-inline'")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Write(uiPage)
+}
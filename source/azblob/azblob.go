@@ -0,0 +1,280 @@
+// Package azblob registers an Azure Blob Storage backend for
+// az://account/container/prefix source URLs.
+//
+// Requests are authorized with a SAS token, taken from the sas query
+// parameter or AZURE_STORAGE_SAS_TOKEN, or else with a token for the managed
+// identity of the Azure VM, App Service or container the process runs in.
+// Set the client_id query parameter to pick a user-assigned identity.
+//
+// Captions are written as the "caption" entry of each blob's metadata.
+package azblob
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+const (
+	apiVersion   = "2021-08-06"
+	imdsURL      = "http://169.254.169.254/metadata/identity/oauth2/token"
+	storageScope = "https://storage.azure.com/"
+)
+
+func init() {
+	source.Register("az", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Container is a Source for the blobs of a container under a name prefix.
+type Container struct {
+	Account    string
+	Name       string
+	Prefix     string
+	HTTPClient *http.Client
+
+	// Exactly one of sas and identity is used to authorize requests.
+	sas      url.Values
+	identity *managedIdentity
+}
+
+var (
+	_ source.Source        = (*Container)(nil)
+	_ source.CaptionWriter = (*Container)(nil)
+	_ source.FileWriter    = (*Container)(nil)
+)
+
+// Open creates a Container from an az:// URL.
+func Open(u *url.URL) (*Container, error) {
+	name, prefix, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/")
+	if u.Host == "" || name == "" {
+		return nil, fmt.Errorf("azblob: URL must be az://account/container/prefix, not %s", u)
+	}
+	container := &Container{Account: u.Host, Name: name, Prefix: prefix}
+
+	query := u.Query()
+	sas := query.Get("sas")
+	if sas == "" {
+		sas = os.Getenv("AZURE_STORAGE_SAS_TOKEN")
+	}
+	if sas != "" {
+		values, err := url.ParseQuery(strings.TrimPrefix(sas, "?"))
+		if err != nil {
+			return nil, fmt.Errorf("azblob: invalid SAS token: %s", err)
+		}
+		container.sas = values
+	} else {
+		container.identity = &managedIdentity{clientID: query.Get("client_id")}
+	}
+	return container, nil
+}
+
+// managedIdentity fetches and caches tokens from the instance metadata
+// service.
+type managedIdentity struct {
+	clientID string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (identity *managedIdentity) Token() (string, error) {
+	identity.mu.Lock()
+	defer identity.mu.Unlock()
+
+	if identity.token != "" && time.Until(identity.expiry) > time.Minute {
+		return identity.token, nil
+	}
+
+	query := url.Values{}
+	query.Set("api-version", "2018-02-01")
+	query.Set("resource", storageScope)
+	if identity.clientID != "" {
+		query.Set("client_id", identity.clientID)
+	}
+	req, err := http.NewRequest("GET", imdsURL+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("azblob: no SAS token and managed identity unavailable: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("azblob: managed identity token request returned status %d", resp.StatusCode)
+	}
+	var tok struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	seconds, _ := tok.ExpiresIn.Int64()
+	identity.token = tok.AccessToken
+	identity.expiry = time.Now().Add(time.Duration(seconds) * time.Second)
+	return identity.token, nil
+}
+
+func (container *Container) httpClient() *http.Client {
+	if container.HTTPClient != nil {
+		return container.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// blobURL returns the URL of blob (or of the container if blob is empty)
+// with query merged with the SAS token, if any.
+func (container *Container) blobURL(blob string, query url.Values) string {
+	path := "/" + container.Name
+	if blob != "" {
+		path += "/" + blob
+	}
+	u := url.URL{Scheme: "https", Host: container.Account + ".blob.core.windows.net", Path: path}
+
+	merged := url.Values{}
+	for key, values := range container.sas {
+		merged[key] = values
+	}
+	for key, values := range query {
+		merged[key] = values
+	}
+	u.RawQuery = merged.Encode()
+	return u.String()
+}
+
+func (container *Container) do(method, endpoint string, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-version", apiVersion)
+	if container.identity != nil {
+		token, err := container.identity.Token()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := container.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("azblob: %s %s: status %d %s", method, req.URL.Path, resp.StatusCode, resp.Header.Get("x-ms-error-code"))
+	}
+	return resp, nil
+}
+
+// Walk lists every blob under the prefix.
+func (container *Container) Walk(fn func(source.Object) error) error {
+	query := url.Values{}
+	query.Set("restype", "container")
+	query.Set("comp", "list")
+	query.Set("prefix", container.Prefix)
+
+	for {
+		resp, err := container.do("GET", container.blobURL("", query), nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Blobs []struct {
+				Name       string
+				Properties struct {
+					ContentLength int64 `xml:"Content-Length"`
+				}
+			} `xml:"Blobs>Blob"`
+			NextMarker string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, blob := range result.Blobs {
+			if err := fn(source.Object{Key: blob.Name, Size: blob.Properties.ContentLength}); err != nil {
+				return err
+			}
+		}
+
+		if result.NextMarker == "" {
+			return nil
+		}
+		query.Set("marker", result.NextMarker)
+	}
+}
+
+// Open streams the content of obj.
+func (container *Container) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := container.do("GET", container.blobURL(obj.Key, nil), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption sets the "caption" metadata entry of obj. Setting metadata
+// replaces all of it, so the existing entries are read and written back.
+func (container *Container) WriteCaption(obj source.Object, caption string) error {
+	query := url.Values{}
+	query.Set("comp", "metadata")
+
+	resp, err := container.do("HEAD", container.blobURL(obj.Key, query), nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	header := http.Header{}
+	for name, values := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-meta-") {
+			header[name] = values
+		}
+	}
+	header.Set("x-ms-meta-caption", url.QueryEscape(caption))
+
+	resp, err = container.do("PUT", container.blobURL(obj.Key, query), header, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// WriteFile uploads data as a block blob named name under the prefix.
+func (container *Container) WriteFile(name string, data []byte) error {
+	if container.Prefix != "" {
+		name = strings.TrimSuffix(container.Prefix, "/") + "/" + name
+	}
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	header.Set("Content-Type", "application/json")
+
+	resp, err := container.do("PUT", container.blobURL(name, nil), header, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
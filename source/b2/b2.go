@@ -0,0 +1,316 @@
+// Package b2 registers a native Backblaze B2 backend for b2://bucket/prefix
+// source URLs. It authorizes with the application key in
+// B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY.
+//
+// With presign=DURATION, objects carry download URLs authorized for that
+// long, so captionbot.ai fetches them directly instead of through an
+// upload.
+//
+// Captions are written as the "caption" file info entry. B2 file info is
+// immutable, so this copies the file onto a new version with the extra
+// entry.
+package b2
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+// AuthorizeURL is the B2 account authorization endpoint.
+var AuthorizeURL = "https://api.backblazeb2.com/b2api/v2/b2_authorize_account"
+
+func init() {
+	source.Register("b2", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Bucket is a Source for the files of a B2 bucket under a name prefix.
+type Bucket struct {
+	Name       string
+	Prefix     string
+	Presign    time.Duration
+	HTTPClient *http.Client
+
+	bucketID    string
+	apiURL      string
+	downloadURL string
+	token       string
+	// downloadToken authorizes presigned downloads under Prefix.
+	downloadToken string
+	// files remembers file IDs, content types and info for WriteCaption.
+	files map[string]fileVersion
+}
+
+type fileVersion struct {
+	FileName      string            `json:"fileName"`
+	FileID        string            `json:"fileId"`
+	ContentLength int64             `json:"contentLength"`
+	ContentType   string            `json:"contentType"`
+	FileInfo      map[string]string `json:"fileInfo"`
+	Action        string            `json:"action"`
+}
+
+var (
+	_ source.Source        = (*Bucket)(nil)
+	_ source.CaptionWriter = (*Bucket)(nil)
+	_ source.FileWriter    = (*Bucket)(nil)
+)
+
+// Open authorizes the account and creates a Bucket from a b2:// URL.
+func Open(u *url.URL) (*Bucket, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("b2: missing bucket name in %s", u)
+	}
+	bucket := &Bucket{
+		Name:   u.Host,
+		Prefix: strings.TrimPrefix(u.Path, "/"),
+		files:  map[string]fileVersion{},
+	}
+	if presign := u.Query().Get("presign"); presign != "" {
+		d, err := time.ParseDuration(presign)
+		if err != nil {
+			return nil, fmt.Errorf("b2: presign: %s", err)
+		}
+		bucket.Presign = d
+	}
+	if err := bucket.authorize(os.Getenv("B2_APPLICATION_KEY_ID"), os.Getenv("B2_APPLICATION_KEY")); err != nil {
+		return nil, err
+	}
+	return bucket, nil
+}
+
+func (bucket *Bucket) httpClient() *http.Client {
+	if bucket.HTTPClient != nil {
+		return bucket.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (bucket *Bucket) send(req *http.Request, out interface{}) error {
+	resp, err := bucket.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("b2: %s: status %d %s %s", req.URL.Path, resp.StatusCode, apiErr.Code, apiErr.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// call invokes a B2 API operation.
+func (bucket *Bucket) call(operation string, args interface{}, out interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", bucket.apiURL+"/b2api/v2/"+operation, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", bucket.token)
+	return bucket.send(req, out)
+}
+
+// authorize logs in and looks up the bucket ID.
+func (bucket *Bucket) authorize(keyID, key string) error {
+	if keyID == "" || key == "" {
+		return fmt.Errorf("b2: B2_APPLICATION_KEY_ID and B2_APPLICATION_KEY must be set")
+	}
+	req, err := http.NewRequest("GET", AuthorizeURL, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(keyID, key)
+
+	var account struct {
+		AccountID          string `json:"accountId"`
+		AuthorizationToken string `json:"authorizationToken"`
+		APIURL             string `json:"apiUrl"`
+		DownloadURL        string `json:"downloadUrl"`
+	}
+	if err := bucket.send(req, &account); err != nil {
+		return err
+	}
+	bucket.apiURL = account.APIURL
+	bucket.downloadURL = account.DownloadURL
+	bucket.token = account.AuthorizationToken
+
+	var buckets struct {
+		Buckets []struct {
+			BucketID string `json:"bucketId"`
+		} `json:"buckets"`
+	}
+	err = bucket.call("b2_list_buckets", map[string]string{
+		"accountId":  account.AccountID,
+		"bucketName": bucket.Name,
+	}, &buckets)
+	if err != nil {
+		return err
+	}
+	if len(buckets.Buckets) == 0 {
+		return fmt.Errorf("b2: no bucket named %s", bucket.Name)
+	}
+	bucket.bucketID = buckets.Buckets[0].BucketID
+
+	if bucket.Presign > 0 {
+		var auth struct {
+			AuthorizationToken string `json:"authorizationToken"`
+		}
+		err := bucket.call("b2_get_download_authorization", map[string]interface{}{
+			"bucketId":               bucket.bucketID,
+			"fileNamePrefix":         bucket.Prefix,
+			"validDurationInSeconds": int(bucket.Presign / time.Second),
+		}, &auth)
+		if err != nil {
+			return err
+		}
+		bucket.downloadToken = auth.AuthorizationToken
+	}
+	return nil
+}
+
+// escapeName percent-encodes a file name, keeping its slashes.
+func escapeName(name string) string {
+	escaped := strings.Split(name, "/")
+	for i := range escaped {
+		escaped[i] = url.PathEscape(escaped[i])
+	}
+	return strings.Join(escaped, "/")
+}
+
+// fileURL returns the download URL of a file.
+func (bucket *Bucket) fileURL(name string) string {
+	return bucket.downloadURL + "/file/" + url.PathEscape(bucket.Name) + "/" + escapeName(name)
+}
+
+// Walk lists the current version of every file under the prefix.
+func (bucket *Bucket) Walk(fn func(source.Object) error) error {
+	start := ""
+	for {
+		var result struct {
+			Files        []fileVersion `json:"files"`
+			NextFileName *string       `json:"nextFileName"`
+		}
+		args := map[string]interface{}{
+			"bucketId":     bucket.bucketID,
+			"prefix":       bucket.Prefix,
+			"maxFileCount": 1000,
+		}
+		if start != "" {
+			args["startFileName"] = start
+		}
+		if err := bucket.call("b2_list_file_names", args, &result); err != nil {
+			return err
+		}
+
+		for _, file := range result.Files {
+			if file.Action != "upload" {
+				continue
+			}
+			bucket.files[file.FileName] = file
+			obj := source.Object{Key: file.FileName, ID: file.FileID, Size: file.ContentLength}
+			if bucket.downloadToken != "" {
+				obj.URL = bucket.fileURL(file.FileName) + "?Authorization=" + url.QueryEscape(bucket.downloadToken)
+			}
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+
+		if result.NextFileName == nil {
+			return nil
+		}
+		start = *result.NextFileName
+	}
+}
+
+// Open downloads obj.
+func (bucket *Bucket) Open(obj source.Object) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", bucket.fileURL(obj.Key), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", bucket.token)
+
+	resp, err := bucket.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("b2: downloading %s: status %d", obj.Key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption copies obj onto a new version whose file info has a
+// "caption" entry, keeping the other entries.
+func (bucket *Bucket) WriteCaption(obj source.Object, caption string) error {
+	file, ok := bucket.files[obj.Key]
+	if !ok {
+		return fmt.Errorf("b2: %s was not listed by Walk", obj.Key)
+	}
+	info := map[string]string{}
+	for key, value := range file.FileInfo {
+		info[key] = value
+	}
+	info["caption"] = url.QueryEscape(caption)
+
+	return bucket.call("b2_copy_file", map[string]interface{}{
+		"sourceFileId":      file.FileID,
+		"fileName":          file.FileName,
+		"metadataDirective": "REPLACE",
+		"contentType":       file.ContentType,
+		"fileInfo":          info,
+	}, nil)
+}
+
+// WriteFile uploads data as a file named name under the prefix.
+func (bucket *Bucket) WriteFile(name string, data []byte) error {
+	if bucket.Prefix != "" {
+		name = strings.TrimSuffix(bucket.Prefix, "/") + "/" + name
+	}
+
+	var upload struct {
+		UploadURL          string `json:"uploadUrl"`
+		AuthorizationToken string `json:"authorizationToken"`
+	}
+	if err := bucket.call("b2_get_upload_url", map[string]string{"bucketId": bucket.bucketID}, &upload); err != nil {
+		return err
+	}
+
+	sum := sha1.Sum(data)
+	req, err := http.NewRequest("POST", upload.UploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", upload.AuthorizationToken)
+	req.Header.Set("X-Bz-File-Name", escapeName(name))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	req.Header.Set("X-Bz-Content-Sha1", hex.EncodeToString(sum[:]))
+	return bucket.send(req, nil)
+}
@@ -0,0 +1,63 @@
+package source
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Dir is a Source for a local directory tree. Captions are written as
+// sidecar files next to each image, with a .txt extension.
+type Dir string
+
+var (
+	_ Source        = Dir("")
+	_ CaptionWriter = Dir("")
+	_ FileWriter    = Dir("")
+	_ FileCreator   = Dir("")
+)
+
+// Walk calls fn for every regular file under the directory.
+func (dir Dir) Walk(fn func(Object) error) error {
+	return filepath.WalkDir(string(dir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		key, err := filepath.Rel(string(dir), path)
+		if err != nil {
+			return err
+		}
+		return fn(Object{Key: filepath.ToSlash(key), Size: info.Size()})
+	})
+}
+
+// Open opens the file for obj.
+func (dir Dir) Open(obj Object) (io.ReadCloser, error) {
+	return os.Open(dir.path(obj.Key))
+}
+
+// WriteCaption writes caption to a sidecar file next to obj.
+func (dir Dir) WriteCaption(obj Object, caption string) error {
+	path := dir.path(obj.Key)
+	sidecar := path[:len(path)-len(filepath.Ext(path))] + ".txt"
+	return os.WriteFile(sidecar, []byte(caption+"\n"), 0644)
+}
+
+// WriteFile writes a file at the root of the directory.
+func (dir Dir) WriteFile(name string, data []byte) error {
+	return os.WriteFile(dir.path(name), data, 0644)
+}
+
+// CreateFile creates a file at the root of the directory.
+func (dir Dir) CreateFile(name string) (io.WriteCloser, error) {
+	return os.Create(dir.path(name))
+}
+
+func (dir Dir) path(key string) string {
+	return filepath.Join(string(dir), filepath.FromSlash(key))
+}
@@ -0,0 +1,224 @@
+// Package dropbox registers a Dropbox backend for dropbox://folder/path
+// source URLs. The access token comes from the token query parameter or
+// DROPBOX_ACCESS_TOKEN.
+//
+// Captions are written as .txt sidecar files next to each image.
+package dropbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+var (
+	// APIURL is the root of the Dropbox RPC endpoints.
+	APIURL = "https://api.dropboxapi.com/2/"
+	// ContentURL is the root of the Dropbox content endpoints.
+	ContentURL = "https://content.dropboxapi.com/2/"
+)
+
+func init() {
+	source.Register("dropbox", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Folder is a Source for the files of a Dropbox folder and its subfolders.
+type Folder struct {
+	// Path is the folder path, "" for the root.
+	Path       string
+	Token      string
+	HTTPClient *http.Client
+}
+
+var (
+	_ source.Source        = (*Folder)(nil)
+	_ source.CaptionWriter = (*Folder)(nil)
+	_ source.FileWriter    = (*Folder)(nil)
+)
+
+// Open creates a Folder from a dropbox:// URL.
+func Open(u *url.URL) (*Folder, error) {
+	token := u.Query().Get("token")
+	if token == "" {
+		token = os.Getenv("DROPBOX_ACCESS_TOKEN")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("dropbox: no access token")
+	}
+
+	folder := path.Clean("/" + u.Host + u.Path)
+	if folder == "/" {
+		folder = ""
+	}
+	return &Folder{Path: folder, Token: token}, nil
+}
+
+func (folder *Folder) httpClient() *http.Client {
+	if folder.HTTPClient != nil {
+		return folder.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// apiArg encodes v for the Dropbox-API-Arg header, which must be ASCII.
+func apiArg(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, r := range string(data) {
+		if r < utf8.RuneSelf {
+			b.WriteRune(r)
+		} else if r > 0xFFFF {
+			r1, r2 := utf16Pair(r)
+			fmt.Fprintf(&b, `\u%04x\u%04x`, r1, r2)
+		} else {
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String(), nil
+}
+
+func utf16Pair(r rune) (rune, rune) {
+	r -= 0x10000
+	return 0xD800 + (r>>10)&0x3FF, 0xDC00 + r&0x3FF
+}
+
+// call makes an RPC request with a JSON body and decodes the JSON response.
+func (folder *Folder) call(endpoint string, args interface{}, out interface{}) error {
+	body, err := json.Marshal(args)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", APIURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := folder.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// content makes a content request, passing args in the Dropbox-API-Arg
+// header.
+func (folder *Folder) content(endpoint string, args interface{}, body []byte) (*http.Response, error) {
+	arg, err := apiArg(args)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", ContentURL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Dropbox-API-Arg", arg)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return folder.send(req)
+}
+
+func (folder *Folder) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Authorization", "Bearer "+folder.Token)
+	resp, err := folder.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		summary, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("dropbox: %s: status %d %s", req.URL.Path, resp.StatusCode, bytes.TrimSpace(summary))
+	}
+	return resp, nil
+}
+
+// Walk lists every file in the folder and its subfolders. Keys are paths
+// relative to the folder.
+func (folder *Folder) Walk(fn func(source.Object) error) error {
+	type entry struct {
+		Tag         string `json:".tag"`
+		PathDisplay string `json:"path_display"`
+		Size        int64  `json:"size"`
+	}
+	var result struct {
+		Entries []entry `json:"entries"`
+		Cursor  string  `json:"cursor"`
+		HasMore bool    `json:"has_more"`
+	}
+
+	err := folder.call("files/list_folder", map[string]interface{}{
+		"path":      folder.Path,
+		"recursive": true,
+	}, &result)
+	for {
+		if err != nil {
+			return err
+		}
+		for _, e := range result.Entries {
+			if e.Tag != "file" {
+				continue
+			}
+			// Dropbox paths are case-insensitive, so path_display may
+			// not start with folder.Path byte for byte.
+			key := strings.TrimPrefix(e.PathDisplay[len(folder.Path):], "/")
+			if err := fn(source.Object{Key: key, Size: e.Size}); err != nil {
+				return err
+			}
+		}
+		if !result.HasMore {
+			return nil
+		}
+
+		cursor := result.Cursor
+		result.Entries = nil
+		err = folder.call("files/list_folder/continue", map[string]string{"cursor": cursor}, &result)
+	}
+}
+
+// Open downloads obj.
+func (folder *Folder) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := folder.content("files/download", map[string]string{"path": folder.path(obj.Key)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption uploads caption as a .txt file next to obj.
+func (folder *Folder) WriteCaption(obj source.Object, caption string) error {
+	sidecar := strings.TrimSuffix(obj.Key, path.Ext(obj.Key)) + ".txt"
+	return folder.WriteFile(sidecar, []byte(caption+"\n"))
+}
+
+// WriteFile uploads data to name in the folder, overwriting any existing
+// file.
+func (folder *Folder) WriteFile(name string, data []byte) error {
+	resp, err := folder.content("files/upload", map[string]string{
+		"path": folder.path(name),
+		"mode": "overwrite",
+	}, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (folder *Folder) path(key string) string {
+	return folder.Path + "/" + key
+}
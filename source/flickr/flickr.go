@@ -0,0 +1,251 @@
+// Package flickr registers a Flickr backend for source URLs of the form
+// flickr://USER_ID, a user's public photostream, and
+// flickr://USER_ID/sets/SET_ID, one of their albums.
+//
+// Reading needs an API key in FLICKR_API_KEY. Writing captions into photo
+// descriptions also needs FLICKR_API_SECRET and an OAuth token with write
+// permission in FLICKR_OAUTH_TOKEN and FLICKR_OAUTH_TOKEN_SECRET.
+//
+// Flickr allows 3600 API calls per hour per key; calls are spaced by the
+// interval query parameter, one second by default.
+package flickr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot/internal/oauth1"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// APIURL is the Flickr REST endpoint.
+var APIURL = "https://www.flickr.com/services/rest/"
+
+func init() {
+	source.Register("flickr", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Photostream is a Source for a user's public photos or one of their sets.
+// Object URLs are the public "large" renditions, which captionbot.ai fetches
+// directly.
+type Photostream struct {
+	UserID     string
+	SetID      string
+	APIKey     string
+	APISecret  string
+	Token      string
+	Secret     string
+	Interval   time.Duration
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	lastCall time.Time
+	titles   map[string]string
+}
+
+var (
+	_ source.Source        = (*Photostream)(nil)
+	_ source.CaptionWriter = (*Photostream)(nil)
+)
+
+// Open creates a Photostream from a flickr:// URL.
+func Open(u *url.URL) (*Photostream, error) {
+	stream := &Photostream{
+		UserID:    u.Host,
+		APIKey:    os.Getenv("FLICKR_API_KEY"),
+		APISecret: os.Getenv("FLICKR_API_SECRET"),
+		Token:     os.Getenv("FLICKR_OAUTH_TOKEN"),
+		Secret:    os.Getenv("FLICKR_OAUTH_TOKEN_SECRET"),
+		Interval:  time.Second,
+		titles:    map[string]string{},
+	}
+	if stream.UserID == "" {
+		return nil, fmt.Errorf("flickr: missing user ID in %s", u)
+	}
+	if stream.APIKey == "" {
+		return nil, fmt.Errorf("flickr: FLICKR_API_KEY is not set")
+	}
+	if parts := strings.Split(strings.Trim(u.Path, "/"), "/"); len(parts) == 2 && parts[0] == "sets" {
+		stream.SetID = parts[1]
+	} else if u.Path != "" && u.Path != "/" {
+		return nil, fmt.Errorf("flickr: URL path must be /sets/SET_ID, not %s", u.Path)
+	}
+	if interval := u.Query().Get("interval"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("flickr: interval: %s", err)
+		}
+		stream.Interval = d
+	}
+	return stream, nil
+}
+
+func (stream *Photostream) httpClient() *http.Client {
+	if stream.HTTPClient != nil {
+		return stream.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// wait blocks until Interval has passed since the previous API call.
+func (stream *Photostream) wait() {
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if delay := stream.Interval - time.Since(stream.lastCall); delay > 0 {
+		time.Sleep(delay)
+	}
+	stream.lastCall = time.Now()
+}
+
+// sign adds OAuth 1.0a HMAC-SHA1 signature parameters to params.
+func (stream *Photostream) sign(method string, params url.Values) {
+	credentials := oauth1.Credentials{
+		ConsumerKey:    stream.APIKey,
+		ConsumerSecret: stream.APISecret,
+		Token:          stream.Token,
+		TokenSecret:    stream.Secret,
+	}
+	for key, values := range credentials.Sign(method, APIURL, params) {
+		params[key] = values
+	}
+}
+
+// call invokes a Flickr API method. Signed calls are made as POSTs.
+func (stream *Photostream) call(method string, params url.Values, signed bool, out interface{}) error {
+	params.Set("method", method)
+	params.Set("format", "json")
+	params.Set("nojsoncallback", "1")
+
+	var req *http.Request
+	var err error
+	if signed {
+		stream.sign("POST", params)
+		req, err = http.NewRequest("POST", APIURL, strings.NewReader(params.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		params.Set("api_key", stream.APIKey)
+		req, err = http.NewRequest("GET", APIURL+"?"+params.Encode(), nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	stream.wait()
+	resp, err := stream.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		Stat    string `json:"stat"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(data, &status); err != nil {
+		return fmt.Errorf("flickr: %s: %s", method, err)
+	}
+	if status.Stat != "ok" {
+		return fmt.Errorf("flickr: %s: %s", method, status.Message)
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+type photoPage struct {
+	Pages int `json:"pages"`
+	Photo []struct {
+		ID    string `json:"id"`
+		Title string `json:"title"`
+		URL   string `json:"url_l"`
+	} `json:"photo"`
+}
+
+// Walk lists the photos of the photostream or set that have a large
+// rendition.
+func (stream *Photostream) Walk(fn func(source.Object) error) error {
+	for page, pages := 1, 1; page <= pages; page++ {
+		params := url.Values{}
+		params.Set("user_id", stream.UserID)
+		params.Set("extras", "url_l")
+		params.Set("per_page", "500")
+		params.Set("page", strconv.Itoa(page))
+
+		var result photoPage
+		if stream.SetID == "" {
+			var response struct {
+				Photos photoPage `json:"photos"`
+			}
+			if err := stream.call("flickr.people.getPublicPhotos", params, false, &response); err != nil {
+				return err
+			}
+			result = response.Photos
+		} else {
+			params.Set("photoset_id", stream.SetID)
+			var response struct {
+				Photoset photoPage `json:"photoset"`
+			}
+			if err := stream.call("flickr.photosets.getPhotos", params, false, &response); err != nil {
+				return err
+			}
+			result = response.Photoset
+		}
+		pages = result.Pages
+
+		for _, photo := range result.Photo {
+			if photo.URL == "" {
+				continue
+			}
+			stream.titles[photo.ID] = photo.Title
+			obj := source.Object{Key: path.Base(photo.URL), ID: photo.ID, URL: photo.URL}
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Open downloads the large rendition of obj.
+func (stream *Photostream) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := stream.httpClient().Get(obj.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("flickr: downloading %s: status %d", obj.Key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption sets the description of the photo, keeping its title.
+func (stream *Photostream) WriteCaption(obj source.Object, caption string) error {
+	if stream.APISecret == "" || stream.Token == "" {
+		return fmt.Errorf("flickr: updating descriptions needs FLICKR_API_SECRET, FLICKR_OAUTH_TOKEN and FLICKR_OAUTH_TOKEN_SECRET")
+	}
+	params := url.Values{}
+	params.Set("photo_id", obj.ID)
+	params.Set("title", stream.titles[obj.ID])
+	params.Set("description", caption)
+	return stream.call("flickr.photos.setMeta", params, true, nil)
+}
@@ -0,0 +1,174 @@
+// Package gcs registers a Google Cloud Storage backend for gs://bucket/prefix
+// source URLs. It authenticates with application default credentials.
+//
+// Captions are written as the "caption" entry of each object's custom
+// metadata.
+package gcs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nhatbui/captionbot/internal/googleauth"
+	"github.com/nhatbui/captionbot/source"
+)
+
+// BaseURL is the root of the Cloud Storage JSON API.
+var BaseURL = "https://storage.googleapis.com"
+
+const scope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+func init() {
+	source.Register("gs", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Bucket is a Source for the objects of a bucket under a name prefix.
+type Bucket struct {
+	Name       string
+	Prefix     string
+	HTTPClient *http.Client
+}
+
+var (
+	_ source.Source        = (*Bucket)(nil)
+	_ source.CaptionWriter = (*Bucket)(nil)
+	_ source.FileWriter    = (*Bucket)(nil)
+)
+
+// Open creates a Bucket from a gs:// URL.
+func Open(u *url.URL) (*Bucket, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("gcs: missing bucket name in %s", u)
+	}
+	tokens, err := googleauth.DefaultTokenSource(scope)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket{
+		Name:       u.Host,
+		Prefix:     strings.TrimPrefix(u.Path, "/"),
+		HTTPClient: googleauth.NewClient(tokens),
+	}, nil
+}
+
+func (bucket *Bucket) do(method, endpoint string, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := bucket.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("gcs: %s: status %d %s", method, resp.StatusCode, apiErr.Error.Message)
+	}
+	return resp, nil
+}
+
+func (bucket *Bucket) objectURL(name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", BaseURL, url.PathEscape(bucket.Name), url.PathEscape(name))
+}
+
+// Walk lists every object under the prefix.
+func (bucket *Bucket) Walk(fn func(source.Object) error) error {
+	query := url.Values{}
+	query.Set("prefix", bucket.Prefix)
+	query.Set("fields", "items(name,size),nextPageToken")
+
+	for {
+		endpoint := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", BaseURL, url.PathEscape(bucket.Name), query.Encode())
+		resp, err := bucket.do("GET", endpoint, "", nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+				Size string `json:"size"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, item := range result.Items {
+			if strings.HasSuffix(item.Name, "/") {
+				continue
+			}
+			size, _ := strconv.ParseInt(item.Size, 10, 64)
+			if err := fn(source.Object{Key: item.Name, Size: size}); err != nil {
+				return err
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// Open streams the content of obj.
+func (bucket *Bucket) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := bucket.do("GET", bucket.objectURL(obj.Key)+"?alt=media", "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption sets the "caption" metadata entry of obj, keeping its other
+// metadata.
+func (bucket *Bucket) WriteCaption(obj source.Object, caption string) error {
+	body, err := json.Marshal(map[string]map[string]string{
+		"metadata": {"caption": caption},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := bucket.do("PATCH", bucket.objectURL(obj.Key), "application/json", body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// WriteFile uploads data as an object named name under the prefix.
+func (bucket *Bucket) WriteFile(name string, data []byte) error {
+	if bucket.Prefix != "" {
+		name = strings.TrimSuffix(bucket.Prefix, "/") + "/" + name
+	}
+	query := url.Values{}
+	query.Set("uploadType", "media")
+	query.Set("name", name)
+
+	endpoint := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", BaseURL, url.PathEscape(bucket.Name), query.Encode())
+	resp, err := bucket.do("POST", endpoint, "application/json", data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,239 @@
+// Package gdrive registers a Google Drive backend for source URLs of the
+// form gdrive://FOLDER_ID, which covers the folder and its subfolders, or
+// gdrive:///?q=QUERY, which covers the files matching a Drive search query.
+//
+// When GDRIVE_CLIENT_ID and GDRIVE_CLIENT_SECRET name an OAuth client of the
+// "TVs and Limited Input devices" type, the user authorizes access once
+// through the device flow and the refresh token is cached in the user
+// config directory. Otherwise application default credentials are used.
+//
+// Captions are written into each file's description, which Drive shows in
+// its details pane.
+package gdrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/nhatbui/captionbot/internal/googleauth"
+	"github.com/nhatbui/captionbot/source"
+)
+
+var (
+	// APIURL is the root of the Drive v3 API.
+	APIURL = "https://www.googleapis.com/drive/v3/"
+	// UploadURL is the root of the Drive v3 upload API.
+	UploadURL = "https://www.googleapis.com/upload/drive/v3/"
+
+	// Prompt shows the device flow code to the user.
+	Prompt googleauth.Prompt = func(verificationURL, userCode string) {
+		fmt.Fprintf(os.Stderr, "To allow captionbot to access Google Drive, visit %s and enter the code %s\n", verificationURL, userCode)
+	}
+)
+
+const (
+	scope        = "https://www.googleapis.com/auth/drive"
+	folderMime   = "application/vnd.google-apps.folder"
+	listFields   = "nextPageToken,files(id,name,mimeType,size)"
+	maxPageFiles = "1000"
+)
+
+func init() {
+	source.Register("gdrive", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Drive is a Source for a Drive folder tree or search query.
+type Drive struct {
+	// FolderID is the root folder, if the source is a folder.
+	FolderID string
+	// Query is the search query, if the source is a query.
+	Query      string
+	HTTPClient *http.Client
+}
+
+var (
+	_ source.Source        = (*Drive)(nil)
+	_ source.CaptionWriter = (*Drive)(nil)
+	_ source.FileWriter    = (*Drive)(nil)
+)
+
+// Open creates a Drive from a gdrive:// URL.
+func Open(u *url.URL) (*Drive, error) {
+	drive := &Drive{FolderID: u.Host, Query: u.Query().Get("q")}
+	if drive.FolderID == "" && drive.Query == "" {
+		return nil, fmt.Errorf("gdrive: URL must name a folder ID or a query, not %s", u)
+	}
+
+	tokens, err := googleauth.UserTokenSource(os.Getenv("GDRIVE_CLIENT_ID"), os.Getenv("GDRIVE_CLIENT_SECRET"), "gdrive-token", Prompt, scope)
+	if err != nil {
+		return nil, err
+	}
+	drive.HTTPClient = googleauth.NewClient(tokens)
+	return drive, nil
+}
+
+func (drive *Drive) do(method, endpoint, contentType string, body io.Reader, out interface{}) error {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := drive.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("gdrive: %s: status %d %s", method, resp.StatusCode, apiErr.Error.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+type file struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	MimeType string `json:"mimeType"`
+	Size     string `json:"size"`
+}
+
+// list calls fn for every file matching q.
+func (drive *Drive) list(q string, fn func(file) error) error {
+	query := url.Values{}
+	query.Set("q", q)
+	query.Set("fields", listFields)
+	query.Set("pageSize", maxPageFiles)
+	query.Set("supportsAllDrives", "true")
+	query.Set("includeItemsFromAllDrives", "true")
+
+	for {
+		var result struct {
+			Files         []file `json:"files"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := drive.do("GET", APIURL+"files?"+query.Encode(), "", nil, &result); err != nil {
+			return err
+		}
+		for _, f := range result.Files {
+			if err := fn(f); err != nil {
+				return err
+			}
+		}
+		if result.NextPageToken == "" {
+			return nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// walkFolder calls fn for every file under folderID, recursing into
+// subfolders. Keys are slash-separated name paths below the root.
+func (drive *Drive) walkFolder(folderID, prefix string, fn func(source.Object) error) error {
+	q := fmt.Sprintf("'%s' in parents and trashed = false", folderID)
+	return drive.list(q, func(f file) error {
+		if f.MimeType == folderMime {
+			return drive.walkFolder(f.ID, prefix+f.Name+"/", fn)
+		}
+		size, _ := strconv.ParseInt(f.Size, 10, 64)
+		return fn(source.Object{Key: prefix + f.Name, ID: f.ID, Size: size})
+	})
+}
+
+// Walk lists the files of the folder tree or matching the query.
+func (drive *Drive) Walk(fn func(source.Object) error) error {
+	if drive.FolderID != "" {
+		return drive.walkFolder(drive.FolderID, "", fn)
+	}
+	return drive.list(drive.Query+" and trashed = false", func(f file) error {
+		if f.MimeType == folderMime {
+			return nil
+		}
+		size, _ := strconv.ParseInt(f.Size, 10, 64)
+		return fn(source.Object{Key: f.Name, ID: f.ID, Size: size})
+	})
+}
+
+// Open downloads obj.
+func (drive *Drive) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := drive.HTTPClient.Get(APIURL + "files/" + url.PathEscape(obj.ID) + "?alt=media&supportsAllDrives=true")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("gdrive: downloading %s: status %d", obj.Key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption stores caption as the description of obj.
+func (drive *Drive) WriteCaption(obj source.Object, caption string) error {
+	body, err := json.Marshal(map[string]string{"description": caption})
+	if err != nil {
+		return err
+	}
+	endpoint := APIURL + "files/" + url.PathEscape(obj.ID) + "?supportsAllDrives=true"
+	return drive.do("PATCH", endpoint, "application/json", bytes.NewReader(body), nil)
+}
+
+// WriteFile creates a file named name in the root folder. It fails for
+// query sources, which have no folder to write to.
+func (drive *Drive) WriteFile(name string, data []byte) error {
+	if drive.FolderID == "" {
+		return fmt.Errorf("gdrive: can't write %s to a query source", name)
+	}
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "application/json; charset=UTF-8")
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(map[string]interface{}{
+		"name":    name,
+		"parents": []string{drive.FolderID},
+	}); err != nil {
+		return err
+	}
+
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "application/json")
+	if part, err = writer.CreatePart(h); err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	endpoint := UploadURL + "files?uploadType=multipart&supportsAllDrives=true"
+	contentType := "multipart/related; boundary=" + writer.Boundary()
+	return drive.do("POST", endpoint, contentType, &body, nil)
+}
@@ -0,0 +1,201 @@
+// Package gphotos registers a Google Photos backend for gphotos:// source
+// URLs, which cover the whole library, and gphotos://ALBUM_ID, which covers
+// one album. It also lists albums so callers can build per-album caption
+// manifests, since Photos has no field to store alt text in.
+//
+// When GPHOTOS_CLIENT_ID and GPHOTOS_CLIENT_SECRET name an OAuth client of
+// the "TVs and Limited Input devices" type, the user authorizes access once
+// through the device flow. Otherwise application default credentials are
+// used.
+package gphotos
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/nhatbui/captionbot/internal/googleauth"
+	"github.com/nhatbui/captionbot/source"
+)
+
+var (
+	// APIURL is the root of the Photos Library API.
+	APIURL = "https://photoslibrary.googleapis.com/v1/"
+
+	// Prompt shows the device flow code to the user.
+	Prompt googleauth.Prompt = func(verificationURL, userCode string) {
+		fmt.Fprintf(os.Stderr, "To allow captionbot to read Google Photos, visit %s and enter the code %s\n", verificationURL, userCode)
+	}
+)
+
+const (
+	scope = "https://www.googleapis.com/auth/photoslibrary.readonly"
+	// imageSize asks for a rendition captionbot.ai can handle comfortably.
+	imageSize = "=w1600-h1600"
+)
+
+func init() {
+	source.Register("gphotos", func(u *url.URL) (source.Source, error) {
+		library, err := NewLibrary()
+		if err != nil {
+			return nil, err
+		}
+		return library.Album(u.Host), nil
+	})
+}
+
+// Library is a Google Photos library.
+type Library struct {
+	HTTPClient *http.Client
+}
+
+// Album is a Source for the images of an album, or of the whole library if
+// ID is empty. Object URLs are the items' base URLs, which captionbot.ai can
+// fetch directly for about an hour after listing.
+type Album struct {
+	ID      string
+	Title   string
+	library *Library
+}
+
+var _ source.Source = (*Album)(nil)
+
+// NewLibrary connects to the library of the authorized user.
+func NewLibrary() (*Library, error) {
+	tokens, err := googleauth.UserTokenSource(os.Getenv("GPHOTOS_CLIENT_ID"), os.Getenv("GPHOTOS_CLIENT_SECRET"), "gphotos-token", Prompt, scope)
+	if err != nil {
+		return nil, err
+	}
+	return &Library{HTTPClient: googleauth.NewClient(tokens)}, nil
+}
+
+func (library *Library) do(method, endpoint string, body interface{}, out interface{}) error {
+	var data bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&data).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, APIURL+endpoint, &data)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := library.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("gphotos: %s: status %d %s", endpoint, resp.StatusCode, apiErr.Error.Message)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Albums returns every album in the library.
+func (library *Library) Albums() ([]*Album, error) {
+	var albums []*Album
+	query := url.Values{}
+	query.Set("pageSize", "50")
+	for {
+		var result struct {
+			Albums []struct {
+				ID    string `json:"id"`
+				Title string `json:"title"`
+			} `json:"albums"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := library.do("GET", "albums?"+query.Encode(), nil, &result); err != nil {
+			return nil, err
+		}
+		for _, album := range result.Albums {
+			albums = append(albums, &Album{ID: album.ID, Title: album.Title, library: library})
+		}
+		if result.NextPageToken == "" {
+			return albums, nil
+		}
+		query.Set("pageToken", result.NextPageToken)
+	}
+}
+
+// Album returns the album with the given ID, or the whole library if id is
+// empty.
+func (library *Library) Album(id string) *Album {
+	return &Album{ID: id, library: library}
+}
+
+// Walk lists the images in the album.
+func (album *Album) Walk(fn func(source.Object) error) error {
+	pageToken := ""
+	for {
+		var result struct {
+			MediaItems []struct {
+				ID       string `json:"id"`
+				Filename string `json:"filename"`
+				MimeType string `json:"mimeType"`
+				BaseURL  string `json:"baseUrl"`
+			} `json:"mediaItems"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+
+		var err error
+		if album.ID == "" {
+			query := url.Values{}
+			query.Set("pageSize", "100")
+			query.Set("pageToken", pageToken)
+			err = album.library.do("GET", "mediaItems?"+query.Encode(), nil, &result)
+		} else {
+			err = album.library.do("POST", "mediaItems:search", map[string]interface{}{
+				"albumId":   album.ID,
+				"pageSize":  100,
+				"pageToken": pageToken,
+			}, &result)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, item := range result.MediaItems {
+			if !strings.HasPrefix(item.MimeType, "image/") {
+				continue
+			}
+			obj := source.Object{Key: item.Filename, ID: item.ID, URL: item.BaseURL + imageSize}
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+
+		if result.NextPageToken == "" {
+			return nil
+		}
+		pageToken = result.NextPageToken
+	}
+}
+
+// Open downloads obj through its base URL.
+func (album *Album) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := album.library.HTTPClient.Get(obj.URL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("gphotos: downloading %s: status %d", obj.Key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
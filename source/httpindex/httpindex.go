@@ -0,0 +1,193 @@
+// Package httpindex registers a backend for plain HTTP(S) directory
+// listings, such as nginx autoindex or Apache mod_autoindex pages, for
+// http:// and https:// source URLs.
+//
+// The index page is parsed for links; links to subdirectories below the
+// root are followed and links to files are listed if their extension is in
+// the ext query parameter (a comma separated list, image extensions by
+// default). Requests are spaced by the delay query parameter, 500ms by
+// default, to stay polite to the server, and identify themselves with the
+// ua query parameter, or captionbot.UserAgent by default.
+//
+// Objects carry their URL, so captionbot.ai fetches the images itself.
+package httpindex
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/source"
+)
+
+func init() {
+	opener := func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	}
+	source.Register("http", opener)
+	source.Register("https", opener)
+}
+
+// Index is a Source for the files linked from a directory index page and
+// the index pages below it.
+type Index struct {
+	Root       *url.URL
+	Extensions map[string]bool
+	Delay      time.Duration
+	// UserAgent, if set, is the User-Agent of the requests.
+	UserAgent  string
+	HTTPClient *http.Client
+
+	mu       sync.Mutex
+	lastCall time.Time
+}
+
+var _ source.Source = (*Index)(nil)
+
+// Open creates an Index from an http:// or https:// URL.
+func Open(u *url.URL) (*Index, error) {
+	query := u.Query()
+	root := *u
+	root.RawQuery = ""
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+
+	index := &Index{Root: &root, Delay: 500 * time.Millisecond, UserAgent: captionbot.UserAgent}
+	if ua := query.Get("ua"); ua != "" {
+		index.UserAgent = ua
+	}
+	if exts := query.Get("ext"); exts != "" {
+		index.Extensions = map[string]bool{}
+		for _, ext := range strings.Split(exts, ",") {
+			index.Extensions["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = true
+		}
+	}
+	if delay := query.Get("delay"); delay != "" {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return nil, fmt.Errorf("httpindex: delay: %s", err)
+		}
+		index.Delay = d
+	}
+	return index, nil
+}
+
+func (index *Index) httpClient() *http.Client {
+	if index.HTTPClient != nil {
+		return index.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// get fetches u once Delay has passed since the previous request.
+func (index *Index) get(u string) (*http.Response, error) {
+	index.mu.Lock()
+	if delay := index.Delay - time.Since(index.lastCall); delay > 0 {
+		time.Sleep(delay)
+	}
+	index.lastCall = time.Now()
+	index.mu.Unlock()
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if index.UserAgent != "" {
+		req.Header.Set("User-Agent", index.UserAgent)
+	}
+	resp, err := index.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("httpindex: GET %s: status %d", u, resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (index *Index) accepts(name string) bool {
+	if index.Extensions == nil {
+		return source.IsImage(name)
+	}
+	return index.Extensions[strings.ToLower(path.Ext(name))]
+}
+
+var hrefAttr = regexp.MustCompile(`(?i)<a\s[^>]*href\s*=\s*("[^"]*"|'[^']*'|[^\s>]+)`)
+
+// links returns the absolute URLs of the links on the page at page.
+func links(page *url.URL, html string) []*url.URL {
+	var urls []*url.URL
+	for _, match := range hrefAttr.FindAllStringSubmatch(html, -1) {
+		href := strings.Trim(match[1], `"'`)
+		ref, err := url.Parse(href)
+		if err != nil || ref.RawQuery != "" || ref.Fragment != "" {
+			// Query links are column sorting options.
+			continue
+		}
+		urls = append(urls, page.ResolveReference(ref))
+	}
+	return urls
+}
+
+func (index *Index) walk(page *url.URL, seen map[string]bool, fn func(source.Object) error) error {
+	resp, err := index.get(page.String())
+	if err != nil {
+		return err
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links(page, string(body)) {
+		// Only follow links that stay below the root, which also
+		// skips the parent directory link.
+		if link.Host != index.Root.Host || !strings.HasPrefix(link.Path, page.Path) || link.Path == page.Path {
+			continue
+		}
+		if seen[link.Path] {
+			continue
+		}
+		seen[link.Path] = true
+
+		if strings.HasSuffix(link.Path, "/") {
+			if err := index.walk(link, seen, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if !index.accepts(link.Path) {
+			continue
+		}
+		key := strings.TrimPrefix(link.Path, index.Root.Path)
+		if err := fn(source.Object{Key: key, URL: link.String()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Walk lists the accepted files linked from the root index and the index
+// pages below it.
+func (index *Index) Walk(fn func(source.Object) error) error {
+	return index.walk(index.Root, map[string]bool{}, fn)
+}
+
+// Open downloads obj.
+func (index *Index) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := index.get(obj.URL)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,170 @@
+// Package ipfs registers a backend for ipfs://CID and ipfs://CID/path source
+// URLs.
+//
+// Content is fetched from the local node's HTTP API when IPFS_API is set
+// (e.g. http://127.0.0.1:5001), which also lists directories, and otherwise
+// from the gateway in IPFS_GATEWAY (https://ipfs.io by default), which
+// serves single files only. Either way the images are uploaded to
+// captionbot.ai rather than captioned by URL, since it can't reach local
+// nodes and public gateways are often too slow for it.
+package ipfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+// DefaultGateway is used when IPFS_GATEWAY is not set.
+const DefaultGateway = "https://ipfs.io"
+
+func init() {
+	source.Register("ipfs", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Path is a Source for an IPFS file or directory tree.
+type Path struct {
+	// Root is the /ipfs/CID/path of the file or directory.
+	Root       string
+	API        string
+	Gateway    string
+	HTTPClient *http.Client
+}
+
+var _ source.Source = (*Path)(nil)
+
+// Open creates a Path from an ipfs:// URL.
+func Open(u *url.URL) (*Path, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("ipfs: missing CID in %s", u)
+	}
+	p := &Path{
+		Root:    path.Join("/ipfs", u.Host, u.Path),
+		API:     strings.TrimRight(os.Getenv("IPFS_API"), "/"),
+		Gateway: strings.TrimRight(os.Getenv("IPFS_GATEWAY"), "/"),
+	}
+	if p.Gateway == "" {
+		p.Gateway = DefaultGateway
+	}
+	return p, nil
+}
+
+func (p *Path) httpClient() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// api calls a node RPC command; all of them are POSTs.
+func (p *Path) api(command, arg string) (*http.Response, error) {
+	query := url.Values{}
+	query.Set("arg", arg)
+	resp, err := p.httpClient().Post(p.API+"/api/v0/"+command+"?"+query.Encode(), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr struct{ Message string }
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return nil, fmt.Errorf("ipfs: %s %s: %s", command, arg, apiErr.Message)
+	}
+	return resp, nil
+}
+
+// ls returns the links of the directory at ipfsPath.
+func (p *Path) ls(ipfsPath string) ([]link, error) {
+	resp, err := p.api("ls", ipfsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Objects []struct {
+			Links []link
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+	if len(result.Objects) == 0 {
+		return nil, nil
+	}
+	return result.Objects[0].Links, nil
+}
+
+// link is a directory entry; Type is 1 for directories and 2 for files.
+type link struct {
+	Name string
+	Size int64
+	Type int
+}
+
+func (p *Path) walk(rel string, fn func(source.Object) error) error {
+	links, err := p.ls(path.Join(p.Root, rel))
+	if err != nil {
+		return err
+	}
+	for _, l := range links {
+		key := path.Join(rel, l.Name)
+		switch l.Type {
+		case 1:
+			if err := p.walk(key, fn); err != nil {
+				return err
+			}
+		case 2:
+			if err := fn(source.Object{Key: key, Size: l.Size}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Walk lists the files below a directory root through the node API. With
+// only a gateway, or if the root is a file, the root itself is the single
+// object, keyed by its base name.
+func (p *Path) Walk(fn func(source.Object) error) error {
+	if p.API == "" || source.IsImage(p.Root) {
+		return fn(source.Object{Key: path.Base(p.Root), ID: p.Root})
+	}
+	return p.walk("", fn)
+}
+
+// Open fetches the content of obj from the node or the gateway.
+func (p *Path) Open(obj source.Object) (io.ReadCloser, error) {
+	// Single file roots carry their full path as the ID.
+	ipfsPath := obj.ID
+	if ipfsPath == "" {
+		ipfsPath = path.Join(p.Root, obj.Key)
+	}
+
+	if p.API != "" {
+		resp, err := p.api("cat", ipfsPath)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+
+	resp, err := p.httpClient().Get(p.Gateway + ipfsPath)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("ipfs: GET %s%s: status %d", p.Gateway, ipfsPath, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
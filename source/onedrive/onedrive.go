@@ -0,0 +1,285 @@
+// Package onedrive registers a Microsoft Graph backend for OneDrive and
+// SharePoint document libraries. Source URLs name the drive and a folder in
+// it: onedrive://me/Pictures for the signed-in user's OneDrive, or
+// onedrive://DRIVE_ID/Shared%20Documents/Photos for any drive, including
+// SharePoint libraries.
+//
+// Requests use the access token in MS_GRAPH_TOKEN, or else a token obtained
+// with the client credentials in AZURE_TENANT_ID, AZURE_CLIENT_ID and
+// AZURE_CLIENT_SECRET.
+//
+// Captions are written into a SharePoint column when the column query
+// parameter names one, and into the item description otherwise, which only
+// OneDrive personal supports.
+package onedrive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+var (
+	// GraphURL is the root of the Microsoft Graph API.
+	GraphURL = "https://graph.microsoft.com/v1.0"
+	// LoginURL is the root of the Microsoft identity platform.
+	LoginURL = "https://login.microsoftonline.com"
+)
+
+func init() {
+	source.Register("onedrive", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Folder is a Source for a folder tree in a drive.
+type Folder struct {
+	// DriveID is the drive's ID, or "me" for the user's OneDrive.
+	DriveID string
+	// Path is the folder's path from the drive root, "" for the root.
+	Path string
+	// Column is the SharePoint column to store captions in.
+	Column     string
+	HTTPClient *http.Client
+
+	tokens *tokenSource
+}
+
+var (
+	_ source.Source        = (*Folder)(nil)
+	_ source.CaptionWriter = (*Folder)(nil)
+	_ source.FileWriter    = (*Folder)(nil)
+)
+
+// Open creates a Folder from a onedrive:// URL.
+func Open(u *url.URL) (*Folder, error) {
+	if u.Host == "" {
+		return nil, fmt.Errorf("onedrive: missing drive in %s", u)
+	}
+	folder := &Folder{
+		DriveID: u.Host,
+		Path:    strings.Trim(u.Path, "/"),
+		Column:  u.Query().Get("column"),
+		tokens: &tokenSource{
+			static:       os.Getenv("MS_GRAPH_TOKEN"),
+			tenantID:     os.Getenv("AZURE_TENANT_ID"),
+			clientID:     os.Getenv("AZURE_CLIENT_ID"),
+			clientSecret: os.Getenv("AZURE_CLIENT_SECRET"),
+		},
+	}
+	if folder.tokens.static == "" && folder.tokens.clientID == "" {
+		return nil, fmt.Errorf("onedrive: set MS_GRAPH_TOKEN or AZURE_TENANT_ID, AZURE_CLIENT_ID and AZURE_CLIENT_SECRET")
+	}
+	return folder, nil
+}
+
+// tokenSource returns a static token or caches client credential tokens.
+type tokenSource struct {
+	static                           string
+	tenantID, clientID, clientSecret string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (tokens *tokenSource) Token() (string, error) {
+	if tokens.static != "" {
+		return tokens.static, nil
+	}
+
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+
+	if tokens.token != "" && time.Until(tokens.expiry) > time.Minute {
+		return tokens.token, nil
+	}
+
+	resp, err := http.PostForm(LoginURL+"/"+url.PathEscape(tokens.tenantID)+"/oauth2/v2.0/token", url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {tokens.clientID},
+		"client_secret": {tokens.clientSecret},
+		"scope":         {"https://graph.microsoft.com/.default"},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var tok struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	if tok.AccessToken == "" {
+		return "", fmt.Errorf("onedrive: token request failed: %s", tok.ErrorDescription)
+	}
+	tokens.token = tok.AccessToken
+	tokens.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return tokens.token, nil
+}
+
+func (folder *Folder) httpClient() *http.Client {
+	if folder.HTTPClient != nil {
+		return folder.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// driveURL returns the Graph URL of the drive.
+func (folder *Folder) driveURL() string {
+	if folder.DriveID == "me" {
+		return GraphURL + "/me/drive"
+	}
+	return GraphURL + "/drives/" + url.PathEscape(folder.DriveID)
+}
+
+// pathURL returns the Graph URL of the item at path below the folder.
+func (folder *Folder) pathURL(path string) string {
+	full := strings.Trim(folder.Path+"/"+path, "/")
+	if full == "" {
+		return folder.driveURL() + "/root"
+	}
+	escaped := strings.Split(full, "/")
+	for i := range escaped {
+		escaped[i] = url.PathEscape(escaped[i])
+	}
+	return folder.driveURL() + "/root:/" + strings.Join(escaped, "/") + ":"
+}
+
+func (folder *Folder) do(method, endpoint, contentType string, body []byte, out interface{}) error {
+	token, err := folder.tokens.Token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := folder.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var apiErr struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("onedrive: %s: status %d %s", method, resp.StatusCode, apiErr.Error.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+type driveItem struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	Folder      *struct{} `json:"folder"`
+	File        *struct{} `json:"file"`
+	DownloadURL string    `json:"@microsoft.graph.downloadUrl"`
+}
+
+func (folder *Folder) walk(endpoint, prefix string, fn func(source.Object) error) error {
+	for endpoint != "" {
+		var page struct {
+			Value    []driveItem `json:"value"`
+			NextLink string      `json:"@odata.nextLink"`
+		}
+		if err := folder.do("GET", endpoint, "", nil, &page); err != nil {
+			return err
+		}
+
+		for _, item := range page.Value {
+			switch {
+			case item.Folder != nil:
+				children := folder.driveURL() + "/items/" + url.PathEscape(item.ID) + "/children"
+				if err := folder.walk(children, prefix+item.Name+"/", fn); err != nil {
+					return err
+				}
+			case item.File != nil:
+				// The download URL is pre-authenticated, so
+				// captionbot.ai can fetch it directly.
+				obj := source.Object{Key: prefix + item.Name, ID: item.ID, Size: item.Size, URL: item.DownloadURL}
+				if err := fn(obj); err != nil {
+					return err
+				}
+			}
+		}
+		endpoint = page.NextLink
+	}
+	return nil
+}
+
+// Walk lists every file in the folder and its subfolders.
+func (folder *Folder) Walk(fn func(source.Object) error) error {
+	return folder.walk(folder.pathURL("")+"/children", "", fn)
+}
+
+// Open downloads obj.
+func (folder *Folder) Open(obj source.Object) (io.ReadCloser, error) {
+	token, err := folder.tokens.Token()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", folder.driveURL()+"/items/"+url.PathEscape(obj.ID)+"/content", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := folder.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("onedrive: downloading %s: status %d", obj.Key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption stores caption in the configured SharePoint column, or in
+// the item description.
+func (folder *Folder) WriteCaption(obj source.Object, caption string) error {
+	endpoint := folder.driveURL() + "/items/" + url.PathEscape(obj.ID)
+	fields := map[string]string{"description": caption}
+	if folder.Column != "" {
+		endpoint += "/listItem/fields"
+		fields = map[string]string{folder.Column: caption}
+	}
+
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return folder.do("PATCH", endpoint, "application/json", body, nil)
+}
+
+// WriteFile uploads data to name in the folder, replacing any existing file.
+func (folder *Folder) WriteFile(name string, data []byte) error {
+	return folder.do("PUT", folder.pathURL(name)+"/content", "application/json", data, nil)
+}
@@ -0,0 +1,306 @@
+// Package s3 registers an Amazon S3 backend for s3://bucket/prefix source
+// URLs.
+//
+// Credentials come from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN, or else from the AWS_PROFILE (default "default") entry
+// of the shared credentials file. The region comes from the region query
+// parameter, AWS_REGION or AWS_DEFAULT_REGION, in that order.
+//
+// Other query parameters:
+//
+//	endpoint=URL     use an S3-compatible service, with path-style requests
+//	presign=DURATION caption through presigned URLs instead of uploading
+//	caption=tag      write captions as a "caption" object tag (the default)
+//	caption=metadata write captions as x-amz-meta-caption object metadata
+package s3
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nhatbui/captionbot/internal/awsv4"
+	"github.com/nhatbui/captionbot/source"
+)
+
+func init() {
+	source.Register("s3", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Bucket is a Source for the objects of an S3 bucket under a key prefix.
+type Bucket struct {
+	Name     string
+	Prefix   string
+	Region   string
+	Endpoint string
+	// Presign, if non-zero, makes Walk attach presigned URLs valid for
+	// this long to each object.
+	Presign time.Duration
+	// CaptionMode is "tag" or "metadata".
+	CaptionMode string
+	HTTPClient  *http.Client
+
+	signer *awsv4.Signer
+}
+
+var (
+	_ source.Source        = (*Bucket)(nil)
+	_ source.CaptionWriter = (*Bucket)(nil)
+	_ source.FileWriter    = (*Bucket)(nil)
+)
+
+// Open creates a Bucket from an s3:// URL.
+func Open(u *url.URL) (*Bucket, error) {
+	query := u.Query()
+	bucket := &Bucket{
+		Name:        u.Host,
+		Prefix:      strings.TrimPrefix(u.Path, "/"),
+		Region:      query.Get("region"),
+		Endpoint:    strings.TrimRight(query.Get("endpoint"), "/"),
+		CaptionMode: query.Get("caption"),
+	}
+	if bucket.Name == "" {
+		return nil, fmt.Errorf("s3: missing bucket name in %s", u)
+	}
+	if bucket.Region == "" {
+		bucket.Region = os.Getenv("AWS_REGION")
+	}
+	if bucket.Region == "" {
+		bucket.Region = os.Getenv("AWS_DEFAULT_REGION")
+	}
+	if bucket.Region == "" {
+		bucket.Region = "us-east-1"
+	}
+	if bucket.CaptionMode == "" {
+		bucket.CaptionMode = "tag"
+	}
+	if bucket.CaptionMode != "tag" && bucket.CaptionMode != "metadata" {
+		return nil, fmt.Errorf("s3: caption must be tag or metadata, not %q", bucket.CaptionMode)
+	}
+	if presign := query.Get("presign"); presign != "" {
+		d, err := time.ParseDuration(presign)
+		if err != nil {
+			return nil, fmt.Errorf("s3: presign: %s", err)
+		}
+		bucket.Presign = d
+	}
+
+	creds, err := LoadCredentials()
+	if err != nil {
+		return nil, err
+	}
+	bucket.signer = awsv4.NewSigner(creds, bucket.Region, "s3")
+	return bucket, nil
+}
+
+// Credentials are AWS access keys.
+type Credentials = awsv4.Credentials
+
+// LoadCredentials reads AWS credentials from the environment or the shared
+// credentials file.
+func LoadCredentials() (Credentials, error) {
+	return awsv4.LoadCredentials()
+}
+
+func (bucket *Bucket) httpClient() *http.Client {
+	if bucket.HTTPClient != nil {
+		return bucket.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// objectURL returns the URL of key, virtual-hosted style on AWS and
+// path style on custom endpoints.
+func (bucket *Bucket) objectURL(key string, query url.Values) *url.URL {
+	var u *url.URL
+	var path string
+	if bucket.Endpoint != "" {
+		u, _ = url.Parse(bucket.Endpoint)
+		path = "/" + bucket.Name + "/" + key
+	} else {
+		u = &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.s3.%s.amazonaws.com", bucket.Name, bucket.Region)}
+		path = "/" + key
+	}
+	u.Path = path
+	u.RawPath = awsv4.URIEncode(path, false)
+	u.RawQuery = query.Encode()
+	return u
+}
+
+func (bucket *Bucket) do(method string, u *url.URL, header http.Header, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	bucket.signer.Sign(req, awsv4.PayloadHash(body))
+
+	resp, err := bucket.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string
+			Message string
+		}
+		xml.NewDecoder(resp.Body).Decode(&s3Err)
+		return nil, fmt.Errorf("s3: %s %s: status %d %s %s", method, u.Path, resp.StatusCode, s3Err.Code, s3Err.Message)
+	}
+	return resp, nil
+}
+
+// Walk lists every object under the prefix.
+func (bucket *Bucket) Walk(fn func(source.Object) error) error {
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("prefix", bucket.Prefix)
+
+	for {
+		resp, err := bucket.do("GET", bucket.objectURL("", query), nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Contents []struct {
+				Key  string
+				Size int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		for _, content := range result.Contents {
+			if strings.HasSuffix(content.Key, "/") {
+				continue
+			}
+			obj := source.Object{Key: content.Key, Size: content.Size}
+			if bucket.Presign > 0 {
+				obj.URL = bucket.signer.Presign(bucket.objectURL(content.Key, nil), bucket.Presign)
+			}
+			if err := fn(obj); err != nil {
+				return err
+			}
+		}
+
+		if !result.IsTruncated {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// Open streams the content of obj.
+func (bucket *Bucket) Open(obj source.Object) (io.ReadCloser, error) {
+	resp, err := bucket.do("GET", bucket.objectURL(obj.Key, nil), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// WriteCaption stores caption on obj as a tag or as metadata, depending on
+// CaptionMode. Tagging replaces the object's existing tags; updating
+// metadata copies the object onto itself, keeping its other metadata.
+func (bucket *Bucket) WriteCaption(obj source.Object, caption string) error {
+	if bucket.CaptionMode == "metadata" {
+		return bucket.writeMetadata(obj.Key, caption)
+	}
+
+	var tagging struct {
+		XMLName xml.Name `xml:"Tagging"`
+		Tags    []struct {
+			Key   string
+			Value string
+		} `xml:"TagSet>Tag"`
+	}
+	tagging.Tags = append(tagging.Tags, struct {
+		Key   string
+		Value string
+	}{"caption", tagValue(caption)})
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("tagging", "")
+	resp, err := bucket.do("PUT", bucket.objectURL(obj.Key, query), nil, body)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (bucket *Bucket) writeMetadata(key, caption string) error {
+	head, err := bucket.do("HEAD", bucket.objectURL(key, nil), nil, nil)
+	if err != nil {
+		return err
+	}
+	head.Body.Close()
+
+	header := http.Header{}
+	for name, values := range head.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-amz-meta-") {
+			header[name] = values
+		}
+	}
+	if contentType := head.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	header.Set("X-Amz-Meta-Caption", url.QueryEscape(caption))
+	header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	header.Set("X-Amz-Copy-Source", awsv4.URIEncode("/"+bucket.Name+"/"+key, false))
+
+	resp, err := bucket.do("PUT", bucket.objectURL(key, nil), header, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// tagValue trims caption to the characters and length S3 allows in tags.
+func tagValue(caption string) string {
+	value := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case strings.ContainsRune(" +-=._:/@", r):
+			return r
+		}
+		return -1
+	}, caption)
+	if len(value) > 256 {
+		value = value[:256]
+	}
+	return value
+}
+
+// WriteFile stores data as an object named name under the prefix.
+func (bucket *Bucket) WriteFile(name string, data []byte) error {
+	key := name
+	if bucket.Prefix != "" {
+		key = strings.TrimSuffix(bucket.Prefix, "/") + "/" + name
+	}
+	resp, err := bucket.do("PUT", bucket.objectURL(key, nil), nil, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
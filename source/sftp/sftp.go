@@ -0,0 +1,237 @@
+// Package sftp registers an SFTP backend for sftp://user@host:port/path
+// source URLs.
+//
+// Authentication uses the key file named by the key query parameter, or the
+// keys of a running ssh-agent, or ~/.ssh/id_ed25519 and ~/.ssh/id_rsa. Host
+// keys are checked against ~/.ssh/known_hosts unless insecure=1 is given.
+// At most concurrency files (4 by default) are read at once.
+//
+// Captions are written as .txt sidecar files next to each image.
+package sftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/nhatbui/captionbot/source"
+)
+
+func init() {
+	source.Register("sftp", func(u *url.URL) (source.Source, error) {
+		return Open(u)
+	})
+}
+
+// Dir is a Source for a directory tree on an SFTP server.
+type Dir struct {
+	Root   string
+	client *sftp.Client
+	// slots limits the number of files open at once.
+	slots chan struct{}
+}
+
+var (
+	_ source.Source        = (*Dir)(nil)
+	_ source.CaptionWriter = (*Dir)(nil)
+	_ source.FileWriter    = (*Dir)(nil)
+)
+
+// checkHostKeys returns a callback checking server keys against
+// ~/.ssh/known_hosts, unless the URL's query has insecure=1.
+func checkHostKeys(query url.Values) (ssh.HostKeyCallback, error) {
+	if query.Get("insecure") == "1" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	callback, err := knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+	if err != nil {
+		return nil, fmt.Errorf("sftp: loading known_hosts: %s", err)
+	}
+	return callback, nil
+}
+
+// Open connects to the server of an sftp:// URL.
+func Open(u *url.URL) (*Dir, error) {
+	query := u.Query()
+
+	username := u.User.Username()
+	if username == "" {
+		current, err := user.Current()
+		if err != nil {
+			return nil, err
+		}
+		username = current.Username
+	}
+
+	auth, err := authMethods(query.Get("key"))
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, err := checkHostKeys(query)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency := 4
+	if value := query.Get("concurrency"); value != "" {
+		if concurrency, err = strconv.Atoi(value); err != nil || concurrency < 1 {
+			return nil, fmt.Errorf("sftp: invalid concurrency %q", value)
+		}
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sftp: %s", err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("sftp: %s", err)
+	}
+
+	root := u.Path
+	if root == "" {
+		root = "."
+	}
+	return &Dir{Root: root, client: client, slots: make(chan struct{}, concurrency)}, nil
+}
+
+// authMethods returns the public key methods to try, in order.
+func authMethods(keyFile string) ([]ssh.AuthMethod, error) {
+	var keyFiles []string
+	if keyFile != "" {
+		keyFiles = []string{keyFile}
+	} else if home, err := os.UserHomeDir(); err == nil {
+		keyFiles = []string{filepath.Join(home, ".ssh", "id_ed25519"), filepath.Join(home, ".ssh", "id_rsa")}
+	}
+
+	var methods []ssh.AuthMethod
+	if keyFile == "" {
+		if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+			if conn, err := net.Dial("unix", sock); err == nil {
+				methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			}
+		}
+	}
+
+	var signers []ssh.Signer
+	for _, file := range keyFiles {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			if keyFile != "" {
+				return nil, err
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("sftp: %s: %s", file, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("sftp: no SSH keys or agent available")
+	}
+	return methods, nil
+}
+
+// Close closes the connection to the server.
+func (dir *Dir) Close() error {
+	return dir.client.Close()
+}
+
+// Walk lists every regular file under the root.
+func (dir *Dir) Walk(fn func(source.Object) error) error {
+	walker := dir.client.Walk(dir.Root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return err
+		}
+		info := walker.Stat()
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(walker.Path(), dir.Root), "/")
+		if err := fn(source.Object{Key: key, Size: info.Size()}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// slotFile releases its concurrency slot when closed.
+type slotFile struct {
+	*sftp.File
+	release func()
+}
+
+func (file *slotFile) Close() error {
+	defer file.release()
+	return file.File.Close()
+}
+
+// Open opens obj for reading, waiting for a free slot if too many files are
+// already open.
+func (dir *Dir) Open(obj source.Object) (io.ReadCloser, error) {
+	dir.slots <- struct{}{}
+	release := func() { <-dir.slots }
+
+	file, err := dir.client.Open(dir.path(obj.Key))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &slotFile{File: file, release: release}, nil
+}
+
+// WriteCaption writes caption to a sidecar file next to obj.
+func (dir *Dir) WriteCaption(obj source.Object, caption string) error {
+	sidecar := strings.TrimSuffix(obj.Key, path.Ext(obj.Key)) + ".txt"
+	return dir.WriteFile(sidecar, []byte(caption+"\n"))
+}
+
+// WriteFile writes a file below the root.
+func (dir *Dir) WriteFile(name string, data []byte) error {
+	file, err := dir.client.Create(dir.path(name))
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func (dir *Dir) path(key string) string {
+	return path.Join(dir.Root, key)
+}
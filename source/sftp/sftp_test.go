@@ -0,0 +1,70 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestCheckHostKeys(t *testing.T) {
+	known, other := newHostKey(t), newHostKey(t)
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{"files.example.com"}, known) + "\n"
+	if err := os.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(line), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 22}
+
+	tests := []struct {
+		name     string
+		query    string
+		hostname string
+		key      ssh.PublicKey
+		ok       bool
+	}{
+		{"known key", "", "files.example.com:22", known, true},
+		{"changed key", "", "files.example.com:22", other, false},
+		{"unknown host", "", "other.example.com:22", known, false},
+		{"insecure", "insecure=1", "other.example.com:22", other, true},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		callback, err := checkHostKeys(query)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if err := callback(test.hostname, addr, test.key); (err == nil) != test.ok {
+			t.Errorf("%s: err = %v, want success %v", test.name, err, test.ok)
+		}
+	}
+
+	// Without a known_hosts file, connections are refused up front.
+	t.Setenv("HOME", t.TempDir())
+	if _, err := checkHostKeys(url.Values{}); err == nil {
+		t.Error("checkHostKeys succeeded without known_hosts")
+	}
+}
@@ -0,0 +1,143 @@
+// Package source lists and reads images from storage backends so they can be
+// captioned in bulk. Backends register themselves by URL scheme, in the same
+// way database/sql drivers do; import them for their side effect:
+//
+//	import _ "github.com/nhatbui/captionbot/source/s3"
+//
+//	src, err := source.Open("s3://bucket/photos/")
+package source
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/nhatbui/captionbot"
+)
+
+// Object is one file found by a Source.
+type Object struct {
+	// Key identifies the object within the source, e.g. its path relative
+	// to the source root.
+	Key string
+	// ID is a backend-specific identifier, for backends that don't
+	// address objects by their Key.
+	ID   string
+	Size int64
+	// URL, if set, is an address captionbot.ai can fetch the object from
+	// directly (a public or presigned URL), which avoids an upload.
+	URL string
+}
+
+// Source lists and reads the objects of a storage backend.
+type Source interface {
+	// Walk calls fn for every object under the source root. Walking
+	// stops at the first error returned by fn.
+	Walk(fn func(Object) error) error
+	// Open returns the content of obj.
+	Open(obj Object) (io.ReadCloser, error)
+}
+
+// CaptionWriter is implemented by sources that can attach a caption to the
+// object itself, as metadata, tags, a description field or a sidecar file.
+type CaptionWriter interface {
+	WriteCaption(obj Object, caption string) error
+}
+
+// FileWriter is implemented by sources that can store a new file, such as a
+// results manifest, under the source root.
+type FileWriter interface {
+	WriteFile(name string, data []byte) error
+}
+
+// FileCreator is implemented by FileWriters that can also store a file
+// written in parts, so that large files needn't be held in memory.
+type FileCreator interface {
+	CreateFile(name string) (io.WriteCloser, error)
+}
+
+// Opener creates a Source from a parsed source URL.
+type Opener func(u *url.URL) (Source, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]Opener{}
+)
+
+// Register makes a backend available for URLs with the given scheme.
+// It panics if the scheme is registered twice.
+func Register(scheme string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	if _, dup := openers[scheme]; dup {
+		panic("source: Register called twice for scheme " + scheme)
+	}
+	openers[scheme] = opener
+}
+
+// Schemes returns the sorted list of registered schemes.
+func Schemes() []string {
+	openersMu.RLock()
+	defer openersMu.RUnlock()
+
+	schemes := make([]string, 0, len(openers))
+	for scheme := range openers {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// Open returns the Source for rawurl. Anything without a registered scheme
+// is treated as a local directory.
+func Open(rawurl string) (Source, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Scheme == "" || len(u.Scheme) == 1 {
+		// No scheme, or a Windows drive letter.
+		return Dir(rawurl), nil
+	}
+	if u.Scheme == "file" {
+		return Dir(u.Path), nil
+	}
+
+	openersMu.RLock()
+	opener, ok := openers[u.Scheme]
+	openersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("source: unknown scheme %q", u.Scheme)
+	}
+	return opener(u)
+}
+
+var imageExts = map[string]bool{
+	".jpg":  true,
+	".jpeg": true,
+	".png":  true,
+	".gif":  true,
+}
+
+// IsImage reports whether name has the extension of an image format
+// captionbot.ai accepts.
+func IsImage(name string) bool {
+	return imageExts[strings.ToLower(filepath.Ext(name))]
+}
+
+// Caption captions obj with captioner, by URL when the source provides
+// one and by uploading its content otherwise.
+func Caption(captioner captionbot.Captioner, src Source, obj Object) (string, error) {
+	if obj.URL != "" {
+		return captioner.CaptionURL(obj.URL)
+	}
+
+	r, err := src.Open(obj)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	return captioner.CaptionReader(r, obj.Key)
+}
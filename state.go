@@ -0,0 +1,64 @@
+package captionbot
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"time"
+)
+
+// SessionState is what a CaptionBot needs to carry on its conversation,
+// such as after a restart. It can be stored as JSON.
+type SessionState struct {
+	ConversationID string    `json:"conversationID"`
+	WaterMark      string    `json:"waterMark"`
+	LastUsed       time.Time `json:"lastUsed"`
+	// Cookies are the values of the cookies of the session's Jar for
+	// captionbot.ai, by name.
+	Cookies map[string]string `json:"cookies,omitempty"`
+}
+
+// ExportState returns the session's state, with the cookies of its Jar.
+func (captionBot *CaptionBot) ExportState() SessionState {
+	state := SessionState{
+		ConversationID: captionBot.state.conversationID,
+		WaterMark:      captionBot.state.waterMark,
+		LastUsed:       captionBot.state.lastUsed,
+	}
+	if u, err := url.Parse(captionBot.baseURL()); err == nil && captionBot.Jar != nil {
+		for _, cookie := range captionBot.Jar.Cookies(u) {
+			if state.Cookies == nil {
+				state.Cookies = map[string]string{}
+			}
+			state.Cookies[cookie.Name] = cookie.Value
+		}
+	}
+	return state
+}
+
+// RestoreState carries on the conversation of state, exported from this
+// or another session, without calling Initialize. Its cookies are added
+// to the session's Jar, which is created if the session has none.
+func (captionBot *CaptionBot) RestoreState(state SessionState) error {
+	captionBot.state = CaptionBotClientState{
+		conversationID: state.ConversationID,
+		waterMark:      state.WaterMark,
+		lastUsed:       state.LastUsed,
+	}
+	if len(state.Cookies) == 0 {
+		return nil
+	}
+	u, err := url.Parse(captionBot.baseURL())
+	if err != nil {
+		return err
+	}
+	if captionBot.Jar == nil {
+		captionBot.Jar, _ = cookiejar.New(nil)
+	}
+	cookies := make([]*http.Cookie, 0, len(state.Cookies))
+	for name, value := range state.Cookies {
+		cookies = append(cookies, &http.Cookie{Name: name, Value: value, Path: "/"})
+	}
+	captionBot.Jar.SetCookies(u, cookies)
+	return nil
+}
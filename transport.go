@@ -0,0 +1,46 @@
+package captionbot
+
+import (
+	"crypto/tls"
+	"net/http"
+	"time"
+)
+
+// TransportOptions tunes the connections to a service, for deployments
+// making many requests at once. Zero values keep the defaults of
+// http.DefaultTransport.
+type TransportOptions struct {
+	// MaxIdleConnsPerHost is how many idle connections to keep open to
+	// the service, beyond the default of 2, so bursts of requests reuse
+	// them rather than dial new ones.
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout is how long an idle connection is kept open.
+	IdleConnTimeout time.Duration
+	// DisableKeepAlives uses each connection for one request only.
+	DisableKeepAlives bool
+	// DisableHTTP2 keeps to HTTP/1.1, whose connections each carry one
+	// request at a time, instead of multiplexing requests over one
+	// HTTP/2 connection.
+	DisableHTTP2 bool
+}
+
+// NewTransport returns a copy of http.DefaultTransport tuned by opts.
+func NewTransport(opts TransportOptions) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+		if transport.MaxIdleConns < opts.MaxIdleConnsPerHost {
+			transport.MaxIdleConns = opts.MaxIdleConnsPerHost
+		}
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	transport.DisableKeepAlives = opts.DisableKeepAlives
+	if opts.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		// A non-nil, empty map turns off HTTP/2.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
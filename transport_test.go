@@ -0,0 +1,33 @@
+package captionbot_test
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/nhatbui/captionbot"
+	"github.com/nhatbui/captionbot/captionbottest"
+)
+
+func TestWithTransportLeavesClientAlone(t *testing.T) {
+	server := captionbottest.NewServer()
+	defer server.Close()
+	shared := &http.Client{Timeout: time.Minute}
+	bot, err := captionbot.New(server.Option(), captionbot.WithHTTPClient(shared),
+		captionbot.WithTransport(captionbot.TransportOptions{MaxIdleConnsPerHost: 8}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := bot.URLCaption(testImage); err != nil {
+		t.Fatalf("URLCaption: %v", err)
+	}
+	if shared.Transport != nil {
+		t.Error("WithTransport changed the client it was given")
+	}
+	if bot.HTTPClient == shared || bot.HTTPClient.Timeout != time.Minute {
+		t.Errorf("bot's client = %p with timeout %s, want a copy of %p", bot.HTTPClient, bot.HTTPClient.Timeout, shared)
+	}
+	if transport, ok := bot.HTTPClient.Transport.(*http.Transport); !ok || transport.MaxIdleConnsPerHost != 8 {
+		t.Errorf("bot's transport = %#v, want one tuned by the options", bot.HTTPClient.Transport)
+	}
+}
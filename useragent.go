@@ -0,0 +1,31 @@
+package captionbot
+
+import "runtime/debug"
+
+// modulePath is the import path of this module.
+const modulePath = "github.com/nhatbui/captionbot"
+
+// UserAgent is sent as the User-Agent of the requests to captionbot.ai,
+// unless a CaptionBot sets its own, so that operators can tell the
+// traffic apart. It is captionbot-go and the version of this module the
+// program was built with.
+var UserAgent = "captionbot-go/" + moduleVersion()
+
+// moduleVersion returns the version of this module in the program's build
+// information, or "dev" if there is none, as when it is built from a
+// checkout.
+func moduleVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "dev"
+	}
+	if info.Main.Path == modulePath && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			return dep.Version
+		}
+	}
+	return "dev"
+}